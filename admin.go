@@ -0,0 +1,429 @@
+package dnsredir
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Admin HTTP server, which is shared by all dnsredir instances specified the same address
+// It survives Corefile reloads, since the new instance acquires it before the old one releases it.
+type adminServer struct {
+	addr string
+	srv  *http.Server
+	refs int
+	// Stanza name to its owner, later registrations take precedence
+	stanzas map[string]*Dnsredir
+}
+
+var (
+	adminLock    sync.Mutex
+	adminServers = make(map[string]*adminServer)
+)
+
+// Return true if HOST:PORT only listens on the loopback interface
+// An empty host(i.e. all interfaces) isn't the case.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Acquire the admin server listening on `addr', and register all stanzas of `r' to it
+func acquireAdminServer(addr string, r *Dnsredir) error {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+
+	s, ok := adminServers[addr]
+	if !ok {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		s = &adminServer{
+			addr:    addr,
+			stanzas: make(map[string]*Dnsredir),
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/stanzas", s.handleStanzas)
+		mux.HandleFunc("/patch", s.handlePatch)
+		mux.HandleFunc("/resources", s.handleResources)
+		mux.HandleFunc("/metrics", s.handleMetrics)
+		mux.HandleFunc("/reconcile", s.handleReconcile)
+		mux.HandleFunc("/maintenance", s.handleMaintenance)
+		mux.HandleFunc("/freeze", s.handleFreeze)
+		s.srv = &http.Server{Handler: mux}
+		go func() {
+			if err := s.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Errorf("Admin server %v stopped: %v", addr, err)
+			}
+		}()
+		adminServers[addr] = s
+		log.Infof("Admin server listening on %v", addr)
+	}
+	s.refs++
+
+	for _, name := range r.stanzas() {
+		s.stanzas[name] = r
+	}
+	return nil
+}
+
+// Release the admin server acquired by `r', the server will be closed once no one referencing it
+func releaseAdminServer(addr string, r *Dnsredir) {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+
+	s, ok := adminServers[addr]
+	if !ok {
+		return
+	}
+	for name, owner := range s.stanzas {
+		if owner == r {
+			delete(s.stanzas, name)
+		}
+	}
+	s.refs--
+	if s.refs == 0 {
+		delete(adminServers, addr)
+		Close(s.srv)
+		log.Infof("Admin server %v closed", addr)
+	}
+}
+
+// Return owner of the stanza, nil if not found
+func (s *adminServer) lookup(stanza string) *Dnsredir {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+	return s.stanzas[stanza]
+}
+
+// Return bearer token of the request, empty if absent
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// Return true if the token grants access to the stanza
+// Stanzas without `admin_token' are accessible by anyone, unless `tokenRequired' is true.
+func (u *reloadableUpstream) adminGrants(token string, tokenRequired bool) bool {
+	if len(u.adminToken) == 0 {
+		return !tokenRequired
+	}
+	return subtle.ConstantTimeCompare([]byte(u.adminToken), []byte(token)) == 1
+}
+
+// Return true if any of the stanzas specified `admin_token'
+// Stanzas without one are then denied, so tokenless stanzas on a shared address aren't exposed to other teams.
+func tokenRequired(ups []*reloadableUpstream) bool {
+	for _, u := range ups {
+		if len(u.adminToken) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the stanza specified by `stanza' query parameter if the request is authorized
+// Otherwise an error is replied and nil is returned.
+func (s *adminServer) authorize(w http.ResponseWriter, req *http.Request) (*Dnsredir, *reloadableUpstream) {
+	stanza := req.URL.Query().Get("stanza")
+	var u *reloadableUpstream
+	r := s.lookup(stanza)
+	if r != nil {
+		u = r.upstream(stanza)
+	}
+	if u == nil {
+		http.Error(w, errStanzaNotFound.Error(), http.StatusNotFound)
+		return nil, nil
+	}
+	if !u.adminGrants(bearerToken(req), tokenRequired(s.registered())) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, nil
+	}
+	return r, u
+}
+
+// Return all registered stanzas
+func (s *adminServer) registered() []*reloadableUpstream {
+	adminLock.Lock()
+	stanzas := make(map[string]*Dnsredir, len(s.stanzas))
+	owners := make(map[*Dnsredir]struct{})
+	for name, r := range s.stanzas {
+		stanzas[name] = r
+		owners[r] = struct{}{}
+	}
+	adminLock.Unlock()
+
+	var ups []*reloadableUpstream
+	for r := range owners {
+		r.RLock()
+		for _, up := range *r.Upstreams {
+			u := up.(*reloadableUpstream)
+			if stanzas[u.stanza] == r {
+				ups = append(ups, u)
+			}
+		}
+		r.RUnlock()
+	}
+	return ups
+}
+
+// Return registered stanzas accessible by the token
+func (s *adminServer) granted(token string) []*reloadableUpstream {
+	all := s.registered()
+	required := tokenRequired(all)
+	var ups []*reloadableUpstream
+	for _, u := range all {
+		if u.adminGrants(token, required) {
+			ups = append(ups, u)
+		}
+	}
+	return ups
+}
+
+// GET /stanzas
+// List names of all registered stanzas accessible by the bearer token
+func (s *adminServer) handleStanzas(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	ups := s.granted(bearerToken(req))
+	names := make([]string, 0, len(ups))
+	for _, u := range ups {
+		names = append(names, u.stanza)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(names)
+}
+
+// POST /patch?stanza=NAME
+// Request body is a partial stanza, i.e. directive lines, e.g. `to 1.1.1.1 8.8.8.8'
+func (s *adminServer) handlePatch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	r, u := s.authorize(w, req)
+	if r == nil {
+		return
+	}
+	if u.isFrozen() {
+		http.Error(w, errStanzaFrozen.Error(), http.StatusConflict)
+		return
+	}
+	stanza := u.stanza
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxPatchSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := r.patch(stanza, string(body)); err != nil {
+		if err == errStanzaNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /resources
+// Estimated resource usage of each registered stanza accessible by the bearer token, along with process-wide usage
+func (s *adminServer) handleResources(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	stanzas := make(map[string]stanzaResources)
+	for _, u := range s.granted(bearerToken(req)) {
+		stanzas[u.stanza] = u.resources()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Process processResources           `json:"process"`
+		Stanzas map[string]stanzaResources `json:"stanzas"`
+	}{currentProcessResources(), stanzas})
+}
+
+// GET /metrics?stanza=NAME
+// Metrics of the stanza in Prometheus text format, i.e. series labeled with the stanza or its upstream hosts
+func (s *adminServer) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	_, u := s.authorize(w, req)
+	if u == nil {
+		return
+	}
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	for _, mf := range u.scopeMetrics(mfs) {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			log.Warningf("Failed to write metrics of stanza %q: %v", u.stanza, err)
+			return
+		}
+	}
+}
+
+// GET /reconcile?stanza=NAME
+// Reconciliation of exclusions against FROM... of the stanza, see reconcile()
+func (s *adminServer) handleReconcile(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	_, u := s.authorize(w, req)
+	if u == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(u.reconcile())
+}
+
+// GET /maintenance?stanza=NAME
+// POST /maintenance?stanza=NAME&host=HOST&on=BOOL
+// List maintenance mode of upstream hosts of the stanza, or put a host into or out of maintenance mode
+func (s *adminServer) handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	_, u := s.authorize(w, req)
+	if u == nil {
+		return
+	}
+	if req.Method == http.MethodPost {
+		if u.isFrozen() {
+			http.Error(w, errStanzaFrozen.Error(), http.StatusConflict)
+			return
+		}
+		query := req.URL.Query()
+		host := u.host(query.Get("host"))
+		if host == nil {
+			http.Error(w, errHostNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		on, err := strconv.ParseBool(query.Get("on"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		host.setMaintenance(on)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	hosts := make(map[string]bool)
+	for _, host := range u.allHosts() {
+		hosts[host.Name()] = host.inMaintenance()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(hosts)
+}
+
+// GET /freeze?stanza=NAME
+// POST /freeze?stanza=NAME&on=BOOL
+// Report whether the stanza is frozen, or freeze or unfreeze it
+func (s *adminServer) handleFreeze(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	_, u := s.authorize(w, req)
+	if u == nil {
+		return
+	}
+	if req.Method == http.MethodPost {
+		on, err := strconv.ParseBool(req.URL.Query().Get("on"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u.setFrozen(on)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Frozen bool `json:"frozen"`
+	}{u.isFrozen()})
+}
+
+// Return metric families of this plugin concerning the stanza only
+// Metric names are prefixed by `metrics_namespace' instead of the plugin one if specified.
+func (u *reloadableUpstream) scopeMetrics(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	hosts := make(map[string]bool)
+	for _, host := range u.allHosts() {
+		hosts[host.Name()] = true
+	}
+	prefix := plugin.Namespace + "_" + pluginName + "_"
+
+	var scoped []*dto.MetricFamily
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), prefix) {
+			continue
+		}
+		var metrics []*dto.Metric
+		for _, m := range mf.Metric {
+			for _, label := range m.Label {
+				if (label.GetName() == "stanza" && label.GetValue() == u.stanza) ||
+					(label.GetName() == "to" && hosts[label.GetValue()]) {
+					metrics = append(metrics, m)
+					break
+				}
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		mf.Metric = metrics
+		if len(u.metricsNamespace) != 0 {
+			name := u.metricsNamespace + "_" + strings.TrimPrefix(mf.GetName(), prefix)
+			mf.Name = &name
+		}
+		scoped = append(scoped, mf)
+	}
+	return scoped
+}
+
+// Return true if `s' is a valid Prometheus metric name prefix
+func isMetricsNamespace(s string) bool {
+	for i, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || i != 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return len(s) != 0
+}
+
+const maxPatchSize = 64 * 1024
@@ -0,0 +1,265 @@
+// Package audit implements the audit log format of dnsredir, an append-only log of matched queries.
+//
+// Layout(all integers are little endian):
+//
+//	header   magic "DRAL", version(uint16)
+//	records  payload length(uint32), CRC32 of the payload(uint32), payload
+//	payload  time in Unix nanoseconds(int64), rcode(int16, -1 if failed), query type(uint16),
+//	         duration in microseconds(uvarint), then client, name, upstream and error,
+//	         each one is a length(uvarint) prefixed string
+//
+// Records are appended without rewriting, a torn record at the end(e.g. after a crash) is treated as the end of log,
+// and dropped by the next Open().
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	Magic   = "DRAL"
+	Version = 1
+
+	headerSize = 6
+	// Record header, i.e. payload length and CRC32
+	recordHeaderSize = 8
+	// Payloads larger than this are considered corrupted
+	maxPayloadSize = 4096
+)
+
+var (
+	errNotAuditLog = errors.New("not an audit log")
+	errVersion     = errors.New("unsupported audit log version")
+	ErrCorrupted   = errors.New("corrupted audit log")
+)
+
+// Record of a matched query
+type Record struct {
+	Time     time.Time
+	Client   string // Client IP address
+	Name     string // Query name, lower cased and without trailing dot
+	Qtype    uint16
+	Upstream string        // Upstream host answered the query, empty if none
+	Rcode    int           // Rcode of the reply, -1 if the query failed
+	Err      string        // Error of the failed query, empty if succeeded
+	Duration time.Duration // Truncated to microseconds
+}
+
+func (r *Record) marshal() []byte {
+	buf := make([]byte, 12, 12+binary.MaxVarintLen64+len(r.Client)+len(r.Name)+len(r.Upstream)+len(r.Err)+4*binary.MaxVarintLen64)
+	binary.LittleEndian.PutUint64(buf[0:], uint64(r.Time.UnixNano()))
+	binary.LittleEndian.PutUint16(buf[8:], uint16(int16(r.Rcode)))
+	binary.LittleEndian.PutUint16(buf[10:], r.Qtype)
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(r.Duration/time.Microsecond))
+	buf = append(buf, tmp[:n]...)
+	for _, s := range []string{r.Client, r.Name, r.Upstream, r.Err} {
+		n := binary.PutUvarint(tmp[:], uint64(len(s)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+func (r *Record) unmarshal(payload []byte) error {
+	if len(payload) < 12 {
+		return ErrCorrupted
+	}
+	r.Time = time.Unix(0, int64(binary.LittleEndian.Uint64(payload[0:])))
+	r.Rcode = int(int16(binary.LittleEndian.Uint16(payload[8:])))
+	r.Qtype = binary.LittleEndian.Uint16(payload[10:])
+	payload = payload[12:]
+	us, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return ErrCorrupted
+	}
+	r.Duration = time.Duration(us) * time.Microsecond
+	payload = payload[n:]
+	for _, s := range []*string{&r.Client, &r.Name, &r.Upstream, &r.Err} {
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < size {
+			return ErrCorrupted
+		}
+		*s = string(payload[n : n+int(size)])
+		payload = payload[n+int(size):]
+	}
+	return nil
+}
+
+// Writer appends records to an audit log file
+// The file is rotated to PATH.1 once its size exceeded the limit, thus at most two files are kept.
+// MT-Unsafe
+type Writer struct {
+	path    string
+	maxSize int64
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+}
+
+// Open the audit log for appending, it's created if not exists
+// Zero `maxSize' means never rotate.
+func Open(path string, maxSize int64) (*Writer, error) {
+	w := &Writer{path: path, maxSize: maxSize}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		var header [headerSize]byte
+		copy(header[:], Magic)
+		binary.LittleEndian.PutUint16(header[4:], Version)
+		if _, err := f.Write(header[:]); err != nil {
+			_ = f.Close()
+			return err
+		}
+		size = headerSize
+	} else {
+		// Drop the torn tail(if any), otherwise records appended after it are unreadable
+		r, err := NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		for err == nil {
+			_, err = r.Next()
+		}
+		if r.offset != size {
+			if err := f.Truncate(r.offset); err != nil {
+				_ = f.Close()
+				return err
+			}
+			size = r.offset
+		}
+	}
+	w.f, w.w, w.size = f, bufio.NewWriter(f), size
+	return nil
+}
+
+func checkHeader(r io.Reader) error {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return errNotAuditLog
+	}
+	if !bytes.Equal(header[:4], []byte(Magic)) {
+		return errNotAuditLog
+	}
+	if binary.LittleEndian.Uint16(header[4:]) != Version {
+		return errVersion
+	}
+	return nil
+}
+
+// Append the record, which is buffered until Flush()
+func (w *Writer) Write(r *Record) error {
+	if w.maxSize > 0 && w.size >= w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	payload := r.marshal()
+	var header [recordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(payload); err != nil {
+		return err
+	}
+	w.size += int64(len(header) + len(payload))
+	return nil
+}
+
+func (w *Writer) rotate() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+func (w *Writer) Close() error {
+	err := w.w.Flush()
+	if err2 := w.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Reader reads records of an audit log sequentially
+type Reader struct {
+	r       *bufio.Reader
+	payload []byte
+	// End offset of the last intact record
+	offset int64
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	if err := checkHeader(br); err != nil {
+		return nil, err
+	}
+	return &Reader{r: br, offset: headerSize}, nil
+}
+
+// Read the next record, io.EOF is returned at the end of log
+func (r *Reader) Next() (*Record, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// Torn record
+			err = io.EOF
+		}
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:])
+	if size > maxPayloadSize {
+		return nil, ErrCorrupted
+	}
+	if cap(r.payload) < int(size) {
+		r.payload = make([]byte, size)
+	}
+	payload := r.payload[:size]
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, ErrCorrupted
+	}
+	rec := &Record{}
+	if err := rec.unmarshal(payload); err != nil {
+		return nil, err
+	}
+	r.offset += int64(recordHeaderSize + len(payload))
+	return rec, nil
+}
@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	records := []*Record{
+		{Time: time.Unix(1600000000, 0), Client: "192.0.2.1", Name: "example.com", Qtype: 1, Upstream: "udp://1.1.1.1:53", Rcode: 0, Duration: 1500 * time.Microsecond},
+		{Time: time.Unix(1600000001, 0), Client: "2001:db8::1", Name: "example.org", Qtype: 28, Rcode: -1, Err: "i/o timeout"},
+	}
+	w, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(records[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a torn record, which should be dropped by reopening
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{42, 0, 0})
+	_ = f.Close()
+	if w, err = Open(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(records[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range records {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatalf("Record %v: %v", i, err)
+		}
+		if !rec.Time.Equal(expected.Time) {
+			t.Errorf("Record %v: expected time %v, got %v", i, expected.Time, rec.Time)
+		}
+		rec.Time = expected.Time
+		if !reflect.DeepEqual(rec, expected) {
+			t.Errorf("Record %v: expected %+v, got %+v", i, expected, rec)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Expected %v, got %v", io.EOF, err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	w, err := Open(path, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.Write(&Record{Time: time.Now(), Client: "192.0.2.1", Name: "example.com", Qtype: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("Expected rotated log, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/leiless/dnsredir/audit"
+	"sync"
+	"time"
+)
+
+// Audit trail of matched queries of a stanza, see `audit_log'
+// Records are written by a worker, they're dropped rather than blocking query processing if the worker lags behind.
+type auditLog struct {
+	stanza  string
+	path    string
+	maxSize int64
+
+	records chan *audit.Record
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newAuditLog(path string, maxSize int64) *auditLog {
+	return &auditLog{
+		path:    path,
+		maxSize: maxSize,
+		records: make(chan *audit.Record, auditQueueSize),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Record the query answered by `upstream'(empty if answered locally) with `rcode', or failed with `err'
+func (a *auditLog) record(state *request.Request, name, upstream string, rcode int, err error, begin time.Time) {
+	rec := &audit.Record{
+		Time:     begin,
+		Client:   state.IP(),
+		Name:     name,
+		Qtype:    state.QType(),
+		Upstream: upstream,
+		Rcode:    rcode,
+		Duration: time.Since(begin),
+	}
+	if err != nil {
+		rec.Rcode, rec.Err = -1, err.Error()
+	}
+	select {
+	case a.records <- rec:
+	default:
+		AuditDroppedCount.WithLabelValues(a.stanza).Inc()
+	}
+}
+
+func (a *auditLog) start(stanza string) error {
+	a.stanza = stanza
+	w, err := audit.Open(a.path, a.maxSize)
+	if err != nil {
+		return err
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		ticker := time.NewTicker(auditFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case rec := <-a.records:
+				if err := w.Write(rec); err != nil {
+					log.Warningf("Failed to write audit log %q: %v", a.path, err)
+				}
+			case <-ticker.C:
+				if err := w.Flush(); err != nil {
+					log.Warningf("Failed to flush audit log %q: %v", a.path, err)
+				}
+			case <-a.stop:
+				// Drain pending records
+				for {
+					select {
+					case rec := <-a.records:
+						_ = w.Write(rec)
+					default:
+						if err := w.Close(); err != nil {
+							log.Warningf("Failed to close audit log %q: %v", a.path, err)
+						}
+						return
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *auditLog) shutdown() {
+	close(a.stop)
+	a.wg.Wait()
+}
+
+const (
+	auditQueueSize     = 1024
+	auditFlushInterval = time.Second
+)
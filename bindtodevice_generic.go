@@ -0,0 +1,20 @@
+// +build !linux
+
+package dnsredir
+
+import (
+	"errors"
+	"syscall"
+)
+
+// SO_BINDTODEVICE is Linux-specific
+const bindToDeviceSupported = false
+
+var errBindToDevice = errors.New("binding to network interface is not supported")
+
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	_ = iface
+	return func(network, address string, c syscall.RawConn) error {
+		return errBindToDevice
+	}
+}
@@ -0,0 +1,24 @@
+// +build linux
+
+package dnsredir
+
+import (
+	"syscall"
+)
+
+const bindToDeviceSupported = true
+
+// Return a net.Dialer control function which binds the socket to given network interface
+// Useful when the same upstream IP exists on multiple VLANs, requires CAP_NET_RAW.
+func bindToDeviceControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,94 @@
+package dnsredir
+
+import (
+	"math"
+)
+
+// Bloom filter of names of a name item, which rejects most non-matching names before looking up the name set
+// i.e. names of huge block lists, see `match_accel bloom'
+// Names are hashed from the last character, so hashes of all parents of a name are computed in one pass.
+type bloomFilter struct {
+	bits []uint64
+	k    uint32 // Number of hash functions
+}
+
+func newBloomFilter(names domainSet) *bloomFilter {
+	n := names.Len()
+	if n == 0 {
+		return nil
+	}
+	m := n * bloomBitsPerName
+	f := &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		k:    uint32(math.Round(bloomBitsPerName * math.Ln2)),
+	}
+	_ = names.ForEachDomain(func(name string) error {
+		f.add(reverseHash(name))
+		return nil
+	})
+	return f
+}
+
+// Return FNV-1a hash of the name in reversed order
+func reverseHash(name string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := len(name) - 1; i >= 0; i-- {
+		h = (h ^ uint64(name[i])) * fnvPrime64
+	}
+	return h
+}
+
+// Double hashing, see: https://www.eecs.harvard.edu/~michaelm/postscripts/rsa2008.pdf
+func (f *bloomFilter) locate(h uint64, i uint32) (int, uint64) {
+	bit := (uint64(uint32(h)) + uint64(i)*(h>>32)) % uint64(len(f.bits)*64)
+	return int(bit / 64), 1 << (bit % 64)
+}
+
+func (f *bloomFilter) add(h uint64) {
+	for i := uint32(0); i < f.k; i++ {
+		word, mask := f.locate(h, i)
+		f.bits[word] |= mask
+	}
+}
+
+func (f *bloomFilter) mayContain(h uint64) bool {
+	for i := uint32(0); i < f.k; i++ {
+		word, mask := f.locate(h, i)
+		if f.bits[word]&mask == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Return false if neither the name nor any of its parents is in the filter, true if the filter is nil
+// Assume `child' is lower cased and without trailing dot
+func (f *bloomFilter) mayMatch(child string) bool {
+	if f == nil {
+		return true
+	}
+	h := uint64(fnvOffset64)
+	for i := len(child) - 1; i >= 0; i-- {
+		h = (h ^ uint64(child[i])) * fnvPrime64
+		if (i == 0 || child[i-1] == '.') && f.mayContain(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return memory footprint of the filter in bytes
+func (f *bloomFilter) size() uint64 {
+	if f == nil {
+		return 0
+	}
+	return uint64(len(f.bits) * 8)
+}
+
+const (
+	// About 1% false positive rate
+	bloomBitsPerName = 10
+
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
@@ -0,0 +1,33 @@
+package dnsredir
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+type queryBudgetKey struct{}
+
+// queryBudget caps total upstream attempts made on behalf of a single query
+// It's carried in the request context, so nested lookups(e.g. a query re-entering the plugin chain,
+// possibly hitting another stanza) share the budget of the outermost one.
+type queryBudget struct {
+	left int32
+}
+
+// Attach a query budget to the context, an existing budget will be reused
+func withQueryBudget(ctx context.Context, n int32) (context.Context, *queryBudget) {
+	if b, ok := ctx.Value(queryBudgetKey{}).(*queryBudget); ok {
+		return ctx, b
+	}
+	b := &queryBudget{left: n}
+	return context.WithValue(ctx, queryBudgetKey{}, b), b
+}
+
+// Consume an attempt, return false if the budget is exhausted
+// MT-Safe
+func (b *queryBudget) take() bool {
+	return atomic.AddInt32(&b.left, -1) >= 0
+}
+
+var errDepthExceeded = errors.New("maximum query depth exceeded")
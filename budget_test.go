@@ -0,0 +1,72 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQueryBudget(t *testing.T) {
+	ctx, b := withQueryBudget(context.Background(), 2)
+	// Nested lookups share the budget of the outermost query
+	ctx2, b2 := withQueryBudget(ctx, 16)
+	if b2 != b || ctx2 != ctx {
+		t.Fatalf("Expected the outermost budget reused")
+	}
+
+	tests := []bool{true, true, false, false}
+	for i, expected := range tests {
+		budget := b
+		if i%2 != 0 {
+			budget = b2
+		}
+		if ok := budget.take(); ok != expected {
+			t.Errorf("Test#%v: expected take() %v, got %v", i, expected, ok)
+		}
+	}
+}
+
+func TestQueryBudgetExhausted(t *testing.T) {
+	// Upstream never answers, thus every attempt fails
+	var attempts int32
+	addr, stop := startTestServer(t, udpProto, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Name != "." {
+			atomic.AddInt32(&attempts, 1)
+		}
+	}))
+	defer stop()
+	r, stopRedir := newTestDnsredir(t, "dnsredir . {\n to "+addr+"\n max_fails 0\n max_retry 10\n max_depth 3\n read_timeout 100ms\n}")
+	defer stopRedir()
+
+	tests := []struct {
+		// Attempts already made on behalf of the query, e.g. by an outer stanza
+		taken    int32
+		attempts int32
+	}{
+		{0, 3},
+		{2, 1},
+		{3, 0},
+		{10, 0},
+	}
+	for i, test0 := range tests {
+		atomic.StoreInt32(&attempts, 0)
+		ctx, b := withQueryBudget(context.Background(), 3)
+		for j := int32(0); j < test0.taken; j++ {
+			b.take()
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rc, err := r.ServeDNS(ctx, rec, req)
+		if rc != dns.RcodeServerFailure || err != errDepthExceeded {
+			t.Errorf("Test#%v: expected %v with %v, got %v %v", i, dns.RcodeToString[dns.RcodeServerFailure], errDepthExceeded, rc, err)
+		}
+		if n := atomic.LoadInt32(&attempts); n != test0.attempts {
+			t.Errorf("Test#%v: expected %v upstream attempts, got %v", i, test0.attempts, n)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/leiless/dnsredir/compiled"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Pending name list update of a NameItem under canary rollout
+type canaryNames struct {
+	names   domainSet
+	tags    map[string][]string
+	excepts domainSet // Exception names of adblock rules
+	bloom   *bloomFilter
+	until   time.Time // Soak deadline, after which the update will be fully activated
+	bytes   uint64    // Estimated memory footprint
+}
+
+// canaryRollout applies freshly reloaded name lists only to a subset of queries for a soak period
+// The update will be rolled back if SERVFAIL rate of canary queries is elevated.
+type canaryRollout struct {
+	soak    time.Duration
+	percent float64 // Percentage of clients under canary
+	clients []*net.IPNet
+
+	// Outcome counters since the last update, canary and baseline respectively
+	total        uint64
+	servfail     uint64
+	baseTotal    uint64
+	baseServfail uint64
+}
+
+// Return true if the request should see the canary name list
+func (c *canaryRollout) selects(state *request.Request) bool {
+	if len(c.clients) != 0 {
+		if ip := net.ParseIP(state.IP()); ip != nil {
+			for _, cidr := range c.clients {
+				if cidr.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	// Sticky by client, so a client won't flap between the old and new list
+	return c.percent > 0 && float64(stringHash(state.IP())%10000) < c.percent*100
+}
+
+func (c *canaryRollout) reset() {
+	atomic.StoreUint64(&c.total, 0)
+	atomic.StoreUint64(&c.servfail, 0)
+	atomic.StoreUint64(&c.baseTotal, 0)
+	atomic.StoreUint64(&c.baseServfail, 0)
+}
+
+// Record outcome of a request, return true if the canary should be rolled back
+func (c *canaryRollout) record(canary, servfail bool) bool {
+	if !canary {
+		atomic.AddUint64(&c.baseTotal, 1)
+		if servfail {
+			atomic.AddUint64(&c.baseServfail, 1)
+		}
+		return false
+	}
+
+	total := atomic.AddUint64(&c.total, 1)
+	var bad uint64
+	if servfail {
+		bad = atomic.AddUint64(&c.servfail, 1)
+	} else {
+		bad = atomic.LoadUint64(&c.servfail)
+	}
+	if total < canaryMinSamples {
+		return false
+	}
+
+	var baseRatio float64
+	if baseTotal := atomic.LoadUint64(&c.baseTotal); baseTotal != 0 {
+		baseRatio = float64(atomic.LoadUint64(&c.baseServfail)) / float64(baseTotal)
+	}
+	return float64(bad)/float64(total) > baseRatio+canaryServfailMargin
+}
+
+// Put freshly parsed names into the item, under canary rollout if enabled
+// MT-Unsafe: must be called with item locked
+func (n *NameList) swapNames(item *NameItem, names domainSet, tags map[string][]string, excepts domainSet) {
+	count := names.Len()
+	if item.except {
+		excepts = mergeExcepts(names, excepts)
+		names, tags = make(domainSet), nil
+	}
+	var list *compiled.List
+	if n.compact {
+		if l, err := compactNames(names); err != nil {
+			log.Warningf("Failed to compact %v, err: %v", item, err)
+		} else {
+			list, names = l, make(domainSet)
+		}
+	}
+	var bloom *bloomFilter
+	if n.bloom {
+		bloom = newBloomFilter(names)
+	}
+	bytes := estimateNamesBytes(names, tags) + estimateNamesBytes(excepts, nil) + bloom.size()
+	if list != nil {
+		bytes += uint64(list.Size())
+	}
+	if !n.reserveMemory(item, bytes) {
+		log.Warningf("Update of %v refused, names: %v, since memory ceiling %v bytes exceeded", item, count, n.memoryCeiling)
+		return
+	}
+	publish(Event{Type: EventListReloaded, Stanza: n.stanza, Source: item.String(), Names: count})
+
+	// Initial population is always fully activated
+	cur := item.loadNames()
+	if n.canary == nil || cur.names == nil {
+		if n.flushHook != nil && cur.names != nil {
+			n.flushHook.notify(n.stanza, item.String(), cur.names, names)
+		}
+		item.storeNames(&itemNames{
+			names:    names,
+			tags:     tags,
+			excepts:  excepts,
+			compiled: list,
+			bloom:    bloom,
+			bytes:    bytes,
+		})
+		return
+	}
+	next := *cur
+	next.canary = &canaryNames{
+		names:   names,
+		tags:    tags,
+		excepts: excepts,
+		bloom:   bloom,
+		until:   clock.Now().Add(n.canary.soak),
+		bytes:   bytes,
+	}
+	item.storeNames(&next)
+	n.canary.reset()
+	log.Infof("Canary rollout of %v started, soak: %v", item, n.canary.soak)
+}
+
+// Return true if any name item is under canary rollout
+func (n *NameList) inCanary() bool {
+	for _, item := range n.items {
+		if item.loadNames().canary != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Fully activate canary name lists which survived the soak period
+func (n *NameList) promoteCanary() {
+	now := clock.Now()
+	for _, item := range n.items {
+		item.Lock()
+		if cur := item.loadNames(); cur.canary != nil && now.After(cur.canary.until) {
+			if n.flushHook != nil {
+				n.flushHook.notify(n.stanza, item.String(), cur.names, cur.canary.names)
+			}
+			item.storeNames(&itemNames{
+				names:   cur.canary.names,
+				tags:    cur.canary.tags,
+				excepts: cur.canary.excepts,
+				bloom:   cur.canary.bloom,
+				bytes:   cur.canary.bytes,
+			})
+			log.Infof("Canary rollout of %v promoted", item)
+		}
+		item.Unlock()
+	}
+}
+
+// Discard all canary name lists
+func (n *NameList) rollbackCanary() {
+	for _, item := range n.items {
+		item.Lock()
+		if cur := item.loadNames(); cur.canary != nil {
+			next := *cur
+			next.canary = nil
+			item.storeNames(&next)
+			log.Warningf("Canary rollout of %v rolled back due to elevated SERVFAIL rate", item)
+		}
+		item.Unlock()
+	}
+}
+
+// Record outcome of a matched request, and roll back canary name lists if necessary
+func (n *NameList) recordCanary(canary, servfail bool) {
+	if n.canary.record(canary, servfail) {
+		n.rollbackCanary()
+		n.canary.reset()
+	}
+}
+
+const (
+	canaryCheckInterval = 1 * time.Second
+	// Minimal number of canary requests before rollback is considered
+	canaryMinSamples = 100
+	// Rollback if canary SERVFAIL rate exceeds the baseline by this margin
+	canaryServfailMargin = 0.05
+)
@@ -0,0 +1,90 @@
+package dnsredir
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCanaryRollout(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+
+	_, cidr, _ := net.ParseCIDR("10.1.0.0/16")
+	item := &NameItem{path: "list.txt"}
+	n := &NameList{items: []*NameItem{item}, canary: &canaryRollout{soak: time.Minute, clients: []*net.IPNet{cidr}}}
+	update := func(names ...string) {
+		set := make(domainSet)
+		for _, name := range names {
+			set.Add(name)
+		}
+		item.Lock()
+		n.swapNames(item, set, nil, nil)
+		item.Unlock()
+	}
+	// Resolve the name as seen by the client
+	matches := func(client, name string) bool {
+		return n.match(name, n.canary.selects(newSplitTestState(name+".", client)))
+	}
+
+	// Initial population is fully activated
+	update("example.com")
+	if n.inCanary() || !matches("10.1.0.1", "example.com") || !matches("10.2.0.1", "example.com") {
+		t.Fatalf("Expected initial names seen by all clients")
+	}
+
+	tests := []struct {
+		client   string
+		name     string
+		expected bool
+	}{
+		// Canary clients see the update
+		{"10.1.0.1", "example.org", true},
+		{"10.1.255.255", "example.org", true},
+		{"10.1.0.1", "example.com", false},
+		// Others stay on the old names
+		{"10.2.0.1", "example.org", false},
+		{"10.2.0.1", "example.com", true},
+		{"192.168.1.1", "example.com", true},
+	}
+	update("example.org")
+	if !n.inCanary() {
+		t.Fatalf("Expected the update under canary rollout")
+	}
+	for i, test := range tests {
+		if matched := matches(test.client, test.name); matched != test.expected {
+			t.Errorf("Test#%v: expected %q matched %v for client %v, got %v", i, test.name, test.expected, test.client, matched)
+		}
+	}
+
+	// Not promoted until the soak period elapsed
+	fc.Advance(30 * time.Second)
+	n.promoteCanary()
+	if !n.inCanary() || matches("10.2.0.1", "example.org") {
+		t.Fatalf("Expected the update still under canary rollout")
+	}
+	fc.Advance(31 * time.Second)
+	n.promoteCanary()
+	if n.inCanary() || !matches("10.2.0.1", "example.org") || matches("10.2.0.1", "example.com") {
+		t.Fatalf("Expected the update promoted to all clients")
+	}
+
+	// Rolled back once canary SERVFAIL rate is elevated, regardless of the soak period
+	update("example.net")
+	for i := 0; i < canaryMinSamples; i++ {
+		n.recordCanary(false, false)
+		if !n.inCanary() {
+			t.Fatalf("Test#%v: expected rollback not triggered by baseline requests", i)
+		}
+	}
+	for i := 0; i < canaryMinSamples-1; i++ {
+		n.recordCanary(true, true)
+	}
+	if !n.inCanary() {
+		t.Fatalf("Expected rollback not triggered until %v canary requests", canaryMinSamples)
+	}
+	n.recordCanary(true, true)
+	if n.inCanary() || matches("10.1.0.1", "example.net") || !matches("10.1.0.1", "example.org") {
+		t.Fatalf("Expected the update rolled back for canary clients")
+	}
+}
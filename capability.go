@@ -0,0 +1,152 @@
+package dnsredir
+
+import (
+	"crypto/tls"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// Capabilities of an upstream host detected by probing
+type hostCapabilities struct {
+	edns    bool   // Responds with OPT RR to EDNS0 queries
+	tcp     bool   // Answers over TCP
+	dot     bool   // Answers DNS over TLS on port 853
+	cookie  bool   // Returns server cookie(RFC 7873)
+	maxSize uint16 // EDNS0 buffer size advertised by the host, zero if unknown
+}
+
+// Return true if the upstream host is capability probable, i.e. a classic DNS host
+func (uh *UpstreamHost) isCapabilityProbable() bool {
+	return uh.proto == "dns" || uh.proto == "udp" || uh.proto == "tcp"
+}
+
+// Return a DNS client for probing purpose, which honors the outgoing network interface(if any)
+func (uh *UpstreamHost) probeClient(network string, tlsConfig *tls.Config) *dns.Client {
+	c := &dns.Client{
+		Net:       network,
+		TLSConfig: tlsConfig,
+		Timeout:   defaultHcTimeout,
+	}
+	if len(uh.iface) != 0 {
+		c.Dialer = &net.Dialer{
+			Timeout: defaultHcTimeout,
+			Control: bindToDeviceControl(uh.iface),
+		}
+	}
+	return c
+}
+
+func (uh *UpstreamHost) probeCapabilities() {
+	caps := &hostCapabilities{}
+
+	network := "udp"
+	if uh.proto == "tcp" {
+		network = "tcp"
+	}
+	req := &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+	req.MsgHdr.RecursionDesired = uh.transport.recursionDesired
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	opt := req.IsEdns0()
+	// 8 bytes client cookie, server cookie absent
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+	ret, _, err := uh.probeClient(network, nil).Exchange(req, uh.dialAddr())
+	if err != nil {
+		// Host unreachable, leave it to the health check
+		log.Debugf("Capability probe of %v failed: %v", uh.Name(), err)
+		return
+	}
+	if opt := ret.IsEdns0(); opt != nil {
+		caps.edns = true
+		caps.maxSize = opt.UDPSize()
+		for _, o := range opt.Option {
+			// Client cookie is 16 hex digits, server cookie follows
+			if cookie, ok := o.(*dns.EDNS0_COOKIE); ok && len(cookie.Cookie) > 16 {
+				caps.cookie = true
+			}
+		}
+	}
+
+	req = &dns.Msg{}
+	req.SetQuestion(".", dns.TypeNS)
+	req.MsgHdr.RecursionDesired = uh.transport.recursionDesired
+	if network == "tcp" {
+		caps.tcp = true
+	} else if _, _, err := uh.probeClient("tcp", nil).Exchange(req, uh.dialAddr()); err == nil {
+		caps.tcp = true
+	}
+
+	if host, _, err := net.SplitHostPort(uh.addr); err == nil {
+		// Only detect availability, the certificate is not verified since it won't be used
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if _, _, err := uh.probeClient("tcp-tls", tlsConfig).Exchange(req, net.JoinHostPort(host, "853")); err == nil {
+			caps.dot = true
+		}
+	}
+
+	if old := uh.capabilities(); old == nil || *old != *caps {
+		log.Infof("Capabilities of %v probed: edns: %v tcp: %v dot: %v cookie: %v max size: %v",
+			uh.Name(), caps.edns, caps.tcp, caps.dot, caps.cookie, caps.maxSize)
+		if caps.dot && uh.proto != "tls" {
+			log.Infof("%v supports DNS over TLS, consider to use tls:// instead", uh.Name())
+		}
+	}
+	uh.caps.Store(caps)
+
+	for name, ok := range map[string]bool{
+		"edns":   caps.edns,
+		"tcp":    caps.tcp,
+		"dot":    caps.dot,
+		"cookie": caps.cookie,
+	} {
+		v := 0.0
+		if ok {
+			v = 1
+		}
+		UpstreamCapability.WithLabelValues(uh.Name(), name).Set(v)
+	}
+}
+
+// Return probed capabilities of the upstream host, nil if unknown
+func (uh *UpstreamHost) capabilities() *hostCapabilities {
+	caps, _ := uh.caps.Load().(*hostCapabilities)
+	return caps
+}
+
+// Return true unless the host is known to be not EDNS capable
+func (uh *UpstreamHost) ednsCapable() bool {
+	caps := uh.capabilities()
+	return caps == nil || caps.edns
+}
+
+// Return true unless the host is known to be not TCP capable
+func (uh *UpstreamHost) tcpCapable() bool {
+	caps := uh.capabilities()
+	return caps == nil || caps.tcp
+}
+
+func (hc *HealthCheck) capabilityProbe() {
+	for _, host := range hc.hosts {
+		if host.isCapabilityProbable() {
+			go host.probeCapabilities()
+		}
+	}
+}
+
+func (hc *HealthCheck) capabilityProbeWorker() {
+	// Kick off initial probe immediately
+	hc.capabilityProbe()
+
+	ticker := clock.NewTicker(hc.capabilityProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.Chan():
+			if !hc.quiet.active(clock.Now()) {
+				hc.capabilityProbe()
+			}
+		case <-hc.stop:
+			return
+		}
+	}
+}
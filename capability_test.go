@@ -0,0 +1,65 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestCapabilityProbe(t *testing.T) {
+	// A legacy UDP-only server which chokes on EDNS0, as RFC 6891 section 7 allows
+	addr, stop := startTestServer(t, udpProto, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		if req.IsEdns0() != nil {
+			m.SetRcode(req, dns.RcodeFormatError)
+			m.Extra = nil
+		} else {
+			m.SetReply(req)
+		}
+		_ = w.WriteMsg(m)
+	}))
+	defer stop()
+	host, stopHost := newTestHost(t, "dnsredir . {\n to "+addr+"\n}")
+	defer stopHost()
+
+	exchange := func(tcp bool) (*dns.Msg, error) {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		state := &request.Request{W: &test.ResponseWriter{TCP: tcp}, Req: req}
+		return host.Exchange(context.Background(), state, nil, false)
+	}
+
+	tests := []struct {
+		probed bool
+		tcp    bool
+		rcode  int
+		// Expect error since the host doesn't serve TCP
+		shouldErr bool
+	}{
+		// Unknown capabilities, queries are forwarded as is
+		{false, false, dns.RcodeFormatError, false},
+		{false, true, 0, true},
+		// OPT RR is stripped, and TCP queries go over UDP
+		{true, false, dns.RcodeSuccess, false},
+		{true, true, dns.RcodeSuccess, false},
+	}
+	for i, test := range tests {
+		if test.probed && host.capabilities() == nil {
+			host.probeCapabilities()
+			caps := host.capabilities()
+			if caps == nil || caps.edns || caps.tcp || caps.dot || caps.cookie {
+				t.Fatalf("Test#%v: expected no capability probed, got %+v", i, caps)
+			}
+		}
+		reply, err := exchange(test.tcp)
+		if (err != nil) != test.shouldErr {
+			t.Fatalf("Test#%v: expected error %v, got %v", i, test.shouldErr, err)
+		}
+		if err == nil && reply.Rcode != test.rcode {
+			t.Errorf("Test#%v: expected rcode %v, got %v", i, dns.RcodeToString[test.rcode], dns.RcodeToString[reply.Rcode])
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package dnsredir
+
+import (
+	"crypto/x509"
+	"sync/atomic"
+	"time"
+)
+
+// Record expiry of the certificate chain presented by a DoT upstream in a successful handshake
+// The earliest expiry in the chain is taken, since an intermediate certificate may expire before the leaf one.
+// A warning is logged at most once per certExpiryWarnInterval if it expires within `tls_expiry_warning'.
+func (uh *UpstreamHost) recordCertExpiry(certs []*x509.Certificate) {
+	if len(certs) == 0 {
+		return
+	}
+	expiring := certs[0]
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(expiring.NotAfter) {
+			expiring = cert
+		}
+	}
+	atomic.StoreInt64(&uh.certExpiry, expiring.NotAfter.UnixNano())
+
+	left := time.Until(expiring.NotAfter)
+	TlsCertExpiryDays.WithLabelValues(uh.Name()).Set(left.Hours() / 24)
+	if uh.certWarning == 0 || left >= uh.certWarning {
+		return
+	}
+	now := time.Now().UnixNano()
+	warned := atomic.LoadInt64(&uh.certWarned)
+	if now-warned < int64(certExpiryWarnInterval) || !atomic.CompareAndSwapInt64(&uh.certWarned, warned, now) {
+		return
+	}
+	log.Warningf("TLS certificate %q of %v expires in %.1f days, at %v",
+		expiring.Subject.CommonName, uh.Name(), left.Hours()/24, expiring.NotAfter.Format(time.RFC3339))
+}
+
+const (
+	defaultTlsExpiryWarning = 14 * 24 * time.Hour
+	certExpiryWarnInterval  = 6 * time.Hour
+)
@@ -0,0 +1,79 @@
+package dnsredir
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock abstracts time for reload timers, health checks and connection expiry
+// Tests may substitute a fake implementation to drive them deterministically.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the subset of *time.Ticker used by this package
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+// Package wide clock
+// It's replaced atomically, since goroutines of a stopped plugin instance may still read it for a while.
+var clock = newSwappableClock(realClock{})
+
+type swappableClock struct {
+	v atomic.Value
+}
+
+// atomic.Value requires values of the same concrete type
+type clockHolder struct {
+	Clock
+}
+
+func newSwappableClock(c Clock) *swappableClock {
+	s := &swappableClock{}
+	s.v.Store(clockHolder{c})
+	return s
+}
+
+func (s *swappableClock) load() Clock {
+	return s.v.Load().(clockHolder).Clock
+}
+
+// Replace the clock, return the old one
+func (s *swappableClock) swap(c Clock) Clock {
+	old := s.load()
+	s.v.Store(clockHolder{c})
+	return old
+}
+
+func (s *swappableClock) Now() time.Time {
+	return s.load().Now()
+}
+
+func (s *swappableClock) NewTicker(d time.Duration) Ticker {
+	return s.load().NewTicker(d)
+}
+
+func since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
@@ -0,0 +1,234 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves forward when told to, tickers fire as the time passes their periods
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	clock  *fakeClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+	stop   bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1600000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.Lock()
+	defer c.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.tickers {
+		for !t.stop && !t.next.After(c.now) {
+			// Like time.Ticker, drop ticks for slow receivers
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	t.stop = true
+}
+
+// Replace the package clock, the returned function restores it
+func useFakeClock() (*fakeClock, func()) {
+	fc := newFakeClock()
+	old := clock.swap(fc)
+	return fc, func() { clock.swap(old) }
+}
+
+func TestFakeTicker(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+	ticker := clock.NewTicker(time.Minute)
+
+	fc.Advance(59 * time.Second)
+	select {
+	case <-ticker.Chan():
+		t.Fatalf("ticker fired before its period")
+	default:
+	}
+
+	fc.Advance(time.Second)
+	select {
+	case <-ticker.Chan():
+	default:
+		t.Fatalf("ticker didn't fire after its period")
+	}
+
+	ticker.Stop()
+	fc.Advance(time.Hour)
+	select {
+	case <-ticker.Chan():
+		t.Fatalf("stopped ticker fired")
+	default:
+	}
+}
+
+func TestConnExpiry(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+	tr := newTransport()
+	tr.expire = 10 * time.Second
+
+	var conns [typeTotalCount][]*persistConn
+	for i := 0; i < 3; i++ {
+		c1, c2 := net.Pipe()
+		defer Close(c2)
+		conns[typeUdp] = append(conns[typeUdp], &persistConn{c: &dns.Conn{Conn: c1}, used: fc.Now()})
+		fc.Advance(5 * time.Second)
+	}
+
+	// Used at -15s, -10s and -5s respectively
+	tr.cleanup0(&conns, false)
+	if n := len(conns[typeUdp]); n != 1 {
+		t.Fatalf("expected 1 connection left, got %v", n)
+	}
+
+	fc.Advance(4 * time.Second)
+	tr.cleanup0(&conns, false)
+	if n := len(conns[typeUdp]); n != 1 {
+		t.Fatalf("expected 1 connection left, got %v", n)
+	}
+
+	fc.Advance(time.Second)
+	tr.cleanup0(&conns, false)
+	if n := len(conns[typeUdp]); n != 0 {
+		t.Fatalf("expected no connection left, got %v", n)
+	}
+}
+
+func TestFallbackUpgrade(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+	f := &transportFallback{level: 1, upgradeAt: fc.Now().Add(fallbackUpgradeInterval)}
+
+	if level, upgrade := f.pick(); level != 1 || upgrade {
+		t.Fatalf("expected level 1 without upgrade, got %v %v", level, upgrade)
+	}
+	fc.Advance(fallbackUpgradeInterval)
+	if level, upgrade := f.pick(); level != 0 || !upgrade {
+		t.Fatalf("expected upgrade attempt, got %v %v", level, upgrade)
+	}
+	// Next upgrade attempt is deferred
+	if level, upgrade := f.pick(); level != 1 || upgrade {
+		t.Fatalf("expected level 1 without upgrade, got %v %v", level, upgrade)
+	}
+}
+
+func TestAnswerMemo(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+	memo := newAnswerMemo(50 * time.Millisecond)
+
+	query := func(id uint16, qtype uint16) *request.Request {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", qtype)
+		req.Id = id
+		return &request.Request{W: &test.ResponseWriter{}, Req: req}
+	}
+
+	state := query(1, dns.TypeA)
+	if memo.get(state) != nil {
+		t.Fatalf("unexpected memoized reply")
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(state.Req)
+	memo.put(state, reply)
+
+	fc.Advance(20 * time.Millisecond)
+	if got := memo.get(query(2, dns.TypeA)); got == nil || got.Id != 2 {
+		t.Fatalf("expected memoized reply with id 2, got %v", got)
+	}
+	if memo.get(query(3, dns.TypeAAAA)) != nil {
+		t.Fatalf("unexpected memoized reply of another qtype")
+	}
+
+	fc.Advance(30 * time.Millisecond)
+	if memo.get(query(4, dns.TypeA)) != nil {
+		t.Fatalf("unexpected memoized reply after the window")
+	}
+
+	servfail := new(dns.Msg)
+	servfail.SetRcode(state.Req, dns.RcodeServerFailure)
+	memo.put(state, servfail)
+	if memo.get(query(5, dns.TypeA)) != nil {
+		t.Fatalf("unexpected memoized SERVFAIL")
+	}
+
+	// Requests with different EDNS or ECS options never share a reply
+	withEcs := func(id uint16, addr string) *request.Request {
+		state := query(id, dns.TypeA)
+		state.Req.SetEdns0(dns.DefaultMsgSize, false)
+		ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(addr).To4()}
+		opt := state.Req.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+		return state
+	}
+	state = withEcs(6, "1.2.3.0")
+	reply = new(dns.Msg)
+	reply.SetReply(state.Req)
+	reply.SetEdns0(1232, false)
+	opt := reply.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 16, Address: net.ParseIP("1.2.3.0").To4()},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	memo.put(state, reply)
+	if memo.get(withEcs(7, "5.6.7.0")) != nil {
+		t.Fatalf("unexpected memoized reply of another client subnet")
+	}
+	if memo.get(query(8, dns.TypeA)) != nil {
+		t.Fatalf("unexpected memoized reply of an EDNS request")
+	}
+	got := memo.get(withEcs(9, "1.2.3.0"))
+	if got == nil {
+		t.Fatalf("expected memoized reply of the same client subnet")
+	}
+	// OPT is rebuilt from the request, thus no cookie of another client
+	opt = got.IsEdns0()
+	if opt == nil || opt.UDPSize() != 1232 || len(opt.Option) != 1 {
+		t.Fatalf("expected OPT with ECS only, got %v", opt)
+	}
+	if ecs, ok := opt.Option[0].(*dns.EDNS0_SUBNET); !ok || ecs.SourceScope != 16 || !ecs.Address.Equal(net.ParseIP("1.2.3.0")) {
+		t.Fatalf("expected ECS of the request with scope of the upstream, got %v", opt.Option[0])
+	}
+}
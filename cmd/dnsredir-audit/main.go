@@ -0,0 +1,103 @@
+// Command dnsredir-audit prints records of dnsredir audit logs(see `audit_log'), optionally filtered.
+//
+// Usage:
+//
+//	dnsredir-audit [-client CIDR] [-name DOMAIN] [-since DURATION] [-failed] FILE...
+//
+// Records are printed in tab-separated columns: time, client, name, type, upstream, rcode, duration and error.
+// Rotated logs should be given before the current one, e.g. `dnsredir-audit audit.log.1 audit.log'.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/leiless/dnsredir/audit"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	client := flag.String("client", "", "only print records of clients in the IP or CIDR")
+	name := flag.String("name", "", "only print records of the domain and its subdomains")
+	since := flag.Duration("since", 0, "only print records within the duration, e.g. 24h")
+	failed := flag.Bool("failed", false, "only print records of failed queries")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fatalf("no audit log specified")
+	}
+
+	var clients *net.IPNet
+	if len(*client) != 0 {
+		s := *client
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		clients = ipNet
+	}
+	domain := strings.TrimSuffix(strings.ToLower(*name), ".")
+	var after time.Time
+	if *since > 0 {
+		after = time.Now().Add(-*since)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		r, err := audit.NewReader(f)
+		if err != nil {
+			fatalf("%v: %v", path, err)
+		}
+		for {
+			rec, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fatalf("%v: %v", path, err)
+			}
+			if rec.Time.Before(after) ||
+				(clients != nil && !clients.Contains(net.ParseIP(rec.Client))) ||
+				(len(domain) != 0 && rec.Name != domain && !strings.HasSuffix(rec.Name, "."+domain)) ||
+				(*failed && rec.Rcode >= 0) {
+				continue
+			}
+			printRecord(out, rec)
+		}
+		_ = f.Close()
+	}
+}
+
+func printRecord(w io.Writer, rec *audit.Record) {
+	rcode := "FAILED"
+	if rec.Rcode >= 0 {
+		rcode = dns.RcodeToString[rec.Rcode]
+	}
+	upstream := rec.Upstream
+	if len(upstream) == 0 {
+		upstream = "-"
+	}
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+		rec.Time.Format(time.RFC3339Nano), rec.Client, rec.Name, dns.Type(rec.Qtype), upstream, rcode, rec.Duration, rec.Err)
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "dnsredir-audit: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,84 @@
+// Command dnsredir-compile compiles name lists into the binary format of dnsredir, which is loaded in milliseconds
+// and memory-mapped, thus shared by all CoreDNS instances on the same host.
+//
+// Usage:
+//
+//	dnsredir-compile [-hosts] -o OUTPUT [FILE...]
+//
+// Input files(or stdin if none) are merged into OUTPUT, which is replaced atomically.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/leiless/dnsredir"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	output := flag.String("o", "", "path of the compiled name list")
+	hosts := flag.Bool("hosts", false, "ignore lines not in hosts file format")
+	flag.Parse()
+	if len(*output) == 0 {
+		fatalf("-o is required")
+	}
+
+	var readers []io.Reader
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+		// Lines of different files must not be joined
+		readers = append(readers, f, newline{})
+	}
+	if len(readers) == 0 {
+		readers = append(readers, os.Stdin)
+	}
+
+	// Write to a temporary file and rename it, since the old list may be memory-mapped by running instances
+	tmp, err := ioutil.TempFile(filepath.Dir(*output), filepath.Base(*output)+".*")
+	if err != nil {
+		fatalf("%v", err)
+	}
+	stats, err := dnsredir.CompileNameList(io.MultiReader(readers...), tmp, *hosts)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), *output)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		fatalf("%v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%v names compiled into %v\n", stats.Names, *output)
+	if stats.Tagged != 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: tags of %v names dropped\n", stats.Tagged)
+	}
+	if stats.Excepts != 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %v exception rules dropped\n", stats.Excepts)
+	}
+}
+
+// A reader yields a single newline
+type newline struct{}
+
+func (newline) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = '\n'
+	return 1, io.EOF
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "dnsredir-compile: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,82 @@
+// Command dnsredir-convert translates dnsmasq or SmartDNS configs into dnsredir Corefile stanzas and list files.
+//
+// Usage:
+//
+//	dnsredir-convert [-format dnsmasq|smartdns] [-out DIR] [-prefix PREFIX] [FILE...]
+//
+// Stanzas are written to stdout, list files are written to DIR.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/leiless/dnsredir/convert"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	format := flag.String("format", "dnsmasq", "format of input configs, dnsmasq or smartdns")
+	outDir := flag.String("out", ".", "directory to write list files")
+	prefix := flag.String("prefix", "dnsredir", "prefix of list file names")
+	flag.Parse()
+
+	var parse func(io.Reader, string) (*convert.Config, error)
+	switch *format {
+	case "dnsmasq":
+		parse = convert.ParseDnsmasq
+	case "smartdns":
+		parse = convert.ParseSmartDNS
+	default:
+		fatalf("unknown format %q", *format)
+	}
+
+	var readers []io.Reader
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	if len(readers) == 0 {
+		readers = append(readers, os.Stdin)
+	}
+
+	cfg, err := parse(io.MultiReader(readers...), *prefix)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	for _, s := range cfg.Stanzas {
+		if len(s.ListFile) == 0 {
+			continue
+		}
+		path := filepath.Join(*outDir, s.ListFile)
+		if err := writeList(path, s); err != nil {
+			fatalf("%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "%v: %v domain(s)\n", path, len(s.Domains))
+	}
+	if err := cfg.WriteCorefile(os.Stdout); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func writeList(path string, s *convert.Stanza) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := s.WriteList(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "dnsredir-convert: "+format+"\n", args...)
+	os.Exit(1)
+}
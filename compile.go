@@ -0,0 +1,39 @@
+package dnsredir
+
+import (
+	"github.com/leiless/dnsredir/compiled"
+	"io"
+)
+
+// CompileStats reports a compiled name list, tags and exceptions can't be represented in compiled format
+type CompileStats struct {
+	Names   uint64 // Names written
+	Tagged  uint64 // Names whose tags are dropped
+	Excepts uint64 // Exception rules dropped
+}
+
+// CompileNameList parses a name list in any text format supported by FROM... and writes it in compiled format
+// Lines not in hosts(5) format are ignored if `hostsFormat' is true, as `hosts:' prefixed lists.
+func CompileNameList(r io.Reader, w io.Writer, hostsFormat bool) (CompileStats, error) {
+	var n NameList
+	format := nameFormatAuto
+	if hostsFormat {
+		format = nameFormatHosts
+	}
+	names, tags, excepts, _, err := n.parse(r, &NameItem{format: format})
+	if err != nil {
+		return CompileStats{}, err
+	}
+
+	list := make([]string, 0, names.Len())
+	_ = names.ForEachDomain(func(name string) error {
+		list = append(list, name)
+		return nil
+	})
+	stats := CompileStats{
+		Names:   uint64(len(list)),
+		Tagged:  uint64(len(tags)),
+		Excepts: excepts.Len(),
+	}
+	return stats, compiled.Write(w, list)
+}
@@ -0,0 +1,271 @@
+// Package compiled implements the compiled name list format of dnsredir.
+//
+// A compiled list is a versioned binary representation of domain names, which is loaded without parsing,
+// and looked up in place, thus it can be memory-mapped and shared by multiple processes.
+//
+// Layout(all integers are little endian):
+//
+//	header   magic "DRNL", version(uint16), flags(uint16), count(uint32), restart interval(uint16),
+//	         reserved(uint16), restarts(uint32), entries size(uint32), CRC32 of the payload(uint32), reserved(uint32)
+//	entries  sorted byte-reversed names, each one is delta-encoded against the previous one:
+//	         shared prefix length(uvarint), suffix length(uvarint), suffix
+//	restarts offsets(uint32) of entries which aren't delta-encoded, i.e. shared prefix length is zero
+//
+// Names are byte-reversed, so names with a common suffix(e.g. the same zone) share prefixes, and are encoded compactly.
+package compiled
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const (
+	Magic   = "DRNL"
+	Version = 1
+
+	headerSize = 32
+	// Number of entries between restart points, a lookup scans at most this number of entries
+	restartInterval = 16
+)
+
+var (
+	errNotCompiled = errors.New("not a compiled name list")
+	errCorrupted   = errors.New("corrupted compiled name list")
+)
+
+// IsCompiled returns true if data begins with the magic of compiled name lists
+func IsCompiled(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// Write names in compiled format, names must be normalized, i.e. lower cased and without trailing dot
+// Duplicate names are written once.
+func Write(w io.Writer, names []string) error {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = reverse(name)
+	}
+	sort.Strings(keys)
+
+	var entries []byte
+	var restarts []uint32
+	var buf [binary.MaxVarintLen64]byte
+	prev, count := "", 0
+	for _, key := range keys {
+		if len(key) == 0 || (count != 0 && key == prev) {
+			continue
+		}
+		shared := 0
+		if count%restartInterval == 0 {
+			restarts = append(restarts, uint32(len(entries)))
+		} else {
+			for shared < len(prev) && shared < len(key) && prev[shared] == key[shared] {
+				shared++
+			}
+		}
+		n := binary.PutUvarint(buf[:], uint64(shared))
+		entries = append(entries, buf[:n]...)
+		n = binary.PutUvarint(buf[:], uint64(len(key)-shared))
+		entries = append(entries, buf[:n]...)
+		entries = append(entries, key[shared:]...)
+		prev = key
+		count++
+	}
+
+	payload := entries
+	for _, off := range restarts {
+		payload = append(payload, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(payload[len(payload)-4:], off)
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, Magic)
+	binary.LittleEndian.PutUint16(header[4:], Version)
+	binary.LittleEndian.PutUint32(header[8:], uint32(count))
+	binary.LittleEndian.PutUint16(header[12:], restartInterval)
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(restarts)))
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(entries)))
+	binary.LittleEndian.PutUint32(header[24:], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// List is a compiled name list, which is looked up in place
+type List struct {
+	data     []byte
+	count    int
+	entries  []byte
+	restarts []byte
+	// Unmap the data, nil if not memory-mapped
+	unmap func() error
+}
+
+// Parse a compiled name list, data is referenced rather than copied
+func Parse(data []byte) (*List, error) {
+	if !IsCompiled(data) {
+		return nil, errNotCompiled
+	}
+	if len(data) < headerSize {
+		return nil, errCorrupted
+	}
+	if v := binary.LittleEndian.Uint16(data[4:]); v != Version {
+		return nil, fmt.Errorf("unsupported compiled name list version %v, expected %v", v, Version)
+	}
+	count := binary.LittleEndian.Uint32(data[8:])
+	interval := binary.LittleEndian.Uint16(data[12:])
+	restarts := uint64(binary.LittleEndian.Uint32(data[16:]))
+	size := uint64(binary.LittleEndian.Uint32(data[20:]))
+	if interval != restartInterval || headerSize+size+restarts*4 != uint64(len(data)) ||
+		restarts != (uint64(count)+restartInterval-1)/restartInterval {
+		return nil, errCorrupted
+	}
+	payload := data[headerSize:]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[24:]) {
+		return nil, errCorrupted
+	}
+	return &List{
+		data:     data,
+		count:    int(count),
+		entries:  payload[:size],
+		restarts: payload[size:],
+	}, nil
+}
+
+// Len returns number of names in the list
+func (l *List) Len() int {
+	return l.count
+}
+
+// Size returns size of the list data in bytes
+func (l *List) Size() int {
+	return len(l.data)
+}
+
+// Decode the entry at offset `off' with the previous key `prev', return the key and offset of the next entry
+func (l *List) next(off int, prev []byte) ([]byte, int, error) {
+	shared, n := binary.Uvarint(l.entries[off:])
+	if n <= 0 {
+		return nil, 0, errCorrupted
+	}
+	off += n
+	length, n := binary.Uvarint(l.entries[off:])
+	if n <= 0 || shared > uint64(len(prev)) || length > uint64(len(l.entries)-off-n) {
+		return nil, 0, errCorrupted
+	}
+	off += n
+	key := append(prev[:shared:shared], l.entries[off:off+int(length)]...)
+	return key, off + int(length), nil
+}
+
+func (l *List) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(l.restarts[i*4:]))
+}
+
+// Return the first key of the i-th restart block
+func (l *List) restartKey(i int) []byte {
+	off := l.restart(i)
+	if off >= len(l.entries) {
+		return nil
+	}
+	key, _, err := l.next(off, nil)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// Contains returns true if the name is in the list
+func (l *List) Contains(name string) bool {
+	defer runtime.KeepAlive(l)
+	key := []byte(reverse(name))
+	blocks := len(l.restarts) / 4
+	// Index of the last block whose first key <= key
+	i := sort.Search(blocks, func(i int) bool {
+		return bytes.Compare(l.restartKey(i), key) > 0
+	}) - 1
+	if i < 0 {
+		return false
+	}
+
+	off, end := l.restart(i), len(l.entries)
+	if i+1 < blocks {
+		end = l.restart(i + 1)
+	}
+	var cur []byte
+	var err error
+	for off < end {
+		if cur, off, err = l.next(off, cur); err != nil {
+			return false
+		}
+		switch bytes.Compare(cur, key) {
+		case 0:
+			return true
+		case 1:
+			return false
+		}
+	}
+	return false
+}
+
+// Match returns the matched name and true if `child' or any of its parent domains is in the list
+// `child' should be lower cased and without trailing dot.
+func (l *List) Match(child string) (string, bool) {
+	for {
+		if l.Contains(child) {
+			return child, true
+		}
+		i := strings.IndexByte(child, '.')
+		if i <= 0 {
+			return "", false
+		}
+		child = child[i+1:]
+	}
+}
+
+// ForEach calls f with each name in the list, iteration stops if f returns an error
+func (l *List) ForEach(f func(name string) error) error {
+	defer runtime.KeepAlive(l)
+	var cur []byte
+	var err error
+	for off, n := 0, 0; n < l.count; n++ {
+		if off >= len(l.entries) {
+			return errCorrupted
+		}
+		if cur, off, err = l.next(off, cur); err != nil {
+			return err
+		}
+		if err := f(reverse(string(cur))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close unmaps the list if it's memory-mapped, the list must not be used afterwards
+func (l *List) Close() error {
+	if l.unmap == nil {
+		return nil
+	}
+	unmap := l.unmap
+	l.unmap = nil
+	runtime.SetFinalizer(l, nil)
+	return unmap()
+}
+
+func reverse(s string) string {
+	b := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		b[len(s)-1-i] = s[i]
+	}
+	return string(b)
+}
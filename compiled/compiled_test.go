@@ -0,0 +1,105 @@
+package compiled
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestCompiledList(t *testing.T) {
+	names := []string{"example.com", "www.example.com", "example.org", "cn", "example.com"}
+	for i := 0; i < 100; i++ {
+		names = append(names, fmt.Sprintf("host%v.example.net", i))
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, names); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != len(names)-1 {
+		t.Errorf("Expected %v names, got %v", len(names)-1, l.Len())
+	}
+
+	tests := []struct {
+		child    string
+		expected string
+		ok       bool
+	}{
+		{"example.com", "example.com", true},
+		{"a.b.example.com", "example.com", true},
+		{"host42.example.net", "host42.example.net", true},
+		{"www.host99.example.net", "host99.example.net", true},
+		{"host100.example.net", "", false},
+		{"example.net", "", false},
+		{"baidu.cn", "cn", true},
+		{"com", "", false},
+	}
+	for _, test := range tests {
+		name, ok := l.Match(test.child)
+		if name != test.expected || ok != test.ok {
+			t.Errorf("Match(%q) expected %q %v, got %q %v", test.child, test.expected, test.ok, name, ok)
+		}
+	}
+
+	var got []string
+	if err := l.ForEach(func(name string) error {
+		got = append(got, name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if len(got) != l.Len() || got[0] != "cn" || got[len(got)-1] != "www.example.com" {
+		t.Errorf("Unexpected names %v", got)
+	}
+}
+
+func TestParseCompiled(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, []string{"example.com", "example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if _, err := Parse([]byte("example.com\n")); err != errNotCompiled {
+		t.Errorf("Expected %v, got %v", errNotCompiled, err)
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-5] ^= 0xff
+	if _, err := Parse(corrupted); err != errCorrupted {
+		t.Errorf("Expected %v, got %v", errCorrupted, err)
+	}
+	future := append([]byte(nil), data...)
+	future[4] = Version + 1
+	if _, err := Parse(future); err == nil {
+		t.Errorf("Expected unsupported version error")
+	}
+
+	dir, err := ioutil.TempDir("", "compiled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list.bin")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Contains("example.org") || l.Contains("example.net") {
+		t.Errorf("Unexpected lookup result of opened list")
+	}
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package compiled
+
+import "io/ioutil"
+
+// Open a compiled name list, which is read into memory since memory-mapping is unavailable
+func Open(path string) (*List, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
@@ -0,0 +1,45 @@
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package compiled
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Open a compiled name list, which is memory-mapped read-only, thus its pages are shared by all processes opened it
+// The file must be replaced by rename rather than rewritten in place, otherwise the mapping will be broken.
+func Open(path string) (*List, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := st.Size()
+	if size < headerSize || int64(int(size)) != size {
+		return nil, errNotCompiled
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	l, err := Parse(data)
+	if err != nil {
+		_ = syscall.Munmap(data)
+		return nil, err
+	}
+	l.unmap = func() error {
+		return syscall.Munmap(data)
+	}
+	// Unmapped once unreachable, since lookups may still be in flight when the list is replaced
+	runtime.SetFinalizer(l, func(l *List) {
+		_ = l.Close()
+	})
+	return l, nil
+}
@@ -0,0 +1,70 @@
+package dnsredir
+
+import (
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Compression of name lists, large public lists are typically distributed compressed
+const (
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// Return compression of the list file or URL by its extension, i.e. `.gz' or `.zst'
+func compressionOf(name string) string {
+	if u, err := url.Parse(name); err == nil && len(u.Scheme) > 1 {
+		// Ignore query string of URLs, a single letter scheme is a Windows drive letter
+		name = u.Path
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gz":
+		return compressionGzip
+	case ".zst":
+		return compressionZstd
+	}
+	return compressionNone
+}
+
+// Reader with its Close() function, which closes the decompressor along with the underlying reader
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (rc *readCloser) Close() error {
+	return rc.close()
+}
+
+// Wrap `rc' with a decompressor of `compression', it's returned as is if not compressed
+func newDecompressReader(rc io.ReadCloser, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case compressionGzip:
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			return nil, err
+		}
+		return &readCloser{zr, func() error {
+			err := zr.Close()
+			if err2 := rc.Close(); err == nil {
+				err = err2
+			}
+			return err
+		}}, nil
+	case compressionZstd:
+		zr, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return &readCloser{zr, func() error {
+			zr.Close()
+			return rc.Close()
+		}}, nil
+	}
+	return rc, nil
+}
@@ -0,0 +1,218 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/caddy/caddyfile"
+	"github.com/coredns/coredns/core/dnsserver"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Return path of the config file if the stanza is loaded from a config file, see `config_file'
+// The stanza block is consumed if so.
+func configFilePath(c *caddy.Controller) (string, bool, error) {
+	// Dispenser is a value type, a copy has its own cursor
+	d := c.Dispenser
+	if len(d.RemainingArgs()) != 0 || !d.NextBlock() || d.Val() != "config_file" {
+		return "", false, nil
+	}
+	args := d.RemainingArgs()
+	if len(args) != 1 {
+		return "", false, d.ArgErr()
+	}
+	if d.NextBlock() {
+		return "", false, d.Errf("%q must be the only directive of a stanza without FROM...", "config_file")
+	}
+	c.Dispenser = d
+	return args[0], true, nil
+}
+
+// Load the stanza from a YAML or JSON config file
+// The file is validated and translated into Corefile tokens, thus it's parsed as if it's written in the Corefile,
+//	config errors are reported with line numbers of the file.
+func loadConfigFile(c *caddy.Controller, path string) (Upstream, error) {
+	if root := dnsserver.GetConfig(c).Root; !filepath.IsAbs(path) && root != "" {
+		path = filepath.Join(root, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, c.Errf("%v: %v", "config_file", err)
+	}
+	tokens, err := configTokens(path, data)
+	if err != nil {
+		return nil, c.Errf("%v: %v", "config_file", err)
+	}
+	log.Infof("config_file: %v", path)
+
+	// Controller copy shares the server config and Caddy instance storage(e.g. upstream groups)
+	sub := *c
+	sub.Dispenser = caddyfile.NewDispenserTokens(path, tokens)
+	sub.Next()
+	return newReloadableUpstream(&sub)
+}
+
+// Validate the config file against the schema and translate it into Corefile tokens of a stanza
+// The config file is a mapping, in which `match' is FROM..., `inline' is INLINE..., other keys are directives.
+// Directive arguments are a scalar, or a list of scalars, or a list of lists for a directive specified multiple times.
+// `true' or null denotes a directive without arguments, `false' omits the directive.
+func configTokens(path string, data []byte) ([]caddyfile.Token, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%v: empty config", path)
+	}
+	root := resolveAlias(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		return nil, configErrorf(path, root, "expected a mapping of directives")
+	}
+
+	var match []string
+	matchLine := 0
+	var lines []configLine
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], resolveAlias(root.Content[i+1])
+		dir := key.Value
+		if seen[dir] {
+			return nil, configErrorf(path, key, "duplicate key %q, use a list of lists to specify a directive multiple times", dir)
+		}
+		seen[dir] = true
+
+		switch dir {
+		case "match":
+			args, err := configArgs(path, value)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) == 0 {
+				return nil, configErrorf(path, value, "%q expects at least one FROM", dir)
+			}
+			match, matchLine = args, key.Line
+			continue
+		case "inline":
+			args, err := configArgs(path, value)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range args {
+				lines = append(lines, configLine{line: value.Line, args: []string{name}})
+			}
+			continue
+		case "config_file":
+			return nil, configErrorf(path, key, "%q cannot be nested", dir)
+		}
+		if !isKnownDirective(dir) {
+			if suggestion, ok := suggestDirective(dir); ok {
+				return nil, configErrorf(path, key, "unknown key %q, did you mean %q?", dir, suggestion)
+			}
+			return nil, configErrorf(path, key, "unknown key %q", dir)
+		}
+
+		if value.Kind == yaml.SequenceNode && len(value.Content) != 0 && resolveAlias(value.Content[0]).Kind == yaml.SequenceNode {
+			for _, elem := range value.Content {
+				elem = resolveAlias(elem)
+				if elem.Kind != yaml.SequenceNode {
+					return nil, configErrorf(path, elem, "expected a list of arguments of %q", dir)
+				}
+				args, err := configArgs(path, elem)
+				if err != nil {
+					return nil, err
+				}
+				lines = append(lines, configLine{line: elem.Line, args: append([]string{dir}, args...)})
+			}
+			continue
+		}
+		if value.Kind == yaml.ScalarNode && value.ShortTag() == "!!bool" && value.Value == "false" {
+			continue
+		}
+		args, err := configArgs(path, value)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, configLine{line: key.Line, args: append([]string{dir}, args...)})
+	}
+	if match == nil {
+		return nil, configErrorf(path, root, "missing mandatory key %q", "match")
+	}
+
+	// Dispenser tells arguments by line numbers, thus each line must be distinct from its neighbours
+	tokens := []caddyfile.Token{{File: path, Line: matchLine, Text: pluginName}}
+	for _, arg := range match {
+		tokens = append(tokens, caddyfile.Token{File: path, Line: matchLine, Text: arg})
+	}
+	tokens = append(tokens, caddyfile.Token{File: path, Line: matchLine, Text: "{"})
+	prev := matchLine
+	for _, l := range lines {
+		line := l.line
+		for line == matchLine || line <= prev {
+			line++
+		}
+		for _, arg := range l.args {
+			tokens = append(tokens, caddyfile.Token{File: path, Line: line, Text: arg})
+		}
+		prev = line
+	}
+	return append(tokens, caddyfile.Token{File: path, Line: prev + 1, Text: "}"}), nil
+}
+
+// Directive line translated from the config file
+type configLine struct {
+	line int
+	args []string
+}
+
+// Return arguments of a scalar or a list of scalars
+func configArgs(path string, node *yaml.Node) ([]string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!null" || (node.ShortTag() == "!!bool" && node.Value == "true") {
+			return nil, nil
+		}
+		if err := checkConfigScalar(path, node); err != nil {
+			return nil, err
+		}
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		args := make([]string, 0, len(node.Content))
+		for _, elem := range node.Content {
+			elem = resolveAlias(elem)
+			if elem.Kind != yaml.ScalarNode {
+				return nil, configErrorf(path, elem, "expected a scalar argument")
+			}
+			if err := checkConfigScalar(path, elem); err != nil {
+				return nil, err
+			}
+			args = append(args, elem.Value)
+		}
+		return args, nil
+	}
+	return nil, configErrorf(path, node, "expected a scalar or a list of arguments")
+}
+
+func checkConfigScalar(path string, node *yaml.Node) error {
+	if len(node.Value) == 0 || strings.ContainsAny(node.Value, "\r\n") {
+		return configErrorf(path, node, "expected a non-empty single line argument, got %q", node.Value)
+	}
+	return nil
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func configErrorf(path string, node *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("%v:%v - %v", path, node.Line, fmt.Sprintf(format, args...))
+}
+
+func isKnownDirective(dir string) bool {
+	_, ok := blockDirectives[dir]
+	return ok
+}
@@ -0,0 +1,204 @@
+package dnsredir
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification of upstream connections established and closed, see `conn_hook'
+// Thus router users can install policy routing or conntrack entries steering the upstream traffic(e.g. into a tunnel).
+// Events are delivered in order by a worker, they're dropped rather than blocking query processing if it lags behind.
+type connHook struct {
+	stanza string
+	// Program executed per event, or unix datagram socket notified per event
+	exec string
+	unix string
+	// Hosts whose connections are notified, empty for all hosts
+	hosts []string
+
+	events chan *connEvent
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Connection event, which is sent to unix socket as JSON
+type connEvent struct {
+	Event  string `json:"event"` // "established" or "closed"
+	Stanza string `json:"stanza"`
+	Host   string `json:"host"` // Upstream host, e.g. tls://1.1.1.1:853
+	Proto  string `json:"proto"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// Parse exec:PROGRAM or unix:PATH [HOST...]
+func parseConnHook(args []string) (*connHook, error) {
+	h := &connHook{
+		hosts:  args[1:],
+		events: make(chan *connEvent, connHookQueueSize),
+		stop:   make(chan struct{}),
+	}
+	kind, target := SplitByByte(args[0], ':')
+	if len(target) <= 1 {
+		return nil, fmt.Errorf("expected exec:PROGRAM or unix:PATH, got %q", args[0])
+	}
+	target = target[1:]
+	switch kind {
+	case "exec":
+		h.exec = target
+	case "unix":
+		h.unix = target
+	default:
+		return nil, fmt.Errorf("unknown hook type %q", kind)
+	}
+	return h, nil
+}
+
+// Return true if connections of the host are notified
+// Hosts are specified as in `to', optionally without the protocol or port, e.g. tls://1.1.1.1:853, 1.1.1.1:853 or 1.1.1.1
+func (h *connHook) covers(uh *UpstreamHost) bool {
+	if len(h.hosts) == 0 {
+		return true
+	}
+	ip, _, _ := net.SplitHostPort(uh.addr)
+	for _, host := range h.hosts {
+		if host == uh.Name() || host == uh.addr || host == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap the dialed connection, thus closing it is notified, and notify it's established
+func (h *connHook) wrap(uh *UpstreamHost, proto string, conn net.Conn) net.Conn {
+	e := &connEvent{
+		Stanza: h.stanza,
+		Host:   uh.Name(),
+		Proto:  proto,
+		Local:  conn.LocalAddr().String(),
+		Remote: conn.RemoteAddr().String(),
+	}
+	h.notify("established", e)
+	closed := func() {
+		h.notify("closed", e)
+	}
+	// UDP connection is kept as a net.PacketConn, otherwise dns.Conn treats it as a stream
+	if uc, ok := conn.(*net.UDPConn); ok {
+		return &hookedUDPConn{UDPConn: uc, closed: closed}
+	}
+	return &hookedConn{Conn: conn, closed: closed}
+}
+
+func (h *connHook) notify(event string, e *connEvent) {
+	e1 := *e
+	e1.Event = event
+	select {
+	case h.events <- &e1:
+	default:
+		ConnHookDroppedCount.WithLabelValues(h.stanza).Inc()
+	}
+}
+
+func (h *connHook) start(stanza string) {
+	h.stanza = stanza
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		for {
+			select {
+			case e := <-h.events:
+				if err := h.deliver(e); err != nil {
+					log.Warningf("Failed to deliver %v event of %v to connection hook: %v", e.Event, e.Host, err)
+				}
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (h *connHook) shutdown() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+func (h *connHook) deliver(e *connEvent) error {
+	if len(h.unix) != 0 {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		conn, err := net.DialTimeout("unixgram", h.unix, connHookTimeout)
+		if err != nil {
+			return err
+		}
+		defer Close(conn)
+		_ = conn.SetWriteDeadline(time.Now().Add(connHookTimeout))
+		_, err = conn.Write(data)
+		return err
+	}
+
+	// The program runs as the user running CoreDNS, with its privileges(e.g. CAP_NET_ADMIN)
+	// Thus `conn_hook' is never patchable via the admin server, see patchableDirectives.
+	ctx, cancel := context.WithTimeout(context.Background(), connHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.exec, e.Event, e.Host, e.Local, e.Remote)
+	cmd.Env = append(os.Environ(),
+		"DNSREDIR_EVENT="+e.Event,
+		"DNSREDIR_STANZA="+e.Stanza,
+		"DNSREDIR_HOST="+e.Host,
+		"DNSREDIR_PROTO="+e.Proto,
+		"DNSREDIR_LOCAL="+e.Local,
+		"DNSREDIR_REMOTE="+e.Remote,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Connection wrappers notify the hook once closed
+type hookedConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *hookedConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
+
+type hookedUDPConn struct {
+	*net.UDPConn
+	once   sync.Once
+	closed func()
+}
+
+func (c *hookedUDPConn) Close() error {
+	c.once.Do(c.closed)
+	return c.UDPConn.Close()
+}
+
+// Return the underlying connection of a hooked one
+func unwrapConn(conn net.Conn) net.Conn {
+	switch c := conn.(type) {
+	case *hookedConn:
+		return c.Conn
+	case *hookedUDPConn:
+		return c.UDPConn
+	}
+	return conn
+}
+
+const (
+	connHookQueueSize = 256
+	connHookTimeout   = 5 * time.Second
+)
@@ -0,0 +1,419 @@
+// Package convert translates dnsmasq and SmartDNS configs into equivalent dnsredir Corefile stanzas and list files.
+package convert
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Stanza is a dnsredir block converted from forwarding or blocking rules
+type Stanza struct {
+	// Name of the list file holding Domains, empty for the root zone stanza
+	ListFile string
+	Domains  []string
+	// Upstreams in `to' syntax, nil if Block set
+	To []string
+	// Domains are answered NXDOMAIN locally rather than forwarded
+	Block bool
+}
+
+// Config is the conversion result
+type Config struct {
+	Stanzas []*Stanza
+	// Rules which have no dnsredir equivalent, they're emitted as comments in Corefile
+	Warnings []string
+}
+
+// Placeholder upstream of block stanza, `to' is mandatory yet never used since all names are blocked
+const blockPlaceholder = "127.0.0.1"
+
+// rules accumulates domain rules in order of appearance
+type rules struct {
+	domains  []string
+	to       map[string][]string // Upstreams or group names per domain
+	block    map[string]bool
+	defaults []string
+	warnings []string
+}
+
+func newRules() *rules {
+	return &rules{
+		to:    make(map[string][]string),
+		block: make(map[string]bool),
+	}
+}
+
+func (r *rules) warnf(lineNo int, format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf("line %v: ", lineNo)+fmt.Sprintf(format, args...))
+}
+
+func (r *rules) add(domain string, block bool, to ...string) {
+	if _, ok := r.to[domain]; !ok && !r.block[domain] {
+		r.domains = append(r.domains, domain)
+	}
+	if block {
+		r.block[domain] = true
+		return
+	}
+	for _, t := range to {
+		if !contains(r.to[domain], t) {
+			r.to[domain] = append(r.to[domain], t)
+		}
+	}
+	if _, ok := r.to[domain]; !ok {
+		r.to[domain] = nil
+	}
+}
+
+// Group domains with identical upstreams into stanzas, lookup maps group names to upstreams(nil if not grouped)
+func (r *rules) config(prefix string, lookup func(string) ([]string, bool)) *Config {
+	cfg := &Config{Warnings: r.warnings}
+	byKey := make(map[string]*Stanza)
+	var blocked *Stanza
+	for _, domain := range r.domains {
+		if r.block[domain] {
+			if blocked == nil {
+				blocked = &Stanza{ListFile: prefix + "-block.conf", Block: true}
+			}
+			blocked.Domains = append(blocked.Domains, domain)
+			continue
+		}
+		var to []string
+		for _, t := range r.to[domain] {
+			if lookup != nil {
+				hosts, ok := lookup(t)
+				if !ok {
+					cfg.Warnings = append(cfg.Warnings, fmt.Sprintf("%v: unknown server group %q", domain, t))
+					continue
+				}
+				to = appendUnique(to, hosts...)
+			} else {
+				to = appendUnique(to, t)
+			}
+		}
+		if len(to) == 0 {
+			continue
+		}
+		key := strings.Join(to, " ")
+		s, ok := byKey[key]
+		if !ok {
+			s = &Stanza{ListFile: fmt.Sprintf("%v-%v.conf", prefix, len(byKey)+1), To: to}
+			byKey[key] = s
+			cfg.Stanzas = append(cfg.Stanzas, s)
+		}
+		s.Domains = append(s.Domains, domain)
+	}
+	// Blocking takes precedence over forwarding, the root zone comes last as a fallback
+	if blocked != nil {
+		cfg.Stanzas = append([]*Stanza{blocked}, cfg.Stanzas...)
+	}
+	if len(r.defaults) != 0 {
+		cfg.Stanzas = append(cfg.Stanzas, &Stanza{To: r.defaults})
+	}
+	return cfg
+}
+
+// ParseDnsmasq converts `server', `local' and `address' rules of a dnsmasq config
+func ParseDnsmasq(rd io.Reader, prefix string) (*Config, error) {
+	r := newRules()
+	scanner := bufio.NewScanner(rd)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.IndexByte(line, '='); i >= 0 {
+			key, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		switch key {
+		case "server":
+			domains, target, ok := splitDomains(value)
+			if !ok {
+				// Upstream for all domains
+				host, err := dnsmasqHost(value)
+				if err != nil {
+					r.warnf(lineNo, "%v", err)
+					continue
+				}
+				r.defaults = appendUnique(r.defaults, host)
+				continue
+			}
+			switch target {
+			case "":
+				// Answered from local data only
+				addDomains(r, lineNo, domains, true)
+			case "#":
+				// Use the default upstreams, thus nothing to redirect
+			default:
+				host, err := dnsmasqHost(target)
+				if err != nil {
+					r.warnf(lineNo, "%v", err)
+					continue
+				}
+				addDomains(r, lineNo, domains, false, host)
+			}
+		case "local":
+			domains, _, ok := splitDomains(value)
+			if !ok {
+				r.warnf(lineNo, "malformed %q", line)
+				continue
+			}
+			addDomains(r, lineNo, domains, true)
+		case "address":
+			domains, target, ok := splitDomains(value)
+			if !ok {
+				r.warnf(lineNo, "malformed %q", line)
+				continue
+			}
+			if !isNullAddress(target) {
+				r.warnf(lineNo, "%q: answering with a specific address isn't supported", line)
+				continue
+			}
+			addDomains(r, lineNo, domains, true)
+		case "bogus-nxdomain", "conf-file", "conf-dir", "servers-file", "rev-server":
+			r.warnf(lineNo, "%q isn't supported", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r.config(prefix, nil), nil
+}
+
+// Convert dnsmasq IP[#PORT][@SOURCE] into `to' syntax
+func dnsmasqHost(s string) (string, error) {
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		return "", fmt.Errorf("%q: source address or interface isn't supported", s)
+	}
+	host, port := s, ""
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		host, port = s[:i], s[i+1:]
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("%q isn't a valid IP address", host)
+	}
+	if len(port) == 0 {
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Return true if the address answers nothing useful, i.e. equivalent to blocking
+func isNullAddress(s string) bool {
+	if s == "" || s == "#" {
+		return true
+	}
+	ip := net.ParseIP(s)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// smartdnsValueless are SmartDNS server flags which take no argument
+var smartdnsValueless = map[string]bool{
+	"-exclude-default-group": true,
+	"-e":                     true,
+	"-blacklist-ip":          true,
+	"-whitelist-ip":          true,
+	"-check-edns":            true,
+	"-no-check-certificate":  true,
+	"-bootstrap-dns":         true,
+}
+
+var smartdnsTransports = map[string]string{
+	"server":       "dns://",
+	"server-tcp":   "tcp://",
+	"server-tls":   "tls://",
+	"server-https": "",
+}
+
+// ParseSmartDNS converts `server*', `nameserver' and `address' rules of a SmartDNS config
+func ParseSmartDNS(rd io.Reader, prefix string) (*Config, error) {
+	r := newRules()
+	groups := make(map[string][]string)
+	scanner := bufio.NewScanner(rd)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch key := fields[0]; key {
+		case "server", "server-tcp", "server-tls", "server-https":
+			if len(fields) < 2 {
+				r.warnf(lineNo, "%v: missing server address", key)
+				continue
+			}
+			host := smartdnsTransports[key] + fields[1]
+			var hostOpts []string
+			var serverGroups []string
+			excludeDefault := false
+			for i := 2; i < len(fields); i++ {
+				flag, arg := fields[i], ""
+				if !smartdnsValueless[flag] && i+1 < len(fields) {
+					i++
+					arg = fields[i]
+				}
+				switch flag {
+				case "-group", "-g":
+					serverGroups = append(serverGroups, arg)
+				case "-exclude-default-group", "-e":
+					excludeDefault = true
+				case "-host-name":
+					if key == "server-tls" && arg != "-" {
+						host += "@" + arg
+					}
+				case "-spki-pin":
+					hostOpts = append(hostOpts, "tls_pin="+arg)
+				default:
+					r.warnf(lineNo, "%v: flag %v ignored", fields[1], flag)
+				}
+			}
+			to := strings.Join(append([]string{host}, hostOpts...), " ")
+			for _, g := range serverGroups {
+				groups[g] = appendUnique(groups[g], to)
+			}
+			if !excludeDefault {
+				r.defaults = appendUnique(r.defaults, to)
+			}
+		case "nameserver":
+			if len(fields) != 2 {
+				r.warnf(lineNo, "malformed %q", scanner.Text())
+				continue
+			}
+			domains, group, ok := splitDomains(fields[1])
+			if !ok {
+				r.warnf(lineNo, "malformed %q", scanner.Text())
+				continue
+			}
+			if group == "-" || group == "" {
+				// Use the default group, thus nothing to redirect
+				continue
+			}
+			addDomains(r, lineNo, domains, false, group)
+		case "address":
+			if len(fields) != 2 {
+				r.warnf(lineNo, "malformed %q", scanner.Text())
+				continue
+			}
+			domains, target, ok := splitDomains(fields[1])
+			if !ok {
+				r.warnf(lineNo, "malformed %q", scanner.Text())
+				continue
+			}
+			if target == "-" {
+				continue
+			}
+			if !isNullAddress(target) {
+				r.warnf(lineNo, "%q: answering with a specific address isn't supported", scanner.Text())
+				continue
+			}
+			addDomains(r, lineNo, domains, true)
+		case "bogus-nxdomain", "domain-rules", "conf-file", "domain-set":
+			r.warnf(lineNo, "%q isn't supported", scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r.config(prefix, func(group string) ([]string, bool) {
+		hosts, ok := groups[group]
+		return hosts, ok
+	}), nil
+}
+
+// Split /DOMAIN/.../TARGET, false if not in such form
+func splitDomains(s string) ([]string, string, bool) {
+	if !strings.HasPrefix(s, "/") {
+		return nil, "", false
+	}
+	i := strings.LastIndexByte(s, '/')
+	if i == 0 {
+		return nil, "", false
+	}
+	return strings.Split(s[1:i], "/"), s[i+1:], true
+}
+
+func addDomains(r *rules, lineNo int, domains []string, block bool, to ...string) {
+	for _, d := range domains {
+		domain, ok := normalizeDomain(d)
+		if !ok {
+			r.warnf(lineNo, "%q isn't a valid domain name", d)
+			continue
+		}
+		r.add(domain, block, to...)
+	}
+}
+
+func normalizeDomain(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(s, "*"), "."))
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 {
+		return "", false
+	}
+	if _, ok := dns.IsDomainName(s); !ok {
+		return "", false
+	}
+	return s, true
+}
+
+// WriteCorefile writes dnsredir stanzas, which should be embedded in a Corefile server block
+func (cfg *Config) WriteCorefile(w io.Writer) error {
+	b := &strings.Builder{}
+	for _, warning := range cfg.Warnings {
+		fmt.Fprintf(b, "# WARNING: %v\n", warning)
+	}
+	for i, s := range cfg.Stanzas {
+		if i != 0 || len(cfg.Warnings) != 0 {
+			b.WriteString("\n")
+		}
+		from := s.ListFile
+		if len(from) == 0 {
+			from = "."
+		}
+		fmt.Fprintf(b, "dnsredir %v {\n", from)
+		if s.Block {
+			b.WriteString("    tag * block\n")
+			b.WriteString("    # Never used since all names are blocked\n")
+			fmt.Fprintf(b, "    to %v\n", blockPlaceholder)
+		} else {
+			fmt.Fprintf(b, "    to %v\n", strings.Join(s.To, " "))
+		}
+		b.WriteString("}\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteList writes domains of the stanza in list file format, sorted for stable diffs
+func (s *Stanza) WriteList(w io.Writer) error {
+	domains := append([]string(nil), s.Domains...)
+	sort.Strings(domains)
+	_, err := io.WriteString(w, strings.Join(domains, "\n")+"\n")
+	return err
+}
+
+func contains(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, s := range items {
+		if !contains(list, s) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
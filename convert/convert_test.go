@@ -0,0 +1,94 @@
+package convert
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDnsmasq(t *testing.T) {
+	input := `# comment
+server=/example.com/corp.example/10.0.0.1
+server=/example.net/10.0.0.1#5353
+server=/example.org/10.0.0.1
+server=/example.org/10.0.0.2
+server=/lan/#
+local=/ads.example/
+address=/tracker.example/0.0.0.0
+address=/home.example/192.168.1.1
+bogus-nxdomain=1.2.3.4
+server=8.8.8.8
+`
+	cfg, err := ParseDnsmasq(strings.NewReader(input), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &strings.Builder{}
+	if err := cfg.WriteCorefile(b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# WARNING: line 9: "address=/home.example/192.168.1.1": answering with a specific address isn't supported
+# WARNING: line 10: "bogus-nxdomain=1.2.3.4" isn't supported
+
+dnsredir test-block.conf {
+    tag * block
+    # Never used since all names are blocked
+    to 127.0.0.1
+}
+
+dnsredir test-1.conf {
+    to 10.0.0.1
+}
+
+dnsredir test-2.conf {
+    to 10.0.0.1:5353
+}
+
+dnsredir test-3.conf {
+    to 10.0.0.1 10.0.0.2
+}
+
+dnsredir . {
+    to 8.8.8.8
+}
+`
+	if got := b.String(); got != expected {
+		t.Errorf("expected:\n%v\ngot:\n%v", expected, got)
+	}
+	if got := strings.Join(cfg.Stanzas[1].Domains, " "); got != "example.com corp.example" {
+		t.Errorf("unexpected domains %q", got)
+	}
+	if got := strings.Join(cfg.Stanzas[0].Domains, " "); got != "ads.example tracker.example" {
+		t.Errorf("unexpected blocked domains %q", got)
+	}
+}
+
+func TestParseSmartDNS(t *testing.T) {
+	input := `server 8.8.8.8
+server-tls 10.0.0.1 -host-name dot.corp.example -group corp -exclude-default-group
+server-https https://doh.corp.example/dns-query -g corp -e
+nameserver /corp.example/corp
+nameserver /public.example/-
+nameserver /other.example/missing
+address /ads.example/#
+address /keep.example/-
+`
+	cfg, err := ParseSmartDNS(strings.NewReader(input), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Stanzas) != 3 {
+		t.Fatalf("expected 3 stanzas, got %v", len(cfg.Stanzas))
+	}
+	if s := cfg.Stanzas[0]; !s.Block || strings.Join(s.Domains, " ") != "ads.example" {
+		t.Errorf("unexpected block stanza %+v", s)
+	}
+	if s := cfg.Stanzas[1]; strings.Join(s.To, " ") != "tls://10.0.0.1@dot.corp.example https://doh.corp.example/dns-query" {
+		t.Errorf("unexpected upstreams %v", s.To)
+	}
+	if s := cfg.Stanzas[2]; len(s.ListFile) != 0 || strings.Join(s.To, " ") != "dns://8.8.8.8" {
+		t.Errorf("unexpected root stanza %+v", s)
+	}
+	if len(cfg.Warnings) != 1 || !strings.Contains(cfg.Warnings[0], "unknown server group") {
+		t.Errorf("unexpected warnings %v", cfg.Warnings)
+	}
+}
@@ -0,0 +1,73 @@
+package dnsredir
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/miekg/dns"
+	"strings"
+	"sync/atomic"
+)
+
+// DNS Cookies(RFC 7873) of an upstream, which improve spoofing resistance of UDP exchanges without forcing TCP
+type dnsCookies struct {
+	client string       // Client cookie in hex, 8 bytes
+	server atomic.Value // Last server cookie in hex, empty if unknown
+}
+
+func newDnsCookies() *dnsCookies {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	c := &dnsCookies{client: hex.EncodeToString(b)}
+	c.server.Store("")
+	return c
+}
+
+// Return a copy of the query with our cookies attached, any cookie from the client is replaced
+func (c *dnsCookies) attach(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = m.SetEdns0(dns.MinMsgSize, false).IsEdns0()
+	}
+	opt.Option = withoutOption(opt.Option, dns.EDNS0COOKIE)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: c.client + c.server.Load().(string),
+	})
+	return m
+}
+
+// Verify the cookie echoed back and learn the server cookie, the cookie is removed from reply thereafter
+// Replies with a mismatched client cookie are most likely spoofed.
+func (c *dnsCookies) learn(req, reply *dns.Msg) error {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		// Server doesn't support EDNS at all
+		return nil
+	}
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		// Server cookie should be 8 to 32 bytes
+		n := len(cookie.Cookie)
+		if n < 16 || !strings.EqualFold(cookie.Cookie[:16], c.client) {
+			return errCookieMismatch
+		}
+		if n >= 32 && n <= 80 {
+			c.server.Store(strings.ToLower(cookie.Cookie[16:]))
+		}
+	}
+	if req.IsEdns0() == nil {
+		removeOpt(reply)
+	} else {
+		opt.Option = withoutOption(opt.Option, dns.EDNS0COOKIE)
+	}
+	return nil
+}
+
+var errCookieMismatch = errors.New("client cookie mismatch, reply possibly spoofed")
@@ -0,0 +1,139 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// Short answer memoization window, which absorbs retry bursts from impatient stub resolvers
+// It's not a cache, the window is far shorter than any TTL granularity, thus TTL semantics are kept.
+type answerMemo struct {
+	window time.Duration
+
+	sync.Mutex
+	entries   map[memoKey]*memoEntry
+	nextSweep time.Time
+}
+
+type memoKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+	edns   bool
+	// ECS option of the request, empty if none
+	// Upstreams may answer differently per client subnet.
+	ecs string
+}
+
+type memoEntry struct {
+	reply  *dns.Msg
+	expire time.Time
+}
+
+func newAnswerMemo(window time.Duration) *answerMemo {
+	return &answerMemo{
+		window:  window,
+		entries: make(map[memoKey]*memoEntry),
+	}
+}
+
+func newMemoKey(state *request.Request) memoKey {
+	key := memoKey{
+		name:   state.Name(),
+		qtype:  state.QType(),
+		qclass: state.QClass(),
+		do:     state.Do(),
+		cd:     state.Req.CheckingDisabled,
+	}
+	if opt := state.Req.IsEdns0(); opt != nil {
+		key.edns = true
+		if ecs := findSubnet(opt); ecs != nil {
+			key.ecs = ecs.String()
+		}
+	}
+	return key
+}
+
+func findSubnet(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// Replace OPT of a memoized reply with one built from the request
+// Options of the memoized reply(e.g. cookies) were made for the request which fetched it.
+func rebuildOpt(reply *dns.Msg, req *dns.Msg) {
+	size := uint16(dns.MinMsgSize)
+	var scope *dns.EDNS0_SUBNET
+	extra := reply.Extra[:0]
+	for _, rr := range reply.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			size = opt.UDPSize()
+			scope = findSubnet(opt)
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	reply.Extra = extra
+
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(size)
+	opt.SetDo(reqOpt.Do())
+	if ecs := findSubnet(reqOpt); ecs != nil {
+		// Same ECS option as the memoized one since it's part of the key, only scope comes from the upstream
+		e := *ecs
+		e.SourceScope = 0
+		if scope != nil {
+			e.SourceScope = scope.SourceScope
+		}
+		opt.Option = append(opt.Option, &e)
+	}
+	reply.Extra = append(reply.Extra, opt)
+}
+
+// Return a copy of the memoized reply for the request, nil if none within the window
+func (m *answerMemo) get(state *request.Request) *dns.Msg {
+	key := newMemoKey(state)
+	now := clock.Now()
+	m.Lock()
+	e, ok := m.entries[key]
+	m.Unlock()
+	if !ok || !now.Before(e.expire) {
+		return nil
+	}
+	reply := e.reply.Copy()
+	reply.Id = state.Req.Id
+	rebuildOpt(reply, state.Req)
+	return reply
+}
+
+// MT-Unsafe to modify reply afterwards
+func (m *answerMemo) put(state *request.Request, reply *dns.Msg) {
+	if reply.Truncated || (reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError) {
+		return
+	}
+	key := newMemoKey(state)
+	now := clock.Now()
+	m.Lock()
+	defer m.Unlock()
+	if !now.Before(m.nextSweep) {
+		for k, e := range m.entries {
+			if !now.Before(e.expire) {
+				delete(m.entries, k)
+			}
+		}
+		m.nextSweep = now.Add(m.window)
+	}
+	m.entries[key] = &memoEntry{reply: reply, expire: now.Add(m.window)}
+}
@@ -0,0 +1,372 @@
+package dnsredir
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSCrypt v2 client, only the X25519-XSalsa20Poly1305 construction is supported
+// see: https://dnscrypt.info/protocol
+type dnscryptServer struct {
+	addr         string // IP:PORT
+	providerName string // FQDN, e.g. 2.dnscrypt-cert.example.org.
+	providerPk   ed25519.PublicKey
+
+	sync.Mutex
+	cert      *dnscryptCert
+	fetchedAt time.Time
+}
+
+// Resolver certificate, see: https://dnscrypt.info/protocol#certificates
+type dnscryptCert struct {
+	serial      uint32
+	resolverPk  [32]byte
+	clientMagic [8]byte
+	notAfter    time.Time
+}
+
+func (s *dnscryptServer) String() string {
+	return fmt.Sprintf("%v(%v)", s.addr, s.providerName)
+}
+
+// Parse DNSCrypt server in either form:
+//	dnscrypt://IP[:PORT]/PROVIDER_NAME/PUBLIC_KEY
+//	sdns://STAMP
+func parseDnscryptServer(trans, addr string) (*dnscryptServer, error) {
+	if trans == "sdns" {
+		return parseDnscryptStamp(addr)
+	}
+
+	parts := strings.Split(addr, "/")
+	if len(parts) != 3 {
+		return nil, errors.New("expected IP[:PORT]/PROVIDER_NAME/PUBLIC_KEY")
+	}
+	// Public key can be written in dnscrypt-proxy format, i.e. colon-separated hex
+	pk, err := hex.DecodeString(strings.Replace(parts[2], ":", "", -1))
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid provider public key %q", parts[2])
+	}
+	return newDnscryptServer(parts[0], parts[1], pk)
+}
+
+func parseDnscryptStamp(s string) (*dnscryptServer, error) {
+	st, err := parseStamp(s)
+	if err != nil {
+		return nil, err
+	}
+	if st.proto != stampDnscrypt {
+		return nil, errors.New("not a DNSCrypt stamp")
+	}
+	if len(st.pk) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid provider public key in stamp")
+	}
+	return newDnscryptServer(st.addr, st.hostname, st.pk)
+}
+
+func newDnscryptServer(hostport, providerName string, pk []byte) (*dnscryptServer, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.Trim(hostport, "[]"), dnscryptDefaultPort
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("not an IP address: %q", host)
+	}
+	name, ok := stringToDomain(strings.TrimSuffix(providerName, "."))
+	if !ok {
+		return nil, fmt.Errorf("invalid provider name %q", providerName)
+	}
+	return &dnscryptServer{
+		addr:         net.JoinHostPort(host, port),
+		providerName: dns.Fqdn(name),
+		providerPk:   ed25519.PublicKey(pk),
+	}, nil
+}
+
+// Return the newest valid certificate, which is refreshed periodically to follow resolver key rotation
+func (s *dnscryptServer) currentCert(c *dns.Client) (*dnscryptCert, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	if s.cert != nil && now.Sub(s.fetchedAt) < dnscryptCertRefresh && now.Before(s.cert.notAfter) {
+		return s.cert, nil
+	}
+
+	cert, err := s.fetchCert(c)
+	if err != nil {
+		if s.cert != nil && now.Before(s.cert.notAfter) {
+			log.Warningf("Failed to refresh DNSCrypt certificate of %v, keep using serial %v: %v", s, s.cert.serial, err)
+			return s.cert, nil
+		}
+		return nil, err
+	}
+	if s.cert == nil || s.cert.serial != cert.serial {
+		log.Infof("DNSCrypt certificate of %v updated, serial: %v not after: %v", s, cert.serial, cert.notAfter)
+	}
+	s.cert = cert
+	s.fetchedAt = now
+	return cert, nil
+}
+
+// Force certificate refresh upon next exchange, e.g. resolver key rotated
+func (s *dnscryptServer) invalidate() {
+	s.Lock()
+	s.fetchedAt = time.Time{}
+	s.Unlock()
+}
+
+func (s *dnscryptServer) fetchCert(c *dns.Client) (*dnscryptCert, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(s.providerName, dns.TypeTXT)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	reply, _, err := c.Exchange(req, s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var best *dnscryptCert
+	for _, rr := range reply.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := s.parseCert(txtBytes(txt.Txt), now)
+		if err != nil {
+			log.Debugf("Skip DNSCrypt certificate of %v: %v", s, err)
+			continue
+		}
+		if best == nil || cert.serial > best.serial {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, errDnscryptNoCert
+	}
+	return best, nil
+}
+
+func (s *dnscryptServer) parseCert(b []byte, now time.Time) (*dnscryptCert, error) {
+	if len(b) < dnscryptCertSize || !bytes.Equal(b[:4], dnscryptCertMagic) {
+		return nil, errors.New("malformed certificate")
+	}
+	if es := binary.BigEndian.Uint16(b[4:6]); es != dnscryptEsXSalsa20Poly1305 {
+		return nil, fmt.Errorf("unsupported es-version %v", es)
+	}
+	if !ed25519.Verify(s.providerPk, b[72:], b[8:72]) {
+		return nil, errors.New("bad certificate signature")
+	}
+
+	cert := &dnscryptCert{}
+	copy(cert.resolverPk[:], b[72:104])
+	copy(cert.clientMagic[:], b[104:112])
+	cert.serial = binary.BigEndian.Uint32(b[112:116])
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	if now.Before(notBefore) || now.After(cert.notAfter) {
+		return nil, fmt.Errorf("certificate serial %v not valid at present", cert.serial)
+	}
+	return cert, nil
+}
+
+// Encrypt a query packet, padded to at least minSize bytes
+// Per-query ephemeral client key pair is used, so queries can't be linked together.
+func (s *dnscryptServer) encrypt(cert *dnscryptCert, packet []byte, minSize int) ([]byte, *[32]byte, *[24]byte, error) {
+	pk, sk, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	shared := new([32]byte)
+	box.Precompute(shared, &cert.resolverPk, sk)
+
+	// Client nonce is half of the nonce, the other half is filled with zeros
+	nonce := new([24]byte)
+	if _, err := crand.Read(nonce[:dnscryptHalfNonceSize]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// ISO/IEC 7816-4 padding to a multiple of 64 bytes
+	n := (len(packet) + 1 + 63) &^ 63
+	if n < minSize {
+		n = minSize
+	}
+	padded := make([]byte, n)
+	copy(padded, packet)
+	padded[len(packet)] = 0x80
+
+	query := make([]byte, 0, len(cert.clientMagic)+len(pk)+dnscryptHalfNonceSize+n+box.Overhead)
+	query = append(query, cert.clientMagic[:]...)
+	query = append(query, pk[:]...)
+	query = append(query, nonce[:dnscryptHalfNonceSize]...)
+	return box.SealAfterPrecomputation(query, padded, nonce, shared), shared, nonce, nil
+}
+
+func (s *dnscryptServer) decrypt(resp []byte, shared *[32]byte, nonce *[24]byte) ([]byte, error) {
+	if len(resp) < len(dnscryptResolverMagic)+len(nonce)+box.Overhead || !bytes.Equal(resp[:8], dnscryptResolverMagic) {
+		return nil, errors.New("malformed DNSCrypt response")
+	}
+	var respNonce [24]byte
+	copy(respNonce[:], resp[8:32])
+	if !bytes.Equal(respNonce[:dnscryptHalfNonceSize], nonce[:dnscryptHalfNonceSize]) {
+		return nil, errors.New("DNSCrypt response nonce mismatch")
+	}
+	packet, ok := box.OpenAfterPrecomputation(nil, resp[32:], &respNonce, shared)
+	if !ok {
+		return nil, errDnscryptDecrypt
+	}
+
+	i := len(packet) - 1
+	for i >= 0 && packet[i] == 0 {
+		i--
+	}
+	if i < 0 || packet[i] != 0x80 {
+		return nil, errors.New("bad DNSCrypt response padding")
+	}
+	return packet[:i], nil
+}
+
+// Query over UDP, and retry over TCP if the response is truncated
+func (uh *UpstreamHost) dnscryptExchange(ctx context.Context, state *request.Request) (*dns.Msg, error) {
+	ret, err := uh.dnscryptExchange0(ctx, state, "udp")
+	if err == nil && ret.Truncated {
+		ret, err = uh.dnscryptExchange0(ctx, state, "tcp")
+	}
+	return ret, err
+}
+
+func (uh *UpstreamHost) dnscryptExchange0(ctx context.Context, state *request.Request, network string) (*dns.Msg, error) {
+	cert, err := uh.dnscrypt.currentCert(uh.c)
+	if err != nil {
+		return nil, err
+	}
+	packet, err := state.Req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	minSize := 0
+	if network == "udp" {
+		minSize = dnscryptMinUdpQuerySize
+	}
+	query, shared, nonce, err := uh.dnscrypt.encrypt(cert, packet, minSize)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialTimeout(ctx, network, uh.addr, uh.iface, uh.transport.dialTimeout(requestDownstreamType(state)), nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer Close(conn)
+
+	deadline, err := ioDeadline(ctx, uh.transport.writeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetWriteDeadline(deadline)
+	if network == "tcp" {
+		query = append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+	}
+	if _, err := conn.Conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	if deadline, err = ioDeadline(ctx, uh.transport.readTimeout); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(deadline)
+	var resp []byte
+	if network == "tcp" {
+		var l [2]byte
+		if _, err := io.ReadFull(conn.Conn, l[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn.Conn, resp); err != nil {
+			return nil, err
+		}
+	} else {
+		resp = make([]byte, dns.MaxMsgSize)
+		n, err := conn.Conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		resp = resp[:n]
+	}
+
+	packet, err = uh.dnscrypt.decrypt(resp, shared, nonce)
+	if err != nil {
+		if err == errDnscryptDecrypt {
+			// Resolver key possibly rotated
+			uh.dnscrypt.invalidate()
+		}
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(packet); err != nil {
+		return nil, err
+	}
+	if ret.Id != state.Req.Id {
+		return nil, fmt.Errorf("DNSCrypt response id mismatch, expected %v, got %v", state.Req.Id, ret.Id)
+	}
+	return ret, nil
+}
+
+func (uh *UpstreamHost) dnscryptSend() (error, time.Duration) {
+	req := uh.probeMsg()
+	t := time.Now()
+	_, err := uh.dnscryptExchange(context.Background(), &request.Request{Req: req})
+	return err, time.Since(t)
+}
+
+// Concatenate strings of a TXT record into raw bytes, reverting escapes made by the dns library
+func txtBytes(txt []string) []byte {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	var b []byte
+	for _, s := range txt {
+		for i := 0; i < len(s); i++ {
+			if s[i] != '\\' || i+1 == len(s) {
+				b = append(b, s[i])
+				continue
+			}
+			if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+				b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+				i += 3
+			} else {
+				b = append(b, s[i+1])
+				i++
+			}
+		}
+	}
+	return b
+}
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte("r6fnvWj8")
+
+	errDnscryptNoCert  = errors.New("no valid DNSCrypt certificate")
+	errDnscryptDecrypt = errors.New("failed to decrypt DNSCrypt response")
+)
+
+const (
+	dnscryptDefaultPort        = "443"
+	dnscryptEsXSalsa20Poly1305 = 0x0001
+	dnscryptCertSize           = 124
+	dnscryptHalfNonceSize      = 12
+	dnscryptMinUdpQuerySize    = 256
+	dnscryptCertRefresh        = 1 * time.Hour
+)
@@ -7,13 +7,16 @@ package dnsredir
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/debug"
 	"github.com/coredns/coredns/plugin/metrics"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"net"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -23,14 +26,25 @@ var log = clog.NewWithPlugin(pluginName)
 type Dnsredir struct {
 	Next plugin.Handler
 
+	// Protects elements of Upstreams, which may be replaced by hot patching
+	sync.RWMutex
 	Upstreams *[]Upstream
+	// Serializes hot patching
+	patchLock sync.Mutex
+	// Admin server addresses acquired
+	adminAddrs []string
 }
 
 // Upstream manages a pool of proxy upstream hosts
 // see: github.com/coredns/proxy#proxy.go
 type Upstream interface {
-	// Check if given domain name should be routed to this upstream zone
-	Match(name string) bool
+	// Check if given request should be routed to this upstream zone
+	// `name' is the request name lower cased and without trailing dot(except for root zone)
+	Match(state *request.Request, name string) bool
+	// Check if given names would be routed to this upstream zone in bulk, see lookup.go
+	MatchAll(names []string) []bool
+	// Return a point-in-time copy of all names of this upstream zone
+	Snapshot() *NameSnapshot
 	// Select an upstream host to be routed to, nil if no available host
 	Select() *UpstreamHost
 
@@ -49,10 +63,51 @@ func (r *Dnsredir) OnStartup() error {
 			return err
 		}
 	}
+
+	for _, up := range *r.Upstreams {
+		addr := up.(*reloadableUpstream).admin
+		if len(addr) == 0 || stringInSlice(addr, r.adminAddrs) {
+			continue
+		}
+		if err := acquireAdminServer(addr, r); err != nil {
+			return err
+		}
+		r.adminAddrs = append(r.adminAddrs, addr)
+	}
+	return nil
+}
+
+// Return the upstream of the stanza, nil if not found
+func (r *Dnsredir) upstream(stanza string) *reloadableUpstream {
+	r.RLock()
+	defer r.RUnlock()
+	for _, up := range *r.Upstreams {
+		if u := up.(*reloadableUpstream); u.stanza == stanza {
+			return u
+		}
+	}
 	return nil
 }
 
+// Return names of all stanzas
+func (r *Dnsredir) stanzas() []string {
+	r.RLock()
+	defer r.RUnlock()
+	names := make([]string, 0, len(*r.Upstreams))
+	for _, up := range *r.Upstreams {
+		names = append(names, up.(*reloadableUpstream).stanza)
+	}
+	return names
+}
+
 func (r *Dnsredir) OnShutdown() error {
+	for _, addr := range r.adminAddrs {
+		releaseAdminServer(addr, r)
+	}
+	r.adminAddrs = nil
+
+	r.RLock()
+	defer r.RUnlock()
 	for _, up := range *r.Upstreams {
 		if err := up.Stop(); err != nil {
 			return err
@@ -61,48 +116,207 @@ func (r *Dnsredir) OnShutdown() error {
 	return nil
 }
 
-func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (int, error) {
+func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.Msg) (rcode int, err error) {
+	if rc := validateRequest(req); rc != dns.RcodeSuccess {
+		log.Debugf("Malformed request  id: %v opcode: %v qdcount: %v rcode: %v",
+			req.Id, req.Opcode, len(req.Question), dns.RcodeToString[rc])
+		m := new(dns.Msg)
+		m.SetRcode(req, rc)
+		_ = w.WriteMsg(m)
+		return rc, nil
+	}
+
 	state := &request.Request{W: w, Req: req}
 	name := state.Name()
 
+	if reply := r.answerWhichUpstream(state); reply != nil {
+		_ = w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	}
+
 	server := metrics.WithServer(ctx)
-	upstream0, t := r.match(server, name)
+	upstream0, t := r.match(server, state, name)
 	if upstream0 == nil {
-		log.Debugf("%q not found in name list, t: %v", name, t)
+		log.Debugf("%q not found in name list, t: %v", r.redact().redact(name, ""), t)
 		return plugin.NextOrFailure(r.Name(), r.Next, ctx, w, req)
 	}
+	// Only queries are forwarded, other opcodes(e.g. NOTIFY) of zones not matched are left to next plugins
+	if req.Opcode != dns.OpcodeQuery {
+		log.Debugf("Unsupported opcode  id: %v opcode: %v", req.Id, dns.OpcodeToString[req.Opcode])
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNotImplemented)
+		_ = w.WriteMsg(m)
+		return dns.RcodeNotImplemented, nil
+	}
 	upstream := upstream0.(*reloadableUpstream)
-	log.Debugf("%q in name list, t: %v", name, t)
+	logName := upstream.logName(name)
+	log.Debugf("%q in name list, t: %v", logName, t)
+	trace := upstream.traces(state)
+	tracef(trace, state, logName, "matched stanza %q, t: %v", upstream.stanza, t)
+
+	canary := upstream.inCanary(state)
+	if upstream.canary != nil && upstream.NameList.inCanary() {
+		defer func() {
+			upstream.NameList.recordCanary(canary, rcode == dns.RcodeServerFailure)
+		}()
+	}
+
+	if subscribed() {
+		begin := time.Now()
+		defer func() {
+			if err != nil {
+				publish(Event{
+					Type:     EventQueryFailed,
+					Stanza:   upstream.stanza,
+					Name:     name,
+					Qtype:    state.QType(),
+					Duration: time.Since(begin),
+					Err:      err,
+				})
+			}
+		}()
+	}
+
+	if upstream.slo != nil {
+		begin := time.Now()
+		defer func() {
+			upstream.slo.observe(time.Since(begin), err == nil)
+		}()
+	}
+
+	// Upstream host and rcode of the answer forwarded to the client, if any
+	servedBy, servedRcode := "", -1
+	if upstream.audit != nil {
+		begin := time.Now()
+		defer func() {
+			if servedRcode < 0 {
+				servedRcode = rcode
+			}
+			upstream.audit.record(state, name, servedBy, servedRcode, err, begin)
+		}()
+	}
+
+	if len(upstream.tagActions) != 0 && upstream.nameAction(removeTrailingDot(name), canary) == tagActionBlock {
+		log.Debugf("%q blocked by tag action", logName)
+		tracef(trace, state, logName, "blocked by tag action")
+		nxdomain := new(dns.Msg)
+		nxdomain.SetRcode(req, dns.RcodeNameError)
+		_ = w.WriteMsg(nxdomain)
+		return dns.RcodeNameError, nil
+	}
+
+	if upstream.guard != nil && upstream.guard.rejects(removeTrailingDot(name)) {
+		log.Debugf("%q refused by qname guard", logName)
+		tracef(trace, state, logName, "refused by qname guard")
+		QnameGuardCount.WithLabelValues(server).Inc()
+		refused := new(dns.Msg)
+		refused.SetRcode(req, dns.RcodeRefused)
+		_ = w.WriteMsg(refused)
+		return dns.RcodeRefused, nil
+	}
+
+	if upstream.dedup != nil {
+		if reply := upstream.dedup.get(state); reply != nil {
+			log.Debugf("%q answered from dedup window", logName)
+			tracef(trace, state, logName, "answered from dedup window")
+			DedupHitCount.WithLabelValues(server).Inc()
+			if state.Proto() == "udp" {
+				fitReply(reply, state.Size(), upstream.minimalResponses)
+			}
+			_ = w.WriteMsg(reply)
+			return dns.RcodeSuccess, nil
+		}
+	}
+
+	ctx, budget := withQueryBudget(ctx, upstream.maxDepth)
 
 	var reply *dns.Msg
 	var upstreamErr error
 	var tryCount int32
 	deadline := time.Now().Add(defaultTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if upstream.warm != nil {
+		upstream.warm.observe(name, state.QType())
+	}
+
+	if upstream.mirror != nil {
+		upstream.mirror.send(req, logName)
+	}
+
+	if upstream.queue != nil {
+		if err := upstream.queue.acquire(ctx, deadline); err != nil {
+			log.Debugf("Shed %q: %v", logName, err)
+			QueueShedCount.WithLabelValues(server).Inc()
+			tracef(trace, state, logName, "shed: %v", err)
+			return dns.RcodeServerFailure, err
+		}
+		defer upstream.queue.release()
+	}
+
+	hc, arm := upstream.HealthCheck, splitArmA
+	if upstream.split != nil {
+		if upstream.split.inArmB(state) {
+			hc, arm = upstream.split.HealthCheck, splitArmB
+		}
+		SplitRequestCount.WithLabelValues(upstream.stanza, arm).Inc()
+	}
+
+	var client net.IP
+	if _, ok := hc.policy.(clientPolicy); ok {
+		client = clientIP(req, state.IP())
+	}
+	override := upstream.overrideHost(removeTrailingDot(name), canary)
 	for time.Now().Before(deadline) {
 		start := time.Now()
 
 		tryCount++
-		host := upstream.Select()
+		host := override
+		if host != nil {
+			// Only the first try goes to the overriding host, then fallback to hosts in `to'
+			override = nil
+		} else {
+			host = hc.SelectRequest(client, name)
+		}
+		if host == nil && upstream.recursor != nil {
+			tracef(trace, state, logName, "%v, fallback to emergency recursion", errNoHealthy)
+			return upstream.recurse(ctx, w, state, server, logName)
+		}
 		if host == nil || tryCount > upstream.maxRetry {
 			log.Debug(errNoHealthy)
+			tracef(trace, state, logName, "%v, tries: %v", errNoHealthy, tryCount)
 			return dns.RcodeServerFailure, errNoHealthy
 		}
+		if !budget.take() {
+			log.Debugf("%q: %v", logName, errDepthExceeded)
+			DepthExceededCount.WithLabelValues(server).Inc()
+			tracef(trace, state, logName, "%v, tries: %v", errDepthExceeded, tryCount)
+			return dns.RcodeServerFailure, errDepthExceeded
+		}
 		log.Debugf("Upstream host %v is selected", host.Name())
+		tracef(trace, state, logName, "upstream host %v selected, arm: %v", host.Name(), arm)
 
-		for {
-			t := time.Now()
-			reply, upstreamErr = host.Exchange(ctx, state, upstream.bootstrap, upstream.noIPv6)
-			log.Debugf("rtt: %v", time.Since(t))
-			if upstreamErr == errCachedConnClosed {
-				// [sic] Remote side closed conn, can only happen with TCP.
-				// Retry for another connection
-				log.Debugf("%v: %v", upstreamErr, host.Name())
-				continue
-			}
-			break
+		if !host.acquire() {
+			// Lost the race against other queries since selected
+			InflightLimitCount.WithLabelValues(host.Name()).Inc()
+			continue
 		}
+		xstate := state
+		if upstream.dnssec != nil {
+			xstate = &request.Request{W: w, Req: dnssecQuery(req)}
+		}
+		host.usage.add()
+		t := time.Now()
+		reply, upstreamErr = host.Exchange(ctx, xstate, upstream.bootstrap, upstream.noIPv6)
+		host.release()
+		rtt := time.Since(t)
+		log.Debugf("rtt: %v", rtt)
+		host.markExchanged(upstreamErr, rtt)
 
 		if upstreamErr != nil {
+			tracef(trace, state, logName, "exchange with %v failed: %v", host.Name(), upstreamErr)
 			if upstream.maxFails != 0 {
 				log.Warningf("Exchange() failed  error: %v", upstreamErr)
 				healthCheck(upstream, host)
@@ -111,7 +325,9 @@ func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.
 		}
 
 		if !state.Match(reply) {
-			debug.Hexdumpf(reply, "Wrong reply  id: %v, qname: %v qtype: %v", reply.Id, state.QName(), state.QType())
+			if upstream.redact == nil {
+				debug.Hexdumpf(reply, "Wrong reply  id: %v, qname: %v qtype: %v", reply.Id, state.QName(), state.QType())
+			}
 
 			formerr := new(dns.Msg)
 			formerr.SetRcode(state.Req, dns.RcodeFormatError)
@@ -119,13 +335,90 @@ func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.
 			return dns.RcodeSuccess, nil
 		}
 
+		if upstream.dnssec != nil && req.CheckingDisabled {
+			// Client does its own validation, see: https://tools.ietf.org/html/rfc4035#section-3.2.2
+			dnssecReply(req, reply, false)
+		} else if upstream.dnssec != nil {
+			secure, err := upstream.dnssec.validate(reply, func(name string, qtype uint16) (*dns.Msg, error) {
+				m := new(dns.Msg)
+				m.SetQuestion(name, qtype)
+				m.SetEdns0(dns.DefaultMsgSize, true)
+				m.CheckingDisabled = true
+				return host.Exchange(ctx, &request.Request{W: w, Req: m}, upstream.bootstrap, upstream.noIPv6)
+			})
+			if err != nil {
+				log.Warningf("DNSSEC validation of %q from %v failed: %v", logName, host.Name(), err)
+				DnssecBogusCount.WithLabelValues(server, host.Name()).Inc()
+				tracef(trace, state, logName, "DNSSEC validation failed: %v", err)
+				servfail := new(dns.Msg)
+				servfail.SetRcode(req, dns.RcodeServerFailure)
+				_ = w.WriteMsg(servfail)
+				return dns.RcodeServerFailure, nil
+			}
+			dnssecReply(req, reply, secure)
+		}
+
+		if upstream.negativeMinTtl != 0 {
+			raiseNegativeTtl(reply, upstream.negativeMinTtl)
+		}
+
+		if upstream.svcb != nil {
+			upstream.svcb.apply(reply)
+		}
+
+		if upstream.preferFamily != nil {
+			upstream.preferFamily.apply(reply, state.QType(), func(qtype uint16) (*dns.Msg, error) {
+				m := new(dns.Msg)
+				m.SetQuestion(state.QName(), qtype)
+				m.SetEdns0(dns.DefaultMsgSize, false)
+				return host.Exchange(ctx, &request.Request{W: w, Req: m}, upstream.bootstrap, upstream.noIPv6)
+			})
+		}
+
+		if upstream.dedup != nil {
+			upstream.dedup.put(state, reply.Copy())
+		}
+
+		if upstream.explains(req) {
+			explainArm := ""
+			if upstream.split != nil {
+				explainArm = arm
+			}
+			explainReply(reply, upstream.explainCode, upstream.stanza, hc.policy, explainArm, host, tryCount)
+		}
+
+		if state.Proto() == "udp" {
+			fitReply(reply, state.Size(), upstream.minimalResponses)
+		}
+
 		// Add resolved IPs to ipset/pf before write response to DNS resolver
 		// 	thus the rule based routing can take effect immediately
 		ipsetAddIP(upstream, reply)
 		pfAddIP(upstream, reply)
 		_ = w.WriteMsg(reply)
 
-		RequestDuration.WithLabelValues(server, host.Name()).Observe(float64(time.Since(start).Milliseconds()))
+		servedBy, servedRcode = host.Name(), reply.Rcode
+		if upstream.stats != nil {
+			upstream.stats.countUpstream(host.Name())
+		}
+		if upstream.which != nil {
+			upstream.which.record(state.IP(), upstream.stanza, host.Name())
+		}
+		if subscribed() {
+			publish(Event{
+				Type:     EventQueryForwarded,
+				Stanza:   upstream.stanza,
+				Upstream: host.Name(),
+				Name:     name,
+				Qtype:    state.QType(),
+				Reply:    reply,
+				Duration: time.Since(start),
+			})
+		}
+
+		if !upstream.lite {
+			RequestDuration.WithLabelValues(server, host.Name()).Observe(float64(time.Since(start).Milliseconds()))
+		}
 		RequestCount.WithLabelValues(server, host.Name()).Inc()
 
 		rc, ok := dns.RcodeToString[reply.Rcode]
@@ -133,15 +426,104 @@ func (r *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, req *dns.
 			rc = strconv.Itoa(reply.Rcode)
 		}
 		RcodeCount.WithLabelValues(server, host.Name(), rc).Inc()
+		tracef(trace, state, logName, "answered by %v, rcode: %v answers: %v duration: %v", host.Name(), rc, len(reply.Answer), time.Since(start))
+		if upstream.split != nil {
+			SplitRcodeCount.WithLabelValues(upstream.stanza, arm, rc).Inc()
+		}
 		return dns.RcodeSuccess, nil
 	}
 
 	if upstreamErr == nil {
-		panic("Why upstreamErr is nil?! Are you in a debugger or your machine running slow?")
+		// Client deadline passed before any exchange was made
+		return dns.RcodeServerFailure, context.DeadlineExceeded
 	}
 	return dns.RcodeServerFailure, upstreamErr
 }
 
+// Return dns.RcodeSuccess if the inbound request is sane, otherwise the rcode to answer locally
+// Upstreams are not relied on to reject malformed requests.
+func validateRequest(req *dns.Msg) int {
+	if req.Response || len(req.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+// Raise TTL and minimum of SOA records in NXDOMAIN/NODATA answers to at least `floor' seconds
+// Thus downstream caches won't re-ask a dead name over and over.
+func raiseNegativeTtl(reply *dns.Msg, floor uint32) {
+	if reply.Rcode != dns.RcodeNameError && (reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 0) {
+		return
+	}
+	for _, rr := range reply.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		if soa.Hdr.Ttl < floor {
+			soa.Hdr.Ttl = floor
+		}
+		if soa.Minttl < floor {
+			soa.Minttl = floor
+		}
+	}
+}
+
+// Fit a reply into the client's advertised UDP payload size, TC bit will be set if any RR dropped
+// If `minimize' is true, TC won't be set if the reply fits after dropping authority and additional sections.
+// EDNS0 OPT RR is always preserved.
+func fitReply(reply *dns.Msg, size int, minimize bool) {
+	if reply.Len() <= size {
+		return
+	}
+	reply.Compress = true
+	if reply.Len() <= size {
+		return
+	}
+
+	var extra []dns.RR
+	if opt := reply.IsEdns0(); opt != nil {
+		extra = []dns.RR{opt}
+	}
+	reply.Ns = nil
+	reply.Extra = extra
+	if minimize && reply.Len() <= size {
+		return
+	}
+
+	// Truncate at RR boundary
+	answers := reply.Answer
+	reply.Answer = nil
+	for _, rr := range answers {
+		reply.Answer = append(reply.Answer, rr)
+		if reply.Len() > size {
+			reply.Answer = reply.Answer[:len(reply.Answer)-1]
+			break
+		}
+	}
+	reply.Truncated = true
+}
+
+// Log a query trace line if tracing is enabled for the request client
+// `logName' is the query name for log output
+func tracef(trace bool, state *request.Request, logName string, format string, args ...interface{}) {
+	if trace {
+		log.Infof("[%v] %v %v: %v", state.IP(), state.Type(), logName, fmt.Sprintf(format, args...))
+	}
+}
+
+// Return query names redactor for requests not matched by any stanza, nil if no stanza enables redaction
+func (r *Dnsredir) redact() *qnameRedactor {
+	r.RLock()
+	defer r.RUnlock()
+	for _, up := range *r.Upstreams {
+		if redact := up.(*reloadableUpstream).redact; redact != nil {
+			return redact
+		}
+	}
+	return nil
+}
+
 func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
 	// Skip unnecessary health checking
 	if r.checkInterval == 0 || r.maxFails == 0 {
@@ -154,8 +536,8 @@ func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
 		time.Sleep(failTimeout)
 		// Failure count may go negative here, should be rectified by HC eventually
 		atomic.AddInt32(&uh.fails, -1)
-		// Kick off health check on every failureCheck failure
-		if fails%failureCheck == 0 {
+		// Kick off health check on every failureCheck failure, unless in a quiet window
+		if fails%failureCheck == 0 && !r.quiet.active(clock.Now()) {
 			_ = uh.Check()
 		}
 	}(uh)
@@ -163,7 +545,7 @@ func healthCheck(r *reloadableUpstream, uh *UpstreamHost) {
 
 func (r *Dnsredir) Name() string { return pluginName }
 
-func (r *Dnsredir) match(server, name string) (Upstream, time.Duration) {
+func (r *Dnsredir) match(server string, state *request.Request, name string) (Upstream, time.Duration) {
 	t1 := time.Now()
 
 	if r.Upstreams == nil {
@@ -175,10 +557,12 @@ func (r *Dnsredir) match(server, name string) (Upstream, time.Duration) {
 		name = removeTrailingDot(name)
 	}
 
+	r.RLock()
+	defer r.RUnlock()
 	for _, up := range *r.Upstreams {
 		// For maximum performance, we search the first matched item and return directly
 		// Unlike proxy plugin, which try to find longest match
-		if up.Match(name) {
+		if up.Match(state, name) {
 			t2 := time.Since(t1)
 			NameLookupDuration.WithLabelValues(server, "1").Observe(float64(t2.Milliseconds()))
 			return up, t2
@@ -0,0 +1,505 @@
+package dnsredir
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Root zone trust anchors(KSK-2017 and KSK-2024), see: https://data.iana.org/root-anchors/root-anchors.xml
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+const (
+	// Maximum DS/DNSKEY queries made to validate a single answer
+	dnssecMaxQueries = 24
+	// Upper bound of caching validated zone keys
+	dnssecMaxKeyTtl = 1 * time.Hour
+	// Expired zone keys are swept once the cache grows beyond this
+	dnssecKeyCacheSweep = 4096
+)
+
+// DNSSEC validator of upstream answers, the chain of trust is built by DS/DNSKEY queries to the same upstream
+// Answers are either secure(chained to the trust anchor), insecure(provably under an unsigned delegation) or bogus.
+type dnssecValidator struct {
+	anchors []*dns.DS
+
+	sync.Mutex
+	zones map[string]*zoneTrust
+}
+
+type zoneTrust struct {
+	keys   []*dns.DNSKEY // Validated keys of the zone, nil if the zone is insecure
+	expire time.Time
+}
+
+// Parse DS or DNSKEY records of the root zone in zone file format, the default anchors are used if path is empty
+func newDnssecValidator(path string) (*dnssecValidator, error) {
+	v := &dnssecValidator{zones: make(map[string]*zoneTrust)}
+	if len(path) == 0 {
+		for _, s := range defaultTrustAnchors {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				panic(err)
+			}
+			v.anchors = append(v.anchors, rr.(*dns.DS))
+		}
+		return v, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer Close(f)
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Name != "." {
+			return nil, fmt.Errorf("trust anchor %q isn't of the root zone", rr)
+		}
+		switch anchor := rr.(type) {
+		case *dns.DS:
+			v.anchors = append(v.anchors, anchor)
+		case *dns.DNSKEY:
+			v.anchors = append(v.anchors, anchor.ToDS(dns.SHA256))
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(v.anchors) == 0 {
+		return nil, fmt.Errorf("no DS or DNSKEY record found in %q", path)
+	}
+	return v, nil
+}
+
+// Exchange a DNSSEC query with the upstream
+type dnssecExchange func(name string, qtype uint16) (*dns.Msg, error)
+
+// Per-answer validation context
+type validation struct {
+	v        *dnssecValidator
+	exchange dnssecExchange
+	queries  int
+}
+
+// Return true if the answer is secure, false if insecure, error if bogus
+func (v *dnssecValidator) validate(reply *dns.Msg, exchange dnssecExchange) (bool, error) {
+	vc := &validation{v: v, exchange: exchange}
+	secure := true
+	for i, section := range [][]dns.RR{reply.Answer, reply.Ns} {
+		for _, set := range rrsets(section) {
+			t := set[0].Header().Rrtype
+			// Only denial of existence matters in authority section
+			if i == 1 && t != dns.TypeSOA && t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+				continue
+			}
+			name := set[0].Header().Name
+			sigs := sigsOf(section, name, t)
+			if len(sigs) == 0 {
+				insecure, err := vc.provablyInsecure(name)
+				if err != nil {
+					return false, err
+				}
+				if !insecure {
+					return false, fmt.Errorf("%w: unsigned %v %v", errDnssecBogus, name, dns.TypeToString[t])
+				}
+				secure = false
+				continue
+			}
+			ok, err := vc.verify(set, sigs)
+			if err != nil {
+				return false, err
+			}
+			secure = secure && ok
+		}
+	}
+	// Signed NSEC/NSEC3 records prove nothing unless they deny the name asked, otherwise a valid denial of another name could be replayed
+	if secure && isNegative(reply) && !deniesName(reply) {
+		secure = false
+	}
+	return secure, nil
+}
+
+// Return true if the reply is NXDOMAIN or NODATA
+func isNegative(reply *dns.Msg) bool {
+	return reply.Rcode == dns.RcodeNameError || (reply.Rcode == dns.RcodeSuccess && len(reply.Answer) == 0)
+}
+
+// Return true if NSEC/NSEC3 records in authority section deny the question of the reply
+// Only direct proofs are recognized, answers denied by a wildcard or closest encloser proof are treated as insecure.
+func deniesName(reply *dns.Msg) bool {
+	if len(reply.Question) == 0 || len(reply.Answer) != 0 {
+		return false
+	}
+	name := dns.Fqdn(strings.ToLower(reply.Question[0].Name))
+	qtype := reply.Question[0].Qtype
+	nxdomain := reply.Rcode == dns.RcodeNameError
+	for _, rr := range reply.Ns {
+		switch v := rr.(type) {
+		case *dns.NSEC:
+			if nxdomain && nsecCovers(v, name) {
+				return true
+			}
+			if !nxdomain && strings.EqualFold(v.Hdr.Name, name) && !hasType(v.TypeBitMap, qtype) && !hasType(v.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+		case *dns.NSEC3:
+			if nxdomain && v.Cover(name) {
+				return true
+			}
+			if !nxdomain && v.Match(name) && !hasType(v.TypeBitMap, qtype) && !hasType(v.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return true if the name is strictly between owner and next name of the NSEC in canonical order
+// see: https://tools.ietf.org/html/rfc4034#section-6.1
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// Last NSEC of the zone, whose next name wraps around to the apex
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// Verify RRset with any of the signatures, false if the signer zone is insecure
+func (vc *validation) verify(set []dns.RR, sigs []*dns.RRSIG) (bool, error) {
+	owner := set[0].Header().Name
+	var lastErr error
+	for _, sig := range sigs {
+		signer := strings.ToLower(sig.SignerName)
+		if !dns.IsSubDomain(signer, strings.ToLower(owner)) {
+			lastErr = fmt.Errorf("%w: %v signed by unrelated zone %v", errDnssecBogus, owner, signer)
+			continue
+		}
+		keys, err := vc.keys(signer)
+		if err != nil {
+			return false, err
+		}
+		if keys == nil {
+			return false, nil
+		}
+		if err := verifyWithKeys(set, sig, keys); err != nil {
+			lastErr = err
+			continue
+		}
+		return true, nil
+	}
+	return false, lastErr
+}
+
+func verifyWithKeys(set []dns.RR, sig *dns.RRSIG, keys []*dns.DNSKEY) error {
+	if !sig.ValidityPeriod(clock.Now()) {
+		return fmt.Errorf("%w: RRSIG of %v expired or not yet valid", errDnssecBogus, sig.Hdr.Name)
+	}
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, set) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no key verifies RRSIG of %v", errDnssecBogus, sig.Hdr.Name)
+}
+
+// Return validated keys of the zone, nil if the zone is insecure
+func (vc *validation) keys(zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	v := vc.v
+	now := clock.Now()
+	v.Lock()
+	t, ok := v.zones[zone]
+	v.Unlock()
+	if ok && now.Before(t.expire) {
+		return t.keys, nil
+	}
+
+	var ds []*dns.DS
+	if zone == "." {
+		ds = v.anchors
+	} else {
+		r, err := vc.query(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		set := rrsetOf(r.Answer, zone, dns.TypeDS)
+		if len(set) == 0 {
+			// No DS, the zone is trusted only if provably insecure
+			insecure, err := vc.provablyInsecure(zone)
+			if err != nil {
+				return nil, err
+			}
+			if !insecure {
+				return nil, fmt.Errorf("%w: no DS for signer %v", errDnssecBogus, zone)
+			}
+			v.cache(zone, nil, dnssecMaxKeyTtl)
+			return nil, nil
+		}
+		secure, err := vc.verify(set, sigsOf(r.Answer, zone, dns.TypeDS))
+		if err != nil {
+			return nil, err
+		}
+		if !secure {
+			v.cache(zone, nil, dnssecMaxKeyTtl)
+			return nil, nil
+		}
+		for _, rr := range set {
+			ds = append(ds, rr.(*dns.DS))
+		}
+	}
+
+	r, err := vc.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set := rrsetOf(r.Answer, zone, dns.TypeDNSKEY)
+	var keys, ksks []*dns.DNSKEY
+	for _, rr := range set {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		for _, d := range ds {
+			if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+				continue
+			}
+			if kd := key.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+				ksks = append(ksks, key)
+			}
+		}
+	}
+	if len(ksks) == 0 {
+		return nil, fmt.Errorf("%w: no DNSKEY of %v matches DS", errDnssecBogus, zone)
+	}
+	verified := false
+	for _, sig := range sigsOf(r.Answer, zone, dns.TypeDNSKEY) {
+		if verifyWithKeys(set, sig, ksks) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: DNSKEY of %v isn't signed by a trusted key", errDnssecBogus, zone)
+	}
+
+	ttl := time.Duration(set[0].Header().Ttl) * time.Second
+	if ttl > dnssecMaxKeyTtl {
+		ttl = dnssecMaxKeyTtl
+	}
+	v.cache(zone, keys, ttl)
+	return keys, nil
+}
+
+func (v *dnssecValidator) cache(zone string, keys []*dns.DNSKEY, ttl time.Duration) {
+	now := clock.Now()
+	v.Lock()
+	defer v.Unlock()
+	if len(v.zones) >= dnssecKeyCacheSweep {
+		for z, t := range v.zones {
+			if !now.Before(t.expire) {
+				delete(v.zones, z)
+			}
+		}
+	}
+	v.zones[zone] = &zoneTrust{keys: keys, expire: now.Add(ttl)}
+}
+
+// Walk down from the root to check if the name is at or under an insecure delegation
+func (vc *validation) provablyInsecure(name string) (bool, error) {
+	name = dns.Fqdn(strings.ToLower(name))
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		r, err := vc.query(child, dns.TypeDS)
+		if err != nil {
+			return false, err
+		}
+		if set := rrsetOf(r.Answer, child, dns.TypeDS); len(set) != 0 {
+			// Secure delegation(if the DS itself validates), descend into the child zone
+			keys, err := vc.keys(child)
+			if err != nil {
+				return false, err
+			}
+			if keys == nil {
+				return true, nil
+			}
+			continue
+		}
+
+		// No DS, a signed denial is expected since we're in a secure zone so far
+		denied := false
+		for _, set := range rrsets(r.Ns) {
+			t := set[0].Header().Rrtype
+			if t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+				continue
+			}
+			secure, err := vc.verify(set, sigsOf(r.Ns, set[0].Header().Name, t))
+			if err != nil {
+				return false, err
+			}
+			if !secure {
+				return true, nil
+			}
+			denied = true
+		}
+		if !denied {
+			return false, fmt.Errorf("%w: no signed denial of DS for %v", errDnssecBogus, child)
+		}
+		if insecureDelegation(r.Ns, child) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (vc *validation) query(name string, qtype uint16) (*dns.Msg, error) {
+	if vc.queries++; vc.queries > dnssecMaxQueries {
+		return nil, errDnssecTooManyQueries
+	}
+	r, err := vc.exchange(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%v %v: unexpected rcode %v", name, dns.TypeToString[qtype], dns.RcodeToString[r.Rcode])
+	}
+	return r, nil
+}
+
+// Return true if the denial proves the name is a delegation without DS, or covered by NSEC3 opt-out
+func insecureDelegation(ns []dns.RR, name string) bool {
+	for _, rr := range ns {
+		switch v := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(v.Hdr.Name, name) && hasType(v.TypeBitMap, dns.TypeNS) && !hasType(v.TypeBitMap, dns.TypeDS) {
+				return true
+			}
+		case *dns.NSEC3:
+			if v.Match(name) && hasType(v.TypeBitMap, dns.TypeNS) && !hasType(v.TypeBitMap, dns.TypeDS) {
+				return true
+			}
+			if v.Cover(name) && v.Flags&0x01 != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Group records(except RRSIG and OPT) into RRsets, in order of appearance
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	type key struct {
+		name  string
+		rtype uint16
+	}
+	var keys []key
+	sets := make(map[key][]dns.RR)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		k := key{strings.ToLower(h.Name), h.Rrtype}
+		if _, ok := sets[k]; !ok {
+			keys = append(keys, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	ret := make([][]dns.RR, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, sets[k])
+	}
+	return ret
+}
+
+func rrsetOf(rrs []dns.RR, name string, t uint16) []dns.RR {
+	var set []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t && strings.EqualFold(rr.Header().Name, name) {
+			set = append(set, rr)
+		}
+	}
+	return set
+}
+
+func sigsOf(rrs []dns.RR, name string, t uint16) []*dns.RRSIG {
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t && strings.EqualFold(sig.Hdr.Name, name) {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// Return a copy of the query with DO bit set, thus signatures are returned by upstreams
+func dnssecQuery(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	if opt := m.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		m.SetEdns0(dns.MinMsgSize, true)
+	}
+	return m
+}
+
+// Strip DNSSEC records the client didn't ask for, and set AD bit if the answer is secure and the client is interested
+// see: https://tools.ietf.org/html/rfc4035#section-3.2.1
+func dnssecReply(req, reply *dns.Msg, secure bool) {
+	opt := req.IsEdns0()
+	do := opt != nil && opt.Do()
+	if !do {
+		qtype := req.Question[0].Qtype
+		for _, section := range []*[]dns.RR{&reply.Answer, &reply.Ns, &reply.Extra} {
+			rrs := (*section)[:0]
+			for _, rr := range *section {
+				switch t := rr.Header().Rrtype; t {
+				case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+					if t != qtype {
+						continue
+					}
+				}
+				rrs = append(rrs, rr)
+			}
+			*section = rrs
+		}
+	}
+	if opt == nil {
+		removeOpt(reply)
+	} else if rOpt := reply.IsEdns0(); rOpt != nil && !do {
+		rOpt.SetDo(false)
+	}
+	reply.AuthenticatedData = secure && (do || req.AuthenticatedData)
+}
+
+var (
+	errDnssecBogus          = errors.New("DNSSEC bogus")
+	errDnssecTooManyQueries = errors.New("DNSSEC validation needs too many queries")
+)
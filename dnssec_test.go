@@ -0,0 +1,141 @@
+package dnsredir
+
+import (
+	"crypto"
+	"errors"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testZoneKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZoneKey(t *testing.T, zone string) *testZoneKey {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZoneKey{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (k *testZoneKey) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(k.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestDnssecValidate(t *testing.T) {
+	root := newTestZoneKey(t, ".")
+	example := newTestZoneKey(t, "example.")
+
+	ds := example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	nsec := mustRR(t, "insecure. 3600 IN NSEC zzz. NS RRSIG NSEC")
+	responses := map[string][]dns.RR{
+		". DNSKEY":        root.sign(t, root.key),
+		"example. DS":     root.sign(t, ds),
+		"example. DNSKEY": example.sign(t, example.key),
+	}
+	denials := map[string][]dns.RR{
+		"insecure. DS": root.sign(t, nsec),
+	}
+	exchange := func(name string, qtype uint16) (*dns.Msg, error) {
+		key := strings.ToLower(name) + " " + dns.TypeToString[qtype]
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.Response = true
+		m.Answer = responses[key]
+		m.Ns = denials[key]
+		return m, nil
+	}
+
+	v := &dnssecValidator{anchors: []*dns.DS{root.key.ToDS(dns.SHA256)}, zones: make(map[string]*zoneTrust)}
+	answer := func(rrs ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.Answer = rrs
+		return m
+	}
+
+	a := mustRR(t, "www.example. 300 IN A 192.0.2.1")
+	secure, err := v.validate(answer(example.sign(t, a)...), exchange)
+	if err != nil || !secure {
+		t.Errorf("expected secure answer, got %v %v", secure, err)
+	}
+
+	tampered := example.sign(t, a)
+	tampered[0] = mustRR(t, "www.example. 300 IN A 192.0.2.2")
+	if _, err := v.validate(answer(tampered...), exchange); !errors.Is(err, errDnssecBogus) {
+		t.Errorf("expected bogus tampered answer, got %v", err)
+	}
+
+	if _, err := v.validate(answer(a), exchange); !errors.Is(err, errDnssecBogus) {
+		t.Errorf("expected bogus unsigned answer in secure zone, got %v", err)
+	}
+
+	secure, err = v.validate(answer(mustRR(t, "www.insecure. 300 IN A 192.0.2.3")), exchange)
+	if err != nil || secure {
+		t.Errorf("expected insecure answer, got %v %v", secure, err)
+	}
+
+	// Signed denials are secure only if they deny the query name
+	negative := func(name string, qtype uint16, rcode int, ns ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		m.Rcode = rcode
+		m.Ns = ns
+		return m
+	}
+	tests := []struct {
+		reply  *dns.Msg
+		secure bool
+	}{
+		{negative("nx.example.", dns.TypeA, dns.RcodeNameError, example.sign(t, mustRR(t, "mail.example. 3600 IN NSEC www.example. A RRSIG NSEC"))...), true},
+		// Denial replayed from another name
+		{negative("zzz.example.", dns.TypeA, dns.RcodeNameError, example.sign(t, mustRR(t, "mail.example. 3600 IN NSEC www.example. A RRSIG NSEC"))...), false},
+		// Last NSEC of the zone wraps around to the apex
+		{negative("zzz.example.", dns.TypeA, dns.RcodeNameError, example.sign(t, mustRR(t, "www.example. 3600 IN NSEC example. A RRSIG NSEC"))...), true},
+		{negative("www.example.", dns.TypeAAAA, dns.RcodeSuccess, example.sign(t, mustRR(t, "www.example. 3600 IN NSEC zzz.example. A RRSIG NSEC"))...), true},
+		// NSEC of the name which has the type asked
+		{negative("www.example.", dns.TypeA, dns.RcodeSuccess, example.sign(t, mustRR(t, "www.example. 3600 IN NSEC zzz.example. A RRSIG NSEC"))...), false},
+		{negative("mail.example.", dns.TypeAAAA, dns.RcodeSuccess, example.sign(t, mustRR(t, "www.example. 3600 IN NSEC zzz.example. A RRSIG NSEC"))...), false},
+	}
+	for i, test := range tests {
+		secure, err := v.validate(test.reply, exchange)
+		if err != nil || secure != test.secure {
+			t.Errorf("Test#%v: expected secure %v, got %v %v", i, test.secure, secure, err)
+		}
+	}
+
+	untrusted := &dnssecValidator{anchors: []*dns.DS{example.key.ToDS(dns.SHA256)}, zones: make(map[string]*zoneTrust)}
+	if _, err := untrusted.validate(answer(example.sign(t, a)...), exchange); !errors.Is(err, errDnssecBogus) {
+		t.Errorf("expected bogus answer with mismatched trust anchor, got %v", err)
+	}
+}
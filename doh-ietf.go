@@ -31,7 +31,7 @@ func (uh *UpstreamHost) ietfDnsExchange(ctx context.Context, state *request.Requ
 	r.Id = reqId
 
 	reqBase64 := base64.RawURLEncoding.EncodeToString(reqBytes)
-	reqURL := fmt.Sprintf("%v?ct=%v&dns=%v", uh.Name(), requestContentType, reqBase64)
+	reqURL := fmt.Sprintf("%v?ct=%v&dns=%v", uh.dohURL(), requestContentType, reqBase64)
 
 	var req *http.Request
 	// see:
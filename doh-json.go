@@ -45,7 +45,7 @@ func (uh *UpstreamHost) jsonDnsExchange(ctx context.Context, state *request.Requ
 	}
 
 	reqURL := fmt.Sprintf("%v?ct=%v&name=%v&type=%v",
-		uh.Name(), requestContentType, url.QueryEscape(q.Name), url.QueryEscape(QType))
+		uh.dohURL(), requestContentType, url.QueryEscape(q.Name), url.QueryEscape(QType))
 	if r.CheckingDisabled {
 		// Disable DNSSEC validation
 		reqURL += "&cd=1"
@@ -84,7 +84,7 @@ func (uh *UpstreamHost) jsonDnsParseResponse(state *request.Request, resp *http.
 		return nil, err
 	}
 	if respJSON.Status != dns.RcodeSuccess && respJSON.Comment != "" {
-		log.Warningf("DNS error when query %q: %v", state.Name(), respJSON.Comment)
+		log.Warningf("DNS error when query %q: %v", uh.redact.redact(state.Name(), ""), respJSON.Comment)
 	}
 	fixEmptyNames(&respJSON)
 
@@ -0,0 +1,83 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// EDNS Client Subnet(RFC 7871) policy applied to queries forwarded to upstreams
+type ecsPolicy struct {
+	// Replacement of the client subnet, nil to strip it
+	subnet *dns.EDNS0_SUBNET
+}
+
+// Parse `keep', `strip' or a fixed prefix, nil policy is returned for `keep'
+func parseEcs(arg string) (*ecsPolicy, error) {
+	switch arg {
+	case "keep":
+		return nil, nil
+	case "strip":
+		return &ecsPolicy{}, nil
+	}
+	ip, ipNet, err := net.ParseCIDR(arg)
+	if err != nil {
+		return nil, fmt.Errorf("expected %q, %q or a prefix, got %q", "keep", "strip", arg)
+	}
+	ones, _ := ipNet.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+		Address:       ipNet.IP,
+	}
+	if ip.To4() != nil {
+		subnet.Family = 1
+	} else {
+		subnet.Family = 2
+	}
+	return &ecsPolicy{subnet: subnet}, nil
+}
+
+func (e *ecsPolicy) String() string {
+	if e.subnet == nil {
+		return "strip"
+	}
+	return fmt.Sprintf("%v/%v", e.subnet.Address, e.subnet.SourceNetmask)
+}
+
+// Return a copy of the query with client subnet stripped or replaced
+func (e *ecsPolicy) apply(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		if e.subnet == nil {
+			return m
+		}
+		// Stick to the classic payload size since the client knows nothing about EDNS
+		opt = m.SetEdns0(dns.MinMsgSize, false).IsEdns0()
+	}
+	opt.Option = withoutOption(opt.Option, dns.EDNS0SUBNET)
+	if e.subnet != nil {
+		opt.Option = append(opt.Option, e.subnet)
+	}
+	return m
+}
+
+// Restore client subnet of the original query in reply, thus the client never sees our replacement
+func (e *ecsPolicy) restore(req, reply *dns.Msg) {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return
+	}
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		removeOpt(reply)
+		return
+	}
+	opt.Option = withoutOption(opt.Option, dns.EDNS0SUBNET)
+	for _, o := range reqOpt.Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			opt.Option = append(opt.Option, o)
+		}
+	}
+}
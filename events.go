@@ -0,0 +1,102 @@
+package dnsredir
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the type of events published by the plugin
+type EventType int
+
+const (
+	// A name list in FROM... is reloaded, Source is the path or URL
+	EventListReloaded EventType = iota
+	// An upstream host is considered up by health check, Upstream is the host
+	EventUpstreamUp
+	// An upstream host is considered down by health check, Upstream is the host
+	EventUpstreamDown
+	// A query is answered by an upstream host
+	EventQueryForwarded
+	// A query failed, Err is the reason
+	EventQueryFailed
+)
+
+var eventTypeNames = []string{"list_reloaded", "upstream_up", "upstream_down", "query_forwarded", "query_failed"}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventTypeNames) {
+		return "unknown"
+	}
+	return eventTypeNames[t]
+}
+
+// Event is an internal event of the plugin, fields not applicable to the event type are left zero
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	Stanza   string // Name of the stanza, empty for upstream state changes
+	Source   string // Path or URL of the reloaded name list
+	Names    uint64 // Number of names in the reloaded name list
+	Upstream string // Name of the upstream host, e.g. udp://1.1.1.1:53
+
+	Name     string   // Query name, note that it's never redacted
+	Qtype    uint16   // Query type
+	Reply    *dns.Msg // Reply of the upstream, which must not be modified
+	Duration time.Duration
+	Err      error
+}
+
+type eventBus struct {
+	sync.RWMutex
+	subs map[chan Event]struct{}
+	// Number of subscribers, checked before publishing without lock
+	n int32
+}
+
+var events = &eventBus{subs: make(map[chan Event]struct{})}
+
+// Subscribe to events of all dnsredir instances in the process, `size' is the channel buffer size
+// Events are dropped rather than blocking query processing if the channel is full, thus subscribers should drain it promptly.
+// The returned function cancels the subscription and closes the channel.
+func Subscribe(size int) (<-chan Event, func()) {
+	ch := make(chan Event, size)
+	events.Lock()
+	events.subs[ch] = struct{}{}
+	atomic.AddInt32(&events.n, 1)
+	events.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			events.Lock()
+			delete(events.subs, ch)
+			atomic.AddInt32(&events.n, -1)
+			close(ch)
+			events.Unlock()
+		})
+	}
+}
+
+// Return true if anyone subscribed to events, so building events can be skipped
+func subscribed() bool {
+	return atomic.LoadInt32(&events.n) != 0
+}
+
+func publish(e Event) {
+	if !subscribed() {
+		return
+	}
+	e.Time = clock.Now()
+	events.RLock()
+	defer events.RUnlock()
+	for ch := range events.subs {
+		select {
+		case ch <- e:
+		default:
+			EventDropCount.Inc()
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package dnsredir
+
+import (
+	"errors"
+	"strings"
+)
+
+// Return the source of `except' names, i.e. file:PATH or URL, which is loaded and reloaded as sources in FROM...
+// A format prefix is kept, e.g. hosts:file:/etc/hosts is the source hosts:/etc/hosts.
+func exceptSource(arg string) (string, bool) {
+	from, _ := splitFormPrefix(arg)
+	prefix := arg[:len(arg)-len(from)]
+	if strings.HasPrefix(from, exceptFilePrefix) {
+		return prefix + from[len(exceptFilePrefix):], true
+	}
+	if strings.Contains(from, "://") {
+		return arg, true
+	}
+	return "", false
+}
+
+// Return the item of an `except' source, nil if not found
+// The source is specified as in `except', with or without the file: prefix.
+func (u *reloadableUpstream) exceptItem(source string) *NameItem {
+	if s, ok := exceptSource(source); ok {
+		source = s
+	}
+	for i, item := range u.exceptItems {
+		form := u.exceptForms[i]
+		if stripped, _ := splitFormPrefix(form); form == source || stripped == source {
+			return item
+		}
+	}
+	return nil
+}
+
+// Names of an `except' source are exceptions as a whole, as well as its adblock exception rules
+func mergeExcepts(names, excepts domainSet) domainSet {
+	if excepts == nil {
+		excepts = make(domainSet)
+	}
+	_ = names.ForEachDomain(func(name string) error {
+		excepts.Add(name)
+		return nil
+	})
+	return excepts
+}
+
+var errCompiledExcept = errors.New("compiled name lists cannot be sources of except")
+
+const exceptFilePrefix = "file:"
@@ -0,0 +1,122 @@
+package dnsredir
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expand braces of the template like shells do, e.g.
+//	`{a,b}.example.com' -> a.example.com b.example.com
+//	`cdn{1..3}.example.com' -> cdn1.example.com cdn2.example.com cdn3.example.com
+//	`node{08..10}.example.com' -> node08.example.com node09.example.com node10.example.com
+// Braces can be nested or repeated, total number of expanded strings is limited to maxExpandedNames.
+func expandBraces(s string) ([]string, error) {
+	open := strings.IndexByte(s, '{')
+	if open < 0 {
+		if strings.IndexByte(s, '}') >= 0 {
+			return nil, errUnbalancedBraces
+		}
+		return []string{s}, nil
+	}
+	if strings.IndexByte(s[:open], '}') >= 0 {
+		return nil, errUnbalancedBraces
+	}
+
+	// Split alternatives of the first brace at top level commas
+	var alts []string
+	depth, start, end := 0, open+1, -1
+	for i := open + 1; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth == 0 {
+				alts = append(alts, s[start:i])
+				end = i
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				alts = append(alts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if end < 0 {
+		return nil, errUnbalancedBraces
+	}
+	if len(alts) == 1 {
+		seq, err := expandSequence(alts[0])
+		if err != nil {
+			return nil, err
+		}
+		alts = seq
+	}
+
+	suffixes, err := expandBraces(s[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	var expanded []string
+	for _, alt := range alts {
+		prefixes, err := expandBraces(s[:open] + alt)
+		if err != nil {
+			return nil, err
+		}
+		if len(expanded)+len(prefixes)*len(suffixes) > maxExpandedNames {
+			return nil, errTooManyExpanded
+		}
+		for _, prefix := range prefixes {
+			for _, suffix := range suffixes {
+				expanded = append(expanded, prefix+suffix)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// Expand numeric range `N..M', leading zeros of either end pad expanded numbers to the same width
+func expandSequence(s string) ([]string, error) {
+	i := strings.Index(s, "..")
+	if i < 0 {
+		return nil, fmt.Errorf("expected alternatives or a numeric range in braces, got %q", s)
+	}
+	from, err1 := strconv.ParseUint(s[:i], 10, 32)
+	to, err2 := strconv.ParseUint(s[i+2:], 10, 32)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid numeric range %q", s)
+	}
+	width := 0
+	if (i > 1 && s[0] == '0') || (len(s)-i-2 > 1 && s[i+2] == '0') {
+		width = len(s[:i])
+		if n := len(s[i+2:]); n > width {
+			width = n
+		}
+	}
+
+	step := int64(1)
+	if from > to {
+		step = -1
+	}
+	if n := (int64(to)-int64(from))*step + 1; n > maxExpandedNames {
+		return nil, errTooManyExpanded
+	}
+	var seq []string
+	for n := int64(from); ; n += step {
+		seq = append(seq, fmt.Sprintf("%0*d", width, n))
+		if n == int64(to) {
+			break
+		}
+	}
+	return seq, nil
+}
+
+var (
+	errUnbalancedBraces = errors.New("unbalanced braces")
+	errTooManyExpanded  = fmt.Errorf("expanded to more than %v names", maxExpandedNames)
+)
+
+// Maximum names expanded from a single INLINE template
+const maxExpandedNames = 4096
@@ -0,0 +1,48 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// Return true if the request asks for the routing explanation, i.e. it carries the EDNS0 option of `explain'
+func (u *reloadableUpstream) explains(req *dns.Msg) bool {
+	if u.explainCode == 0 {
+		return false
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == u.explainCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Attach the routing explanation to the reply as an EDNS0 local option of `code'
+// Option data is text of space separated `key=value' pairs, e.g.
+//	stanza="example.com example.org" policy=round_robin upstream=udp://1.1.1.1:53 attempts=2
+// `arm' is omitted if empty, i.e. A/B splitting is disabled.
+func explainReply(reply *dns.Msg, code uint16, stanza string, policy Policy, arm string, host *UpstreamHost, attempts int32) {
+	policyName := "random"
+	if policy != nil {
+		policyName = fmt.Sprint(policy)
+	}
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "stanza=%q policy=%v upstream=%v attempts=%v", stanza, policyName, host.Name(), attempts)
+	if len(arm) != 0 {
+		_, _ = fmt.Fprintf(&sb, " arm=%v", arm)
+	}
+
+	opt := reply.IsEdns0()
+	if opt == nil {
+		opt = reply.SetEdns0(dns.MinMsgSize, false).IsEdns0()
+	}
+	// An upstream dnsredir may explain itself with the same option
+	opt.Option = withoutOption(opt.Option, code)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: code, Data: []byte(sb.String())})
+}
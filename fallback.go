@@ -0,0 +1,147 @@
+package dnsredir
+
+import (
+	"context"
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"time"
+)
+
+// Ordered transport fallback chain of an upstream host
+// The host steps down to the next transport once the current one consistently failed(e.g. DoT blocked on current network),
+//	and periodically attempts to re-upgrade to the preferred transport.
+type transportFallback struct {
+	sync.Mutex
+	hosts     []*UpstreamHost // Fallback transports of the same host, the preferred one excluded
+	level     int             // Index of the current transport, zero for the preferred one
+	fails     int             // Consecutive failures of the current transport
+	upgradeAt time.Time       // Next re-upgrade attempt
+}
+
+var fallbackTransports = []string{"tls", "tcp", "udp"}
+
+func (u *reloadableUpstream) initFallback(c *caddy.Controller, host *UpstreamHost, tlsServerName string) error {
+	ip, _, err := net.SplitHostPort(host.addr)
+	if err != nil {
+		return c.Errf("transport fallback isn't supported for %v", host.Name())
+	}
+	if len(host.iface) != 0 {
+		ip += "%" + host.iface
+	}
+
+	opts := host.opts
+	opts.fallback = nil
+	f := &transportFallback{}
+	for _, proto := range host.opts.fallback {
+		port := transport.Port
+		if proto == transport.TLS {
+			port = transport.TLSPort
+		}
+		hopts := opts
+		if proto != transport.TLS {
+			// TLS only options don't apply to plain siblings
+			hopts.pins, hopts.spkiPins = nil, nil
+			hopts.tlsCert, hopts.tlsKey, hopts.tlsCa = "", "", ""
+		}
+		h := &UpstreamHost{
+			proto:    proto,
+			addr:     net.JoinHostPort(ip, port),
+			opts:     hopts,
+			downFunc: host.downFunc,
+		}
+		if proto == transport.TLS {
+			h.addr += tlsServerName
+		}
+		if err := u.initHost(c, h); err != nil {
+			return err
+		}
+		f.hosts = append(f.hosts, h)
+	}
+	host.fallback = f
+	log.Infof("Transport fallback of %v: %v", host.Name(), f)
+	return nil
+}
+
+// Return the transport level to use, an upgrade attempt is made once in a while if stepped down
+func (f *transportFallback) pick() (int, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if f.level != 0 && !clock.Now().Before(f.upgradeAt) {
+		f.upgradeAt = clock.Now().Add(fallbackUpgradeInterval)
+		return 0, true
+	}
+	return f.level, false
+}
+
+func (f *transportFallback) record(uh *UpstreamHost, level int, err error) {
+	f.Lock()
+	defer f.Unlock()
+	if err == nil {
+		if level < f.level {
+			log.Infof("%v re-upgraded to %v", uh.Name(), f.host(uh, level).Name())
+			f.level = level
+		}
+		if level == f.level {
+			f.fails = 0
+		}
+		return
+	}
+	if level != f.level {
+		return
+	}
+	if f.fails++; f.fails >= fallbackFailsBeforeStepDown && f.level < len(f.hosts) {
+		f.level++
+		f.fails = 0
+		f.upgradeAt = clock.Now().Add(fallbackUpgradeInterval)
+		log.Warningf("%v consistently failed, stepped down to %v", f.host(uh, f.level-1).Name(), f.host(uh, f.level).Name())
+	}
+}
+
+func (f *transportFallback) host(uh *UpstreamHost, level int) *UpstreamHost {
+	if level == 0 {
+		return uh
+	}
+	return f.hosts[level-1]
+}
+
+func (f *transportFallback) exchange(uh *UpstreamHost, ctx context.Context, state *request.Request, bootstrap []string, noIPv6 bool) (*dns.Msg, error) {
+	level, upgrade := f.pick()
+	ret, err := f.host(uh, level).exchangeDirect(ctx, state, bootstrap, noIPv6)
+	f.record(uh, level, err)
+	if err != nil && upgrade {
+		// Failed upgrade attempt shouldn't fail the query
+		log.Debugf("Re-upgrade attempt of %v failed: %v", uh.Name(), err)
+		level, _ = f.pick()
+		ret, err = f.host(uh, level).exchangeDirect(ctx, state, bootstrap, noIPv6)
+		f.record(uh, level, err)
+	}
+	return ret, err
+}
+
+// Health check over the current transport, thus a blocked preferred transport won't mark the host down
+func (f *transportFallback) send(uh *UpstreamHost) (error, time.Duration) {
+	f.Lock()
+	level := f.level
+	f.Unlock()
+	err, rtt := f.host(uh, level).sendDirect()
+	f.record(uh, level, err)
+	return err, rtt
+}
+
+func (f *transportFallback) String() string {
+	names := make([]string, 0, len(f.hosts))
+	for _, h := range f.hosts {
+		names = append(names, h.Name())
+	}
+	return fmt.Sprintf("%v", names)
+}
+
+const (
+	fallbackFailsBeforeStepDown = 3
+	fallbackUpgradeInterval     = 5 * time.Minute
+)
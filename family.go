@@ -0,0 +1,85 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+)
+
+// Preference of address family of matched domains, see `prefer_family'
+// Answers of the other family are dropped if the preferred family has any(or always if filtering),
+// thus clients won't take the unreliable path, e.g. Happy Eyeballs still tries IPv6 first if both present.
+type familyPreference struct {
+	qtype  uint16 // Query type of the preferred family, i.e. A or AAAA
+	filter bool   // Always drop answers of the other family
+}
+
+// Parse FAMILY [filter] arguments
+func parseFamilyPreference(args []string) (*familyPreference, error) {
+	p := &familyPreference{}
+	switch args[0] {
+	case "ipv4":
+		p.qtype = dns.TypeA
+	case "ipv6":
+		p.qtype = dns.TypeAAAA
+	default:
+		return nil, fmt.Errorf("unknown address family %q", args[0])
+	}
+	if len(args) == 2 {
+		if args[1] != "filter" {
+			return nil, fmt.Errorf("unknown option %q", args[1])
+		}
+		p.filter = true
+	}
+	return p, nil
+}
+
+func (p *familyPreference) String() string {
+	s := "ipv4"
+	if p.qtype == dns.TypeAAAA {
+		s = "ipv6"
+	}
+	if p.filter {
+		s += " filter"
+	}
+	return s
+}
+
+// Return query type of the other family
+func (p *familyPreference) other() uint16 {
+	if p.qtype == dns.TypeA {
+		return dns.TypeAAAA
+	}
+	return dns.TypeA
+}
+
+// Apply the preference to the reply of the question `qtype'
+// `lookup' resolves the preferred family of the same name, it's only called when not filtering.
+func (p *familyPreference) apply(reply *dns.Msg, qtype uint16, lookup func(qtype uint16) (*dns.Msg, error)) {
+	if qtype != p.other() || reply.Rcode != dns.RcodeSuccess || !hasRRType(reply.Answer, qtype) {
+		return
+	}
+	if !p.filter {
+		m, err := lookup(p.qtype)
+		if err != nil || m.Rcode != dns.RcodeSuccess || !hasRRType(m.Answer, p.qtype) {
+			// Keep the other family if the preferred one is absent(or unknown), otherwise the name is unreachable
+			return
+		}
+	}
+	// Aliases(i.e. CNAME) are kept, the reply becomes NODATA
+	answer := reply.Answer[:0]
+	for _, rr := range reply.Answer {
+		if rr.Header().Rrtype != qtype {
+			answer = append(answer, rr)
+		}
+	}
+	reply.Answer = answer
+}
+
+func hasRRType(rrs []dns.RR, qtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
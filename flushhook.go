@@ -0,0 +1,99 @@
+package dnsredir
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Cache flush hints of names whose routing is changed by name list reloads, see `flush_hook'
+// Thus downstream caches can drop answers of the old upstream instead of serving them for their full TTL.
+type flushHook struct {
+	url    string
+	client *http.Client
+}
+
+// JSON body posted to the hook
+type flushHint struct {
+	Stanza string `json:"stanza"`
+	Source string `json:"source"`
+	// Names(along with their subdomains) newly routed to the stanza, and no longer routed to it respectively
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// True if any of above is truncated to maxFlushHintNames, receivers should flush the whole cache
+	Truncated bool `json:"truncated"`
+}
+
+func newFlushHook(url string) *flushHook {
+	return &flushHook{
+		url:    url,
+		client: &http.Client{Timeout: flushHookTimeout},
+	}
+}
+
+// Post the hint of names changed from `prev' to `next' asynchronously
+// Name sets are replaced rather than modified by reloads, thus they're diffed without the item lock.
+func (h *flushHook) notify(stanza, source string, prev, next domainSet) {
+	go func() {
+		hint := &flushHint{Stanza: stanza, Source: source}
+		hint.Added, hint.Truncated = diffNames(next, prev)
+		var truncated bool
+		hint.Removed, truncated = diffNames(prev, next)
+		hint.Truncated = hint.Truncated || truncated
+		if len(hint.Added) == 0 && len(hint.Removed) == 0 {
+			return
+		}
+		if err := h.post(hint); err != nil {
+			log.Warningf("Failed to post cache flush hint of %v to %v: %v", source, h.url, err)
+			return
+		}
+		log.Debugf("Cache flush hint of %v posted to %v, added: %v removed: %v truncated: %v",
+			source, h.url, len(hint.Added), len(hint.Removed), hint.Truncated)
+	}()
+}
+
+func (h *flushHook) post(hint *flushHint) error {
+	body, err := json.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	Close(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// Return sorted names in `a' but not in `b', and true if truncated to maxFlushHintNames
+func diffNames(a, b domainSet) ([]string, bool) {
+	names := make([]string, 0)
+	truncated := false
+	_ = a.ForEachDomain(func(name string) error {
+		if b.Contains(name) {
+			return nil
+		}
+		if len(names) == maxFlushHintNames {
+			truncated = true
+			return errFlushHintFull
+		}
+		names = append(names, name)
+		return nil
+	})
+	sort.Strings(names)
+	return names, truncated
+}
+
+var errFlushHintFull = errors.New("flush hint is full")
+
+const (
+	flushHookTimeout  = 10 * time.Second
+	maxFlushHintNames = 1000
+)
@@ -0,0 +1,26 @@
+package dnsredir
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Return true if the stanza is frozen, see `POST /freeze' of admin
+// A frozen stanza keeps its current name lists, i.e. reloads and canary promotions are skipped,
+// and runtime modifications through admin are refused, thus its matching state stays known during incident response.
+func (n *NameList) isFrozen() bool {
+	return atomic.LoadInt32(&n.frozen) != 0
+}
+
+func (n *NameList) setFrozen(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&n.frozen, v) != v {
+		StanzaFrozen.WithLabelValues(n.stanza).Set(float64(v))
+		log.Infof("Stanza %q frozen: %v", n.stanza, on)
+	}
+}
+
+var errStanzaFrozen = errors.New("stanza is frozen")
@@ -0,0 +1,147 @@
+package dnsredir
+
+import (
+	"github.com/miekg/dns"
+	"github.com/oschwald/maxminddb-golang"
+	"math"
+	"math/rand"
+	"net"
+)
+
+// MaxMind database(e.g. GeoLite2-City.mmdb) which locates clients and upstream hosts
+type geoipDB struct {
+	path   string
+	reader *maxminddb.Reader
+}
+
+func openGeoipDB(path string) (*geoipDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoipDB{path: path, reader: reader}, nil
+}
+
+func (db *geoipDB) Close() error {
+	return db.reader.Close()
+}
+
+// Fields of GeoIP2/GeoLite2 Country and City records in use, country databases have no location
+type geoipRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+type geoLocation struct {
+	country   string
+	hasCoords bool
+	lat, lon  float64
+}
+
+// Return location of the IP, false if unknown
+func (db *geoipDB) locate(ip net.IP) (geoLocation, bool) {
+	var rec geoipRecord
+	if ip == nil || db.reader.Lookup(ip, &rec) != nil {
+		return geoLocation{}, false
+	}
+	loc := geoLocation{country: rec.Country.IsoCode}
+	if rec.Location.Latitude != nil && rec.Location.Longitude != nil {
+		loc.hasCoords = true
+		loc.lat, loc.lon = *rec.Location.Latitude, *rec.Location.Longitude
+	}
+	return loc, loc.hasCoords || len(loc.country) != 0
+}
+
+// Return distance in kilometers between two locations
+// Locations without coordinates are either zero(the same country) or farthest apart.
+func (l geoLocation) distance(other geoLocation) float64 {
+	if l.hasCoords && other.hasCoords {
+		// Haversine formula
+		const earthRadius = 6371
+		rad := math.Pi / 180
+		dLat := (other.lat - l.lat) * rad
+		dLon := (other.lon - l.lon) * rad
+		a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+			math.Cos(l.lat*rad)*math.Cos(other.lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+		return 2 * earthRadius * math.Asin(math.Sqrt(a))
+	}
+	if len(l.country) != 0 && l.country == other.country {
+		return 0
+	}
+	return math.MaxFloat64
+}
+
+// GeoIP is a policy that selects up hosts geographically closest to the client
+// Clients and hosts are located by a MaxMind database, client subnet(ECS) of the query is preferred to client IP.
+// Falls back to random selection if the client can't be located, hosts can't be located are least preferred.
+type GeoIP struct {
+	db *geoipDB // Set by `geoip_db'
+}
+
+func (g *GeoIP) String() string { return "geoip" }
+
+// Select selects a host at random, since the client is unknown
+func (g *GeoIP) Select(pool UpstreamHostPool) *UpstreamHost {
+	return (&Random{}).Select(pool)
+}
+
+// SelectClient selects the up host closest to the client, nil if all hosts are down
+func (g *GeoIP) SelectClient(pool UpstreamHostPool, client net.IP) *UpstreamHost {
+	loc, ok := g.db.locate(client)
+	if !ok {
+		return g.Select(pool)
+	}
+
+	var closest UpstreamHostPool
+	min := math.Inf(1)
+	for _, host := range pool {
+		if host.Down() {
+			continue
+		}
+		d := math.MaxFloat64
+		if hostLoc, ok := g.db.locate(host.ip()); ok {
+			d = loc.distance(hostLoc)
+		}
+		if d < min {
+			min, closest = d, closest[:0]
+		}
+		if d == min {
+			closest = append(closest, host)
+		}
+	}
+	if len(closest) == 0 {
+		return nil
+	}
+	return closest[rand.Intn(len(closest))]
+}
+
+// Policies which select hosts depending on the client
+type clientPolicy interface {
+	SelectClient(pool UpstreamHostPool, client net.IP) *UpstreamHost
+}
+
+// Return IP address of the host, the resolved one if the host is a domain name, nil if unknown
+func (uh *UpstreamHost) ip() net.IP {
+	host, _, err := net.SplitHostPort(uh.dialAddr())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// Return the client IP address for client policies, i.e. address of the client subnet(if any) or the source address
+func clientIP(req *dns.Msg, remote string) net.IP {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok && subnet.SourceNetmask != 0 {
+				return subnet.Address
+			}
+		}
+	}
+	return net.ParseIP(remote)
+}
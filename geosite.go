@@ -0,0 +1,138 @@
+package dnsredir
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// v2ray/xray geosite.dat is a protobuf encoded GeoSiteList:
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+// see: https://github.com/v2fly/v2ray-core/blob/master/app/router/config.proto
+const (
+	geositeTypePlain  = 0 // Keyword
+	geositeTypeRegex  = 1
+	geositeTypeDomain = 2 // The domain and its subdomains
+	geositeTypeFull   = 3 // The exact domain
+)
+
+const geositeCategoryQuery = "?category="
+
+var errGeositeCorrupted = errors.New("corrupted geosite.dat")
+
+// Split the category selector of a `geosite:' form, e.g. `/path/geosite.dat?category=geolocation-cn'
+func splitGeositeCategory(from string) (string, string, error) {
+	i := strings.LastIndex(from, geositeCategoryQuery)
+	if i < 0 || i+len(geositeCategoryQuery) == len(from) {
+		return "", "", fmt.Errorf("geosite %q: expected a category selector, e.g. /path/geosite.dat?category=cn", from)
+	}
+	path := from[:i]
+	if strings.Index(path, "://") > 0 {
+		return "", "", fmt.Errorf("geosite %q: only paths are supported", from)
+	}
+	return path, from[i+len(geositeCategoryQuery):], nil
+}
+
+// Parse domains of the category(case insensitive) in geosite.dat, return number of domains in the category
+// Both domain and full rules are added to `names', i.e. a full rule also matches subdomains,
+// since name lists always match subdomains. Keyword and regex rules aren't applicable thus ignored.
+func parseGeosite(names domainSet, data []byte, category string) (uint64, error) {
+	var count uint64
+	found := false
+	err := protoFields(data, func(num int, _ uint64, site []byte) error {
+		if num != 1 || site == nil {
+			return nil
+		}
+		var code string
+		var domains [][]byte
+		err := protoFields(site, func(num int, _ uint64, b []byte) error {
+			switch num {
+			case 1:
+				code = string(b)
+			case 2:
+				domains = append(domains, b)
+			}
+			return nil
+		})
+		if err != nil || !strings.EqualFold(code, category) {
+			return err
+		}
+
+		found = true
+		for _, domain := range domains {
+			typ, value := uint64(geositeTypePlain), ""
+			err := protoFields(domain, func(num int, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					typ = v
+				case 2:
+					value = string(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			count++
+			if typ != geositeTypeDomain && typ != geositeTypeFull {
+				continue
+			}
+			if _, ok := names.add(value); !ok {
+				log.Debugf("%q isn't a domain name", value)
+			}
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("category %q not found", category)
+	}
+	return count, err
+}
+
+// Iterate fields of a protobuf message, `v' is the value of varint fields, `b' is the data of length-delimited fields
+// Fields of other wire types are skipped.
+func protoFields(msg []byte, f func(num int, v uint64, b []byte) error) error {
+	for len(msg) != 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errGeositeCorrupted
+		}
+		msg = msg[n:]
+
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return errGeositeCorrupted
+			}
+			msg = msg[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return errGeositeCorrupted
+			}
+			msg = msg[size:]
+			continue
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return errGeositeCorrupted
+			}
+			b = msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+		default:
+			return errGeositeCorrupted
+		}
+		if err := f(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
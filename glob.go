@@ -0,0 +1,131 @@
+package dnsredir
+
+import (
+	"errors"
+	"github.com/leiless/dnsredir/compiled"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Return true if the path in FROM... is a glob pattern, e.g. /etc/coredns/redirect.d/*.list
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// Stat of a file matched by a glob item, used to tell whether the matched files changed
+type globFileStat struct {
+	mtime time.Time
+	size  int64
+}
+
+// Return regular files matched by the glob pattern in lexical order
+// Hidden files(e.g. editor swap files) and detached signatures are skipped.
+func (n *NameList) globFiles(pattern string) (map[string]globFileStat, []string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	stats := make(map[string]globFileStat, len(matches))
+	paths := make([]string, 0, len(matches))
+	for _, path := range matches {
+		base := filepath.Base(path)
+		if strings.HasPrefix(base, ".") || (n.signer != nil && strings.HasSuffix(base, n.signer.suffix())) {
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil || !st.Mode().IsRegular() {
+			continue
+		}
+		stats[path] = globFileStat{mtime: st.ModTime(), size: st.Size()}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return stats, paths, nil
+}
+
+// Load all files matched by the glob item into a single name set
+// Files are reloaded as a whole once any of them changed, added or removed, a file failed to load keeps the old names.
+func (n *NameList) updateItemFromGlob(item *NameItem) {
+	stats, paths, err := n.globFiles(item.glob)
+	if err != nil {
+		log.Warningf("Failed to match %v, err: %v", item.glob, err)
+		return
+	}
+	item.RLock()
+	unchanged := len(stats) == len(item.files)
+	if unchanged {
+		for path, st := range stats {
+			if old, ok := item.files[path]; !ok || old != st {
+				unchanged = false
+				break
+			}
+		}
+	}
+	item.RUnlock()
+	if unchanged {
+		return
+	}
+
+	t1 := time.Now()
+	names := make(domainSet)
+	tags := make(map[string][]string)
+	excepts := make(domainSet)
+	var totalLines uint64
+	for _, path := range paths {
+		count, err := n.parseFileInto(names, tags, excepts, path, item)
+		totalLines += count
+		if err != nil {
+			log.Warningf("Failed to load %v of %v, old list is kept, err: %v", path, item.glob, err)
+			item.Lock()
+			item.files = stats
+			item.Unlock()
+			return
+		}
+	}
+	log.Debugf("Parsed %v files of %v  time spent: %v name added: %v / %v",
+		len(paths), item.glob, time.Since(t1), names.Len(), totalLines)
+
+	item.Lock()
+	n.swapNames(item, names, tags, excepts)
+	item.files = stats
+	item.Unlock()
+}
+
+// Parse a file matched by a glob item into existing sets
+func (n *NameList) parseFileInto(names domainSet, tags map[string][]string, excepts domainSet, path string, item *NameItem) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer Close(file)
+
+	magic := make([]byte, len(compiled.Magic))
+	if _, err := file.ReadAt(magic, 0); err == nil && compiled.IsCompiled(magic) {
+		return 0, errCompiledGlob
+	}
+	v, err := n.fileVerifier(path)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := newDecompressReader(ioutil.NopCloser(file), compressionOf(path))
+	if err != nil {
+		return 0, err
+	}
+	defer Close(rc)
+	var r io.Reader = rc
+	if v != nil {
+		r = io.TeeReader(r, v)
+	}
+	totalLines, err := n.parseInto(names, tags, excepts, r, item)
+	if err == nil && v != nil {
+		err = n.verifyContent(v, r)
+	}
+	return totalLines, err
+}
+
+var errCompiledGlob = errors.New("compiled name lists cannot be matched by glob patterns")
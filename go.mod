@@ -3,13 +3,25 @@ module github.com/leiless/dnsredir
 go 1.13
 
 require (
+	cloud.google.com/go/storage v1.36.0
+	github.com/aws/aws-sdk-go-v2 v1.24.1
+	github.com/aws/aws-sdk-go-v2/config v1.26.6
+	github.com/aws/aws-sdk-go-v2/service/s3 v1.48.1
 	github.com/coredns/caddy v1.1.1
 	github.com/coredns/coredns v1.11.2
 	github.com/digineo/go-ipset/v2 v2.2.1
+	github.com/fsnotify/fsnotify v1.6.0
+	github.com/klauspost/compress v1.17.1
 	github.com/m13253/dns-over-https/v2 v2.3.0
 	github.com/mdlayher/netlink v1.4.1
 	github.com/miekg/dns v1.1.58
+	github.com/oschwald/maxminddb-golang v1.11.0
 	github.com/prometheus/client_golang v1.17.0
+	github.com/prometheus/client_model v0.5.0
+	github.com/prometheus/common v0.45.0
 	github.com/ti-mo/netfilter v0.4.0 // indirect
+	golang.org/x/crypto v0.21.0
 	golang.org/x/net v0.23.0
+	google.golang.org/grpc v1.61.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,43 @@
+package dnsredir
+
+import (
+	"github.com/coredns/caddy"
+)
+
+// Key of upstream groups in Caddy instance storage
+// Groups are kept per instance, so they're rebuilt on every Corefile reload.
+const upstreamGroupsKey = "dnsredir:upstream_groups"
+
+// Return upstream groups defined so far, keyed by group name
+// An upstream group shares hosts, transport(i.e. connection pools) and health check state
+//	across dnsredir stanzas, even in different server blocks.
+func upstreamGroups(c *caddy.Controller) map[string]*HealthCheck {
+	groups, _ := c.Get(upstreamGroupsKey).(map[string]*HealthCheck)
+	if groups == nil {
+		groups = make(map[string]*HealthCheck)
+		c.Set(upstreamGroupsKey, groups)
+	}
+	return groups
+}
+
+func registerUpstreamGroup(c *caddy.Controller, name string, hc *HealthCheck) error {
+	groups := upstreamGroups(c)
+	if _, ok := groups[name]; ok {
+		return c.Errf("upstream group %q already defined", name)
+	}
+	groups[name] = hc
+	log.Infof("Upstream group %q defined, hosts: %v", name, hc.hosts)
+	return nil
+}
+
+func isGroupName(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
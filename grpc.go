@@ -0,0 +1,85 @@
+package dnsredir
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/coredns/coredns/pb"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"time"
+)
+
+// Client of an upstream speaking the CoreDNS gRPC DNS protocol
+// see: https://coredns.io/plugins/grpc
+type grpcClient struct {
+	conn   *grpc.ClientConn
+	client pb.DnsServiceClient
+}
+
+// Plaintext is used if tlsConfig is nil
+// The connection is established lazily, and it's reconnected by grpc itself.
+func (uh *UpstreamHost) initGrpc(tlsConfig *tls.Config, bootstrap []string, noIPv6 bool) error {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		timeout := maxDialTimeout
+		if d, ok := ctx.Deadline(); ok {
+			timeout = time.Until(d)
+		}
+		conn, err := dialTimeout(ctx, "tcp", uh.dialAddr(), uh.iface, timeout, bootstrap, noIPv6)
+		if err != nil {
+			return nil, err
+		}
+		return conn.Conn, nil
+	}
+
+	conn, err := grpc.Dial(uh.addr, grpc.WithTransportCredentials(creds), grpc.WithContextDialer(dialer))
+	if err != nil {
+		return err
+	}
+	uh.grpc = &grpcClient{
+		conn:   conn,
+		client: pb.NewDnsServiceClient(conn),
+	}
+	return nil
+}
+
+func (uh *UpstreamHost) grpcExchange(ctx context.Context, state *request.Request) (*dns.Msg, error) {
+	packet, err := state.Req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	deadline, err := ioDeadline(ctx, uh.transport.writeTimeout+uh.transport.readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	reply, err := uh.grpc.client.Query(ctx, &pb.DnsPacket{Msg: packet})
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(reply.Msg); err != nil {
+		return nil, err
+	}
+	if ret.Id != state.Req.Id {
+		return nil, fmt.Errorf("gRPC response id mismatch, expected %v, got %v", state.Req.Id, ret.Id)
+	}
+	return ret, nil
+}
+
+func (uh *UpstreamHost) grpcSend() (error, time.Duration) {
+	req := uh.probeMsg()
+	t := time.Now()
+	_, err := uh.grpcExchange(context.Background(), &request.Request{Req: req})
+	return err, time.Since(t)
+}
@@ -0,0 +1,85 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// A CoreDNS gRPC DNS server answering A queries with 127.0.0.1
+type testGrpcServer struct {
+	pb.UnimplementedDnsServiceServer
+	queries int32
+}
+
+func (s *testGrpcServer) Query(_ context.Context, in *pb.DnsPacket) (*pb.DnsPacket, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(in.Msg); err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&s.queries, 1)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	if req.Question[0].Qtype == dns.TypeA {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DnsPacket{Msg: packed}, nil
+}
+
+func TestGrpcExchange(t *testing.T) {
+	ln, err := net.Listen(tcpProto, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl := &testGrpcServer{}
+	server := grpc.NewServer()
+	pb.RegisterDnsServiceServer(server, impl)
+	go func() { _ = server.Serve(ln) }()
+	defer server.Stop()
+
+	// Plaintext since neither tls nor TLS server name specified
+	host, stopHost := newTestHost(t, "dnsredir . {\n to grpc://"+ln.Addr().String()+"\n}")
+	defer stopHost()
+	if host.grpc == nil {
+		t.Fatalf("Expected gRPC client of %v", host.Name())
+	}
+
+	names := []string{"example.com.", "example.org.", "example.net."}
+	for i, name := range names {
+		reply, err := host.Exchange(context.Background(), newTestState(name), nil, false)
+		if err != nil {
+			t.Fatalf("Test#%v: Exchange() failed, error: %v", i, err)
+		}
+		if len(reply.Answer) != 1 || reply.Answer[0].Header().Name != name {
+			t.Fatalf("Test#%v: expected A record of %q, got %v", i, name, reply)
+		}
+		if n := atomic.LoadInt32(&impl.queries); n != int32(i+1) {
+			t.Fatalf("Test#%v: expected %v queries over gRPC, got %v", i, i+1, n)
+		}
+	}
+
+	// Health check goes over gRPC as well
+	if err, _ := host.grpcSend(); err != nil {
+		t.Fatalf("grpcSend() failed, error: %v", err)
+	}
+	if n := atomic.LoadInt32(&impl.queries); n != int32(len(names)+1) {
+		t.Fatalf("Expected health check query over gRPC, got %v queries", n)
+	}
+
+	// Unreachable once the server stopped
+	server.Stop()
+	if _, err := host.Exchange(context.Background(), newTestState("example.com."), nil, false); err == nil {
+		t.Fatalf("Expected error once the gRPC server stopped")
+	}
+}
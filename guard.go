@@ -0,0 +1,44 @@
+package dnsredir
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Query name guards of a `.' stanza, rejected names are refused locally instead of forwarded
+// Thus obviously junk names won't waste queries of paid or rate-limited upstreams.
+type qnameGuard struct {
+	deny  []*regexp.Regexp
+	allow []*regexp.Regexp
+}
+
+func compileRegexps(args []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(args))
+	for _, arg := range args {
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", arg, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Return true if the name should be refused
+// `name' is lower cased and without trailing dot
+func (g *qnameGuard) rejects(name string) bool {
+	for _, re := range g.deny {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	if len(g.allow) == 0 {
+		return false
+	}
+	for _, re := range g.allow {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	return true
+}
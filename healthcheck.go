@@ -22,8 +22,9 @@ import (
 // A persistConn hold the dns.Conn and the last used time(time.Time struct)
 // Taken from github.com/coredns/plugin/forward/persistent.go
 type persistConn struct {
-	c    *dns.Conn
-	used time.Time
+	c          *dns.Conn
+	used       time.Time
+	downstream downstreamType // Pool of the downstream protocol which the connection belongs to
 }
 
 func (pc *persistConn) String() string {
@@ -34,49 +35,73 @@ func (pc *persistConn) String() string {
 // Inspired from coredns/plugin/forward/persistent.go
 // addr isn't sealed into this struct since it's a high-level item
 type Transport struct {
-	avgDialTime int64 // Cumulative moving average dial time in ns(i.e. time.Duration)
+	avgDialTime      [downstreamTotalCount]int64 // Cumulative moving average dial time in ns(i.e. time.Duration) per downstream protocol
+	avgHandshakeTime [downstreamTotalCount]int64 // Ditto, but TLS handshake time, which excluded from dial time
 
 	recursionDesired bool          // RD flag
 	expire           time.Duration // [sic] After this duration a connection is expired
+	tcpFallback      time.Duration // Duration to pin to TCP once UDP consistently failed, zero to disable
+	readTimeout      time.Duration // Read timeout of a single exchange
+	writeTimeout     time.Duration // Write timeout of a single exchange
 	tlsConfig        *tls.Config
-
-	conns [typeTotalCount][]*persistConn // Buckets for udp, tcp and tcp-tls
-	dial  chan string
-	yield chan *persistConn
-	ret   chan *persistConn
-	stop  chan struct{}
+	tlsExplicit      bool        // Set if `tls' or `tls_servername' directive present
+	cookies          *dnsCookies // DNS Cookies of UDP exchanges, nil if disabled
+	maxPooled        int         // Maximum pooled connections of each bucket, zero if unlimited
+
+	conns  [downstreamTotalCount][typeTotalCount][]*persistConn // Buckets for udp, tcp and tcp-tls per downstream protocol
+	pooled [typeTotalCount]int32                                // Number of pooled connections of each bucket, for resource reporting
+	dial   chan connKey
+	yield  chan *persistConn
+	ret    chan *persistConn
+	stop   chan struct{}
 }
 
 func newTransport() *Transport {
 	return &Transport{
-		avgDialTime: int64(minDialTimeout),
-		expire:      defaultConnExpire,
-		conns:       [typeTotalCount][]*persistConn{},
-		dial:        make(chan string),
-		yield:       make(chan *persistConn),
-		ret:         make(chan *persistConn),
-		stop:        make(chan struct{}),
+		avgDialTime: [downstreamTotalCount]int64{
+			int64(minDialTimeout), int64(minDialTimeout), int64(minDialTimeout),
+		},
+		avgHandshakeTime: [downstreamTotalCount]int64{
+			int64(minDialTimeout), int64(minDialTimeout), int64(minDialTimeout),
+		},
+		expire:       defaultConnExpire,
+		readTimeout:  defaultReadTimeout,
+		writeTimeout: defaultWriteTimeout,
+		conns:        [downstreamTotalCount][typeTotalCount][]*persistConn{},
+		dial:         make(chan connKey),
+		yield:        make(chan *persistConn),
+		ret:          make(chan *persistConn),
+		stop:         make(chan struct{}),
 	}
 }
 
 func (t *Transport) connManager() {
-	ticker := time.NewTicker(t.expire)
+	ticker := clock.NewTicker(t.expire)
 
 	for {
+		for i := range t.pooled {
+			n := 0
+			for _, conns := range t.conns {
+				n += len(conns[i])
+			}
+			atomic.StoreInt32(&t.pooled[i], int32(n))
+		}
+
 		select {
-		case proto := <-t.dial:
-			transType := stringToTransportType(proto)
+		case key := <-t.dial:
+			transType := stringToTransportType(key.proto)
+			conns := &t.conns[key.downstream]
 			// Take the last used conn - complexity O(1)
-			if stack := t.conns[transType]; len(stack) > 0 {
+			if stack := conns[transType]; len(stack) > 0 {
 				pc := stack[len(stack)-1]
-				if time.Since(pc.used) < t.expire {
+				if since(pc.used) < t.expire {
 					// Found one, remove from pool and return this conn.
-					t.conns[transType] = stack[:len(stack)-1]
+					conns[transType] = stack[:len(stack)-1]
 					t.ret <- pc
 					continue
 				}
 				// clear entire cache if the last conn is expired
-				t.conns[transType] = nil
+				conns[transType] = nil
 				// now, the connections being passed to closeConns() are not reachable from
 				// transport methods anymore. So, it's safe to close them in a separate goroutine
 				go closeConns(stack)
@@ -85,9 +110,14 @@ func (t *Transport) connManager() {
 
 		case pc := <-t.yield:
 			transType := t.transportTypeFromConn(pc)
-			t.conns[transType] = append(t.conns[transType], pc)
+			conns := &t.conns[pc.downstream]
+			if t.maxPooled != 0 && len(conns[transType]) >= t.maxPooled {
+				go closeConns([]*persistConn{pc})
+				continue
+			}
+			conns[transType] = append(conns[transType], pc)
 
-		case <-ticker.C:
+		case <-ticker.Chan():
 			t.cleanup(false)
 
 		case <-t.stop:
@@ -106,14 +136,20 @@ func closeConns(conns []*persistConn) {
 
 // cleanup removes connections from cache.
 func (t *Transport) cleanup(all bool) {
-	staleTime := time.Now().Add(-t.expire)
+	for i := range t.conns {
+		t.cleanup0(&t.conns[i], all)
+	}
+}
 
-	for transType, stack := range t.conns {
+func (t *Transport) cleanup0(conns *[typeTotalCount][]*persistConn, all bool) {
+	staleTime := clock.Now().Add(-t.expire)
+
+	for transType, stack := range conns {
 		if len(stack) == 0 {
 			continue
 		}
 		if all {
-			t.conns[transType] = nil
+			conns[transType] = nil
 			// now, the connections being passed to closeConns() are not reachable from
 			// transport methods anymore. So, it's safe to close them in a separate goroutine
 			go closeConns(stack)
@@ -128,7 +164,7 @@ func (t *Transport) cleanup(all bool) {
 		firstGood := sort.Search(len(stack), func(i int) bool {
 			return stack[i].used.After(staleTime)
 		})
-		t.conns[transType] = stack[firstGood:]
+		conns[transType] = stack[firstGood:]
 		log.Debugf("Going to cleanup expired connection(s): %v count: %v", stack[0].c.RemoteAddr(), firstGood)
 		// now, the connections being passed to closeConns() are not reachable from
 		// transport methods anymore. So, it's safe to close them in a separate goroutine
@@ -141,7 +177,7 @@ const yieldTimeout = 25 * time.Millisecond
 
 // Yield return the connection to transport for reuse.
 func (t *Transport) Yield(pc *persistConn) {
-	pc.used = time.Now() // update used time
+	pc.used = clock.Now() // update used time
 
 	// Make this non-blocking, because in the case of a very busy forwarder we will *block* on this yield. This
 	// blocks the outer go-routine and stuff will just pile up.  We timeout when the send fails to as returning
@@ -169,9 +205,50 @@ type UpstreamHost struct {
 	proto string // DNS protocol, i.e. "udp", "tcp", etc.
 	addr  string // IP:PORT
 
+	opts hostOptions // Per-host options override global ones, see parseHostOption()
+
 	fails    int32                // Fail count
 	downFunc UpstreamHostDownFunc // This function should be side-effect safe
 
+	maintenance int32 // Non-zero if under planned maintenance, see maintenance.go
+
+	certExpiry  int64         // Unix time in ns when the DoT certificate chain expires, see certexpiry.go
+	certWarning time.Duration // Warn if the certificate chain expires within, zero if disabled
+	certWarned  int64         // Unix time in ns of the last expiry warning
+
+	lastAnswered int64 // Unix time in ns of last successful exchange, used by Spray
+	lastFailed   int64 // Unix time in ns of last failed exchange, used by Spray
+	avgRtt       int64 // Cumulative moving average exchange RTT in ns, zero if unknown, used by Latency
+
+	udpFails    int32  // Consecutive UDP exchange failures
+	tcpPinUntil int64  // Unix time in ns until which UDP queries are sent over TCP
+	udpSize     int32  // Probed UDP payload size, zero if unknown
+	ipv6Only    bool   // Resolve and dial the host over IPv6 only, see nat64.go
+	iface       string // Outgoing network interface(SO_BINDTODEVICE), empty if unspecified
+
+	warm *warmSample  // Real questions used for health check, nil to use `. IN NS'
+	caps atomic.Value // Probed *hostCapabilities, see capability.go
+
+	redact *qnameRedactor // Query names redaction in log output, nil if disabled
+	ecs    *ecsPolicy     // EDNS Client Subnet policy, nil to keep the client one
+
+	padding     int   // Block size of EDNS0 padding of encrypted queries, zero if disabled
+	inflight    int32 // Number of in-flight queries
+	maxInflight int32 // Maximum in-flight queries, zero if unlimited
+
+	usage monthlyUsage // Queries sent in the current month, see quota.go
+
+	dnscrypt *dnscryptServer // DNSCrypt resolver, nil if not a DNSCrypt host
+	grpc     *grpcClient     // gRPC client, nil if not a gRPC host
+
+	fallback *transportFallback // Transport fallback chain, nil if disabled
+	connHook *connHook          // Notified of connections established and closed, nil if disabled
+
+	resolves     bool          // Host is specified by domain name, see resolve.go
+	resolver     *net.Resolver // Bootstrap resolver, nil to use system default resolvers
+	resolvedAddr atomic.Value  // Resolved IP:PORT string
+	noIPv6       bool          // Resolve IPv4 addresses only
+
 	c *dns.Client // DNS client used for health check
 
 	// Transport settings related to this upstream host
@@ -187,6 +264,11 @@ func (uh *UpstreamHost) Name() string {
 	return uh.proto + "://" + uh.addr
 }
 
+// Return URL of the DoH host, IPv6 zone(if any) is percent-encoded
+func (uh *UpstreamHost) dohURL() string {
+	return uh.proto + "://" + zoneEscaped(uh.addr)
+}
+
 func (uh *UpstreamHost) IsDOH() bool {
 	return uh.proto == "https"
 }
@@ -226,6 +308,18 @@ func (uh *UpstreamHost) InitDOH(u *reloadableUpstream) {
 		TLSHandshakeTimeout:   8 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
+	if u.lite {
+		httpTransport.MaxIdleConns = litePooledConns
+		httpTransport.MaxIdleConnsPerHost = litePooledConns
+	}
+	verify := uh.opts.verifyPeer()
+	if tc := u.transport.tlsConfig; verify != nil || tc.MinVersion != 0 || tc.CipherSuites != nil {
+		httpTransport.TLSClientConfig = &tls.Config{
+			MinVersion:            tc.MinVersion,
+			CipherSuites:          tc.CipherSuites,
+			VerifyPeerCertificate: verify,
+		}
+	}
 	if u.noIPv6 {
 		httpTransport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 			if strings.HasPrefix(network, "tcp") {
@@ -274,95 +368,181 @@ func limitDialTimeout(currentAvg *int64, minValue, maxValue time.Duration) time.
 	return maxValue
 }
 
-func (t *Transport) dialTimeout() time.Duration {
-	return limitDialTimeout(&t.avgDialTime, minDialTimeout, maxDialTimeout)
+func (t *Transport) dialTimeout(downstream downstreamType) time.Duration {
+	return limitDialTimeout(&t.avgDialTime[downstream], minDialTimeout, maxDialTimeout)
 }
 
-func (t *Transport) updateDialTimeout(newDialTime time.Duration) {
-	oldDialTime := time.Duration(atomic.LoadInt64(&t.avgDialTime))
+func (t *Transport) updateDialTimeout(downstream downstreamType, newDialTime time.Duration) {
+	oldDialTime := time.Duration(atomic.LoadInt64(&t.avgDialTime[downstream]))
 	dt := int64(newDialTime - oldDialTime)
-	atomic.AddInt64(&t.avgDialTime, dt/cumulativeAvgWeight)
+	atomic.AddInt64(&t.avgDialTime[downstream], dt/cumulativeAvgWeight)
 }
 
-func dialTimeout0(network, address string, tlsConfig *tls.Config, timeout time.Duration, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
-	var resolver *net.Resolver
+func (t *Transport) handshakeTimeout(downstream downstreamType) time.Duration {
+	return limitDialTimeout(&t.avgHandshakeTime[downstream], minDialTimeout, maxDialTimeout)
+}
 
-	if len(bootstrap) != 0 {
-		resolver = &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				if noIPv6 {
-					if strings.HasPrefix(network, "tcp") {
-						network = "tcp4"
-					}
-					if strings.HasPrefix(network, "udp") {
-						network = "udp4"
-					}
-				}
-				var d net.Dialer
-				// Randomly choose a bootstrap DNS to resolve upstream host
-				addr := bootstrap[rand.Intn(len(bootstrap))]
-				return d.DialContext(ctx, network, addr)
-			},
-		}
-	} else {
-		// Fallback to use system default resolvers, which located at /etc/resolv.conf
-	}
+// Return the previous average handshake time
+func (t *Transport) updateHandshakeTime(downstream downstreamType, newHandshakeTime time.Duration) time.Duration {
+	oldHandshakeTime := time.Duration(atomic.LoadInt64(&t.avgHandshakeTime[downstream]))
+	dt := int64(newHandshakeTime - oldHandshakeTime)
+	atomic.AddInt64(&t.avgHandshakeTime[downstream], dt/cumulativeAvgWeight)
+	return oldHandshakeTime
+}
 
+func dialTimeout0(ctx context.Context, network, address, iface string, tlsConfig *tls.Config, timeout time.Duration, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
 	dialer := &net.Dialer{
 		Timeout:  timeout,
-		Resolver: resolver,
+		Resolver: bootstrapResolver(bootstrap, noIPv6),
 	}
-	client := dns.Client{Net: network, Dialer: dialer, TLSConfig: tlsConfig}
-	return client.Dial(address)
-}
-
-// [sic] DialTimeoutWithTLS acts like DialWithTLS but takes a timeout.
-// Taken from dns.DialTimeoutWithTLS() with modification
-func dialTimeoutWithTLS(network, address string, tlsConfig *tls.Config, timeout time.Duration, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
-	if !strings.HasSuffix(network, "-tls") {
-		network += "-tls"
+	if len(iface) != 0 {
+		dialer.Control = bindToDeviceControl(iface)
 	}
-	return dialTimeout0(network, address, tlsConfig, timeout, bootstrap, noIPv6)
+	client := dns.Client{Net: network, Dialer: dialer, TLSConfig: tlsConfig}
+	return client.DialContext(ctx, address)
 }
 
 // [sic] DialTimeout acts like Dial but takes a timeout.
 // Taken from dns.DialTimeout() with modification
-func dialTimeout(network, address string, timeout time.Duration, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
-	return dialTimeout0(network, address, nil, timeout, bootstrap, noIPv6)
+// The dial is aborted once `ctx' is done, e.g. the client query is abandoned.
+func dialTimeout(ctx context.Context, network, address, iface string, timeout time.Duration, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
+	return dialTimeout0(ctx, network, address, iface, nil, timeout, bootstrap, noIPv6)
 }
 
 // Return:
 //	#0	Persistent connection
 //	#1	true if it's a cached connection
 //	#2	error(if any)
-func (uh *UpstreamHost) Dial(proto string, bootstrap []string, noIPv6 bool) (*persistConn, bool, error) {
-	if uh.proto != "dns" {
-		proto = protoToNetwork(uh.proto)
+// `downstream' is protocol of the downstream listener, connections are pooled per downstream protocol
+// In-progress dial and TLS handshake are aborted once `ctx' is done, which are neither pooled nor counted into dial time averages.
+func (uh *UpstreamHost) Dial(ctx context.Context, proto string, downstream downstreamType, bootstrap []string, noIPv6 bool) (*persistConn, bool, error) {
+	return uh.dial(ctx, proto, downstream, bootstrap, noIPv6, !uh.opts.noReuse)
+}
+
+// Same as Dial(), a fresh connection is always dialed if `reuse' is false
+func (uh *UpstreamHost) dial(ctx context.Context, proto string, downstream downstreamType, bootstrap []string, noIPv6, reuse bool) (*persistConn, bool, error) {
+	if reuse {
+		// Only abandon before the request is taken, since the connection manager always sends a reply
+		select {
+		case uh.transport.dial <- connKey{downstream: downstream, proto: proto}:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		pc := <-uh.transport.ret
+		if pc != nil {
+			return pc, true, nil
+		}
 	}
 
-	uh.transport.dial <- proto
-	pc := <-uh.transport.ret
-	if pc != nil {
-		return pc, true, nil
+	// Network used for dialing, proto is kept for connection pool
+	network := proto
+	if uh.ipv6Only {
+		network = ipv6Network(proto)
 	}
 
-	reqTime := time.Now()
-	timeout := uh.transport.dialTimeout()
 	if proto == "tcp-tls" {
-		conn, err := dialTimeoutWithTLS(proto, uh.addr, uh.transport.tlsConfig, timeout, bootstrap, noIPv6)
-		uh.transport.updateDialTimeout(time.Since(reqTime))
+		conn, err := uh.dialTls(ctx, network, downstream, bootstrap, noIPv6)
 		if err != nil {
 			return nil, false, err
 		}
-		return &persistConn{c: conn}, false, err
+		if uh.connHook != nil {
+			conn.Conn = uh.connHook.wrap(uh, proto, conn.Conn)
+		}
+		return &persistConn{c: conn, downstream: downstream}, false, err
 	}
-	conn, err := dialTimeout(proto, uh.addr, timeout, bootstrap, noIPv6)
-	uh.transport.updateDialTimeout(time.Since(reqTime))
+
+	reqTime := time.Now()
+	timeout := uh.transport.dialTimeout(downstream)
+	conn, err := dialTimeout(ctx, network, uh.dialAddr(), uh.iface, timeout, bootstrap, noIPv6)
+	if ctx.Err() != nil {
+		if err == nil {
+			Close(conn)
+		}
+		return nil, false, ctx.Err()
+	}
+	uh.transport.updateDialTimeout(downstream, time.Since(reqTime))
 	if err != nil {
 		return nil, false, err
 	}
-	return &persistConn{c: conn}, false, err
+	if uh.connHook != nil {
+		conn.Conn = uh.connHook.wrap(uh, proto, conn.Conn)
+	}
+	return &persistConn{c: conn, downstream: downstream}, false, err
+}
+
+// Dial a DoT connection, TLS handshake time is measured and auto-tuned separately from TCP connect time
+// Since handshake degradation is an early warning of upstream overload.
+func (uh *UpstreamHost) dialTls(ctx context.Context, network string, downstream downstreamType, bootstrap []string, noIPv6 bool) (*dns.Conn, error) {
+	t := uh.transport
+	reqTime := time.Now()
+	conn, err := dialTimeout(ctx, strings.TrimSuffix(network, "-tls"), uh.dialAddr(), uh.iface, t.dialTimeout(downstream), bootstrap, noIPv6)
+	if ctx.Err() != nil {
+		if err == nil {
+			Close(conn)
+		}
+		return nil, ctx.Err()
+	}
+	t.updateDialTimeout(downstream, time.Since(reqTime))
+	if err != nil {
+		return nil, err
+	}
+
+	config := t.tlsConfig
+	if len(config.ServerName) == 0 {
+		// Same as tls.DialWithDialer()
+		if host, _, err := net.SplitHostPort(uh.addr); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+	tlsConn := tls.Client(conn.Conn, config)
+	_ = tlsConn.SetDeadline(time.Now().Add(t.handshakeTimeout(downstream)))
+	reqTime = time.Now()
+	unwatch := interruptOnDone(ctx, conn.Conn)
+	err = tlsConn.Handshake()
+	unwatch()
+	rtt := time.Since(reqTime)
+	if ctx.Err() != nil {
+		Close(conn.Conn)
+		return nil, ctx.Err()
+	}
+	avg := t.updateHandshakeTime(downstream, rtt)
+	if err != nil {
+		Close(conn.Conn)
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	uh.recordCertExpiry(tlsConn.ConnectionState().PeerCertificates)
+
+	TlsHandshakeDuration.WithLabelValues(uh.Name()).Observe(float64(rtt.Milliseconds()))
+	if rtt > avg*tlsHandshakeSlowRatio {
+		TlsHandshakeSlowCount.WithLabelValues(uh.Name()).Inc()
+		log.Warningf("TLS handshake with %v took %v, which is %vx slower than average %v, upstream may be overloaded",
+			uh.Name(), rtt, tlsHandshakeSlowRatio, avg)
+	}
+	return &dns.Conn{Conn: tlsConn}, nil
+}
+
+// Interrupt blocking I/O of the connection once `ctx' is done, by setting a deadline in the past
+// The returned function stops watching, after which no more deadline will be set.
+func interruptOnDone(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
 }
 
 func (uh *UpstreamHost) dohExchange(ctx context.Context, state *request.Request) (*dns.Msg, error) {
@@ -416,12 +596,121 @@ func (uh *UpstreamHost) dohExchange(ctx context.Context, state *request.Request)
 	}
 }
 
-func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bootstrap []string, noIPv6 bool) (*dns.Msg, error) {
+func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bootstrap []string, noIPv6 bool) (ret *dns.Msg, err error) {
+	if uh.ecs != nil {
+		req := state.Req
+		state = &request.Request{W: state.W, Req: uh.ecs.apply(req)}
+		defer func() {
+			if ret != nil {
+				uh.ecs.restore(req, ret)
+			}
+		}()
+	}
+	if uh.fallback != nil {
+		return uh.fallback.exchange(uh, ctx, state, bootstrap, noIPv6)
+	}
+	return uh.exchangeDirect(ctx, state, bootstrap, noIPv6)
+}
+
+// Exchange over the transport of this host, regardless of transport fallback
+func (uh *UpstreamHost) exchangeDirect(ctx context.Context, state *request.Request, bootstrap []string, noIPv6 bool) (ret *dns.Msg, err error) {
+	if uh.padding != 0 && (uh.IsDOH() || uh.proto == "tls") {
+		req := state.Req
+		state = &request.Request{W: state.W, Req: padQuery(req, uh.padding)}
+		defer func() {
+			if ret != nil {
+				unpadReply(req, ret)
+			}
+		}()
+	}
 	if uh.IsDOH() {
 		return uh.dohExchange(ctx, state)
 	}
+	if uh.dnscrypt != nil {
+		return uh.dnscryptExchange(ctx, state)
+	}
+	if uh.grpc != nil {
+		return uh.grpcExchange(ctx, state)
+	}
+
+	proto := state.Proto()
+	if uh.proto != "dns" {
+		proto = protoToNetwork(uh.proto)
+	} else if proto == "tcp" && !uh.tcpCapable() {
+		proto = "udp"
+	}
+	if proto != "udp" || uh.transport.tcpFallback == 0 || !uh.tcpCapable() {
+		return uh.exchange(ctx, state, proto, bootstrap, noIPv6)
+	}
 
-	pc, cached, err := uh.Dial(state.Proto(), bootstrap, noIPv6)
+	if uh.tcpPinned() {
+		return uh.exchange(ctx, state, "tcp", bootstrap, noIPv6)
+	}
+	ret, err = uh.exchange(ctx, state, proto, bootstrap, noIPv6)
+	if err == nil {
+		atomic.StoreInt32(&uh.udpFails, 0)
+		return ret, nil
+	}
+	if atomic.AddInt32(&uh.udpFails, 1) < udpFailsBeforeTcpFallback {
+		return nil, err
+	}
+
+	// UDP consistently failed, try TCP and pin the host to it if TCP works
+	ret, err1 := uh.exchange(ctx, state, "tcp", bootstrap, noIPv6)
+	if err1 != nil {
+		log.Debugf("TCP fallback of %v failed: %v", uh.Name(), err1)
+		return nil, err
+	}
+	atomic.StoreInt32(&uh.udpFails, 0)
+	atomic.StoreInt64(&uh.tcpPinUntil, clock.Now().Add(uh.transport.tcpFallback).UnixNano())
+	log.Infof("UDP to %v consistently failed, pinned to TCP for %v", uh.Name(), uh.transport.tcpFallback)
+	return ret, nil
+}
+
+// Return deadline of a single I/O operation, which never exceeds the client deadline(if any) minus a safety margin
+// Thus we never spend longer on an upstream than the client will wait, and still have time to write the reply.
+func ioDeadline(ctx context.Context, timeout time.Duration) (time.Time, error) {
+	now := time.Now()
+	deadline := now.Add(timeout)
+	if d, ok := ctx.Deadline(); ok {
+		d = d.Add(-clientDeadlineMargin)
+		if !d.After(now) {
+			return time.Time{}, context.DeadlineExceeded
+		}
+		if d.Before(deadline) || timeout == 0 {
+			deadline = d
+		}
+	}
+	return deadline, nil
+}
+
+// Return true if the host is pinned to TCP due to consecutive UDP failures
+func (uh *UpstreamHost) tcpPinned() bool {
+	return clock.Now().UnixNano() < atomic.LoadInt64(&uh.tcpPinUntil)
+}
+
+func (uh *UpstreamHost) exchange(ctx context.Context, state *request.Request, proto string, bootstrap []string, noIPv6 bool) (*dns.Msg, error) {
+	ret, err := uh.exchange0(ctx, state, proto, bootstrap, noIPv6, !uh.opts.noReuse)
+	if err == errCachedConnClosed {
+		// [sic] Remote side closed conn, can only happen with TCP.
+		// Retry once with a freshly dialed connection, instead of burning a whole upstream attempt
+		log.Debugf("%v: %v, retry with a fresh connection", err, uh.Name())
+		ret, err = uh.exchange0(ctx, state, proto, bootstrap, noIPv6, false)
+	}
+	if err == nil && ret.Rcode == dns.RcodeBadCookie && uh.transport.cookies != nil {
+		// Server cookie was learned from the BADCOOKIE reply, retry once
+		// see: https://tools.ietf.org/html/rfc7873#section-5.3
+		log.Debugf("BADCOOKIE from %v, retry with the new server cookie", uh.Name())
+		ret, err = uh.exchange0(ctx, state, proto, bootstrap, noIPv6, !uh.opts.noReuse)
+	}
+	return ret, err
+}
+
+func (uh *UpstreamHost) exchange0(ctx context.Context, state *request.Request, proto string, bootstrap []string, noIPv6, reuse bool) (*dns.Msg, error) {
+	if _, err := ioDeadline(ctx, 0); err != nil {
+		return nil, err
+	}
+	pc, cached, err := uh.dial(ctx, proto, requestDownstreamType(state), bootstrap, noIPv6, reuse)
 	if err != nil {
 		return nil, err
 	}
@@ -436,8 +725,39 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 		pc.c.UDPSize = dns.MinMsgSize
 	}
 
-	_ = pc.c.SetWriteDeadline(time.Now().Add(maxWriteTimeout))
-	if err := pc.c.WriteMsg(state.Req); err != nil {
+	req := state.Req
+	// Strip OPT RR for hosts which known to choke on EDNS0
+	if !uh.ednsCapable() && req.IsEdns0() != nil {
+		req = req.Copy()
+		extra := req.Extra[:0]
+		for _, rr := range req.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		req.Extra = extra
+	}
+	// Clamp advertised buffer size to the probed one, in case of fragmented responses being blackholed
+	if size := uh.probedUdpSize(); size != 0 && proto == "udp" {
+		if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > size {
+			req = req.Copy()
+			req.IsEdns0().SetUDPSize(size)
+		}
+	}
+	cookies := uh.transport.cookies
+	if cookies != nil && proto == "udp" && uh.ednsCapable() {
+		req = cookies.attach(req)
+	} else {
+		cookies = nil
+	}
+
+	deadline, err := ioDeadline(ctx, uh.transport.writeTimeout)
+	if err != nil {
+		Close(pc.c)
+		return nil, err
+	}
+	_ = pc.c.SetWriteDeadline(deadline)
+	if err := pc.c.WriteMsg(req); err != nil {
 		Close(pc.c)
 		if err == io.EOF && cached {
 			return nil, errCachedConnClosed
@@ -445,7 +765,12 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 		return nil, err
 	}
 
-	_ = pc.c.SetReadDeadline(time.Now().Add(maxReadTimeout))
+	if deadline, err = ioDeadline(ctx, uh.transport.readTimeout); err != nil {
+		// Response may arrive later, connection can't be reused
+		Close(pc.c)
+		return nil, err
+	}
+	_ = pc.c.SetReadDeadline(deadline)
 	ret, err := pc.c.ReadMsg()
 	if err != nil {
 		Close(pc.c)
@@ -461,40 +786,84 @@ func (uh *UpstreamHost) Exchange(ctx context.Context, state *request.Request, bo
 		// Thus we have some time to retry for another upstream, for example
 		return nil, errors.New(fmt.Sprintf(
 			"met out-of-order response\nid: %v cached: %v name: %q\nresponse:\n%v",
-			state.Req.Id, cached, state.Name(), ret))
+			state.Req.Id, cached, uh.redact.redact(state.Name(), ""), uh.redactMsg(ret)))
+	}
+	if cookies != nil {
+		if err := cookies.learn(state.Req, ret); err != nil {
+			Close(pc.c)
+			return nil, err
+		}
 	}
 
-	uh.transport.Yield(pc)
+	if uh.opts.noReuse {
+		Close(pc.c)
+	} else {
+		uh.transport.Yield(pc)
+	}
 	return ret, nil
 }
 
-// For health check we send to . IN NS +norec message to the upstream.
+// Return the message for log output, which is omitted if query names redaction enabled
+func (uh *UpstreamHost) redactMsg(m *dns.Msg) interface{} {
+	if uh.redact != nil {
+		return "<redacted>"
+	}
+	return m
+}
+
+// For health check we send to . IN NS +norec message(or a sampled real question if `warm_probe' enabled) to the upstream.
 // Dial timeouts and empty replies are considered fails
 // 	basically anything else constitutes a healthy upstream.
 func (uh *UpstreamHost) Check() error {
+	wasDown := uh.downFunc != nil && uh.downFunc(uh)
 	if err, rtt := uh.send(); err != nil {
 		HealthCheckFailureCount.WithLabelValues(uh.Name()).Inc()
 		atomic.AddInt32(&uh.fails, 1)
 		log.Warningf("hc: DNS %v failed  rtt: %v err: %v", uh.Name(), rtt, err)
+		if !wasDown && uh.downFunc != nil && uh.downFunc(uh) {
+			publish(Event{Type: EventUpstreamDown, Upstream: uh.Name(), Err: err})
+		}
 		return err
 	} else {
 		// Reset failure counter once health check success
 		atomic.StoreInt32(&uh.fails, 0)
+		if wasDown {
+			publish(Event{Type: EventUpstreamUp, Upstream: uh.Name(), Duration: rtt})
+		}
 		return nil
 	}
 }
 
 func (uh *UpstreamHost) send() (error, time.Duration) {
+	if uh.fallback != nil {
+		return uh.fallback.send(uh)
+	}
+	return uh.sendDirect()
+}
+
+func (uh *UpstreamHost) sendDirect() (error, time.Duration) {
 	if uh.IsDOH() {
 		return uh.dohSend()
 	}
+	if uh.dnscrypt != nil {
+		return uh.dnscryptSend()
+	}
+	if uh.grpc != nil {
+		return uh.grpcSend()
+	}
 	return uh.udpWireFormatSend()
 }
 
-func (uh *UpstreamHost) dohSend() (error, time.Duration) {
+func (uh *UpstreamHost) probeMsg() *dns.Msg {
+	q := uh.warm.pick()
 	req := &dns.Msg{}
-	req.SetQuestion(".", dns.TypeNS)
+	req.SetQuestion(q.Name, q.Qtype)
 	req.MsgHdr.RecursionDesired = uh.transport.recursionDesired
+	return req
+}
+
+func (uh *UpstreamHost) dohSend() (error, time.Duration) {
+	req := uh.probeMsg()
 	state := &request.Request{Req: req}
 	t := time.Now()
 	msg, err := uh.dohExchange(context.Background(), state)
@@ -509,12 +878,10 @@ func (uh *UpstreamHost) dohSend() (error, time.Duration) {
 }
 
 func (uh *UpstreamHost) udpWireFormatSend() (error, time.Duration) {
-	req := &dns.Msg{}
-	req.SetQuestion(".", dns.TypeNS)
-	req.MsgHdr.RecursionDesired = uh.transport.recursionDesired
+	req := uh.probeMsg()
 	t := time.Now()
 	// rtt stands for Round Trip Time, it may 0 if Exchange() failed
-	msg, rtt, err := uh.c.Exchange(req, uh.addr)
+	msg, rtt, err := uh.c.Exchange(req, uh.dialAddr())
 	if err != nil && rtt == 0 {
 		rtt = time.Since(t)
 	}
@@ -529,6 +896,30 @@ func (uh *UpstreamHost) udpWireFormatSend() (error, time.Duration) {
 	return err, rtt
 }
 
+// Record the exchange result, which biases the spray selection, see Spray.weight()
+// RTT of a successful exchange(including the dial time of a fresh connection) is averaged into avgRtt for the latency policy.
+// Neither of them affects dial timeouts, which are averaged from dial time only, see updateDialTimeout().
+func (uh *UpstreamHost) markExchanged(err error, rtt time.Duration) {
+	now := clock.Now().UnixNano()
+	if err != nil {
+		atomic.StoreInt64(&uh.lastFailed, now)
+	} else {
+		atomic.StoreInt64(&uh.lastAnswered, now)
+		if !atomic.CompareAndSwapInt64(&uh.avgRtt, 0, int64(rtt)) {
+			dt := int64(rtt) - atomic.LoadInt64(&uh.avgRtt)
+			atomic.AddInt64(&uh.avgRtt, dt/cumulativeAvgWeight)
+		}
+	}
+}
+
+// Return weight of the host, see host option `weight'
+func (uh *UpstreamHost) weight() int {
+	if uh.opts.weight == 0 {
+		return 1
+	}
+	return uh.opts.weight
+}
+
 // UpstreamHostPool is an array of upstream DNS servers
 type UpstreamHostPool []*UpstreamHost
 
@@ -563,6 +954,14 @@ type HealthCheck struct {
 	maxFails      int32         // Maximum fail count considered as down
 	checkInterval time.Duration // Health check interval
 
+	udpProbeInterval time.Duration // UDP payload size probe interval, zero to disable
+	warm             *warmSample   // Sampled real questions for health check, nil if disabled
+
+	capabilityProbeInterval time.Duration // Upstream capability probe interval, zero to disable
+
+	quiet   quietWindows // Active health checks are suppressed during these windows
+	inQuiet bool         // MT-Unsafe: only accessed by health check worker
+
 	// A global transport since Caddy doesn't support over nested blocks
 	transport *Transport
 }
@@ -576,8 +975,37 @@ func (hc *HealthCheck) Start() {
 		}()
 	}
 
+	if hc.udpProbeInterval != 0 {
+		hc.wg.Add(1)
+		go func() {
+			defer hc.wg.Done()
+			hc.udpSizeProbeWorker()
+		}()
+	}
+
+	if hosts := hc.hostsToResolve(); len(hosts) != 0 {
+		hc.wg.Add(1)
+		go func() {
+			defer hc.wg.Done()
+			hc.resolveWorker(hosts)
+		}()
+	}
+
+	if hc.capabilityProbeInterval != 0 {
+		hc.wg.Add(1)
+		go func() {
+			defer hc.wg.Done()
+			hc.capabilityProbeWorker()
+		}()
+	}
+
 	for _, host := range hc.hosts {
 		host.transport.Start()
+		if host.fallback != nil {
+			for _, h := range host.fallback.hosts {
+				h.transport.Start()
+			}
+		}
 	}
 }
 
@@ -587,6 +1015,14 @@ func (hc *HealthCheck) Stop() {
 
 	for _, host := range hc.hosts {
 		host.transport.Stop()
+		if host.grpc != nil {
+			Close(host.grpc.conn)
+		}
+		if host.fallback != nil {
+			for _, h := range host.fallback.hosts {
+				h.transport.Stop()
+			}
+		}
 	}
 }
 
@@ -598,12 +1034,17 @@ func (hc *HealthCheck) healthCheck() {
 
 func (hc *HealthCheck) healthCheckWorker() {
 	// Kick off initial health check immediately
-	hc.healthCheck()
+	if !hc.quietNow() {
+		hc.healthCheck()
+	}
 
-	ticker := time.NewTicker(hc.checkInterval)
+	ticker := clock.NewTicker(hc.checkInterval)
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.Chan():
+			if hc.quietNow() {
+				continue
+			}
 			hc.healthCheck()
 		case <-hc.stop:
 			return
@@ -614,7 +1055,20 @@ func (hc *HealthCheck) healthCheckWorker() {
 // Select an upstream host based on the policy and the health check result
 // Taken from proxy/healthcheck/healthcheck.go with modification
 func (hc *HealthCheck) Select() *UpstreamHost {
-	pool := hc.hosts
+	return hc.SelectClient(nil)
+}
+
+// SelectClient is Select with the client IP address consulted by client policies(e.g. geoip), nil if unknown
+func (hc *HealthCheck) SelectClient(client net.IP) *UpstreamHost {
+	return hc.SelectRequest(client, "")
+}
+
+// SelectRequest is SelectClient with the query name consulted by name policies(e.g. qname_hash), empty if unknown
+func (hc *HealthCheck) SelectRequest(client net.IP, qname string) *UpstreamHost {
+	pool := hc.hosts.outOfMaintenance().withinQuota().unsaturated()
+	if len(pool) == 0 {
+		return nil
+	}
 	if len(pool) == 1 {
 		if pool[0].Down() && hc.spray == nil {
 			return nil
@@ -648,7 +1102,14 @@ func (hc *HealthCheck) Select() *UpstreamHost {
 		return hc.spray.Select(pool)
 	}
 
-	h := hc.policy.Select(pool)
+	var h *UpstreamHost
+	if cp, ok := hc.policy.(clientPolicy); ok && client != nil {
+		h = cp.SelectClient(pool, client)
+	} else if np, ok := hc.policy.(namePolicy); ok && len(qname) != 0 {
+		h = np.SelectName(pool, qname)
+	} else {
+		h = hc.policy.Select(pool)
+	}
 	if h != nil {
 		return h
 	}
@@ -666,6 +1127,14 @@ const (
 	maxDialTimeout      = 5 * time.Second
 	cumulativeAvgWeight = 4
 
-	maxWriteTimeout = 2 * time.Second
-	maxReadTimeout  = 2 * time.Second
+	defaultWriteTimeout = 2 * time.Second
+	defaultReadTimeout  = 2 * time.Second
+
+	udpFailsBeforeTcpFallback = 3
+
+	// Handshakes slower than this ratio of the average are considered as degradation
+	tlsHandshakeSlowRatio = 3
+
+	// Time reserved for writing the reply before client deadline
+	clientDeadlineMargin = 100 * time.Millisecond
 )
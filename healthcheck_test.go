@@ -1,9 +1,25 @@
 package dnsredir
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"math/big"
+	"net"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -85,3 +101,610 @@ func TestSend(t *testing.T) {
 		}
 	}
 }
+
+func TestQuietWindows(t *testing.T) {
+	parse := func(args ...string) quietWindows {
+		var ws quietWindows
+		for _, arg := range args {
+			w, err := parseQuietWindow(arg)
+			if err != nil {
+				t.Fatalf("parseQuietWindow(%q) failed: %v", arg, err)
+			}
+			ws = append(ws, w)
+		}
+		return ws
+	}
+	at := func(h, m int) time.Time {
+		return time.Date(2020, 1, 1, h, m, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		windows  quietWindows
+		t        time.Time
+		expected bool
+	}{
+		{parse("01:00-05:00"), at(0, 59), false},
+		{parse("01:00-05:00"), at(1, 0), true},
+		{parse("01:00-05:00"), at(4, 59), true},
+		{parse("01:00-05:00"), at(5, 0), false},
+		{parse("23:00-07:00"), at(23, 30), true},
+		{parse("23:00-07:00"), at(0, 0), true},
+		{parse("23:00-07:00"), at(7, 0), false},
+		{parse("23:00-07:00"), at(12, 0), false},
+		{parse("22:00-24:00"), at(23, 59), true},
+		{parse("01:00-02:00", "13:00-14:00"), at(13, 30), true},
+		{nil, at(13, 30), false},
+	}
+	for i, test := range tests {
+		if active := test.windows.active(test.t); active != test.expected {
+			t.Errorf("Test %v: %v at %v expected %v, got %v", i, test.windows, test.t.Format("15:04"), test.expected, active)
+		}
+	}
+
+	for _, s := range []string{"", "01:00", "01:00-01:00", "25:00-01:00", "01:60-02:00", "1-2", "24:01-01:00"} {
+		if _, err := parseQuietWindow(s); err == nil {
+			t.Errorf("parseQuietWindow(%q) should fail", s)
+		}
+	}
+}
+
+func TestIoDeadline(t *testing.T) {
+	d, err := ioDeadline(context.Background(), 2*s)
+	if err != nil || time.Until(d) > 2*s || time.Until(d) < 1*s {
+		t.Errorf("Expected deadline about 2s later, got %v %v", time.Until(d), err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*ms)
+	defer cancel()
+	d, err = ioDeadline(ctx, 2*s)
+	if err != nil || time.Until(d) > 500*ms-clientDeadlineMargin {
+		t.Errorf("Expected deadline bounded by client deadline, got %v %v", time.Until(d), err)
+	}
+
+	ctx1, cancel1 := context.WithTimeout(context.Background(), clientDeadlineMargin/2)
+	defer cancel1()
+	if _, err := ioDeadline(ctx1, 2*s); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	up := func(*UpstreamHost) bool { return false }
+	a := &UpstreamHost{proto: "udp", addr: "10.0.0.1:53", downFunc: up}
+	b := &UpstreamHost{proto: "udp", addr: "10.0.0.2:53", downFunc: up}
+	hc := &HealthCheck{hosts: UpstreamHostPool{a, b}, policy: &Sequential{}}
+
+	if h := hc.Select(); h != a {
+		t.Fatalf("Expected %v selected, got %v", a.Name(), h)
+	}
+	a.setMaintenance(true)
+	if h := hc.Select(); h != b {
+		t.Fatalf("Expected %v selected during maintenance of %v, got %v", b.Name(), a.Name(), h)
+	}
+	if a.Down() {
+		t.Fatalf("Expected %v not down during maintenance", a.Name())
+	}
+	b.setMaintenance(true)
+	if got := hc.hosts.outOfMaintenance(); len(got) != 2 {
+		t.Fatalf("Expected all hosts kept if every host is under maintenance, got %v", got)
+	}
+	a.setMaintenance(false)
+	if h := hc.Select(); h != a {
+		t.Fatalf("Expected %v selected after maintenance, got %v", a.Name(), h)
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	a := &UpstreamHost{addr: "10.0.0.1:53", maxInflight: 2}
+	b := &UpstreamHost{addr: "10.0.0.2:53", maxInflight: 2}
+	pool := UpstreamHostPool{a, b}
+
+	if !a.acquire() || !a.acquire() {
+		t.Fatalf("expected two slots available")
+	}
+	if a.acquire() {
+		t.Fatalf("expected saturated host")
+	}
+	if got := pool.unsaturated(); len(got) != 1 || got[0] != b {
+		t.Fatalf("expected only %v unsaturated, got %v", b.Name(), got)
+	}
+
+	a.release()
+	if got := pool.unsaturated(); len(got) != 2 {
+		t.Fatalf("expected all hosts unsaturated, got %v", got)
+	}
+
+	unlimited := &UpstreamHost{addr: "10.0.0.3:53"}
+	for i := 0; i < 100; i++ {
+		if !unlimited.acquire() {
+			t.Fatalf("unexpected saturation of unlimited host")
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+
+	down := func(uh *UpstreamHost) bool { return uh.fails > 0 }
+	a := &UpstreamHost{addr: "10.0.0.1:53", opts: hostOptions{quota: 2}, downFunc: down}
+	b := &UpstreamHost{addr: "10.0.0.2:53", downFunc: down}
+	pool := UpstreamHostPool{a, b}
+
+	a.usage.add()
+	if got := pool.withinQuota(); len(got) != 2 {
+		t.Fatalf("expected all hosts within quota, got %v", got)
+	}
+	a.usage.add()
+	if got := pool.withinQuota(); len(got) != 1 || got[0] != b {
+		t.Fatalf("expected only %v within quota, got %v", b.Name(), got)
+	}
+
+	// Demoted hosts are still used if every host within quota is down
+	b.fails = 1
+	if got := pool.withinQuota(); len(got) != 2 {
+		t.Fatalf("expected demoted host used as last resort, got %v", got)
+	}
+	b.fails = 0
+
+	// Past month counts are ignored
+	a.usage.restore("2020-08", 100)
+	if n := a.usage.get(); n != 2 {
+		t.Fatalf("expected count 2, got %v", n)
+	}
+
+	fc.Advance(31 * 24 * time.Hour)
+	if n := a.usage.get(); n != 0 {
+		t.Fatalf("expected count rolled over, got %v", n)
+	}
+	if got := pool.withinQuota(); len(got) != 2 {
+		t.Fatalf("expected all hosts within quota after rollover, got %v", got)
+	}
+}
+
+func TestInterruptOnDone(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	unwatch := interruptOnDone(ctx, c1)
+	go func() {
+		time.Sleep(10 * ms)
+		cancel()
+	}()
+	if _, err := c1.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected blocked read interrupted")
+	}
+	unwatch()
+
+	// Dial of an abandoned query never takes a pooled connection
+	uh := &UpstreamHost{transport: newTransport()}
+	if _, _, err := uh.dial(ctx, "udp", downstreamUdp, nil, false, true); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRecordCertExpiry(t *testing.T) {
+	now := time.Now()
+	leaf := &x509.Certificate{NotAfter: now.Add(30 * 24 * time.Hour)}
+	intermediate := &x509.Certificate{NotAfter: now.Add(5 * 24 * time.Hour)}
+	uh := &UpstreamHost{proto: tcpTlsProto, addr: "127.0.0.1:853", certWarning: defaultTlsExpiryWarning}
+
+	uh.recordCertExpiry(nil)
+	if uh.certExpiry != 0 {
+		t.Fatalf("Expected no expiry recorded, got %v", uh.certExpiry)
+	}
+	uh.recordCertExpiry([]*x509.Certificate{leaf, intermediate})
+	if uh.certExpiry != intermediate.NotAfter.UnixNano() {
+		t.Errorf("Expected expiry of the intermediate certificate %v, got %v", intermediate.NotAfter, time.Unix(0, uh.certExpiry))
+	}
+	warned := uh.certWarned
+	if warned == 0 {
+		t.Fatalf("Expected an expiry warning")
+	}
+	uh.recordCertExpiry([]*x509.Certificate{leaf, intermediate})
+	if uh.certWarned != warned {
+		t.Errorf("Expected no more warning within %v", certExpiryWarnInterval)
+	}
+
+	uh = &UpstreamHost{proto: tcpTlsProto, addr: "127.0.0.1:853", certWarning: defaultTlsExpiryWarning}
+	uh.recordCertExpiry([]*x509.Certificate{leaf})
+	if uh.certWarned != 0 {
+		t.Errorf("Expected no warning of certificate expires in %v", time.Until(leaf.NotAfter))
+	}
+}
+
+func TestConnHook(t *testing.T) {
+	h, err := parseConnHook([]string{"unix:/run/dnsredir.sock", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Failed to parse connection hook: %v", err)
+	}
+	uh := &UpstreamHost{proto: udpProto, addr: "127.0.0.1:53"}
+	if !h.covers(uh) {
+		t.Errorf("Expected %v covered", uh.Name())
+	}
+	if h.covers(&UpstreamHost{proto: udpProto, addr: "127.0.0.2:53"}) {
+		t.Errorf("Expected 127.0.0.2:53 not covered")
+	}
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Close(server)
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooked := h.wrap(uh, udpProto, conn)
+	if _, ok := hooked.(net.PacketConn); !ok {
+		t.Errorf("Expected hooked UDP connection kept as net.PacketConn, got %T", hooked)
+	}
+	if unwrapConn(hooked) != conn {
+		t.Errorf("Expected %v unwrapped, got %v", conn, unwrapConn(hooked))
+	}
+	_ = hooked.Close()
+	_ = hooked.Close()
+
+	for _, event := range []string{"established", "closed"} {
+		select {
+		case e := <-h.events:
+			if e.Event != event || e.Host != uh.Name() || e.Remote != server.LocalAddr().String() {
+				t.Errorf("Expected %v event of %v, got %+v", event, uh.Name(), e)
+			}
+		default:
+			t.Fatalf("Expected %v event", event)
+		}
+	}
+	if len(h.events) != 0 {
+		t.Errorf("Expected closed event notified once, got %v more events", len(h.events))
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	down := func(uh *UpstreamHost) bool { return uh.fails > 0 }
+	a := &UpstreamHost{addr: "10.0.0.1:53", opts: hostOptions{weight: 3}, downFunc: down}
+	b := &UpstreamHost{addr: "10.0.0.2:53", downFunc: down}
+	pool := UpstreamHostPool{a, b}
+
+	policy := &WeightedRoundRobin{}
+	var got []*UpstreamHost
+	for i := 0; i < 8; i++ {
+		got = append(got, policy.Select(pool))
+	}
+	if expected := []*UpstreamHost{a, a, b, a, a, a, b, a}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected smooth weighted selections %v, got %v", expected, got)
+	}
+
+	a.fails = 1
+	if h := policy.Select(pool); h != b {
+		t.Fatalf("expected %v selected once %v is down, got %v", b.Name(), a.Name(), h)
+	}
+	b.fails = 1
+	if h := policy.Select(pool); h != nil {
+		t.Fatalf("expected nil once all hosts are down, got %v", h.Name())
+	}
+}
+
+func TestLatencyPolicy(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+
+	down := func(uh *UpstreamHost) bool { return uh.fails > 0 }
+	a := &UpstreamHost{addr: "10.0.0.1:53", downFunc: down}
+	b := &UpstreamHost{addr: "10.0.0.2:53", downFunc: down}
+	pool := UpstreamHostPool{a, b}
+
+	policy := &Latency{}
+	// The first selection re-probes, which is the unmeasured host anyway
+	if h := policy.Select(pool); h != a {
+		t.Fatalf("expected unmeasured %v selected, got %v", a.Name(), h.Name())
+	}
+	a.markExchanged(nil, 80*ms)
+	if h := policy.Select(pool); h != b {
+		t.Fatalf("expected unmeasured %v selected, got %v", b.Name(), h.Name())
+	}
+	fc.Advance(time.Second)
+	b.markExchanged(nil, 20*ms)
+	for i := 0; i < 3; i++ {
+		if h := policy.Select(pool); h != b {
+			t.Fatalf("expected the fastest %v selected, got %v", b.Name(), h.Name())
+		}
+	}
+
+	// The slow host is re-probed periodically
+	fc.Advance(latencyProbeInterval)
+	if h := policy.Select(pool); h != a {
+		t.Fatalf("expected %v re-probed, got %v", a.Name(), h.Name())
+	}
+	if h := policy.Select(pool); h != b {
+		t.Fatalf("expected the fastest %v selected after re-probe, got %v", b.Name(), h.Name())
+	}
+
+	// Moving average follows the recent RTT
+	for i := 0; i < 20; i++ {
+		a.markExchanged(nil, 10*ms)
+	}
+	if h := policy.Select(pool); h != a {
+		t.Fatalf("expected recovered %v selected, got %v", a.Name(), h.Name())
+	}
+	a.fails = 1
+	if h := policy.Select(pool); h != b {
+		t.Fatalf("expected %v selected once %v is down, got %v", b.Name(), a.Name(), h.Name())
+	}
+}
+
+func TestSequentialPolicy(t *testing.T) {
+	down := func(uh *UpstreamHost) bool { return uh.fails > 0 }
+	a := &UpstreamHost{addr: "10.0.0.1:53", downFunc: down}
+	b := &UpstreamHost{addr: "10.0.0.2:53", downFunc: down}
+	c := &UpstreamHost{addr: "10.0.0.3:53", downFunc: down}
+	pool := UpstreamHostPool{a, b, c}
+
+	policy := &Sequential{}
+	for i := 0; i < 3; i++ {
+		if h := policy.Select(pool); h != a {
+			t.Fatalf("expected the first host %v always selected, got %v", a.Name(), h.Name())
+		}
+	}
+	a.fails = 1
+	if h := policy.Select(pool); h != b {
+		t.Fatalf("expected %v selected once %v is down, got %v", b.Name(), a.Name(), h.Name())
+	}
+	b.fails = 1
+	if h := policy.Select(pool); h != c {
+		t.Fatalf("expected %v selected once %v is down, got %v", c.Name(), b.Name(), h.Name())
+	}
+	a.fails = 0
+	if h := policy.Select(pool); h != a {
+		t.Fatalf("expected %v selected once it's up again, got %v", a.Name(), h.Name())
+	}
+	a.fails, c.fails = 1, 1
+	if h := policy.Select(pool); h != nil {
+		t.Fatalf("expected nil once all hosts are down, got %v", h.Name())
+	}
+}
+
+func TestQnameHashPolicy(t *testing.T) {
+	down := func(uh *UpstreamHost) bool { return uh.fails > 0 }
+	a := &UpstreamHost{addr: "10.0.0.1:53", downFunc: down}
+	b := &UpstreamHost{addr: "10.0.0.2:53", downFunc: down}
+	c := &UpstreamHost{addr: "10.0.0.3:53", downFunc: down}
+	pool := UpstreamHostPool{a, b, c}
+
+	policy := &QnameHash{}
+	selected := make(map[string]*UpstreamHost)
+	counts := make(map[*UpstreamHost]int)
+	for i := 0; i < 3000; i++ {
+		qname := fmt.Sprintf("host%v.example.com.", i)
+		h := policy.SelectName(pool, qname)
+		if h2 := policy.SelectName(UpstreamHostPool{c, b, a}, qname); h2 != h {
+			t.Fatalf("expected %q always hashed onto %v regardless of order, got %v", qname, h.Name(), h2.Name())
+		}
+		selected[qname] = h
+		counts[h]++
+	}
+	for _, host := range pool {
+		if counts[host] < 800 || counts[host] > 1200 {
+			t.Errorf("expected names spread evenly, got %v of %v", counts[host], host.Name())
+		}
+	}
+
+	// Only names of the down host are moved
+	b.fails = 1
+	for qname, h := range selected {
+		h2 := policy.SelectName(pool, qname)
+		if h2 == b || (h != b && h2 != h) {
+			t.Fatalf("expected %q moved only if it's hashed onto the down host, got %v -> %v", qname, h.Name(), h2.Name())
+		}
+	}
+	a.fails, c.fails = 1, 1
+	if h := policy.SelectName(pool, "example.com."); h != nil {
+		t.Fatalf("expected nil once all hosts are down, got %v", h.Name())
+	}
+}
+
+// Return a handler answering A queries of any name with 127.0.0.1, answered queries are counted in `served'
+func answerHandler(served *int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(served, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+		_ = w.WriteMsg(m)
+	}
+}
+
+// Start a local DNS server over `proto', the returned function stops it
+func startTestServer(t *testing.T, proto string, handler dns.Handler) (string, func()) {
+	started := make(chan struct{})
+	// Large UDP queries must not be truncated
+	server := &dns.Server{Handler: handler, UDPSize: dns.MaxMsgSize, NotifyStartedFunc: func() { close(started) }}
+	if proto == udpProto {
+		pc, err := net.ListenPacket(udpProto, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn = pc
+	} else {
+		ln, err := net.Listen(tcpProto, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto == tcpTlsProto {
+			ln = tls.NewListener(ln, testServerTlsConfig(t))
+		}
+		server.Listener = ln
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+
+	addr := ""
+	if server.PacketConn != nil {
+		addr = server.PacketConn.LocalAddr().String()
+	} else {
+		addr = server.Listener.Addr().String()
+	}
+	return addr, func() { _ = server.Shutdown() }
+}
+
+// Return a TLS config of a self-signed certificate for 127.0.0.1
+func testServerTlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// Return the only upstream host of a stanza, its transport is started
+func newTestHost(t *testing.T, stanza string) (*UpstreamHost, func()) {
+	c := caddy.NewTestController("dns", stanza)
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, error: %v", err)
+	}
+	host := up.(*reloadableUpstream).hosts[0]
+	host.transport.Start()
+	return host, host.transport.Stop
+}
+
+func newTestState(name string) *request.Request {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	return &request.Request{W: &test.ResponseWriter{}, Req: req}
+}
+
+func TestTcpFallback(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+
+	// Only TCP is served, UDP queries to the same port are refused
+	var served int32
+	addr, stop := startTestServer(t, tcpProto, answerHandler(&served))
+	defer stop()
+	host, stopHost := newTestHost(t, "dnsredir . {\n to "+addr+"\n tcp_fallback 1m\n}")
+	defer stopHost()
+
+	tests := []struct {
+		advance   time.Duration
+		shouldErr bool
+		pinned    bool
+		served    int32
+	}{
+		// TCP is tried only after consecutive UDP failures
+		{0, true, false, 0},
+		{0, true, false, 0},
+		{0, false, true, 1},
+		// UDP isn't tried at all once pinned
+		{30 * time.Second, false, true, 2},
+		// Pin expired, UDP is tried again
+		{30 * time.Second, true, false, 2},
+	}
+	for i, test := range tests {
+		fc.Advance(test.advance)
+		_, err := host.Exchange(context.Background(), newTestState("example.com."), nil, false)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test#%v: expected error %v, got %v", i, test.shouldErr, err)
+		}
+		if pinned := host.tcpPinned(); pinned != test.pinned {
+			t.Errorf("Test#%v: expected pinned %v, got %v", i, test.pinned, pinned)
+		}
+		if n := atomic.LoadInt32(&served); n != test.served {
+			t.Errorf("Test#%v: expected %v queries served over TCP, got %v", i, test.served, n)
+		}
+	}
+}
+
+func TestTlsHandshakeMetrics(t *testing.T) {
+	var served int32
+	addr, stop := startTestServer(t, tcpTlsProto, answerHandler(&served))
+	defer stop()
+	host, stopHost := newTestHost(t, "dnsredir . {\n to tls://"+addr+"\n}")
+	defer stopHost()
+	host.transport.tlsConfig.InsecureSkipVerify = true
+
+	handshakes := func() (uint64, float64) {
+		m := &dto.Metric{}
+		if err := TlsHandshakeDuration.WithLabelValues(host.Name()).(prometheus.Metric).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		n := &dto.Metric{}
+		if err := TlsHandshakeSlowCount.WithLabelValues(host.Name()).Write(n); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount(), n.GetCounter().GetValue()
+	}
+
+	tests := []struct {
+		avgHandshakeTime time.Duration
+		slow             float64
+	}{
+		// Way faster than a previous average of one minute
+		{time.Minute, 0},
+		// Any real handshake is considerably slower than a previous average of 1ns
+		{time.Nanosecond, 1},
+	}
+	for i, test := range tests {
+		atomic.StoreInt64(&host.transport.avgHandshakeTime[downstreamUdp], int64(test.avgHandshakeTime))
+		count0, slow0 := handshakes()
+		pc, cached, err := host.dial(context.Background(), tcpTlsProto, downstreamUdp, nil, false, false)
+		if err != nil {
+			t.Fatalf("Test#%v: dial failed, error: %v", i, err)
+		}
+		Close(pc.c)
+		if cached {
+			t.Errorf("Test#%v: expected a fresh connection", i)
+		}
+		count, slow := handshakes()
+		if count != count0+1 {
+			t.Errorf("Test#%v: expected %v handshakes observed, got %v", i, count0+1, count)
+		}
+		if slow-slow0 != test.slow {
+			t.Errorf("Test#%v: expected %v slow handshakes counted, got %v", i, test.slow, slow-slow0)
+		}
+		// The average moves towards the handshake time just measured
+		avg := time.Duration(atomic.LoadInt64(&host.transport.avgHandshakeTime[downstreamUdp]))
+		if avg == test.avgHandshakeTime {
+			t.Errorf("Test#%v: expected average handshake time updated, got %v", i, avg)
+		}
+	}
+}
+
+// Return a Dnsredir of the Corefile which falls through to a next plugin answering REFUSED
+func newTestDnsredir(t *testing.T, corefile string) (*Dnsredir, func()) {
+	c := caddy.NewTestController("dns", corefile)
+	ups, err := NewReloadableUpstreams(c)
+	if err != nil {
+		t.Fatalf("NewReloadableUpstreams() failed, error: %v", err)
+	}
+	r := &Dnsredir{Next: test.NextHandler(dns.RcodeRefused, nil), Upstreams: &ups}
+	if err := r.OnStartup(); err != nil {
+		t.Fatalf("OnStartup() failed, error: %v", err)
+	}
+	return r, func() { _ = r.OnShutdown() }
+}
+
+// Serve an A query of the name, the answer(if any) is returned along with the rcode
+func serveTestQuery(r *Dnsredir, name string) (*dns.Msg, int, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rc, err := r.ServeDNS(context.Background(), rec, req)
+	return rec.Msg, rc, err
+}
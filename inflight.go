@@ -0,0 +1,46 @@
+package dnsredir
+
+import "sync/atomic"
+
+// Reserve an in-flight slot of the host, false if the host is saturated
+func (uh *UpstreamHost) acquire() bool {
+	if uh.maxInflight == 0 {
+		return true
+	}
+	if atomic.AddInt32(&uh.inflight, 1) > uh.maxInflight {
+		atomic.AddInt32(&uh.inflight, -1)
+		return false
+	}
+	return true
+}
+
+func (uh *UpstreamHost) release() {
+	if uh.maxInflight != 0 {
+		atomic.AddInt32(&uh.inflight, -1)
+	}
+}
+
+func (uh *UpstreamHost) saturated() bool {
+	return uh.maxInflight != 0 && atomic.LoadInt32(&uh.inflight) >= uh.maxInflight
+}
+
+// Return hosts which aren't saturated by in-flight queries, the pool itself is returned if none saturated
+func (pool UpstreamHostPool) unsaturated() UpstreamHostPool {
+	var ret UpstreamHostPool
+	for i, host := range pool {
+		if !host.saturated() {
+			if ret != nil {
+				ret = append(ret, host)
+			}
+			continue
+		}
+		InflightLimitCount.WithLabelValues(host.Name()).Inc()
+		if ret == nil {
+			ret = append(make(UpstreamHostPool, 0, len(pool)), pool[:i]...)
+		}
+	}
+	if ret == nil {
+		return pool
+	}
+	return ret
+}
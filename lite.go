@@ -0,0 +1,87 @@
+package dnsredir
+
+import (
+	"bytes"
+	"errors"
+	"github.com/leiless/dnsredir/compiled"
+	"strconv"
+	"strings"
+)
+
+// Apply the lite mode to the stanza, which is tuned for memory constrained devices(e.g. OpenWrt routers)
+// i.e. compact name lists under a memory ceiling, fewer pooled connections and no per-upstream histograms.
+func (u *reloadableUpstream) applyLite(ceiling uint64) {
+	u.lite = true
+	u.NameList.compact = true
+	u.NameList.memoryCeiling = ceiling
+	u.NameList.itemBytes = make(map[*NameItem]uint64)
+	u.transport.maxPooled = litePooledConns
+}
+
+// Convert names into the compiled representation, which is several times smaller than domainSet
+func compactNames(names domainSet) (*compiled.List, error) {
+	list := make([]string, 0, names.Len())
+	_ = names.ForEachDomain(func(name string) error {
+		list = append(list, name)
+		return nil
+	})
+	var buf bytes.Buffer
+	if err := compiled.Write(&buf, list); err != nil {
+		return nil, err
+	}
+	return compiled.Parse(buf.Bytes())
+}
+
+// Account memory footprint of names of the item, return false if the memory ceiling would be exceeded
+// Names of other items are accounted by their last accepted update.
+func (n *NameList) reserveMemory(item *NameItem, bytes uint64) bool {
+	if n.memoryCeiling == 0 {
+		return true
+	}
+	n.memoryLock.Lock()
+	defer n.memoryLock.Unlock()
+	var total uint64
+	for other, b := range n.itemBytes {
+		if other != item {
+			total += b
+		}
+	}
+	if total+bytes > n.memoryCeiling {
+		return false
+	}
+	n.itemBytes[item] = bytes
+	return true
+}
+
+// Parse byte size with optional binary unit suffix K, M or G, e.g. 512K, 16M
+func parseByteSize(s string) (uint64, error) {
+	if len(s) == 0 {
+		return 0, errByteSize
+	}
+	shift := uint(0)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 || n > (1<<63)>>shift {
+		return 0, errByteSize
+	}
+	return n << shift, nil
+}
+
+var errByteSize = errors.New("expected a positive size with optional unit K, M or G, e.g. 16M")
+
+const (
+	// Pooled connections per transport type and downstream protocol of each host
+	litePooledConns = 2
+	// Memory ceiling of name lists of a stanza, if not specified
+	defaultLiteMemoryCeiling = 16 << 20
+)
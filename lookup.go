@@ -0,0 +1,109 @@
+package dnsredir
+
+import (
+	"sort"
+	"strings"
+)
+
+// Public lookup API for Go programs embedding this package, so loaded name lists can be reused
+//	without reaching into unexported fields.
+
+// Normalize names for lookups, i.e. lower cased and without trailing dot(except for root zone)
+func normalizeNames(names []string) []string {
+	normalized := make([]string, len(names))
+	for i, name := range names {
+		name = strings.ToLower(name)
+		if name != "." {
+			name = strings.TrimSuffix(name, ".")
+		}
+		if len(name) == 0 {
+			name = "."
+		}
+		normalized[i] = name
+	}
+	return normalized
+}
+
+// MatchAll checks membership of names in bulk, names needn't to be normalized
+// Names of each item are loaded only once per call, thus it's cheaper than calling Match() repeatedly.
+func (n *NameList) MatchAll(names []string) []bool {
+	normalized := normalizeNames(names)
+	matched := make([]bool, len(names))
+	for _, item := range n.items {
+		s := item.loadNames()
+		for i, name := range normalized {
+			if matched[i] || name == "." {
+				continue
+			}
+			if _, ok := s.matchIn(s.names, s.bloom, name); ok {
+				matched[i] = true
+			}
+		}
+	}
+	return matched
+}
+
+// Snapshot returns a point-in-time copy of all names in the name list
+func (n *NameList) Snapshot() *NameSnapshot {
+	return n.snapshot(nil)
+}
+
+func (n *NameList) snapshot(extra domainSet) *NameSnapshot {
+	set := make(StringSet)
+	add := func(name string) error {
+		set.Add(name)
+		return nil
+	}
+	for _, item := range n.items {
+		s := item.loadNames()
+		_ = s.names.ForEachDomain(add)
+		if s.compiled != nil {
+			_ = s.compiled.ForEach(add)
+		}
+	}
+	_ = extra.ForEachDomain(add)
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &NameSnapshot{names: names}
+}
+
+// NameSnapshot iterates over a sorted copy of names, it's unaffected by later name list reloads
+// MT-Unsafe
+type NameSnapshot struct {
+	names []string
+	next  int
+}
+
+// Len returns total number of names in the snapshot
+func (s *NameSnapshot) Len() int {
+	return len(s.names)
+}
+
+// Next returns the next name and true, or false if the iteration is over
+func (s *NameSnapshot) Next() (string, bool) {
+	if s.next >= len(s.names) {
+		return "", false
+	}
+	s.next++
+	return s.names[s.next-1], true
+}
+
+// MatchAll checks whether names would be routed to this stanza, names needn't to be normalized
+// Unlike Match(), canary name lists and statistics are not involved.
+func (u *reloadableUpstream) MatchAll(names []string) []bool {
+	normalized := normalizeNames(names)
+	matched := make([]bool, len(names))
+	for i, name := range normalized {
+		matched[i] = u.match(name, false)
+	}
+	return matched
+}
+
+// Snapshot returns a point-in-time copy of all names of this stanza, including INLINE ones
+func (u *reloadableUpstream) Snapshot() *NameSnapshot {
+	return u.NameList.snapshot(u.inline)
+}
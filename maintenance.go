@@ -0,0 +1,55 @@
+package dnsredir
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Return true if the host is under planned maintenance, see `POST /maintenance' of admin
+func (uh *UpstreamHost) inMaintenance() bool {
+	return atomic.LoadInt32(&uh.maintenance) != 0
+}
+
+func (uh *UpstreamHost) setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&uh.maintenance, v) != v {
+		HostMaintenance.WithLabelValues(uh.Name()).Set(float64(v))
+		log.Infof("%v maintenance mode: %v", uh.Name(), on)
+	}
+}
+
+// Return hosts not under maintenance, hosts under maintenance are removed from selection
+// Unlike down hosts, they don't trigger `spray', i.e. the pool itself is returned if every host is under maintenance.
+func (pool UpstreamHostPool) outOfMaintenance() UpstreamHostPool {
+	var ret UpstreamHostPool
+	for i, host := range pool {
+		if !host.inMaintenance() {
+			if ret != nil {
+				ret = append(ret, host)
+			}
+			continue
+		}
+		if ret == nil {
+			ret = append(make(UpstreamHostPool, 0, len(pool)), pool[:i]...)
+		}
+	}
+	if len(ret) == 0 {
+		return pool
+	}
+	return ret
+}
+
+// Return the host of the stanza named `name', nil if not found
+func (u *reloadableUpstream) host(name string) *UpstreamHost {
+	for _, host := range u.allHosts() {
+		if host.Name() == name {
+			return host
+		}
+	}
+	return nil
+}
+
+var errHostNotFound = errors.New("upstream host not found")
@@ -45,6 +45,203 @@ var (
 		Help:      "Rcode counter of requests made per upstream.",
 	}, []string{"server", "to", "rcode"})
 
+	TlsHandshakeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "tls_handshake_duration_ms",
+		Buckets:   requestBuckets,
+		Help:      "Histogram of the time(in milliseconds) each TLS handshake with DoT upstream took.",
+	}, []string{"to"})
+
+	TlsHandshakeSlowCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "tls_handshake_slow_count_total",
+		Help:      "Counter of TLS handshakes considerably slower than average per DoT upstream.",
+	}, []string{"to"})
+
+	QueueShedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "queue_shed_count_total",
+		Help:      "Counter of queries shed by the exchange queue.",
+	}, []string{"server"})
+
+	DepthExceededCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "depth_exceeded_count_total",
+		Help:      "Counter of queries aborted due to exceeding the maximum query depth.",
+	}, []string{"server"})
+
+	DedupHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "dedup_hit_count_total",
+		Help:      "Counter of queries answered from the dedup window.",
+	}, []string{"server"})
+
+	EmergencyRecursionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "emergency_recursion_count_total",
+		Help:      "Counter of queries resolved by emergency recursion.",
+	}, []string{"server", "success"})
+
+	DnssecBogusCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "dnssec_bogus_count_total",
+		Help:      "Counter of upstream answers failed DNSSEC validation.",
+	}, []string{"server", "to"})
+
+	InflightLimitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "inflight_limit_count_total",
+		Help:      "Counter of upstream selections skipping a host due to its in-flight limit.",
+	}, []string{"to"})
+
+	QuotaExceededCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "quota_exceeded_count_total",
+		Help:      "Counter of upstream selections demoting a host exceeded its monthly quota.",
+	}, []string{"to"})
+
+	QnameGuardCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "qname_guard_count_total",
+		Help:      "Counter of requests refused by query name regex guards.",
+	}, []string{"server"})
+
+	EventDropCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "event_drop_count_total",
+		Help:      "Counter of events dropped due to full subscriber channels.",
+	})
+
+	ReconcileUnusedExcepts = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "reconcile_unused_excepts",
+		Help:      "Number of exclusions which take no effect per stanza.",
+	}, []string{"stanza"})
+
+	ReconcileDuplicateNames = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "reconcile_duplicate_names",
+		Help:      "Number of names present in multiple sources per stanza.",
+	}, []string{"stanza"})
+
+	HostMaintenance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "host_maintenance",
+		Help:      "Whether the upstream host is under maintenance.",
+	}, []string{"to"})
+
+	UrlFetchFailures = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "url_fetch_failures",
+		Help:      "Consecutive failed fetches of the URL in FROM..., zero once fetched successfully.",
+	}, []string{"stanza", "url"})
+
+	StanzaFrozen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "stanza_frozen",
+		Help:      "Whether the stanza is frozen.",
+	}, []string{"stanza"})
+
+	AuditDroppedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "audit_dropped_count_total",
+		Help:      "Counter of audit records dropped since the audit log writer lagged behind.",
+	}, []string{"stanza"})
+
+	TlsCertExpiryDays = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "tls_cert_expiry_days",
+		Help:      "Days until the certificate chain of the DoT upstream expires, as of the last TLS handshake.",
+	}, []string{"to"})
+
+	ListSignatureFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "list_signature_failure_count_total",
+		Help:      "Counter of list sources rejected since their signatures failed to verify.",
+	}, []string{"stanza"})
+
+	ConnHookDroppedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "conn_hook_dropped_count_total",
+		Help:      "Counter of connection events dropped since the connection hook lagged behind.",
+	}, []string{"stanza"})
+
+	SloRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "slo_request_count_total",
+		Help:      "Counter of requests per stanza, good is whether the latency SLO is met.",
+	}, []string{"stanza", "good"})
+
+	SloBurnRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "slo_burn_rate",
+		Help:      "Error budget burn rate of the latency SLO per stanza.",
+	}, []string{"stanza", "window"})
+
+	MirrorRcodeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "mirror_rcode_count_total",
+		Help:      "Rcode counter of mirrored requests per shadow upstream.",
+	}, []string{"to", "rcode"})
+
+	SplitRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "split_request_count_total",
+		Help:      "Counter of requests per A/B split arm.",
+	}, []string{"stanza", "arm"})
+
+	SplitRcodeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "split_rcode_count_total",
+		Help:      "Rcode counter of requests per A/B split arm.",
+	}, []string{"stanza", "arm", "rcode"})
+
+	UpstreamCapability = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "upstream_capability",
+		Help:      "Probed capabilities of upstream hosts, 1 if capable.",
+	}, []string{"to", "capability"})
+
+	StanzaMemoryBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "stanza_memory_bytes",
+		Help:      "Estimated memory footprint per stanza.",
+	}, []string{"stanza", "kind"})
+
+	StanzaGoroutines = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "stanza_goroutines",
+		Help:      "Estimated number of long-running goroutines per stanza.",
+	}, []string{"stanza"})
+
 	// XXX: currently server not embedded into hc failure count label
 	HealthCheckFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
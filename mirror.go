@@ -0,0 +1,97 @@
+package dnsredir
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/miekg/dns"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// queryMirror asynchronously copies a sample of matched queries to a shadow upstream
+// Responses are discarded, only their rcodes are counted in metrics
+type queryMirror struct {
+	percent float64
+	addr    string // IP:PORT
+	name    string // Used in metric labels
+	client  *dns.Client
+	// Bound number of in-flight mirrored queries, excess ones are dropped
+	inflight chan struct{}
+}
+
+func newQueryMirror(percent float64, to string, tlsConfig *tls.Config) (*queryMirror, error) {
+	hosts, err := HostPort([]string{to})
+	if err != nil {
+		return nil, err
+	}
+	trans, addr := SplitTransportHost(hosts[0])
+	addr, tlsServerName := SplitByByte(addr, '@')
+
+	var network string
+	var config *tls.Config
+	switch trans {
+	case "dns", "udp":
+		network = "udp"
+	case "tcp":
+		network = "tcp"
+	case transport.TLS:
+		network = "tcp-tls"
+		config = tlsConfig.Clone()
+		if len(tlsServerName) != 0 {
+			config.ServerName = tlsServerName[1:]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported mirror transport %q", trans)
+	}
+
+	return &queryMirror{
+		percent: percent,
+		addr:    addr,
+		name:    trans + "://" + addr,
+		client: &dns.Client{
+			Net:       network,
+			TLSConfig: config,
+			Timeout:   defaultTimeout,
+		},
+		inflight: make(chan struct{}, maxMirrorInflight),
+	}, nil
+}
+
+// Mirror the request to the shadow upstream if it's sampled
+// `logName' is the query name for log output
+func (m *queryMirror) send(req *dns.Msg, logName string) {
+	if rand.Float64()*100 >= m.percent {
+		return
+	}
+
+	select {
+	case m.inflight <- struct{}{}:
+	default:
+		MirrorRcodeCount.WithLabelValues(m.name, "dropped").Inc()
+		return
+	}
+
+	// Request may be modified by other plugins once we returned
+	req = req.Copy()
+	go func() {
+		defer func() { <-m.inflight }()
+
+		t := time.Now()
+		reply, _, err := m.client.Exchange(req, m.addr)
+		if err != nil {
+			log.Debugf("Mirror %q to %v failed: %v", logName, m.name, err)
+			MirrorRcodeCount.WithLabelValues(m.name, "error").Inc()
+			return
+		}
+		rc, ok := dns.RcodeToString[reply.Rcode]
+		if !ok {
+			rc = strconv.Itoa(reply.Rcode)
+		}
+		log.Debugf("Mirror %q to %v: %v rtt: %v", logName, m.name, rc, time.Since(t))
+		MirrorRcodeCount.WithLabelValues(m.name, rc).Inc()
+	}()
+}
+
+const maxMirrorInflight = 64
@@ -0,0 +1,67 @@
+package dnsredir
+
+import (
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"testing"
+	"time"
+)
+
+func TestQueryMirror(t *testing.T) {
+	var served int32
+	primary, stopPrimary := startTestServer(t, udpProto, answerHandler(&served))
+	defer stopPrimary()
+
+	// Shadow upstream answers NXDOMAIN, but only after released
+	mirrored := make(chan string, 16)
+	release := make(chan struct{})
+	shadow, stopShadow := startTestServer(t, udpProto, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		mirrored <- req.Question[0].Name
+		<-release
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		_ = w.WriteMsg(m)
+	}))
+	defer stopShadow()
+
+	r, stop := newTestDnsredir(t, "dnsredir . {\n to "+primary+"\n mirror 100% to "+shadow+"\n}")
+	defer stop()
+	mirror := (*r.Upstreams)[0].(*reloadableUpstream).mirror
+	nxdomain := func() float64 {
+		m := &dto.Metric{}
+		if err := MirrorRcodeCount.WithLabelValues(mirror.name, "NXDOMAIN").Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	before := nxdomain()
+
+	names := []string{"example.com.", "example.org."}
+	for i, name := range names {
+		// Answered by the primary upstream while the shadow one still hangs
+		reply, rc, err := serveTestQuery(r, name)
+		if err != nil || rc != dns.RcodeSuccess {
+			t.Fatalf("Test#%v: expected %v, got %v %v", i, dns.RcodeSuccess, rc, err)
+		}
+		if reply == nil || reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 || reply.Answer[0].Header().Name != name {
+			t.Fatalf("Test#%v: expected answer of the primary upstream, got %v", i, reply)
+		}
+
+		select {
+		case got := <-mirrored:
+			if got != name {
+				t.Fatalf("Test#%v: expected %q mirrored, got %q", i, name, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Test#%v: expected %q mirrored", i, name)
+		}
+	}
+
+	// Shadow responses are discarded, only counted
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); nxdomain()-before != float64(len(names)); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v shadow responses counted, got %v", len(names), nxdomain()-before)
+		}
+	}
+}
@@ -4,17 +4,25 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"github.com/coredns/coredns/plugin"
+	"github.com/leiless/dnsredir/compiled"
 	"golang.org/x/net/idna"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// uint16 used to store first two ASCII characters
-type domainSet map[uint16]StringSet
+// Names are partitioned by the last two ASCII characters of their top-level label
+// Each partition is a domainTree, parents and children are always in the same one.
+type domainSet map[uint16]*domainTree
 
 func (d domainSet) String() string {
 	var sb strings.Builder
@@ -22,14 +30,13 @@ func (d domainSet) String() string {
 
 	var i uint64
 	n := d.Len()
-	for _, s := range d {
-		for name := range s {
-			sb.WriteString(name)
-			if i++; i != n {
-				sb.WriteString(", ")
-			}
+	_ = d.ForEachDomain(func(name string) error {
+		sb.WriteString(name)
+		if i++; i != n {
+			sb.WriteString(", ")
 		}
-	}
+		return nil
+	})
 	sb.WriteString("]")
 
 	return sb.String()
@@ -38,8 +45,8 @@ func (d domainSet) String() string {
 // Return total number of domains in the domain set
 func (d *domainSet) Len() uint64 {
 	var n uint64
-	for _, s := range *d {
-		n += uint64(len(s))
+	for _, t := range *d {
+		n += t.n
 	}
 	return n
 }
@@ -49,19 +56,24 @@ func domainToIndex(s string) uint16 {
 	if n == 0 {
 		panic(fmt.Sprintf("Unexpected empty string?!"))
 	}
-	// Since we use two ASCII characters to present index
+	// Take the index from the top-level label, which is shared by all parents of the name
 	//	Insufficient length will padded with '-'
-	//	Since a valid domain segment will never begin with '-'
-	//	So it can maintain balance between buckets
-	if n == 1 {
-		return (uint16('-') << 8) | uint16(s[0])
+	//	Since a valid domain segment will never end with '-'
+	if n == 1 || s[n-2] == '.' {
+		return (uint16('-') << 8) | uint16(s[n-1])
 	}
 	// The index will be encoded in big endian
-	return (uint16(s[0]) << 8) | uint16(s[1])
+	return (uint16(s[n-2]) << 8) | uint16(s[n-1])
 }
 
 // Return true if name added successfully, false otherwise
 func (d *domainSet) Add(str string) bool {
+	_, ok := d.add(str)
+	return ok
+}
+
+// Return the normalized name and true if name added successfully
+func (d *domainSet) add(str string) (string, bool) {
 	// To reduce memory, we don't use full qualified name
 
 	name, ok := stringToDomain(str)
@@ -69,32 +81,36 @@ func (d *domainSet) Add(str string) bool {
 		var err error
 		name, err = idna.ToASCII(str)
 		// idna.ToASCII("") return no error
-		if err != nil || len(name) == 0 {
-			return false
+		if err != nil || len(name) == 0 || len(name) > maxTreeNameLen {
+			return "", false
 		}
 	}
 
-	// To speed up name lookup, we utilized two-way hash
-	// The first one is the first two ASCII characters of the domain name
-	// The second one is the real domain set
-	// Which works somewhat like ordinary English dictionary lookup
-	s := (*d)[domainToIndex(name)]
-	if s == nil {
-		// MT-Unsafe: Initialize real domain set on demand
-		s = make(StringSet)
-		(*d)[domainToIndex(name)] = s
+	t := (*d)[domainToIndex(name)]
+	if t == nil {
+		// MT-Unsafe: Initialize domain tree on demand
+		t = new(domainTree)
+		(*d)[domainToIndex(name)] = t
 	}
-	s.Add(name)
-	return true
+	t.add(name)
+	return name, true
+}
+
+// Return true if the name itself(rather than its parent) is in the domain set
+// Assume `name' is lower cased and without trailing dot
+func (d *domainSet) Contains(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	t := (*d)[domainToIndex(name)]
+	return t != nil && t.contains(name)
 }
 
 // for loop will exit in advance if f() return error
 func (d *domainSet) ForEachDomain(f func(name string) error) error {
-	for _, s := range *d {
-		for name := range s {
-			if err := f(name); err != nil {
-				return err
-			}
+	for _, t := range *d {
+		if err := t.forEach(f); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -102,32 +118,25 @@ func (d *domainSet) ForEachDomain(f func(name string) error) error {
 
 // Assume `child' is lower cased and without trailing dot
 func (d *domainSet) Match(child string) bool {
+	_, ok := d.MatchName(child)
+	return ok
+}
+
+// Return the matched name in the domain set and true if `child' matched
+// The longest matched name is returned if `child' have several parents in the domain set.
+// Assume `child' is lower cased and without trailing dot
+func (d *domainSet) MatchName(child string) (string, bool) {
 	if len(child) == 0 {
 		panic(fmt.Sprintf("Why child is an empty string?!"))
 	}
 
-	for {
-		s := (*d)[domainToIndex(child)]
-		// Fast lookup for a full match
-		if s.Contains(child) {
-			return true
-		}
-
-		// Fallback to iterate the whole set
-		for parent := range s {
-			if plugin.Name(parent).Matches(child) {
-				return true
-			}
-		}
-
-		i := strings.Index(child, ".")
-		if i <= 0 {
-			break
-		}
-		child = child[i+1:]
+	// Parents of `child' share its top-level label, thus the same domain tree
+	// 	which walks down labels of `child' once, without any allocation.
+	t := (*d)[domainToIndex(child)]
+	if t == nil {
+		return "", false
 	}
-
-	return false
+	return t.match(child)
 }
 
 const (
@@ -136,48 +145,152 @@ const (
 	NameItemTypeLast // Dummy
 )
 
+// Names of a NameItem, which is immutable once stored
+// Reloads build new names off to the side and swap them in as a whole, thus lookups never block during reloads.
+type itemNames struct {
+	// Domain name set for lookups
+	names domainSet
+	// Tags of domain names, untagged names are absent
+	// Upstream address of `server=/DOMAIN/IP' lines is kept as a tag with serverTagPrefix
+	tags map[string][]string
+	// Exception names of adblock `@@||DOMAIN^' rules, which take precedence like `except'
+	excepts domainSet
+	// Compiled name list looked up in place, nil if the list isn't compiled, see dnsredir-compile
+	compiled *compiled.List
+	// Bloom filter of names, nil if disabled, see `match_accel'
+	bloom *bloomFilter
+	// Pending update under canary rollout, nil if none
+	canary *canaryNames
+	// Estimated memory footprint of names and tags
+	bytes uint64
+}
+
+// Names of an item never loaded
+var emptyItemNames = &itemNames{}
+
 type NameItem struct {
+	// Guards metadata below(e.g. mtime and contentHash), and serializes updates of names
+	// Lookups don't lock, see loadNames().
 	sync.RWMutex
 
-	// Domain name set for lookups
-	names domainSet
+	// Current names, of type *itemNames
+	current atomic.Value
 
 	whichType int
+	// Format of the name list forced by the FROM form prefix, see splitFormPrefix()
+	format int
+	// Category selected from a geosite.dat, empty if not in geosite format
+	category string
+
+	// Reload interval and URL read timeout overriding the stanza-wide ones, zero if not overridden, see `from'
+	// Negative reload interval means never reloaded.
+	reload  time.Duration
+	timeout time.Duration
 
 	path  string
 	mtime time.Time
 	size  int64
+	// Glob pattern of files loaded as a whole, empty if `path' is a single file, see glob.go
+	// A directory in FROM... is taken as all files in it.
+	glob  string
+	files map[string]globFileStat
 
 	url         string
 	contentHash uint64
+	// Extra request header of the URL, see `url_header'
+	header http.Header
+	// Consecutive failed fetches, and non-zero if being retried, see retry.go
+	failures int32
+	retrying int32
+	// Validators of the last fetched content, nil if the server provided none, see openUrl()
+	validators *urlValidators
+
+	// Names are exceptions of the stanza rather than names to match, see `except'
+	except bool
 }
 
 func NewNameItemsWithForms(forms []string) ([]*NameItem, error) {
 	items := make([]*NameItem, len(forms))
 	for i, from := range forms {
+		from, format := splitFormPrefix(from)
+		if format == nameFormatGeosite {
+			path, category, err := splitGeositeCategory(from)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = &NameItem{
+				whichType: NameItemTypePath,
+				format:    format,
+				category:  category,
+				path:      path,
+			}
+			continue
+		}
 		if j := strings.Index(from, "://"); j > 0 {
 			proto := strings.ToLower(from[:j])
 			if proto == "http" {
 				log.Warningf("Due to security reasons, URL %q is prohibited", from)
 				continue
 			}
-			if proto != "https" {
+			if proto != "https" && !isObjectUrl(from) {
 				return nil, errors.New(fmt.Sprintf("Unsupport URL %q", from))
 			}
+			if isObjectUrl(from) {
+				if _, err := parseObjectUrl(from); err != nil {
+					return nil, err
+				}
+			}
 			items[i] = &NameItem{
 				whichType: NameItemTypeUrl,
+				format:    format,
 				url:       from,
 			}
 		} else {
 			items[i] = &NameItem{
 				whichType: NameItemTypePath,
+				format:    format,
 				path:      from,
 			}
+			if hasGlobMeta(from) {
+				items[i].glob = from
+			} else if st, err := os.Stat(from); err == nil && st.IsDir() {
+				items[i].glob = filepath.Join(from, "*")
+			}
 		}
 	}
 	return items, nil
 }
 
+const (
+	// Lines in any supported format are auto-detected
+	nameFormatAuto = iota
+	// hosts(5) format, i.e. lines without leading IP address are ignored
+	nameFormatHosts
+	// Response Policy Zone file, QNAME triggers are taken as names
+	nameFormatRpz
+	// v2ray/xray geosite.dat, domains of a category are taken as names
+	nameFormatGeosite
+)
+
+var formPrefixes = []struct {
+	prefix string
+	format int
+}{
+	{"hosts:", nameFormatHosts},
+	{"rpz:", nameFormatRpz},
+	{"geosite:", nameFormatGeosite},
+}
+
+// Split the optional format prefix of a FROM form, e.g. `hosts:/etc/hosts' forces hosts(5) format
+func splitFormPrefix(from string) (string, int) {
+	for _, p := range formPrefixes {
+		if strings.HasPrefix(from, p.prefix) {
+			return from[len(p.prefix):], p.format
+		}
+	}
+	return from, nameFormatAuto
+}
+
 type NameList struct {
 	// List of name items
 	items []*NameItem
@@ -190,35 +303,193 @@ type NameList struct {
 	urlReload      time.Duration
 	urlReadTimeout time.Duration
 	stopUrlReload  chan struct{}
+	// Size limit of URL contents, see url_max_size
+	urlMaxSize int64
+
+	// Filesystem cache shared by multiple instances, nil if disabled
+	sharedCache *sharedUrlCache
+	// Persistent cache of URL contents, nil if disabled
+	urlCache *urlCache
+	// Signature verification of sources, nil if disabled
+	signer *listSigner
+	// Canary rollout of name list updates, nil if disabled
+	canary *canaryRollout
+	// Name of the owning stanza, used in events
+	stanza string
+	// Non-zero if frozen, see freeze.go
+	frozen int32
+	// Paths are polled only, rather than watched for changes, see `no_path_watch'
+	noPathWatch bool
+	// Non-zero if paths are being watched, see watch.go
+	watching int32
+
+	// Convert names into the compiled representation after parsing, see lite mode
+	compact bool
+	// Memory ceiling in bytes of names of all items, zero if unlimited
+	memoryCeiling uint64
+	memoryLock    sync.Mutex
+	// Memory footprint of accepted names of each item, only accounted if memoryCeiling isn't zero
+	itemBytes map[*NameItem]uint64
+
+	// Build bloom filters of names, see `match_accel bloom'
+	bloom bool
+	// Posts cache flush hints of reloads, nil if disabled
+	flushHook *flushHook
+}
+
+func (item *NameItem) String() string {
+	if item.whichType == NameItemTypeUrl {
+		return item.url
+	}
+	return item.path
+}
+
+// Return current names of the item, it's safe to use without locking since names are never modified once stored
+func (item *NameItem) loadNames() *itemNames {
+	if s, ok := item.current.Load().(*itemNames); ok {
+		return s
+	}
+	return emptyItemNames
+}
+
+// Swap in names of the item atomically
+// MT-Unsafe: must be called with item locked, thus concurrent updates won't overwrite each other
+func (item *NameItem) storeNames(s *itemNames) {
+	item.current.Store(s)
+}
+
+// Return the name set and tags for lookups, canary ones are returned if requested and present
+func (s *itemNames) lookupSet(canary bool) (domainSet, map[string][]string) {
+	if canary && s.canary != nil {
+		return s.canary.names, s.canary.tags
+	}
+	return s.names, s.tags
+}
+
+// Return the bloom filter of the name set for lookups, see lookupSet()
+func (s *itemNames) lookupFilter(canary bool) *bloomFilter {
+	if canary && s.canary != nil {
+		return s.canary.bloom
+	}
+	return s.bloom
+}
+
+// Return the matched name in the name set or the compiled list(if any)
+// The name set is skipped if the child is rejected by the bloom filter(if any).
+func (s *itemNames) matchIn(names domainSet, filter *bloomFilter, child string) (string, bool) {
+	if filter.mayMatch(child) {
+		if name, ok := names.MatchName(child); ok {
+			return name, true
+		}
+	}
+	if s.compiled != nil {
+		return s.compiled.Match(child)
+	}
+	return "", false
+}
+
+// Return the exception set for lookups, the canary one is returned if requested and present
+func (s *itemNames) lookupExcepts(canary bool) domainSet {
+	if canary && s.canary != nil {
+		return s.canary.excepts
+	}
+	return s.excepts
 }
 
 // Assume `child' is lower cased and without trailing dot
 func (n *NameList) Match(child string) bool {
+	return n.match(child, false)
+}
+
+func (n *NameList) match(child string, canary bool) bool {
 	for _, item := range n.items {
-		item.RLock()
-		if item.names.Match(child) {
-			item.RUnlock()
+		s := item.loadNames()
+		names, _ := s.lookupSet(canary)
+		if _, ok := s.matchIn(names, s.lookupFilter(canary), child); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if `child' matched any exception rule
+// Assume `child' is lower cased and without trailing dot
+func (n *NameList) excepted(child string, canary bool) bool {
+	for _, item := range n.items {
+		excepts := item.loadNames().lookupExcepts(canary)
+		if len(excepts) != 0 && excepts.Match(child) {
 			return true
 		}
-		item.RUnlock()
 	}
 	return false
 }
 
+// Return the matched name and true if `child' matched
+// Assume `child' is lower cased and without trailing dot
+func (n *NameList) matchName(child string) (string, bool) {
+	for _, item := range n.items {
+		s := item.loadNames()
+		if name, ok := s.matchIn(s.names, s.bloom, child); ok {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Return tags of the matched name and true if `child' matched
+// Assume `child' is lower cased and without trailing dot
+func (n *NameList) MatchTags(child string) ([]string, bool) {
+	return n.matchTags(child, false)
+}
+
+func (n *NameList) matchTags(child string, canary bool) ([]string, bool) {
+	for _, item := range n.items {
+		s := item.loadNames()
+		names, tags := s.lookupSet(canary)
+		if name, ok := s.matchIn(names, s.lookupFilter(canary), child); ok {
+			return tags[name], true
+		}
+	}
+	return nil, false
+}
+
 // MT-Unsafe
 func (n *NameList) periodicUpdate(bootstrap []string) {
 	// Kick off initial name list content population
 	n.updateList(NameItemTypeLast, bootstrap)
 
 	if n.pathReload > 0 {
+		interval := n.pathReload
+		if !n.noPathWatch && n.watchPaths() && interval < pathWatchPollInterval {
+			// Polling is kept as a fallback of missed events
+			interval = pathWatchPollInterval
+		}
 		go func() {
-			ticker := time.NewTicker(n.pathReload)
+			ticker := clock.NewTicker(interval)
 			for {
 				select {
 				case <-n.stopPathReload:
 					return
-				case <-ticker.C:
-					n.updateList(NameItemTypePath, bootstrap)
+				case <-ticker.Chan():
+					if !n.isFrozen() {
+						n.updateList(NameItemTypePath, bootstrap)
+					}
+				}
+			}
+		}()
+	}
+
+	if n.canary != nil {
+		go func() {
+			ticker := clock.NewTicker(canaryCheckInterval)
+			for {
+				select {
+				case <-n.stopUrlReload:
+					return
+				case <-ticker.Chan():
+					if !n.isFrozen() {
+						n.promoteCanary()
+					}
 				}
 			}
 		}()
@@ -226,21 +497,33 @@ func (n *NameList) periodicUpdate(bootstrap []string) {
 
 	if n.urlReload > 0 {
 		go func() {
-			ticker := time.NewTicker(n.urlReload)
+			ticker := clock.NewTicker(n.urlReload)
 			for {
 				select {
 				case <-n.stopUrlReload:
 					return
-				case <-ticker.C:
-					n.updateList(NameItemTypeUrl, bootstrap)
+				case <-ticker.Chan():
+					if !n.isFrozen() {
+						n.updateList(NameItemTypeUrl, bootstrap)
+					}
 				}
 			}
 		}()
 	}
+
+	for _, item := range n.items {
+		if item != nil && item.reload > 0 {
+			n.scheduleItem(item, bootstrap)
+		}
+	}
 }
 
 func (n *NameList) updateList(whichType int, bootstrap []string) {
 	for _, item := range n.items {
+		if whichType != NameItemTypeLast && item.reload != 0 {
+			// Reloaded by its own worker, or never reloaded
+			continue
+		}
 		if whichType == NameItemTypeLast || whichType == item.whichType {
 			switch item.whichType {
 			case NameItemTypePath:
@@ -248,8 +531,8 @@ func (n *NameList) updateList(whichType int, bootstrap []string) {
 			case NameItemTypeUrl:
 				if whichType == NameItemTypeLast {
 					n.initialUpdateFromUrl(item, bootstrap)
-				} else {
-					_ = n.updateItemFromUrl(item, bootstrap)
+				} else if atomic.LoadInt32(&item.retrying) == 0 && !n.fetchItem(item, bootstrap) {
+					n.retryItem(item, bootstrap)
 				}
 			default:
 				panic(fmt.Sprintf("Unexpected NameItem type %v", whichType))
@@ -259,6 +542,11 @@ func (n *NameList) updateList(whichType int, bootstrap []string) {
 }
 
 func (n *NameList) updateItemFromPath(item *NameItem) {
+	if len(item.glob) != 0 {
+		n.updateItemFromGlob(item)
+		return
+	}
+
 	file, err := os.Open(item.path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -286,53 +574,369 @@ func (n *NameList) updateItemFromPath(item *NameItem) {
 		log.Warningf("%v", err)
 	}
 
+	v, err := n.itemVerifier(item, nil)
+	if err != nil {
+		log.Warningf("Failed to verify %v, old list is kept, err: %v", file.Name(), err)
+		item.setFileStat(stat)
+		return
+	}
+
+	magic := make([]byte, len(compiled.Magic))
+	if _, err := file.ReadAt(magic, 0); err == nil && compiled.IsCompiled(magic) {
+		if item.except {
+			log.Warningf("Failed to load %v, err: %v", file.Name(), errCompiledExcept)
+			item.setFileStat(stat)
+			return
+		}
+		if v != nil {
+			if err := n.verifyContent(v, file); err != nil {
+				log.Warningf("Failed to verify %v, old list is kept, err: %v", file.Name(), err)
+				item.setFileStat(stat)
+				return
+			}
+		}
+		n.updateItemFromCompiled(item, stat)
+		return
+	}
+
+	// The file is closed by the deferred call above
+	rc, err := newDecompressReader(ioutil.NopCloser(file), compressionOf(item.path))
+	if err != nil {
+		log.Warningf("Failed to decompress %v, old list is kept, err: %v", file.Name(), err)
+		item.setFileStat(stat)
+		return
+	}
+	defer Close(rc)
+	var r io.Reader = rc
+	if v != nil {
+		r = io.TeeReader(r, v)
+	}
+
 	t1 := time.Now()
-	names, totalLines := n.parse(file)
+	names, tags, excepts, totalLines, err := n.parse(r, item)
 	t2 := time.Since(t1)
+	if err != nil {
+		log.Warningf("Failed to parse %v after %v lines, old list is kept, err: %v", file.Name(), totalLines, err)
+		item.setFileStat(stat)
+		return
+	}
+	if v != nil {
+		if err := n.verifyContent(v, r); err != nil {
+			log.Warningf("Failed to verify %v, old list is kept, err: %v", file.Name(), err)
+			item.setFileStat(stat)
+			return
+		}
+	}
 	log.Debugf("Parsed %v  time spent: %v name added: %v / %v",
 		file.Name(), t2, names.Len(), totalLines)
 
 	item.Lock()
-	item.names = names
+	n.swapNames(item, names, tags, excepts)
 	item.mtime = stat.ModTime()
 	item.size = stat.Size()
 	item.Unlock()
 }
 
-func (n *NameList) parse(r io.Reader) (domainSet, uint64) {
+// Record stat of the file which failed to load, thus it won't be loaded again until changed
+func (item *NameItem) setFileStat(stat os.FileInfo) {
+	item.Lock()
+	item.mtime = stat.ModTime()
+	item.size = stat.Size()
+	item.Unlock()
+}
+
+// Load a compiled name list, which is memory-mapped and looked up in place rather than parsed
+// Canary rollout doesn't apply, since there is no parsing cost to amortize nor a name set to keep aside.
+func (n *NameList) updateItemFromCompiled(item *NameItem, stat os.FileInfo) {
+	t1 := time.Now()
+	l, err := compiled.Open(item.path)
+	if err != nil {
+		log.Warningf("Failed to load compiled %v: %v", item.path, err)
+		return
+	}
+	log.Debugf("Loaded compiled %v  time spent: %v names: %v", item.path, time.Since(t1), l.Len())
+	publish(Event{Type: EventListReloaded, Stanza: n.stanza, Source: item.String(), Names: uint64(l.Len())})
+
+	item.Lock()
+	// The old list(if any) is unmapped once unreachable, since lookups may still be in flight
+	item.storeNames(&itemNames{names: make(domainSet), compiled: l, bytes: uint64(l.Size())})
+	item.mtime = stat.ModTime()
+	item.size = stat.Size()
+	item.Unlock()
+}
+
+// Parse a name list in format of the item, the returned count is number of lines or records parsed
+// Names parsed before an error(e.g. a read error of a URL body) are returned along with the error.
+func (n *NameList) parse(r io.Reader, item *NameItem) (domainSet, map[string][]string, domainSet, uint64, error) {
 	names := make(domainSet)
+	tags := make(map[string][]string)
+	excepts := make(domainSet)
+	totalLines, err := n.parseInto(names, tags, excepts, r, item)
+	return names, tags, excepts, totalLines, err
+}
+
+// Parse a name list into existing sets, see parse()
+func (n *NameList) parseInto(names domainSet, tags map[string][]string, excepts domainSet, r io.Reader, item *NameItem) (uint64, error) {
+	switch item.format {
+	case nameFormatRpz:
+		return parseRpz(names, excepts, r)
+	case nameFormatGeosite:
+		var total uint64
+		data, err := ioutil.ReadAll(r)
+		if err == nil {
+			total, err = parseGeosite(names, data, item.category)
+		}
+		return total, err
+	}
 
 	var totalLines uint64
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		totalLines++
+		parseNameLine(names, tags, excepts, scanner.Text(), item.format == nameFormatHosts)
+	}
+	if err := scanner.Err(); err != nil {
+		// e.g. bufio.ErrTooLong
+		return totalLines, fmt.Errorf("line %v: %w", totalLines+1, err)
+	}
+	return totalLines, nil
+}
 
-		line := scanner.Text()
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
+// Parse a single line of name list, the domain name(if any) will be added to `names'
+// Tags following the domain name, e.g. `example.com #streaming #video', will be added to `tags'
+// Lines in hosts(5) format are auto-detected, other lines are ignored if `hostsFormat' is true.
+// Domains of adblock exception rules will be added to `excepts'.
+// Lines of Clash rulesets are auto-detected, see clashRule().
+func parseNameLine(names domainSet, tags map[string][]string, excepts domainSet, line string, hostsFormat bool) {
+	spec := strings.TrimSpace(line)
+	if strings.HasPrefix(spec, "server=/") {
+		if !hostsFormat {
+			parseServerLine(names, tags, spec)
+		}
+		return
+	}
+	if isAdblockLine(spec) {
+		if !hostsFormat {
+			parseAdblockLine(names, excepts, spec)
+		}
+		return
+	}
+	if rule, ok := clashRule(spec); ok {
+		if !hostsFormat && len(rule) != 0 {
+			parseClashRule(names, rule)
 		}
+		return
+	}
 
-		f := strings.Split(line, "/")
-		if len(f) != 3 {
-			// Treat the whole line as a domain name
-			_ = names.Add(line)
-			continue
+	var lineTags []string
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		lineTags = parseTags(line[i:])
+		line = line[:i]
+	}
+
+	if fields := strings.Fields(line); len(fields) != 0 && net.ParseIP(fields[0]) != nil {
+		// Format: <ip> <hostname> [<alias>...], the IP address is discarded
+		for _, field := range fields[1:] {
+			if isHostsPlaceholder(field) {
+				continue
+			}
+			if name, ok := names.add(field); ok && len(lineTags) != 0 {
+				tags[name] = append(tags[name], lineTags...)
+			}
 		}
+		return
+	}
+	if hostsFormat {
+		return
+	}
 
-		// Format: server=/<domain>/<?>
-		if f[0] != "server=" {
+	if strings.Count(line, "/") == 2 {
+		// Other dnsmasq options, e.g. address=/<domain>/<ip>
+		return
+	}
+	// Treat the whole line as a domain name
+	if name, ok := names.add(strings.TrimSpace(line)); ok && len(lineTags) != 0 {
+		tags[name] = append(tags[name], lineTags...)
+	}
+}
+
+// Parse a line in dnsmasq format: server=/<domain>[/<domain>...]/[<ip>[#<port>]]
+// The upstream address(if any) is added to tags of the domains as `@IP:PORT', see server_override.
+// Thus server=/<domain>/, server=/<domain>/# only match the domain, see: https://manpages.ubuntu.com/manpages/bionic/man8/dnsmasq.8.html
+func parseServerLine(names domainSet, tags map[string][]string, line string) {
+	// Port is separated by `#', thus comment must be separated by whitespace
+	spec, comment := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		spec, comment = line[:i], strings.TrimSpace(line[i:])
+	}
+	lineTags := parseTags(comment)
+
+	f := strings.Split(spec, "/")
+	if len(f) < 3 {
+		return
+	}
+	if addr := parseServerAddr(f[len(f)-1]); len(addr) != 0 {
+		lineTags = append(lineTags, serverTagPrefix+addr)
+	}
+	for _, domain := range f[1 : len(f)-1] {
+		name, ok := names.add(domain)
+		if !ok {
+			log.Warningf("%q isn't a domain name", domain)
 			continue
 		}
+		if len(lineTags) != 0 {
+			tags[name] = append(tags[name], lineTags...)
+		}
+	}
+}
+
+// Return IP:PORT of a dnsmasq server address in <ip>[#<port>] format, empty if it's not an IP address
+func parseServerAddr(s string) string {
+	ip, port := SplitByByte(s, '#')
+	if net.ParseIP(ip) == nil {
+		return ""
+	}
+	if len(port) == 0 {
+		return net.JoinHostPort(ip, "53")
+	}
+	if n, err := strconv.Atoi(port[1:]); err != nil || n <= 0 || n > 65535 {
+		return ""
+	}
+	return net.JoinHostPort(ip, port[1:])
+}
+
+// Return true if the line is in AdGuard/uBlock filter syntax, i.e. a basic rule, an exception, a comment or a cosmetic rule
+func isAdblockLine(line string) bool {
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") ||
+		strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return true
+	}
+	// Cosmetic rules, e.g. example.com##.banner, which must not be treated as domain with tags
+	i := strings.IndexByte(line, '#')
+	if i <= 0 || strings.ContainsAny(line[:i], " \t") {
+		return false
+	}
+	for _, sep := range adblockCosmeticSeps {
+		if strings.HasPrefix(line[i:], sep) {
+			return true
+		}
+	}
+	return false
+}
+
+var adblockCosmeticSeps = []string{"##", "#@#", "#?#", "#$#", "#%#"}
+
+// Parse a line in AdGuard/uBlock filter syntax, only domain rules are honored
+// Domain of `||<domain>^' is added to `names', and of exception `@@||<domain>^' is added to `excepts'.
+// Rules with modifiers(except `$important'), wildcards or paths aren't domain rules, thus ignored, as comments and cosmetic rules.
+func parseAdblockLine(names, excepts domainSet, line string) {
+	set := names
+	if strings.HasPrefix(line, "@@") {
+		set = excepts
+		line = line[2:]
+	}
+	if !strings.HasPrefix(line, "||") {
+		return
+	}
+	line = line[2:]
+
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		if line[i+1:] != "important" {
+			return
+		}
+		line = line[:i]
+	}
+	line = strings.TrimSuffix(line, "^")
+	if len(line) == 0 || strings.ContainsAny(line, "*/|^") {
+		return
+	}
+	if _, ok := set.add(line); !ok {
+		log.Debugf("%q isn't a domain name", line)
+	}
+}
+
+// Return the rule of a line in Clash ruleset, i.e. a classical rule(e.g. `DOMAIN-SUFFIX,example.com`)
+// either in text or as a YAML list item(e.g. `  - 'DOMAIN,www.example.com'`) of rule-provider payload
+// Items of domain behavior rule-providers(e.g. `  - '+.example.com'`) are returned as DOMAIN-SUFFIX rules.
+func clashRule(line string) (string, bool) {
+	if line == "payload:" {
+		return "", true
+	}
+	if strings.HasPrefix(line, "- ") {
+		line = strings.Trim(strings.TrimSpace(line[2:]), `'"`)
+		if !strings.Contains(line, ",") {
+			return "DOMAIN-SUFFIX," + strings.TrimLeft(line, "+."), true
+		}
+	}
+	i := strings.IndexByte(line, ',')
+	if i <= 0 {
+		return "", false
+	}
+	for _, c := range line[:i] {
+		if c != '-' && (c < 'A' || c > 'Z') {
+			return "", false
+		}
+	}
+	return line, true
+}
+
+// Parse a Clash rule, domain of DOMAIN and DOMAIN-SUFFIX rules is added to `names'
+// Note that a DOMAIN rule also matches subdomains, since name lists always match subdomains.
+// Other rules(e.g. DOMAIN-KEYWORD, IP-CIDR) aren't applicable thus ignored, as policy of the rule(if any).
+func parseClashRule(names domainSet, rule string) {
+	fields := strings.Split(rule, ",")
+	if len(fields) < 2 || (fields[0] != "DOMAIN" && fields[0] != "DOMAIN-SUFFIX") {
+		return
+	}
+	name := strings.TrimSpace(fields[1])
+	if _, ok := names.add(name); !ok {
+		log.Debugf("%q isn't a domain name", name)
+	}
+}
+
+// Prefix of the upstream address in tags of a name, which never collides with tag names, see isTagName()
+const serverTagPrefix = "@"
+
+// Return the upstream address in tags, empty if none
+func serverOfTags(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, serverTagPrefix) {
+			return tag[len(serverTagPrefix):]
+		}
+	}
+	return ""
+}
 
-		// Don't check f[2], see: http://manpages.ubuntu.com/manpages/bionic/man8/dnsmasq.8.html
-		// Thus server=/<domain>/<ip>, server=/<domain>/, server=/<domain>/# won't be honored
+// Return true if a hosts(5) entry is a well-known local name or an IP address, which isn't a domain to redirect
+// e.g. `127.0.0.1 localhost' and `0.0.0.0 0.0.0.0' in blocklists.
+func isHostsPlaceholder(name string) bool {
+	switch strings.ToLower(strings.TrimSuffix(name, ".")) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost":
+		return true
+	}
+	return strings.HasPrefix(name, "ip6-") || net.ParseIP(name) != nil
+}
 
-		if !names.Add(f[1]) {
-			log.Warningf("%q isn't a domain name", f[1])
+// Parse leading `#tag' words of a comment, the remaining text is treated as ordinary comment
+// Thus `# comment' yields no tag at all
+func parseTags(comment string) []string {
+	var tags []string
+	for _, word := range strings.Fields(comment) {
+		if len(word) < 2 || word[0] != '#' || !isTagName(word[1:]) {
+			break
 		}
+		tags = append(tags, strings.ToLower(word[1:]))
 	}
+	return tags
+}
 
-	return names, totalLines
+func isTagName(s string) bool {
+	for _, c := range s {
+		if c != '-' && c != '_' && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return len(s) != 0
 }
 
 // Return true if NameItem updated
@@ -341,53 +945,143 @@ func (n *NameList) updateItemFromUrl(item *NameItem, bootstrap []string) bool {
 		panic("Function call misuse or bad URL config")
 	}
 
+	if n.sharedCache != nil {
+		return n.updateItemFromSharedUrl(item, bootstrap)
+	}
+
+	item.RLock()
+	cond := item.validators
+	item.RUnlock()
+
 	t1 := time.Now()
-	content, err := getUrlContent(item.url, "text/plain", bootstrap, n.urlReadTimeout)
-	t2 := time.Since(t1)
+	resp, err := openUrl(item.url, "text/plain", bootstrap, n.readTimeout(item), item.header, cond)
+	if err == errNotModified {
+		log.Debugf("%v not modified", item.url)
+		if n.urlCache != nil {
+			n.urlCache.touch(item.url)
+		}
+		return true
+	}
 	if err != nil {
 		log.Warningf("Failed to update %q, err: %v", item.url, err)
 		return false
 	}
+	defer Close(resp.Body)
+
+	v, err := n.itemVerifier(item, bootstrap)
+	if err != nil {
+		log.Warningf("Failed to update %q, old list is kept, err: %v", item.url, err)
+		return false
+	}
+
+	// The body is parsed while downloading, thus huge lists never reside in memory as a whole
+	h := fnv.New64a()
+	r := io.TeeReader(newSizeLimitReader(resp.Body, n.urlMaxSize), h)
+	if v != nil {
+		r = io.TeeReader(r, v)
+	}
+	var cache *urlCacheFile
+	if n.urlCache != nil {
+		if cache, err = n.urlCache.create(item.url); err != nil {
+			log.Warningf("Failed to cache %q, err: %v", item.url, err)
+		} else {
+			r = io.TeeReader(r, cache)
+		}
+	}
+	names, tags, excepts, totalLines, err := n.parse(r, item)
+	t2 := time.Since(t1)
+	if err != nil {
+		if cache != nil {
+			cache.abort()
+		}
+		log.Warningf("Failed to update %q after %v lines parsed, old list is kept, err: %v", item.url, totalLines, err)
+		return false
+	}
+	if v != nil {
+		if err := n.verifyContent(v, r); err != nil {
+			if cache != nil {
+				cache.abort()
+			}
+			log.Warningf("Failed to update %q, old list is kept, err: %v", item.url, err)
+			return false
+		}
+	}
+	if cache != nil {
+		if err := cache.commit(); err != nil {
+			log.Warningf("Failed to cache %q, err: %v", item.url, err)
+		}
+	}
 
 	item.RLock()
 	contentHash := item.contentHash
 	item.RUnlock()
-	contentHash1 := stringHash(content)
+	contentHash1 := h.Sum64()
+	validators := responseValidators(resp)
 	if contentHash1 == contentHash {
+		item.Lock()
+		item.validators = validators
+		item.Unlock()
 		return true
 	}
+	log.Debugf("Fetched %v, time spent: %v, added: %v / %v, hash: %#x",
+		item.url, t2, names.Len(), totalLines, contentHash1)
 
-	names := make(domainSet)
-	var totalLines uint64
-	t3 := time.Now()
-	lines := strings.Split(content, "\n")
-	for _, line := range lines {
-		totalLines++
+	item.Lock()
+	n.swapNames(item, names, tags, excepts)
+	item.contentHash = contentHash1
+	item.validators = validators
+	item.Unlock()
 
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
-		}
+	return true
+}
 
-		f := strings.Split(line, "/")
-		if len(f) != 3 {
-			_ = names.Add(line)
-			continue
-		}
+// Update the item from the content of the shared cache, see url_shared_cache
+// The content is parsed while streaming, as updateItemFromUrl() does.
+func (n *NameList) updateItemFromSharedUrl(item *NameItem, bootstrap []string) bool {
+	v, err := n.itemVerifier(item, bootstrap)
+	if err != nil {
+		log.Warningf("Failed to update %q, old list is kept, err: %v", item.url, err)
+		return false
+	}
 
-		if f[0] != "server=" {
-			continue
+	t1 := time.Now()
+	h := fnv.New64a()
+	var names, excepts domainSet
+	var tags map[string][]string
+	var totalLines uint64
+	err = n.fetchUrlShared(item, bootstrap, func(r io.Reader) error {
+		r = io.TeeReader(r, h)
+		if v != nil {
+			r = io.TeeReader(r, v)
 		}
-
-		if !names.Add(f[1]) {
-			log.Warningf("%q isn't a domain name", f[1])
+		var err error
+		names, tags, excepts, totalLines, err = n.parse(r, item)
+		if err != nil {
+			return fmt.Errorf("parse failed after %v lines: %w", totalLines, err)
+		}
+		if v != nil {
+			return n.verifyContent(v, r)
 		}
+		return nil
+	})
+	t2 := time.Since(t1)
+	if err != nil {
+		log.Warningf("Failed to update %q, old list is kept, err: %v", item.url, err)
+		return false
 	}
-	t4 := time.Since(t3)
-	log.Debugf("Fetched %v, time spent: %v %v, added: %v / %v, hash: %#x",
-		item.url, t2, t4, names.Len(), totalLines, contentHash1)
+
+	item.RLock()
+	contentHash := item.contentHash
+	item.RUnlock()
+	contentHash1 := h.Sum64()
+	if contentHash1 == contentHash {
+		return true
+	}
+	log.Debugf("Fetched %v, time spent: %v, added: %v / %v, hash: %#x",
+		item.url, t2, names.Len(), totalLines, contentHash1)
 
 	item.Lock()
-	item.names = names
+	n.swapNames(item, names, tags, excepts)
 	item.contentHash = contentHash1
 	item.Unlock()
 
@@ -398,6 +1092,10 @@ func (n *NameList) updateItemFromUrl(item *NameItem, bootstrap []string) bool {
 //	thus we need to fallback to it(if any) in case of population failure
 func (n *NameList) initialUpdateFromUrl(item *NameItem, bootstrap []string) {
 	go func() {
+		if n.urlCache != nil {
+			// Matching works before the network is up, or even if the fetches below failed
+			n.loadUrlCache(item)
+		}
 		// Fast retry in case of unstable network
 		retryIntervals := []time.Duration{
 			500 * time.Millisecond,
@@ -405,10 +1103,12 @@ func (n *NameList) initialUpdateFromUrl(item *NameItem, bootstrap []string) {
 		}
 		i := 0
 		for {
-			if n.updateItemFromUrl(item, bootstrap) {
+			if n.fetchItem(item, bootstrap) {
 				break
 			}
 			if i == len(retryIntervals) {
+				// Keep retrying with backoff, rather than waiting for the next reload
+				n.retryItem(item, bootstrap)
 				break
 			}
 			time.Sleep(retryIntervals[i])
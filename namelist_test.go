@@ -0,0 +1,995 @@
+package dnsredir
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseNameLine(t *testing.T) {
+	tests := []struct {
+		line         string
+		expectedName string
+		expectedTags []string
+	}{
+		{"", "", nil},
+		{"# comment", "", nil},
+		{"example.com", "example.com", nil},
+		{"Example.COM.", "example.com", nil},
+		{"example.com # comment", "example.com", nil},
+		{"example.com #streaming", "example.com", []string{"streaming"}},
+		{"example.com #streaming #Video comment #ignored", "example.com", []string{"streaming", "video"}},
+		{"example.com#ads", "example.com", []string{"ads"}},
+		{"#ads", "", nil},
+		{"server=/example.org/114.114.114.114 #cn", "example.org", []string{"cn", "@114.114.114.114:53"}},
+		{"server=/example.org/1.2.3.4#5353", "example.org", []string{"@1.2.3.4:5353"}},
+		{"server=/example.org/", "example.org", nil},
+		{"server=/example.org/#", "example.org", nil},
+		{"server=/example.org/1.2.3.4#99999", "example.org", nil},
+		{"address=/example.org/1.2.3.4 #cn", "", nil},
+		{"0.0.0.0 ads.example.com", "ads.example.com", nil},
+		{"127.0.0.1\tTracker.Example.NET #ads", "tracker.example.net", []string{"ads"}},
+		{"::1 ip6-localhost ip6-loopback", "", nil},
+		{"127.0.0.1 localhost", "", nil},
+		{"0.0.0.0 0.0.0.0", "", nil},
+		{"payload:", "", nil},
+		{"DOMAIN-SUFFIX,Example.com", "example.com", nil},
+		{"DOMAIN,www.example.com,Proxy", "www.example.com", nil},
+		{"  - 'DOMAIN-SUFFIX,example.org'", "example.org", nil},
+		{"  - \"+.example.net\"", "example.net", nil},
+		{"DOMAIN-KEYWORD,example", "", nil},
+		{"IP-CIDR,10.0.0.0/8,DIRECT", "", nil},
+	}
+
+	for i, test := range tests {
+		names := make(domainSet)
+		tags := make(map[string][]string)
+		parseNameLine(names, tags, make(domainSet), test.line, false)
+
+		if test.expectedName == "" {
+			if names.Len() != 0 || len(tags) != 0 {
+				t.Errorf("Test#%v failed  expected nothing, got %v %v", i, names, tags)
+			}
+			continue
+		}
+		if names.Len() != 1 || !names.Match(test.expectedName) {
+			t.Errorf("Test#%v failed  expected %q, got %v", i, test.expectedName, names)
+			continue
+		}
+		if !reflect.DeepEqual(tags[test.expectedName], test.expectedTags) {
+			t.Errorf("Test#%v failed  expected tags %v, got %v", i, test.expectedTags, tags[test.expectedName])
+		}
+	}
+}
+
+func TestParseServerLine(t *testing.T) {
+	names := make(domainSet)
+	tags := make(map[string][]string)
+	parseNameLine(names, tags, make(domainSet), "server=/example.com/example.net/2001:db8::1#5353 #cn", false)
+	for _, name := range []string{"example.com", "example.net"} {
+		if !names.Match(name) {
+			t.Errorf("Expected %q added, got %v", name, names)
+		}
+		if addr := serverOfTags(tags[name]); addr != "[2001:db8::1]:5353" {
+			t.Errorf("Expected server of %q, got %q", name, addr)
+		}
+	}
+	if addr := serverOfTags([]string{"cn"}); addr != "" {
+		t.Errorf("Expected no server, got %q", addr)
+	}
+}
+
+func TestParseAdblockLine(t *testing.T) {
+	names := make(domainSet)
+	tags := make(map[string][]string)
+	excepts := make(domainSet)
+	for _, line := range []string{
+		"[Adblock Plus 2.0]",
+		"! Title: filter list",
+		"||ads.example.com^",
+		"||tracker.example.net^$important",
+		"||cdn.example.org^$third-party",
+		"||*.example.org^",
+		"||example.org/banner.js",
+		"@@||good.ads.example.com^",
+		"example.com##.banner",
+		"example.com#@#.banner",
+	} {
+		parseNameLine(names, tags, excepts, line, false)
+	}
+	if names.Len() != 2 || !names.Match("ads.example.com") || !names.Match("tracker.example.net") {
+		t.Errorf("Expected domain rules only, got %v", names)
+	}
+	if excepts.Len() != 1 || !excepts.Match("www.good.ads.example.com") {
+		t.Errorf("Expected exception rule, got %v", excepts)
+	}
+	if len(tags) != 0 {
+		t.Errorf("Expected no tags, got %v", tags)
+	}
+
+	item := &NameItem{}
+	item.storeNames(&itemNames{names: names, excepts: excepts})
+	n := &NameList{items: []*NameItem{item}}
+	if !n.match("x.ads.example.com", false) || !n.excepted("good.ads.example.com", false) || n.excepted("ads.example.com", false) {
+		t.Errorf("Unexpected match of exception rules")
+	}
+}
+
+func TestParseHostsFormat(t *testing.T) {
+	names := make(domainSet)
+	tags := make(map[string][]string)
+	for _, line := range []string{
+		"# hosts file",
+		"127.0.0.1 localhost",
+		"0.0.0.0 a.example.com b.example.com",
+		"c.example.com",
+	} {
+		parseNameLine(names, tags, make(domainSet), line, true)
+	}
+	if names.Len() != 2 || !names.Match("a.example.com") || !names.Match("b.example.com") {
+		t.Errorf("Expected aliases of hosts entry, got %v", names)
+	}
+	if names.Match("c.example.com") {
+		t.Errorf("Expected non-hosts line ignored, got %v", names)
+	}
+
+	items, err := NewNameItemsWithForms([]string{"hosts:/etc/hosts", "hosts:https://example.com/hosts", "list.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].format != nameFormatHosts || items[0].path != "/etc/hosts" {
+		t.Errorf("Unexpected item %v, format: %v", items[0], items[0].format)
+	}
+	if items[1].format != nameFormatHosts || items[1].whichType != NameItemTypeUrl || items[1].url != "https://example.com/hosts" {
+		t.Errorf("Unexpected item %v, format: %v", items[1], items[1].format)
+	}
+	if items[2].format != nameFormatAuto {
+		t.Errorf("Unexpected format of %v", items[2])
+	}
+}
+
+func TestParseRpz(t *testing.T) {
+	zone := `$TTL 300
+@ IN SOA localhost. root.localhost. 1 3600 600 86400 300
+  IN NS  localhost.
+ads.example.com          CNAME .
+*.tracker.example.net    CNAME *.
+malware.example.org      A     127.0.0.1
+good.ads.example.com     CNAME rpz-passthru.
+32.1.0.0.10.rpz-ip       CNAME .
+ns.example.com.rpz-nsdname CNAME .
+`
+	var n NameList
+	names, _, excepts, _, err := n.parse(strings.NewReader("$ORIGIN rpz.local.\n"+zone), &NameItem{format: nameFormatRpz})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names.Len() != 3 {
+		t.Errorf("Expected 3 names, got %v", names)
+	}
+	for _, name := range []string{"ads.example.com", "tracker.example.net", "malware.example.org"} {
+		if !names.Match(name) {
+			t.Errorf("Expected %q in names", name)
+		}
+	}
+	if excepts.Len() != 1 || !excepts.Match("good.ads.example.com") {
+		t.Errorf("Expected passthru in excepts, got %v", excepts)
+	}
+
+	items, err := NewNameItemsWithForms([]string{"rpz:/etc/zone.rpz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].format != nameFormatRpz || items[0].path != "/etc/zone.rpz" {
+		t.Errorf("Unexpected item %v, format: %v", items[0], items[0].format)
+	}
+}
+
+func TestNameListMatchAll(t *testing.T) {
+	set := make(domainSet)
+	set.Add("example.com")
+	set.Add("example.org")
+	item := &NameItem{}
+	item.storeNames(&itemNames{names: set})
+	n := &NameList{items: []*NameItem{item}}
+
+	matched := n.MatchAll([]string{"example.com", "WWW.Example.ORG.", "example.net", ".", ""})
+	if expected := []bool{true, true, false, false, false}; !reflect.DeepEqual(matched, expected) {
+		t.Errorf("Expected %v, got %v", expected, matched)
+	}
+
+	extra := make(domainSet)
+	extra.Add("example.net")
+	extra.Add("example.com")
+	s := n.snapshot(extra)
+	if s.Len() != 3 {
+		t.Errorf("Expected 3 names, got %v", s.Len())
+	}
+	var names []string
+	for name, ok := s.Next(); ok; name, ok = s.Next() {
+		names = append(names, name)
+	}
+	if expected := []string{"example.com", "example.net", "example.org"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+}
+
+func TestCompiledNameList(t *testing.T) {
+	var buf bytes.Buffer
+	stats, err := CompileNameList(strings.NewReader("example.com\nserver=/example.org/1.1.1.1\n@@||ads.example.com^\n"), &buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Names != 2 || stats.Tagged != 1 || stats.Excepts != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	dir, err := ioutil.TempDir("", "dnsredir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list.bin")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	item := &NameItem{whichType: NameItemTypePath, path: path}
+	n := &NameList{items: []*NameItem{item}}
+	n.updateItemFromPath(item)
+	if item.loadNames().compiled == nil {
+		t.Fatalf("Expected compiled list loaded")
+	}
+	if !n.Match("www.example.com") || !n.Match("example.org") || n.Match("example.net") {
+		t.Errorf("Unexpected match of compiled list")
+	}
+	if matched := n.MatchAll([]string{"Example.COM.", "example.net"}); !reflect.DeepEqual(matched, []bool{true, false}) {
+		t.Errorf("Unexpected bulk match %v", matched)
+	}
+}
+
+func TestParseGeosite(t *testing.T) {
+	field := func(num int, wire uint64, b []byte) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		ret := append([]byte(nil), buf[:binary.PutUvarint(buf, uint64(num)<<3|wire)]...)
+		if wire == 0 {
+			return append(ret, b...)
+		}
+		ret = append(ret, buf[:binary.PutUvarint(buf, uint64(len(b)))]...)
+		return append(ret, b...)
+	}
+	domain := func(typ byte, value string) []byte {
+		return field(2, 2, append(field(1, 0, []byte{typ}), field(2, 2, []byte(value))...))
+	}
+	site := func(code string, domains ...[]byte) []byte {
+		b := field(1, 2, []byte(code))
+		for _, d := range domains {
+			b = append(b, d...)
+		}
+		return field(1, 2, b)
+	}
+	data := append(site("CN", domain(geositeTypeDomain, "example.cn")),
+		site("GEOLOCATION-CN",
+			domain(geositeTypeDomain, "example.com"),
+			domain(geositeTypeFull, "www.example.org"),
+			domain(geositeTypePlain, "keyword"),
+			domain(geositeTypeRegex, `^ads\.`))...)
+
+	names := make(domainSet)
+	count, err := parseGeosite(names, data, "geolocation-cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || names.Len() != 2 || !names.Match("example.com") || !names.Match("www.example.org") {
+		t.Errorf("Unexpected names %v, count: %v", names, count)
+	}
+	if _, err := parseGeosite(make(domainSet), data, "us"); err == nil {
+		t.Error("Expected error of unknown category")
+	}
+	if _, err := parseGeosite(make(domainSet), data[:len(data)-1], "cn"); err != errGeositeCorrupted {
+		t.Errorf("Expected %v, got %v", errGeositeCorrupted, err)
+	}
+
+	items, err := NewNameItemsWithForms([]string{"geosite:/etc/geosite.dat?category=cn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].format != nameFormatGeosite || items[0].path != "/etc/geosite.dat" || items[0].category != "cn" {
+		t.Errorf("Unexpected item %v, format: %v category: %v", items[0], items[0].format, items[0].category)
+	}
+	for _, form := range []string{"geosite:/etc/geosite.dat", "geosite:https://example.com/geosite.dat?category=cn"} {
+		if _, err := NewNameItemsWithForms([]string{form}); err == nil {
+			t.Errorf("Expected error of %q", form)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	aNames, bNames, bExcepts := make(domainSet), make(domainSet), make(domainSet)
+	for _, name := range []string{"example.com", "example.org", "www.example.net"} {
+		aNames.Add(name)
+	}
+	bNames.Add("example.org")
+	bExcepts.Add("example.edu")
+	a, b := &NameItem{path: "a.txt"}, &NameItem{path: "b.txt"}
+	a.storeNames(&itemNames{names: aNames})
+	b.storeNames(&itemNames{names: bNames, excepts: bExcepts})
+	u := &reloadableUpstream{
+		NameList: &NameList{items: []*NameItem{a, b}},
+		inline:   make(domainSet),
+		ignored:  make(domainSet),
+	}
+	u.inline.Add("example.org")
+	// Above, under, the same as and apart from names respectively
+	for _, name := range []string{"example.net", "ads.example.com", "example.org", "example.info"} {
+		u.ignored.Add(name)
+	}
+
+	r := u.reconcile()
+	if !reflect.DeepEqual(r.UnusedExcepts, []string{"example.edu", "example.info"}) || r.UnusedExceptCount != 2 {
+		t.Errorf("Unexpected unused excepts %v, count: %v", r.UnusedExcepts, r.UnusedExceptCount)
+	}
+	expected := []reconcileDuplicate{{Name: "example.org", Sources: []string{"a.txt", "b.txt", "INLINE"}}}
+	if !reflect.DeepEqual(r.Duplicates, expected) || r.DuplicateCount != 1 {
+		t.Errorf("Unexpected duplicates %v, count: %v", r.Duplicates, r.DuplicateCount)
+	}
+}
+
+func TestLiteNameList(t *testing.T) {
+	u := &reloadableUpstream{NameList: &NameList{}, HealthCheck: &HealthCheck{transport: &Transport{}}}
+	u.applyLite(4096)
+	a, b := &NameItem{path: "a.txt"}, &NameItem{path: "b.txt"}
+	u.items = []*NameItem{a, b}
+
+	names := make(domainSet)
+	names.Add("example.com")
+	tags := map[string][]string{"example.com": {"ads"}}
+	u.swapNames(a, names, tags, make(domainSet))
+	if s := a.loadNames(); s.compiled == nil || s.names.Len() != 0 {
+		t.Fatalf("Expected compacted names, got %v %v", s.names, s.compiled)
+	}
+	if nameTags, ok := u.MatchTags("www.example.com"); !ok || !reflect.DeepEqual(nameTags, []string{"ads"}) {
+		t.Errorf("Expected tags of compacted name, got %v %v", nameTags, ok)
+	}
+
+	huge := make(domainSet)
+	for i := 0; i < 5000; i++ {
+		huge.Add(fmt.Sprintf("host%v.example.org", i))
+	}
+	u.swapNames(b, huge, nil, make(domainSet))
+	if s := b.loadNames(); s.names != nil || s.compiled != nil {
+		t.Errorf("Expected update exceeding memory ceiling refused")
+	}
+}
+
+func TestNamePatterns(t *testing.T) {
+	var p namePatterns
+	for _, s := range []string{"*.cdn.example.com", `regex:^ads?[0-9]+\.`} {
+		if ok, err := p.add(s); !ok || err != nil {
+			t.Fatalf("Expected %q added as a pattern, got %v %v", s, ok, err)
+		}
+	}
+	if ok, _ := p.add("example.com"); ok {
+		t.Fatalf("Expected %q isn't a pattern", "example.com")
+	}
+	if ok, err := p.add("*."); !ok || err == nil {
+		t.Fatalf("Expected invalid wildcard, got %v %v", ok, err)
+	}
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"cdn.example.com", false},
+		{"img.cdn.example.com", true},
+		{"a.img.cdn.example.com", true},
+		{"example.com", false},
+		{"ad1.example.org", true},
+		{"ads42.example.org", true},
+		{"bad1.example.org", false},
+	}
+	for i, test := range tests {
+		if matched := p.Match(test.name); matched != test.expected {
+			t.Errorf("Test %v: expected %v for %q, got %v", i, test.expected, test.name, matched)
+		}
+	}
+}
+
+func TestDomainSet(t *testing.T) {
+	d := make(domainSet)
+	for _, name := range []string{"www.example.com", "example.com", "mail.example.com", "a.b.example.net", "example.org", "b.example.net", "Example.ORG."} {
+		if !d.Add(name) {
+			t.Fatalf("Expected %q added", name)
+		}
+	}
+	if n := d.Len(); n != 6 {
+		t.Fatalf("Expected 6 names, got %v", n)
+	}
+
+	tests := []struct {
+		child    string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"www.example.com", "www.example.com"},
+		{"a.www.example.com", "www.example.com"},
+		{"img.example.com", "example.com"},
+		{"com", ""},
+		{"xample.com", ""},
+		{"example.net", ""},
+		{"b.example.net", "b.example.net"},
+		{"a.b.example.net", "a.b.example.net"},
+		{"c.a.b.example.net", "a.b.example.net"},
+		{"ab.example.net", ""},
+		{"c.b.example.net", "b.example.net"},
+		{"example.org", "example.org"},
+		{"org", ""},
+	}
+	for i, test := range tests {
+		matched, ok := d.MatchName(test.child)
+		if ok != (len(test.expected) != 0) || matched != test.expected {
+			t.Errorf("Test %v: expected %q matched by %q, got %q %v", i, test.child, test.expected, matched, ok)
+		}
+	}
+
+	for _, name := range []string{"x", "a.x"} {
+		d.Add(name)
+	}
+	if matched, ok := d.MatchName("b.a.x"); !ok || matched != "a.x" {
+		t.Errorf("Expected %q matched by %q, got %q %v", "b.a.x", "a.x", matched, ok)
+	}
+	if !d.Contains("example.com") || d.Contains("img.example.com") || d.Contains("com") {
+		t.Errorf("Unexpected Contains() of %v", d)
+	}
+
+	var names []string
+	_ = d.ForEachDomain(func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	sort.Strings(names)
+	expected := []string{"a.b.example.net", "a.x", "b.example.net", "example.com", "example.org", "mail.example.com", "www.example.com", "x"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+}
+
+// Return heap bytes retained by the object built by f()
+// Signed since the heap may shrink if garbage of earlier work is collected meanwhile.
+func heapBytes(f func() interface{}) int64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	v := f()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(v)
+	return int64(after.HeapAlloc) - int64(before.HeapAlloc)
+}
+
+// Compare heap bytes of domain tree against hash set of names(i.e. the previous representation of domainSet)
+// Reported as metrics rather than asserted, since heap statistics depend on GC timing.
+func BenchmarkDomainSetMemory(b *testing.B) {
+	const size = 500000
+	name := func(i int) string {
+		return fmt.Sprintf("host%v.domain%v.com", i%7, i)
+	}
+	var hashSet, tree int64
+	for n := 0; n < b.N; n++ {
+		hashSet += heapBytes(func() interface{} {
+			s := make(map[uint16]StringSet)
+			for i := 0; i < size; i++ {
+				name := name(i)
+				set := s[domainToIndex(name)]
+				if set == nil {
+					set = make(StringSet)
+					s[domainToIndex(name)] = set
+				}
+				set.Add(name)
+			}
+			return s
+		})
+		tree += heapBytes(func() interface{} {
+			d := make(domainSet)
+			for i := 0; i < size; i++ {
+				d.Add(name(i))
+			}
+			return d
+		})
+	}
+	b.ReportMetric(float64(hashSet)/float64(b.N), "hashset-bytes")
+	b.ReportMetric(float64(tree)/float64(b.N), "tree-bytes")
+}
+
+func benchmarkDomainSet(size int) (domainSet, []string) {
+	d := make(domainSet)
+	for i := 0; i < size; i++ {
+		d.Add(fmt.Sprintf("host%v.domain%v.com", i%7, i))
+	}
+	queries := make([]string, 1024)
+	for i := range queries {
+		if i%2 == 0 {
+			queries[i] = fmt.Sprintf("www.host%v.domain%v.com", i%7, i*31%size)
+		} else {
+			queries[i] = fmt.Sprintf("www.unknown%v.net", i)
+		}
+	}
+	return d, queries
+}
+
+func BenchmarkDomainSetAdd(b *testing.B) {
+	b.ReportAllocs()
+	d := make(domainSet)
+	for i := 0; i < b.N; i++ {
+		d.Add(fmt.Sprintf("host%v.domain%v.com", i%7, i))
+	}
+}
+
+func BenchmarkDomainSetMatch(b *testing.B) {
+	d, queries := benchmarkDomainSet(1000000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Match(queries[i%len(queries)])
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	if f := newBloomFilter(make(domainSet)); f != nil || !f.mayMatch("example.com") {
+		t.Fatalf("Expected nil filter which matches anything, got %v", f)
+	}
+
+	names := make(domainSet)
+	for i := 0; i < 10000; i++ {
+		names.Add(fmt.Sprintf("ads%v.example.com", i))
+	}
+	f := newBloomFilter(names)
+	for _, child := range []string{"ads0.example.com", "www.ads42.example.com", "a.b.ads9999.example.com"} {
+		if !f.mayMatch(child) {
+			t.Errorf("Expected %q may match", child)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayMatch(fmt.Sprintf("www.example%v.net", i)) {
+			falsePositives++
+		}
+	}
+	// Each name is checked thrice, i.e. itself and two parents
+	if falsePositives > 500 {
+		t.Errorf("Expected false positive rate about 3%%, got %v/10000", falsePositives)
+	}
+}
+
+func TestDiffNames(t *testing.T) {
+	prev, next := make(domainSet), make(domainSet)
+	for _, name := range []string{"example.com", "example.org"} {
+		prev.Add(name)
+	}
+	for _, name := range []string{"example.com", "example.net"} {
+		next.Add(name)
+	}
+	if added, truncated := diffNames(next, prev); !reflect.DeepEqual(added, []string{"example.net"}) || truncated {
+		t.Errorf("Expected %v added, got %v %v", "example.net", added, truncated)
+	}
+	if removed, _ := diffNames(prev, next); !reflect.DeepEqual(removed, []string{"example.org"}) {
+		t.Errorf("Expected %v removed, got %v", "example.org", removed)
+	}
+
+	huge := make(domainSet)
+	for i := 0; i < maxFlushHintNames+1; i++ {
+		huge.Add(fmt.Sprintf("host%v.example.com", i))
+	}
+	if added, truncated := diffNames(huge, prev); len(added) != maxFlushHintNames || !truncated {
+		t.Errorf("Expected %v names truncated, got %v %v", maxFlushHintNames, len(added), truncated)
+	}
+}
+
+func TestParsePartial(t *testing.T) {
+	content := "example.com\nexample.org\n" + strings.Repeat("x", bufio.MaxScanTokenSize) + "\nexample.net\n"
+	var n NameList
+	names, _, _, totalLines, err := n.parse(strings.NewReader(content), &NameItem{})
+	if !errors.Is(err, bufio.ErrTooLong) {
+		t.Fatalf("Expected %v, got %v", bufio.ErrTooLong, err)
+	}
+	if totalLines != 2 || names.Len() != 2 {
+		t.Errorf("Expected 2 lines parsed, got %v lines %v names", totalLines, names.Len())
+	}
+
+	_, _, _, _, err = n.parse(newSizeLimitReader(strings.NewReader(content), 16), &NameItem{})
+	if !errors.Is(err, errContentTooLarge) {
+		t.Errorf("Expected %v, got %v", errContentTooLarge, err)
+	}
+}
+
+func TestReloadInterval(t *testing.T) {
+	n := &NameList{pathReload: 2 * time.Second, urlReload: 30 * time.Minute, urlReadTimeout: 15 * time.Second}
+	path := &NameItem{whichType: NameItemTypePath}
+	url := &NameItem{whichType: NameItemTypeUrl, reload: time.Hour, timeout: 2 * time.Minute}
+	never := &NameItem{whichType: NameItemTypeUrl, reload: noReload}
+	n.items = []*NameItem{path, url, never}
+
+	if d := n.reloadInterval(path); d != n.pathReload {
+		t.Errorf("Expected %v, got %v", n.pathReload, d)
+	}
+	if d := n.reloadInterval(url); d != time.Hour {
+		t.Errorf("Expected %v, got %v", time.Hour, d)
+	}
+	if d := n.reloadInterval(never); d != 0 {
+		t.Errorf("Expected never reloaded, got %v", d)
+	}
+	if d := n.readTimeout(path); d != n.urlReadTimeout {
+		t.Errorf("Expected %v, got %v", n.urlReadTimeout, d)
+	}
+	if d := n.readTimeout(url); d != 2*time.Minute {
+		t.Errorf("Expected %v, got %v", 2*time.Minute, d)
+	}
+	if c := n.scheduledItems(); c != 1 {
+		t.Errorf("Expected 1 item reloaded by its own worker, got %v", c)
+	}
+}
+
+func TestUrlCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsredir-url-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const theUrl = "https://example.com/list.txt"
+	n := &NameList{urlCache: &urlCache{dir: dir, ttl: time.Hour}}
+	item := &NameItem{whichType: NameItemTypeUrl, url: theUrl}
+	n.loadUrlCache(item)
+	if names := item.loadNames().names; names != nil {
+		t.Fatalf("Expected nothing loaded without cached copy, got %v", names)
+	}
+
+	w, err := n.urlCache.create(theUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("example.com\nexample.org\n"))
+	if err := w.commit(); err != nil {
+		t.Fatal(err)
+	}
+	n.loadUrlCache(item)
+	if names := item.loadNames().names; !names.Match("www.example.org") || names.Len() != 2 {
+		t.Errorf("Expected names of the cached copy, got %v", names)
+	}
+	if item.contentHash != stringHash("example.com\nexample.org\n") {
+		t.Errorf("Expected content hash of the cached copy, got %#x", item.contentHash)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(n.urlCache.path(theUrl), old, old); err != nil {
+		t.Fatal(err)
+	}
+	item = &NameItem{whichType: NameItemTypeUrl, url: theUrl}
+	n.loadUrlCache(item)
+	if names := item.loadNames().names; names != nil {
+		t.Errorf("Expected expired cached copy not loaded, got %v", names)
+	}
+}
+
+func TestSharedUrlCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsredir-shared-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var fetched int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("example.com\nexample.org\n"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		maxSize int64
+		updated bool
+		fetched int32
+	}{
+		// The leader fetches the URL and caches its content
+		{0, true, 1},
+		// Other instances use the fresh content in the shared cache
+		{0, true, 1},
+		// Content over url_max_size is neither taken nor cached
+		{10, false, 2},
+	}
+	for i, test := range tests {
+		theUrl := srv.URL + "/list.txt"
+		if test.maxSize != 0 {
+			theUrl = srv.URL + "/large.txt"
+		}
+		n := &NameList{sharedCache: &sharedUrlCache{dir: dir}, urlReload: time.Hour, urlReadTimeout: 5 * time.Second, urlMaxSize: test.maxSize}
+		item := &NameItem{whichType: NameItemTypeUrl, url: theUrl}
+		if updated := n.updateItemFromUrl(item, nil); updated != test.updated {
+			t.Errorf("Test#%v: expected updated %v, got %v", i, test.updated, updated)
+		}
+		if n := atomic.LoadInt32(&fetched); n != test.fetched {
+			t.Errorf("Test#%v: expected %v fetches, got %v", i, test.fetched, n)
+		}
+		names := item.loadNames().names
+		if test.updated && (names.Len() != 2 || !names.Match("www.example.org")) {
+			t.Errorf("Test#%v: expected names of the URL, got %v", i, names)
+		}
+		if !test.updated && names != nil {
+			t.Errorf("Test#%v: expected nothing taken, got %v", i, names)
+		}
+	}
+
+	// Neither partial content nor the lock is left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != filepath.Base((&sharedUrlCache{dir: dir}).contentPath(srv.URL+"/list.txt")) {
+		t.Errorf("Expected only content of the first URL cached, got %v", files)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempt  uint
+		maxDelay time.Duration
+		expected time.Duration
+	}{
+		{0, time.Hour, urlRetryBaseDelay},
+		{1, time.Hour, 2 * urlRetryBaseDelay},
+		{3, time.Hour, 8 * urlRetryBaseDelay},
+		{10, time.Hour, time.Hour},
+		{100, 30 * time.Minute, 30 * time.Minute},
+	}
+	for i, test := range tests {
+		d := retryBackoff(test.attempt, test.maxDelay)
+		if d < test.expected*8/10 || d > test.expected*12/10 {
+			t.Errorf("Test#%v failed  expected %v +/- 20%%, got %v", i, test.expected, d)
+		}
+	}
+}
+
+func TestListSigner(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyId := []byte("01234567")
+	key := base64.StdEncoding.EncodeToString(append(append([]byte(minisignAlgEd), keyId...), pub...))
+	s, err := parseListSigner(signSchemeMinisign, key, ioutil.ReadFile)
+	if err != nil {
+		t.Fatalf("parseListSigner() failed, error: %v", err)
+	}
+
+	content := []byte("example.com\nexample.net\n")
+	minisig := func(alg string, keyId []byte, content []byte) []byte {
+		message := content
+		if alg == minisignAlgPrehashed {
+			sum := blake2b.Sum512(content)
+			message = sum[:]
+		}
+		signature := ed25519.Sign(priv, message)
+		comment := "timestamp:1700000000\tfile:list.txt"
+		global := ed25519.Sign(priv, append(append([]byte{}, signature...), comment...))
+		return []byte("untrusted comment: signature from minisign secret key\n" +
+			base64.StdEncoding.EncodeToString(append(append([]byte(alg), keyId...), signature...)) + "\n" +
+			minisignTrustedComment + comment + "\n" +
+			base64.StdEncoding.EncodeToString(global) + "\n")
+	}
+	verify := func(sig, content []byte) error {
+		v, err := s.verifier(sig)
+		if err != nil {
+			return err
+		}
+		_, _ = v.Write(content)
+		return v.verify()
+	}
+
+	for _, alg := range []string{minisignAlgEd, minisignAlgPrehashed} {
+		if err := verify(minisig(alg, keyId, content), content); err != nil {
+			t.Errorf("Expected %v signature verified, error: %v", alg, err)
+		}
+		if err := verify(minisig(alg, keyId, content), []byte("example.com\nevil.com\n")); err == nil {
+			t.Errorf("Expected tampered content rejected by %v signature", alg)
+		}
+	}
+	if err := verify(minisig(minisignAlgPrehashed, []byte("76543210"), content), content); err == nil {
+		t.Errorf("Expected signature of other key rejected")
+	}
+	tampered := bytes.Replace(minisig(minisignAlgPrehashed, keyId, content), []byte("list.txt"), []byte("evil.txt"), 1)
+	if err := verify(tampered, content); err == nil {
+		t.Errorf("Expected tampered trusted comment rejected")
+	}
+	if err := verify([]byte("untrusted comment: foo\n"), content); err != errMalformedSignature {
+		t.Errorf("Expected %v, got %v", errMalformedSignature, err)
+	}
+
+	if u := s.signatureUrl("https://example.com/list.txt?v=1"); u != "https://example.com/list.txt.minisig?v=1" {
+		t.Errorf("Unexpected signature URL %v", u)
+	}
+	if _, err := parseListSigner("pgp", key, ioutil.ReadFile); err == nil {
+		t.Errorf("Expected unknown scheme rejected")
+	}
+}
+
+func TestWatchPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsredir-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "list.txt")
+	if err := ioutil.WriteFile(path, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	item := &NameItem{whichType: NameItemTypePath, path: path}
+	n := &NameList{items: []*NameItem{item}, pathReload: time.Hour, stopPathReload: make(chan struct{})}
+	defer close(n.stopPathReload)
+	n.updateItemFromPath(item)
+	if !n.watchPaths() {
+		t.Skip("Path watches are unavailable")
+	}
+
+	// Replaced atomically
+	tmp := filepath.Join(dir, "list.txt.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("example.com\nexample.org\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if item.loadNames().names.Match("example.org") {
+			return
+		}
+	}
+	t.Errorf("Expected the replaced path reloaded without polling")
+}
+
+func TestSwapNamesLockFree(t *testing.T) {
+	item := &NameItem{path: "list.txt"}
+	n := &NameList{items: []*NameItem{item}}
+	if n.Match("example.com") {
+		t.Fatalf("Expected nothing matched before loaded")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			names := make(domainSet)
+			names.Add("example.com")
+			names.Add(fmt.Sprintf("host%v.example.org", i))
+			item.Lock()
+			n.swapNames(item, names, nil, nil)
+			item.Unlock()
+		}
+	}()
+	// Lookups see either the old or the new names, never a partial one
+	for matched := 0; ; {
+		select {
+		case <-done:
+			if !n.Match("host99.example.org") || n.Match("host98.example.org") {
+				t.Errorf("Expected the last names swapped in, got %v", item.loadNames().names)
+			}
+			return
+		default:
+		}
+		if n.Match("example.com") {
+			matched++
+		} else if matched != 0 {
+			t.Fatalf("Expected names never absent once loaded")
+		}
+	}
+}
+
+func TestGlobItem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsredir-glob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.list", "example.com\n")
+	write("b.list", "example.org #video\n")
+	write(".c.list.swp", "example.edu\n")
+	write("d.txt", "example.info\n")
+
+	for _, test := range []struct {
+		form     string
+		expected []bool
+	}{
+		{dir, []bool{true, true, false, true}},
+		{filepath.Join(dir, "*.list"), []bool{true, true, false, false}},
+	} {
+		items, err := NewNameItemsWithForms([]string{test.form})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &NameList{items: items}
+		n.updateItemFromPath(items[0])
+		if matched := n.MatchAll([]string{"example.com", "example.org", "example.edu", "example.info"}); !reflect.DeepEqual(matched, test.expected) {
+			t.Errorf("Expected %v matched by %v, got %v", test.expected, test.form, matched)
+		}
+		if tags, _ := n.MatchTags("example.org"); !reflect.DeepEqual(tags, []string{"video"}) {
+			t.Errorf("Expected tags of example.org, got %v", tags)
+		}
+	}
+
+	items, _ := NewNameItemsWithForms([]string{filepath.Join(dir, "*.list")})
+	n := &NameList{items: items}
+	n.updateItemFromPath(items[0])
+	write("e.list", "example.net\n")
+	if err := os.Remove(filepath.Join(dir, "a.list")); err != nil {
+		t.Fatal(err)
+	}
+	n.updateItemFromPath(items[0])
+	if !n.Match("example.net") || n.Match("example.com") {
+		t.Errorf("Expected added file loaded and removed file unloaded, got %v", items[0].loadNames().names)
+	}
+}
+
+func TestExceptItem(t *testing.T) {
+	for _, test := range []struct {
+		arg      string
+		source   string
+		isSource bool
+	}{
+		{"file:/etc/whitelist.txt", "/etc/whitelist.txt", true},
+		{"hosts:file:/etc/hosts", "hosts:/etc/hosts", true},
+		{"https://example.com/whitelist.txt", "https://example.com/whitelist.txt", true},
+		{"example.com", "", false},
+	} {
+		if source, ok := exceptSource(test.arg); source != test.source || ok != test.isSource {
+			t.Errorf("Expected source %q(%v) of %q, got %q(%v)", test.source, test.isSource, test.arg, source, ok)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "dnsredir-except")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("example.com\n@@||example.org^\n"); err != nil {
+		t.Fatal(err)
+	}
+	Close(f)
+
+	items, err := NewNameItemsWithForms([]string{f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items[0].except = true
+	n := &NameList{items: items}
+	n.updateItemFromPath(items[0])
+	if n.Match("www.example.com") {
+		t.Errorf("Expected names of except source not matched")
+	}
+	if !n.excepted("www.example.com", false) || !n.excepted("example.org", false) || n.excepted("example.net", false) {
+		t.Errorf("Expected names of except source excepted, got %v", items[0].loadNames().excepts)
+	}
+}
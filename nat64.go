@@ -0,0 +1,117 @@
+package dnsredir
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Well-known NAT64 prefix, see: https://tools.ietf.org/html/rfc6052#section-2.1
+const defaultNat64Prefix = "64:ff9b::/96"
+
+// Parse a NAT64 prefix, only prefix lengths defined in RFC 6052 are allowed
+func parseNat64Prefix(s string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%q isn't an IPv6 prefix", s)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid NAT64 prefix length %v", ones)
+	}
+	return prefix, nil
+}
+
+// Embed an IPv4 address into the NAT64 prefix
+// see: https://tools.ietf.org/html/rfc6052#section-2.2
+func nat64Embed(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, prefix.IP.To16())
+	i := ones / 8
+	for _, b := range ip4.To4() {
+		// Bits 64 to 71 of the address are reserved and must be zero
+		if i == 8 {
+			i++
+		}
+		ip6[i] = b
+		i++
+	}
+	return ip6
+}
+
+// Return true if the host has a route to IPv4 Internet
+func hasIPv4Route() bool {
+	// Dial an UDP socket won't send any packet, yet the route will be looked up
+	conn, err := net.Dial("udp4", "192.0.2.1:53")
+	if err != nil {
+		return false
+	}
+	Close(conn)
+	return true
+}
+
+// Translate IPv4 literal in IP:PORT into the NAT64 one, ok is false if it's not an IPv4 literal
+func nat64HostPort(prefix *net.IPNet, hostport string) (string, bool) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil {
+		return "", false
+	}
+	return net.JoinHostPort(nat64Embed(prefix, ip).String(), port), true
+}
+
+// Return IPv6-only network of the given one, i.e. "udp" to "udp6", "tcp-tls" to "tcp6-tls"
+func ipv6Network(network string) string {
+	proto, suffix := SplitByByte(network, '-')
+	if strings.HasSuffix(proto, "6") {
+		return network
+	}
+	return proto + "6" + suffix
+}
+
+// Apply NAT64 translation if the host has no IPv4 route
+// IPv4 literal upstream hosts and bootstraps will be translated via the NAT64 prefix,
+// and hostname upstream hosts will be resolved with AAAA only.
+func (u *reloadableUpstream) applyNat64() {
+	if u.nat64 == nil {
+		return
+	}
+	if hasIPv4Route() {
+		log.Infof("IPv4 route found, NAT64 translation skipped")
+		return
+	}
+
+	for i, hp := range u.bootstrap {
+		if addr, ok := nat64HostPort(u.nat64, hp); ok {
+			log.Infof("NAT64: bootstrap %v translated to %v", hp, addr)
+			u.bootstrap[i] = addr
+		}
+	}
+
+	for _, host := range u.allHosts() {
+		if host.IsDOH() {
+			// Hostname is resolved by the HTTP client
+			continue
+		}
+		addr, ok := nat64HostPort(u.nat64, host.addr)
+		if !ok {
+			host.ipv6Only = true
+			continue
+		}
+		if host.transport.tlsConfig != nil && host.transport.tlsConfig.ServerName == "" {
+			// Keep verifying the certificate against the original IPv4 address
+			ip, _, _ := net.SplitHostPort(host.addr)
+			host.transport.tlsConfig.ServerName = ip
+		}
+		log.Infof("NAT64: %v translated to %v", host.Name(), addr)
+		host.addr = addr
+	}
+}
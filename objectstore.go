@@ -0,0 +1,183 @@
+package dnsredir
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Return true if the URL is an object of S3(s3://BUCKET/KEY) or GCS(gs://BUCKET/KEY)
+func isObjectUrl(theUrl string) bool {
+	i := strings.Index(theUrl, "://")
+	if i <= 0 {
+		return false
+	}
+	scheme := strings.ToLower(theUrl[:i])
+	return scheme == objectSchemeS3 || scheme == objectSchemeGcs
+}
+
+// Location of an object in S3 or GCS
+type objectLocation struct {
+	scheme string
+	bucket string
+	key    string
+	// Region of the S3 bucket, empty means the one of the default config(e.g. AWS_REGION)
+	region string
+}
+
+// Parse s3://BUCKET/KEY[?region=REGION] or gs://BUCKET/KEY
+func parseObjectUrl(theUrl string) (*objectLocation, error) {
+	u, err := url.Parse(theUrl)
+	if err != nil {
+		return nil, err
+	}
+	loc := &objectLocation{
+		scheme: strings.ToLower(u.Scheme),
+		bucket: u.Host,
+		key:    strings.TrimPrefix(u.Path, "/"),
+	}
+	if len(loc.bucket) == 0 || len(loc.key) == 0 || strings.HasSuffix(loc.key, "/") {
+		return nil, fmt.Errorf("expected %v://BUCKET/KEY, got %q", loc.scheme, theUrl)
+	}
+	for k, v := range u.Query() {
+		if k != "region" || loc.scheme != objectSchemeS3 || len(v) != 1 || len(v[0]) == 0 {
+			return nil, fmt.Errorf("unknown query %q of %q", k, theUrl)
+		}
+		loc.region = v[0]
+	}
+	return loc, nil
+}
+
+// Open an object of S3 or GCS as an HTTP response, the response body should be closed by the caller
+// Credentials are taken from the standard SDK credential chains, i.e. environment variables, shared config files
+//	and instance metadata of AWS, application default credentials of GCP.
+// errNotModified is returned if `cond' is non-nil and the object isn't modified since.
+func openObject(theUrl string, timeout time.Duration, cond *urlValidators) (*http.Response, error) {
+	loc, err := parseObjectUrl(theUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	// As http.Client.Timeout, the timeout covers reading of the body as well
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	var resp *http.Response
+	if loc.scheme == objectSchemeS3 {
+		resp, err = openS3Object(ctx, loc, cond)
+	} else {
+		resp, err = openGcsObject(ctx, loc, cond)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &closeHookReader{ReadCloser: resp.Body, hook: cancel}
+	return resp, nil
+}
+
+func openS3Object(ctx context.Context, loc *objectLocation, cond *urlValidators) (*http.Response, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if len(loc.region) != 0 {
+		opts = append(opts, awsconfig.WithRegion(loc.region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(loc.bucket),
+		Key:    aws.String(loc.key),
+	}
+	if cond != nil {
+		if len(cond.etag) != 0 {
+			input.IfNoneMatch = aws.String(cond.etag)
+		}
+		if t, err := http.ParseTime(cond.lastModified); err == nil {
+			input.IfModifiedSince = aws.Time(t)
+		}
+	}
+	output, err := s3.NewFromConfig(cfg).GetObject(ctx, input)
+	if err != nil {
+		var re *awshttp.ResponseError
+		if cond != nil && errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotModified {
+			return nil, errNotModified
+		}
+		return nil, err
+	}
+
+	resp := newObjectResponse(output.Body, aws.ToString(output.ETag), output.LastModified)
+	// The SDK doesn't decompress objects uploaded with Content-Encoding: gzip
+	if encoding := aws.ToString(output.ContentEncoding); len(encoding) != 0 {
+		resp.Header.Set("Content-Encoding", encoding)
+	}
+	return resp, nil
+}
+
+func openGcsObject(ctx context.Context, loc *objectLocation, cond *urlValidators) (*http.Response, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	obj := client.Bucket(loc.bucket).Object(loc.key)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		Close(client)
+		return nil, err
+	}
+	if cond != nil && len(cond.etag) != 0 && cond.etag == attrs.Etag {
+		Close(client)
+		return nil, errNotModified
+	}
+	// Pin the generation, thus the content always matches the ETag even if it's overwritten meanwhile
+	// Objects uploaded with Content-Encoding: gzip are decompressed by the client transparently.
+	r, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		Close(client)
+		return nil, err
+	}
+	body := &closeHookReader{ReadCloser: r, hook: func() { Close(client) }}
+	return newObjectResponse(body, attrs.Etag, &attrs.Updated), nil
+}
+
+// Return a 200 response of the object, ETag and Last-Modified are validators of conditional reloads
+func newObjectResponse(body io.ReadCloser, etag string, lastModified *time.Time) *http.Response {
+	header := make(http.Header)
+	if len(etag) != 0 {
+		header.Set("ETag", etag)
+	}
+	if lastModified != nil && !lastModified.IsZero() {
+		header.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       body,
+	}
+}
+
+// Reader which calls `hook' after it's closed, e.g. release the context or client of the object
+type closeHookReader struct {
+	io.ReadCloser
+	hook func()
+}
+
+func (r *closeHookReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.hook()
+	return err
+}
+
+const (
+	objectSchemeS3  = "s3"
+	objectSchemeGcs = "gs"
+)
@@ -0,0 +1,83 @@
+package dnsredir
+
+import "sync"
+
+// Upstream hosts of `server=/DOMAIN/IP' lines in name lists, which override `to' per domain
+// Hosts are created on demand, since addresses are unknown until name lists loaded.
+type serverOverrides struct {
+	sync.Mutex
+	u       *reloadableUpstream
+	hosts   map[string]*UpstreamHost
+	stopped bool
+}
+
+func newServerOverrides(u *reloadableUpstream) *serverOverrides {
+	return &serverOverrides{
+		u:     u,
+		hosts: make(map[string]*UpstreamHost),
+	}
+}
+
+// Return the host of given IP:PORT, nil if too many hosts or already stopped
+func (o *serverOverrides) host(addr string) *UpstreamHost {
+	o.Lock()
+	defer o.Unlock()
+	if o.stopped {
+		return nil
+	}
+	if h, ok := o.hosts[addr]; ok {
+		return h
+	}
+	if len(o.hosts) >= maxServerOverrides {
+		log.Warningf("Too many server overrides, %v ignored", addr)
+		return nil
+	}
+
+	h := &UpstreamHost{
+		proto:    "dns",
+		addr:     addr,
+		downFunc: checkDownFunc(o.u),
+	}
+	// Plain DNS hosts of IP:PORT never fail, thus the controller(only used for errors) isn't needed
+	if err := o.u.initHost(nil, h); err != nil {
+		log.Warningf("Failed to init server override %v: %v", addr, err)
+		return nil
+	}
+	h.transport.Start()
+	o.hosts[addr] = h
+	log.Infof("Server override: %v", h.Name())
+	return h
+}
+
+func (o *serverOverrides) stop() {
+	o.Lock()
+	defer o.Unlock()
+	o.stopped = true
+	for _, h := range o.hosts {
+		h.transport.Stop()
+	}
+}
+
+// Return the host overriding `to' for the name, nil if none or it's down
+// `name' is lower cased and without trailing dot
+func (u *reloadableUpstream) overrideHost(name string, canary bool) *UpstreamHost {
+	if u.overrides == nil {
+		return nil
+	}
+	tags, ok := u.NameList.matchTags(name, canary)
+	if !ok {
+		return nil
+	}
+	addr := serverOfTags(tags)
+	if len(addr) == 0 {
+		return nil
+	}
+	h := u.overrides.host(addr)
+	if h == nil || h.Down() {
+		return nil
+	}
+	return h
+}
+
+// Maximum distinct server overrides of a stanza, so a malicious list won't exhaust resources
+const maxServerOverrides = 64
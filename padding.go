@@ -0,0 +1,51 @@
+package dnsredir
+
+import "github.com/miekg/dns"
+
+// Return a copy of the query padded to a multiple of the block size, see: https://tools.ietf.org/html/rfc8467
+func padQuery(req *dns.Msg, block int) *dns.Msg {
+	m := req.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = m.SetEdns0(dns.MinMsgSize, false).IsEdns0()
+	}
+	opt.Option = withoutOption(opt.Option, dns.EDNS0PADDING)
+	// Option code and length take 4 bytes
+	n := m.Len() + 4
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, (block-n%block)%block)})
+	return m
+}
+
+// Remove padding from the reply, which is useless(if not harmful) for the client transport
+func unpadReply(req, reply *dns.Msg) {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return
+	}
+	if req.IsEdns0() == nil {
+		removeOpt(reply)
+		return
+	}
+	opt.Option = withoutOption(opt.Option, dns.EDNS0PADDING)
+}
+
+func withoutOption(options []dns.EDNS0, code uint16) []dns.EDNS0 {
+	var ret []dns.EDNS0
+	for _, o := range options {
+		if o.Option() != code {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+// Remove OPT RR added by us, since the client knows nothing about EDNS
+func removeOpt(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
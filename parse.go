@@ -1,10 +1,12 @@
 package dnsredir
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/coredns/coredns/plugin/pkg/transport"
 	"net"
 	"net/url"
+	"runtime"
 	"strings"
 )
 
@@ -29,17 +31,29 @@ var knownTrans = []string{
 	"json-doh",
 	"ietf-doh",
 	"doh",
+	"https", // Alias of ietf-doh, i.e. RFC 8484 DNS over HTTPS
+	"dnscrypt",
+	"grpc",
+	"sdns", // DNS stamp, see stamp.go
 }
 
 func SplitTransportHost(s string) (trans string, addr string) {
-	s = strings.ToLower(s)
+	lower := strings.ToLower(s)
 	for _, trans := range knownTrans {
-		if strings.HasPrefix(s, trans+"://") {
-			return trans, s[len(trans+"://"):]
+		if strings.HasPrefix(lower, trans+"://") {
+			addr := lower[len(trans+"://"):]
+			switch trans {
+			case "https":
+				trans = "ietf-doh"
+			case "sdns":
+				// Stamps are case-sensitive base64
+				addr = s[len(trans+"://"):]
+			}
+			return trans, addr
 		}
 	}
 	// Have no proceeding transport? assume it's classic DNS protocol
-	return "dns", s
+	return "dns", lower
 }
 
 // Taken from parse.HostPortOrFile() with modification
@@ -47,10 +61,20 @@ func HostPort(servers []string) ([]string, error) {
 	var list []string
 	for _, h := range servers {
 		trans, host := SplitTransportHost(h)
+		if trans == "dnscrypt" || trans == "sdns" {
+			if _, err := parseDnscryptServer(trans, host); err != nil {
+				return nil, fmt.Errorf("failed to parse %q: %v", h, err)
+			}
+			list = append(list, trans+"://"+host)
+			continue
+		}
+		if strings.HasSuffix(trans, "doh") {
+			host = bracketIPv6(host)
+		}
 		addr, _, err := net.SplitHostPort(host)
 		if err != nil {
 			if strings.HasSuffix(trans, "doh") {
-				if _, err := url.ParseRequestURI(h); err != nil {
+				if _, err := url.ParseRequestURI("https://" + zoneEscaped(host)); err != nil {
 					return nil, fmt.Errorf("failed to parse %q: %v", h, err)
 				}
 			} else {
@@ -71,12 +95,15 @@ func HostPort(servers []string) ([]string, error) {
 			case "tls":
 				host, tlsName := SplitByByte(host, '@')
 				s = trans + "://" + net.JoinHostPort(host, transport.TLSPort) + tlsName
+			case "grpc":
+				host, tlsName := SplitByByte(host, '@')
+				s = trans + "://" + net.JoinHostPort(host, transport.GRPCPort) + tlsName
 			case "json-doh":
 				fallthrough
 			case "ietf-doh":
 				fallthrough
 			case "doh":
-				s = h
+				s = trans + "://" + host
 			default:
 				panic(fmt.Sprintf("Unknown transport %q", trans))
 			}
@@ -90,3 +117,88 @@ func HostPort(servers []string) ([]string, error) {
 	}
 	return list, nil
 }
+
+// Bracket a bare IPv6 host(with zone if any) of a DoH URL, i.e. ::1%eth0/dns-query -> [::1%eth0]/dns-query
+// Otherwise the last colon of the address will be taken as port separator.
+func bracketIPv6(host string) string {
+	hostport, path := SplitByByte(host, '/')
+	if strings.Count(hostport, ":") < 2 || strings.HasPrefix(hostport, "[") {
+		return host
+	}
+	if ip := net.ParseIP(stripZoneAndTlsName(hostport)); ip == nil || ip.To4() != nil {
+		return host
+	}
+	return "[" + hostport + "]" + path
+}
+
+// Percent-encode the IPv6 zone of a DoH host, as RFC 6874 requires in URLs
+// e.g. [fe80::1%eth0]:443/dns-query -> [fe80::1%25eth0]:443/dns-query
+func zoneEscaped(host string) string {
+	i := strings.IndexByte(host, ']')
+	if !strings.HasPrefix(host, "[") || i < 0 {
+		return host
+	}
+	return strings.Replace(host[:i], "%", "%25", 1) + host[i:]
+}
+
+// Split outgoing network interface from an IPv4 host:port, i.e. 192.168.1.1%eth0:53
+// IPv6 zones are kept untouched since they're natively supported by dialer.
+func splitInterface(addr string) (string, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Not a host:port, e.g. DoH URL
+		return addr, "", nil
+	}
+	i := strings.IndexByte(host, '%')
+	if i < 0 {
+		return addr, "", nil
+	}
+	ip := net.ParseIP(host[:i])
+	if ip == nil || ip.To4() == nil {
+		return addr, "", nil
+	}
+	iface := host[i+1:]
+	if len(iface) == 0 {
+		return "", "", fmt.Errorf("empty network interface in %q", addr)
+	}
+	if !bindToDeviceSupported {
+		return "", "", fmt.Errorf("%q: binding to network interface is not supported on %v", addr, runtime.GOOS)
+	}
+	return net.JoinHostPort(host[:i], port), iface, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Parse cipher suite names, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+// Only secure suites up to TLS 1.2 are accepted, since TLS 1.3 suites aren't configurable.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		var suite *tls.CipherSuite
+		for _, s := range tls.CipherSuites() {
+			if s.Name == name {
+				suite = s
+				break
+			}
+		}
+		if suite == nil {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		configurable := false
+		for _, v := range suite.SupportedVersions {
+			if v != tls.VersionTLS13 {
+				configurable = true
+			}
+		}
+		if !configurable {
+			return nil, fmt.Errorf("TLS 1.3 cipher suite %q isn't configurable", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
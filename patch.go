@@ -0,0 +1,187 @@
+package dnsredir
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"strings"
+	"time"
+)
+
+// Source of a stanza, which is used to rebuild the stanza on hot patching
+type stanzaSource struct {
+	root   string     // Corefile root, relative paths are joined with it
+	forms  []string   // FROM...
+	lines  [][]string // Directive lines, each one is directive followed by its arguments
+	groups map[string]*HealthCheck
+}
+
+// Record a directive line without consuming arguments of the controller
+func (s *stanzaSource) record(c *caddy.Controller) {
+	// Dispenser is a value type, a copy has its own cursor
+	d := c.Dispenser
+	s.lines = append(s.lines, append([]string{d.Val()}, d.RemainingArgs()...))
+}
+
+// Return Corefile text of the stanza, in which directives present in `patch' replace all existing lines of them
+func (s *stanzaSource) text(patch [][]string) string {
+	patched := make(map[string]bool)
+	for _, line := range patch {
+		patched[line[0]] = true
+	}
+
+	var b strings.Builder
+	b.WriteString(pluginName + " " + quoteArgs(s.forms) + " {\n")
+	for _, line := range s.lines {
+		if !patched[line[0]] {
+			b.WriteString("\t" + quoteArgs(line) + "\n")
+		}
+	}
+	for _, line := range patch {
+		b.WriteString("\t" + quoteArgs(line) + "\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Directives which can be patched via the admin server, INLINE names are always patchable
+// Others read files, run programs(e.g. `conn_hook' runs as the CoreDNS user), write to disk or pull name lists, thus never patchable.
+var patchableDirectives = []string{
+	"to", "except", "tag", "negate", "spray", "policy", "max_fails", "max_retry", "max_depth", "max_inflight",
+	"health_check", "health_check_quiet", "warm_probe", "capability_probe", "udp_probe",
+	"expire", "read_timeout", "write_timeout", "tcp_fallback", "tls_servername", "tls_pin", "tls_min_version", "tls_ciphers",
+	"bootstrap", "no_ipv6", "no_cookies", "nat64", "padding", "queue", "dedup_window", "deny_qname_regex", "allow_qname_regex",
+	"negative_min_ttl", "minimal_responses", "svcb_rewrite", "prefer_family", "ecs", "redact_qnames",
+	"from_clients", "debug_clients", "whichupstream", "explain", "canary", "slo", "split", "emergency_recursion",
+	"path_reload", "no_path_watch", "url_reload", "url_max_size", "tls_expiry_warning",
+}
+
+// Parse a partial stanza(i.e. directive lines without the enclosing block) into directive lines
+func parsePatch(patch string) ([][]string, error) {
+	c := caddy.NewTestController("dns", pluginName+" . {\n"+patch+"\n}")
+	c.Next()
+	// Skip the placeholder FROM
+	_ = c.RemainingArgs()
+	var lines [][]string
+	for c.NextBlock() {
+		dir := c.Val()
+		if _, ok := blockDirectives[dir]; ok && !stringInSlice(dir, patchableDirectives) {
+			return nil, fmt.Errorf("%q cannot be patched", dir)
+		}
+		args := c.RemainingArgs()
+		if dir == "except" {
+			// Sources of `except' are loaded like FROM..., only INLINE names and patterns can be patched
+			for _, arg := range args {
+				if _, ok := exceptSource(arg); ok {
+					return nil, fmt.Errorf("%q source %q cannot be patched", dir, arg)
+				}
+			}
+		}
+		lines = append(lines, append([]string{dir}, args...))
+	}
+	if len(lines) == 0 {
+		return nil, errEmptyPatch
+	}
+	return lines, nil
+}
+
+// Return a new upstream built from the stanza source with given patch applied
+// The returned upstream is not started.
+func (u *reloadableUpstream) patched(patch string) (*reloadableUpstream, error) {
+	if len(u.group) != 0 {
+		return nil, errPatchGroup
+	}
+	lines, err := parsePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	text := u.source.text(lines)
+	log.Debugf("Patched stanza %q:\n%v", u.stanza, text)
+	c := caddy.NewTestController("dns", text)
+	dnsserver.GetConfig(c).Root = u.source.root
+	if u.source.groups != nil {
+		c.Set(upstreamGroupsKey, u.source.groups)
+	}
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		return nil, err
+	}
+	return up.(*reloadableUpstream), nil
+}
+
+// Apply a partial stanza to a running stanza atomically, without a full Corefile reload
+// The old stanza is stopped once in-flight requests drained.
+func (r *Dnsredir) patch(stanza, patch string) error {
+	r.patchLock.Lock()
+	defer r.patchLock.Unlock()
+
+	r.RLock()
+	index := -1
+	for i, up := range *r.Upstreams {
+		if up.(*reloadableUpstream).stanza == stanza {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		r.RUnlock()
+		return errStanzaNotFound
+	}
+	old := (*r.Upstreams)[index]
+	r.RUnlock()
+
+	u, err := old.(*reloadableUpstream).patched(patch)
+	if err != nil {
+		return err
+	}
+	// Flush stats of the old stanza before the patched one loads them
+	// Otherwise counts since the last save(including monthly usage of `quota') are lost, and the old stanza overwrites the file when stopped.
+	stats := old.(*reloadableUpstream).stats
+	if stats != nil && (u.stats == nil || u.stats.path != stats.path) {
+		stats = nil
+	}
+	if stats != nil {
+		if err := stats.handover(stanza); err != nil {
+			log.Warningf("Failed to save stats %q: %v", stats.path, err)
+		}
+	}
+	if err := u.Start(); err != nil {
+		_ = u.Stop()
+		if stats != nil {
+			stats.resume(stanza)
+		}
+		return err
+	}
+
+	r.Lock()
+	(*r.Upstreams)[index] = u
+	r.Unlock()
+	log.Infof("Stanza %q patched", stanza)
+
+	time.AfterFunc(patchDrainDelay, func() {
+		if err := old.Stop(); err != nil {
+			log.Warningf("Failed to stop patched stanza %q: %v", stanza, err)
+		}
+	})
+	return nil
+}
+
+var (
+	errEmptyPatch     = errors.New("empty patch")
+	errPatchGroup     = errors.New("stanza which defines an upstream group cannot be patched")
+	errStanzaNotFound = errors.New("stanza not found")
+)
+
+// Old stanza is stopped after this delay, so in-flight requests won't be broken
+const patchDrainDelay = defaultTimeout + 5*time.Second
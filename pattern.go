@@ -0,0 +1,79 @@
+package dnsredir
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Names of INLINE and `except' can't be expressed by domain suffixes
+// i.e. explicit wildcards(e.g. `*.cdn.example.com') and `regex:PATTERN'
+type namePatterns struct {
+	// Parents of wildcards, a wildcard matches subdomains but not the parent itself
+	wildcards domainSet
+	// Matched against names lower cased and without trailing dot
+	regexps []*regexp.Regexp
+}
+
+// Add the pattern, return false if `s' isn't a pattern, i.e. it's an ordinary domain name
+func (p *namePatterns) add(s string) (bool, error) {
+	if strings.HasPrefix(s, regexPrefix) {
+		res, err := compileRegexps([]string{s[len(regexPrefix):]})
+		if err != nil {
+			return true, err
+		}
+		p.regexps = append(p.regexps, res...)
+		return true, nil
+	}
+	if strings.HasPrefix(s, "*.") {
+		if p.wildcards == nil {
+			p.wildcards = make(domainSet)
+		}
+		if !p.wildcards.Add(s[2:]) {
+			return true, fmt.Errorf("%q isn't a domain name", s)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *namePatterns) Len() int {
+	return int(p.wildcards.Len()) + len(p.regexps)
+}
+
+// Assume `name' is lower cased and without trailing dot
+func (p *namePatterns) Match(name string) bool {
+	if i := strings.IndexByte(name, '.'); i >= 0 && p.wildcards.Len() != 0 && p.wildcards.Match(name[i+1:]) {
+		return true
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *namePatterns) String() string {
+	patterns := make([]string, 0, p.Len())
+	_ = p.wildcards.ForEachDomain(func(name string) error {
+		patterns = append(patterns, "*."+name)
+		return nil
+	})
+	for _, re := range p.regexps {
+		patterns = append(patterns, regexPrefix+re.String())
+	}
+	return fmt.Sprintf("%v", patterns)
+}
+
+// Return true if the name is in INLINE
+func (u *reloadableUpstream) inlineMatch(name string) bool {
+	return u.inline.Match(name) || u.inlinePatterns.Match(name)
+}
+
+// Return true if the name is excluded by `except'
+func (u *reloadableUpstream) ignoredMatch(name string) bool {
+	return u.ignored.Match(name) || u.ignoredPatterns.Match(name)
+}
+
+const regexPrefix = "regex:"
@@ -0,0 +1,69 @@
+package dnsredir
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Parse base64 encoded SHA256 digests of certificate SubjectPublicKeyInfo, i.e. HPKP style pins
+func parseSpkiPins(args []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, arg := range args {
+		pin, err := base64.StdEncoding.DecodeString(arg)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q, expected base64 encoded SHA256 digest", arg)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// Return a tls.Config.VerifyPeerCertificate callback which accepts the peer if any certificate in the chain matches a pin
+func verifySpkiPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if string(h[:]) == string(pin) {
+					return nil
+				}
+			}
+		}
+		return errSpkiPinMismatch
+	}
+}
+
+// Return tls.Config.VerifyPeerCertificate callback of the host, nil if no pin specified
+// Pins from DNS stamp and SPKI pins must be satisfied both.
+func (opts *hostOptions) verifyPeer() func([][]byte, [][]*x509.Certificate) error {
+	var verifiers []func([][]byte, [][]*x509.Certificate) error
+	if len(opts.pins) != 0 {
+		verifiers = append(verifiers, verifyCertPins(opts.pins))
+	}
+	if len(opts.spkiPins) != 0 {
+		verifiers = append(verifiers, verifySpkiPins(opts.spkiPins))
+	}
+	switch len(verifiers) {
+	case 0:
+		return nil
+	case 1:
+		return verifiers[0]
+	}
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		for _, verify := range verifiers {
+			if err := verify(rawCerts, chains); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+var errSpkiPinMismatch = errors.New("no certificate matches the pinned SPKI hashes")
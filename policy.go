@@ -6,7 +6,9 @@ package dnsredir
 
 import (
 	"math/rand"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // SupportedPolicies is the collection of policies registered
@@ -15,6 +17,13 @@ var SupportedPolicies = map[string]Policy{
 	"round_robin": &RoundRobin{},
 	"sequential":  &Sequential{},
 	"spray":       &Spray{},
+	"qname_hash":  &QnameHash{},
+}
+
+// Policies with per-stanza state, which are instantiated for each stanza rather than shared
+var statefulPolicies = map[string]func() Policy{
+	"weighted_round_robin": func() Policy { return &WeightedRoundRobin{} },
+	"latency":              func() Policy { return &Latency{} },
 }
 
 // Policy decides how a host will be selected from a pool.
@@ -78,7 +87,122 @@ func (r *RoundRobin) Select(pool UpstreamHostPool) *UpstreamHost {
 	return host
 }
 
+// WeightedRoundRobin is a policy that selects up hosts in proportion to their weights, see host option `weight'.
+// Selections are interleaved smoothly(as nginx does), e.g. weights 3:1 yield a a b a rather than a a a b.
+type WeightedRoundRobin struct {
+	sync.Mutex
+	// Current weights of hosts, keyed by host since pools of split arms share the policy
+	current map[*UpstreamHost]int
+}
+
+func (r *WeightedRoundRobin) String() string { return "weighted_round_robin" }
+
+// Select selects an up host from the pool using a smooth weighted round robin ordering scheme.
+func (r *WeightedRoundRobin) Select(pool UpstreamHostPool) *UpstreamHost {
+	r.Lock()
+	defer r.Unlock()
+	if r.current == nil {
+		r.current = make(map[*UpstreamHost]int)
+	}
+
+	var best *UpstreamHost
+	total := 0
+	for _, host := range pool {
+		if host.Down() {
+			continue
+		}
+		weight := host.weight()
+		r.current[host] += weight
+		total += weight
+		if best == nil || r.current[host] > r.current[best] {
+			best = host
+		}
+	}
+	if best != nil {
+		r.current[best] -= total
+	}
+	return best
+}
+
+// Latency is a policy that selects the up host with the lowest average RTT.
+// Hosts never answered are selected first to measure their RTT, and every latencyProbeInterval
+//	the host answered least recently is selected instead, thus a slow host can recover once it becomes fast again.
+type Latency struct {
+	nextProbe int64 // Unix time in ns of the next re-probe
+}
+
+func (l *Latency) String() string { return "latency" }
+
+// Select selects the fastest up host from the pool.
+func (l *Latency) Select(pool UpstreamHostPool) *UpstreamHost {
+	now := clock.Now().UnixNano()
+	next := atomic.LoadInt64(&l.nextProbe)
+	probe := now >= next && atomic.CompareAndSwapInt64(&l.nextProbe, next, now+int64(latencyProbeInterval))
+
+	var fastest, stalest *UpstreamHost
+	for _, host := range pool {
+		if host.Down() {
+			continue
+		}
+		rtt := atomic.LoadInt64(&host.avgRtt)
+		if rtt == 0 {
+			return host
+		}
+		if fastest == nil || rtt < atomic.LoadInt64(&fastest.avgRtt) {
+			fastest = host
+		}
+		if stalest == nil || atomic.LoadInt64(&host.lastAnswered) < atomic.LoadInt64(&stalest.lastAnswered) {
+			stalest = host
+		}
+	}
+	if probe && stalest != nil {
+		return stalest
+	}
+	return fastest
+}
+
+// QnameHash is a policy that hashes the query name onto up hosts, thus the same name always goes to the same host.
+// Rendezvous hashing is used, i.e. the host with the highest hash of the name and itself is selected,
+//	thus only names of a host are moved to others once it's down, which keeps caches of other hosts warm.
+type QnameHash struct{}
+
+func (q *QnameHash) String() string { return "qname_hash" }
+
+// Select selects an up host at random, since the query name is unknown
+func (q *QnameHash) Select(pool UpstreamHostPool) *UpstreamHost {
+	return (&Random{}).Select(pool)
+}
+
+// SelectName selects the up host which the query name is hashed onto, nil if all hosts are down
+func (q *QnameHash) SelectName(pool UpstreamHostPool, qname string) *UpstreamHost {
+	h := stringHash(qname)
+	var best *UpstreamHost
+	var bestScore uint64
+	for _, host := range pool {
+		if host.Down() {
+			continue
+		}
+		if score := mix64(h ^ stringHash(host.Name())); best == nil || score > bestScore {
+			best, bestScore = host, score
+		}
+	}
+	return best
+}
+
+// Policies which select hosts depending on the query name
+type namePolicy interface {
+	SelectName(pool UpstreamHostPool, qname string) *UpstreamHost
+}
+
+// Finalizer of SplitMix64, which spreads the combined hashes of rendezvous hashing uniformly
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
 // Sequential is a policy that selects always the first healthy host in the list order.
+// i.e. a strict priority failover, later hosts are only selected when earlier ones are down.
 type Sequential struct{}
 
 func (s *Sequential) String() string { return "sequential" }
@@ -98,14 +222,65 @@ func (s *Sequential) Select(pool UpstreamHostPool) *UpstreamHost {
 // Spray is a policy that selects a host from a pool at random.
 // This should be used as a last ditch attempt to get
 //	a host when all hosts are reporting unhealthy.
-type Spray struct{}
+//
+// Hosts which actually answered within the cooldown are preferred,
+// and hosts which failed within the cooldown are avoided if possible.
+type Spray struct {
+	cooldown time.Duration // Zero means defaultSprayCooldown
+}
 
 func (s *Spray) String() string { return "spray" }
 
-// Select selects an up host at random from the specified pool.
+// Return weight of the host for spraying, zero means the host should be avoided
+func (s *Spray) weight(host *UpstreamHost, now int64) int {
+	cooldown := s.cooldown
+	if cooldown == 0 {
+		cooldown = defaultSprayCooldown
+	}
+	answered := atomic.LoadInt64(&host.lastAnswered)
+	failed := atomic.LoadInt64(&host.lastFailed)
+	if failed > answered && now-failed < int64(cooldown) {
+		return 0
+	}
+	if answered != 0 && now-answered < int64(cooldown) {
+		return sprayAnsweredWeight
+	}
+	return 1
+}
+
+// Select selects a host at random from the specified pool, biased by recent answers.
 func (s *Spray) Select(pool UpstreamHostPool) *UpstreamHost {
-	i := rand.Int() % len(pool)
-	randHost := pool[i]
+	now := clock.Now().UnixNano()
+	weights := make([]int, len(pool))
+	total := 0
+	for i, host := range pool {
+		weights[i] = s.weight(host, now)
+		total += weights[i]
+	}
+
+	var randHost *UpstreamHost
+	if total == 0 {
+		// All hosts are in cooldown, fallback to pure random selection
+		randHost = pool[rand.Int()%len(pool)]
+	} else {
+		r := rand.Intn(total)
+		for i, host := range pool {
+			if r < weights[i] {
+				randHost = host
+				break
+			}
+			r -= weights[i]
+		}
+	}
 	log.Warningf("All hosts reported as down, spraying to target: %s", randHost.Name())
 	return randHost
 }
+
+const (
+	// Interval of re-probing a host other than the fastest one, see Latency
+	latencyProbeInterval = 10 * time.Second
+
+	defaultSprayCooldown = 30 * time.Second
+	// Weight of a host which answered recently, compared to 1 of an unknown host
+	sprayAnsweredWeight = 4
+)
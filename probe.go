@@ -0,0 +1,79 @@
+package dnsredir
+
+import (
+	"github.com/miekg/dns"
+	"sync/atomic"
+)
+
+// Candidate UDP payload sizes to probe, in ascending order
+// see: https://dnsflagday.net/2020/
+var udpProbeSizes = []uint16{dns.MinMsgSize, 1232, 1432, 4096}
+
+// Return true if the upstream host may be queried over UDP
+func (uh *UpstreamHost) isUdpCapable() bool {
+	return uh.proto == "dns" || uh.proto == "udp"
+}
+
+// Probe effective UDP payload size of the upstream host by sending increasingly padded queries
+// The largest size that got a response will be used to clamp the advertised EDNS0 buffer size
+func (uh *UpstreamHost) probeUdpSize() {
+	c := uh.probeClient("udp", nil)
+
+	var best uint16
+	for _, size := range udpProbeSizes {
+		req := &dns.Msg{}
+		req.SetQuestion(".", dns.TypeNS)
+		req.MsgHdr.RecursionDesired = uh.transport.recursionDesired
+		req.SetEdns0(size, false)
+		// Option code and option length take up 4 bytes
+		if n := int(size) - req.Len() - 4; n > 0 {
+			opt := req.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, n)})
+		}
+
+		if _, _, err := c.Exchange(req, uh.dialAddr()); err != nil {
+			log.Debugf("UDP size probe %v of %v failed: %v", size, uh.Name(), err)
+			break
+		}
+		best = size
+	}
+
+	if best == 0 {
+		// Nothing got through, leave it to the health check
+		return
+	}
+	if old := atomic.SwapInt32(&uh.udpSize, int32(best)); old != int32(best) {
+		log.Infof("UDP payload size of %v probed: %v", uh.Name(), best)
+	}
+}
+
+// Return the probed UDP payload size of the upstream host, zero if unknown
+func (uh *UpstreamHost) probedUdpSize() uint16 {
+	return uint16(atomic.LoadInt32(&uh.udpSize))
+}
+
+func (hc *HealthCheck) udpSizeProbe() {
+	for _, host := range hc.hosts {
+		if host.isUdpCapable() {
+			go host.probeUdpSize()
+		}
+	}
+}
+
+func (hc *HealthCheck) udpSizeProbeWorker() {
+	// Kick off initial probe immediately
+	hc.udpSizeProbe()
+
+	ticker := clock.NewTicker(hc.udpProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.Chan():
+			if !hc.quiet.active(clock.Now()) {
+				hc.udpSizeProbe()
+			}
+		case <-hc.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUdpSizeProbe(t *testing.T) {
+	// Queries larger than 1300 bytes are blackholed, as if fragments were dropped on the path
+	var advertised int32
+	addr, stop := startTestServer(t, udpProto, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Len() > 1300 {
+			return
+		}
+		if opt := req.IsEdns0(); opt != nil {
+			atomic.StoreInt32(&advertised, int32(opt.UDPSize()))
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	}))
+	defer stop()
+	host, stopHost := newTestHost(t, "dnsredir . {\n to udp://"+addr+"\n}")
+	defer stopHost()
+
+	if size := host.probedUdpSize(); size != 0 {
+		t.Fatalf("expected unknown UDP payload size before probing, got %v", size)
+	}
+	host.probeUdpSize()
+	if size := host.probedUdpSize(); size != 1232 {
+		t.Fatalf("expected probed UDP payload size 1232, got %v", size)
+	}
+
+	tests := []struct {
+		size     uint16
+		expected int32
+	}{
+		// Advertised buffer size is clamped to the probed one
+		{4096, 1232},
+		{1432, 1232},
+		// Smaller ones are left intact
+		{1232, 1232},
+		{dns.MinMsgSize, dns.MinMsgSize},
+	}
+	for i, test := range tests {
+		state := newTestState("example.com.")
+		state.Req.SetEdns0(test.size, false)
+		if _, err := host.Exchange(context.Background(), state, nil, false); err != nil {
+			t.Fatalf("Test#%v: Exchange() failed, error: %v", i, err)
+		}
+		if size := atomic.LoadInt32(&advertised); size != test.expected {
+			t.Errorf("Test#%v: expected advertised UDP payload size %v, got %v", i, test.expected, size)
+		}
+		if opt := state.Req.IsEdns0(); opt.UDPSize() != test.size {
+			t.Errorf("Test#%v: expected original request intact, got UDP payload size %v", i, opt.UDPSize())
+		}
+	}
+}
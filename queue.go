@@ -0,0 +1,71 @@
+package dnsredir
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// exchangeQueue is a bounded queue in front of upstream exchange
+// Queries which cannot get a slot before their deadline will be shed
+type exchangeQueue struct {
+	slots      chan struct{}
+	waiting    int32 // Number of queries waiting for a slot
+	maxWaiting int32
+}
+
+func newExchangeQueue(concurrency, length int32) *exchangeQueue {
+	return &exchangeQueue{
+		slots:      make(chan struct{}, concurrency),
+		maxWaiting: length,
+	}
+}
+
+// Acquire an exchange slot, error is returned if the query should be shed
+// deadline is the time by which the client gave up waiting
+func (q *exchangeQueue) acquire(ctx context.Context, deadline time.Time) error {
+	// Fast path
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if atomic.AddInt32(&q.waiting, 1) > q.maxWaiting {
+		atomic.AddInt32(&q.waiting, -1)
+		return errQueueFull
+	}
+	defer atomic.AddInt32(&q.waiting, -1)
+
+	// Leave some time for the exchange itself, otherwise the answer is useless
+	wait := time.Until(deadline) - minExchangeBudget
+	if wait <= 0 {
+		return errQueueDeadline
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errQueueDeadline
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *exchangeQueue) release() {
+	<-q.slots
+}
+
+var (
+	errQueueFull     = errors.New("exchange queue is full")
+	errQueueDeadline = errors.New("query shed since it would exceed its deadline")
+)
+
+const (
+	// Minimal remaining time of a query to be worth forwarding
+	minExchangeBudget = 500 * time.Millisecond
+)
@@ -0,0 +1,126 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExchangeQueue(t *testing.T) {
+	q := newExchangeQueue(2, 1)
+	deadline := time.Now().Add(time.Minute)
+
+	// Slots are granted immediately up to the concurrency
+	for i := 0; i < 2; i++ {
+		if err := q.acquire(context.Background(), deadline); err != nil {
+			t.Fatalf("Test#%v: expected slot acquired, got %v", i, err)
+		}
+	}
+
+	// One query may wait for a slot, the next one overflows the queue
+	waited := make(chan error)
+	go func() { waited <- q.acquire(context.Background(), deadline) }()
+	for atomic.LoadInt32(&q.waiting) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := q.acquire(context.Background(), deadline); err != errQueueFull {
+		t.Fatalf("expected %v, got %v", errQueueFull, err)
+	}
+
+	// Released slot drains to the waiting query
+	q.release()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatalf("expected waiting query to get the released slot, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting query never got the released slot")
+	}
+	if n := len(q.slots); n != 2 {
+		t.Fatalf("expected 2 slots in use, got %v", n)
+	}
+
+	tests := []struct {
+		deadline time.Duration
+		expected error
+	}{
+		// Not even worth waiting, too little time left for the exchange
+		{0, errQueueDeadline},
+		{minExchangeBudget, errQueueDeadline},
+		// Waits until the deadline is about to exceed
+		{minExchangeBudget + 50*time.Millisecond, errQueueDeadline},
+	}
+	for i, test := range tests {
+		begin := time.Now()
+		if err := q.acquire(context.Background(), begin.Add(test.deadline)); err != test.expected {
+			t.Errorf("Test#%v: expected %v, got %v", i, test.expected, err)
+		}
+		if elapsed := time.Since(begin); elapsed >= test.deadline && test.deadline > minExchangeBudget {
+			t.Errorf("Test#%v: expected shed before the deadline, waited %v", i, elapsed)
+		}
+	}
+
+	// Waiting query gives up once cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { waited <- q.acquire(ctx, deadline) }()
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	// All slots drained, no query waiting
+	q.release()
+	q.release()
+	if n := len(q.slots); n != 0 {
+		t.Fatalf("expected all slots released, got %v in use", n)
+	}
+	if n := atomic.LoadInt32(&q.waiting); n != 0 {
+		t.Fatalf("expected no query waiting, got %v", n)
+	}
+}
+
+func TestQueueShedRcode(t *testing.T) {
+	// Upstream hangs until released, thus the only slot is held
+	release := make(chan struct{})
+	addr, stop := startTestServer(t, udpProto, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Question[0].Name != "." {
+			<-release
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	}))
+	defer stop()
+	r, stopRedir := newTestDnsredir(t, "dnsredir . {\n to "+addr+"\n queue 1 0\n}")
+	defer stopRedir()
+	q := (*r.Upstreams)[0].(*reloadableUpstream).queue
+
+	done := make(chan int)
+	go func() {
+		_, rc, _ := serveTestQuery(r, "example.com.")
+		done <- rc
+	}()
+	for len(q.slots) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Queue of zero length overflows immediately
+	if _, rc, err := serveTestQuery(r, "example.org."); rc != dns.RcodeServerFailure || err != errQueueFull {
+		t.Fatalf("expected %v with %v, got %v %v", dns.RcodeToString[dns.RcodeServerFailure], errQueueFull, rc, err)
+	}
+
+	close(release)
+	if rc := <-done; rc != dns.RcodeSuccess {
+		t.Fatalf("expected the query holding the slot answered, got %v", rc)
+	}
+	// Drained, the slot is free again
+	if n := len(q.slots); n != 0 {
+		t.Fatalf("expected the slot released, got %v in use", n)
+	}
+	if _, rc, err := serveTestQuery(r, "example.org."); rc != dns.RcodeSuccess || err != nil {
+		t.Fatalf("expected %v, got %v %v", dns.RcodeToString[dns.RcodeSuccess], rc, err)
+	}
+}
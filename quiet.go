@@ -0,0 +1,91 @@
+package dnsredir
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Daily window in local time during which active health checks are suppressed
+// Minutes since midnight, end may be less than start if the window spans midnight.
+type quietWindow struct {
+	start, end int
+}
+
+type quietWindows []quietWindow
+
+// Parse a window in HH:MM-HH:MM format
+func parseQuietWindow(s string) (quietWindow, error) {
+	start, end := SplitByByte(s, '-')
+	if len(end) == 0 {
+		return quietWindow{}, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	var w quietWindow
+	var err error
+	if w.start, err = parseClock(start); err != nil {
+		return quietWindow{}, err
+	}
+	if w.end, err = parseClock(end[1:]); err != nil {
+		return quietWindow{}, err
+	}
+	if w.start == w.end {
+		return quietWindow{}, fmt.Errorf("empty window %q", s)
+	}
+	return w, nil
+}
+
+// Parse HH:MM into minutes since midnight
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		h, err1 := strconv.Atoi(parts[0])
+		m, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil && h >= 0 && h <= 24 && m >= 0 && m < 60 && h*60+m <= 24*60 {
+			return h*60 + m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q", s)
+}
+
+func (w quietWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// Return true if t falls in any of the windows
+func (ws quietWindows) active(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range ws {
+		if w.start < w.end {
+			if m >= w.start && m < w.end {
+				return true
+			}
+		} else if m >= w.start || m < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if active health checks should be suppressed at present
+// Failure counters are reset once entering a quiet window,
+//	thus hosts marked down by the last active check won't stay down for the whole window.
+func (hc *HealthCheck) quietNow() bool {
+	if len(hc.quiet) == 0 {
+		return false
+	}
+	quiet := hc.quiet.active(clock.Now())
+	if quiet != hc.inQuiet {
+		hc.inQuiet = quiet
+		if quiet {
+			for _, host := range hc.hosts {
+				atomic.StoreInt32(&host.fails, 0)
+			}
+			log.Infof("Entered health check quiet window, rely on passive failure detection")
+		} else {
+			log.Infof("Left health check quiet window")
+		}
+	}
+	return quiet
+}
@@ -0,0 +1,100 @@
+package dnsredir
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Query count of an upstream host in the current calendar month(UTC), rolls over at the beginning of each month
+type monthlyUsage struct {
+	sync.Mutex
+	month string
+	count uint64
+}
+
+func currentMonth() string {
+	return clock.Now().UTC().Format("2006-01")
+}
+
+// Count a query sent to the host, return count of the current month
+func (m *monthlyUsage) add() uint64 {
+	month := currentMonth()
+	m.Lock()
+	defer m.Unlock()
+	if m.month != month {
+		m.month = month
+		m.count = 0
+	}
+	m.count++
+	return m.count
+}
+
+// Return count of the current month
+func (m *monthlyUsage) get() uint64 {
+	month := currentMonth()
+	m.Lock()
+	defer m.Unlock()
+	if m.month != month {
+		return 0
+	}
+	return m.count
+}
+
+// Restore a persisted count, which is ignored if it belongs to a past month
+func (m *monthlyUsage) restore(month string, count uint64) {
+	if month != currentMonth() {
+		return
+	}
+	m.Lock()
+	m.month = month
+	m.count = count
+	m.Unlock()
+}
+
+// Parse quota in N/month format
+func parseQuota(s string) (uint64, error) {
+	n, period := SplitByByte(s, '/')
+	if period != "/month" {
+		return 0, errQuotaFormat
+	}
+	quota, err := strconv.ParseUint(strings.TrimSpace(n), 10, 64)
+	if err != nil || quota == 0 {
+		return 0, errQuotaFormat
+	}
+	return quota, nil
+}
+
+func (uh *UpstreamHost) overQuota() bool {
+	return uh.opts.quota != 0 && uh.usage.get() >= uh.opts.quota
+}
+
+// Return hosts within their monthly quota, hosts exceeded quota are demoted
+// i.e. the pool itself is returned if every host within quota is down.
+func (pool UpstreamHostPool) withinQuota() UpstreamHostPool {
+	var ret UpstreamHostPool
+	for i, host := range pool {
+		if !host.overQuota() {
+			if ret != nil {
+				ret = append(ret, host)
+			}
+			continue
+		}
+		QuotaExceededCount.WithLabelValues(host.Name()).Inc()
+		if ret == nil {
+			ret = append(make(UpstreamHostPool, 0, len(pool)), pool[:i]...)
+		}
+	}
+	if ret == nil {
+		return pool
+	}
+	for _, host := range ret {
+		if !host.Down() {
+			return ret
+		}
+	}
+	return pool
+}
+
+var errQuotaFormat = errors.New("expected a positive quota in N/month format, e.g. 100000/month")
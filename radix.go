@@ -0,0 +1,199 @@
+package dnsredir
+
+// Radix tree of domain names in reversed byte order, e.g. `moc.elpmaxe' for `example.com'
+// Thus parents of a name are prefixes of it which end at a label boundary.
+// Nodes and edge labels are kept in two flat slices and referenced by index,
+// which takes far less memory than a string per name or a struct allocation per node.
+// XXX: not thread safe
+type domainTree struct {
+	nodes  []radixNode // nodes[0] is the root, which has an empty edge
+	labels []byte      // Edge labels of all nodes, in reversed byte order
+	n      uint64      // Number of names
+}
+
+type radixNode struct {
+	off   uint32 // Offset of the edge label in labels
+	child uint32 // First child, 0 if none. Children are sorted by the first byte of their edges
+	next  uint32 // Next sibling, 0 if none
+	n     uint16 // Length of the edge label
+	name  bool   // true if path from the root to the node is a name in the tree
+}
+
+// Longest name which can be added, since length of an edge label is stored in uint16
+const maxTreeNameLen = 1<<16 - 1
+
+// Return the i-th byte of `s' in reversed order
+func reversedByte(s string, i int) byte {
+	return s[len(s)-1-i]
+}
+
+// Return the child of node `cur' whose edge begins with `c'
+// Along with the previous sibling of it(or where it should be inserted), 0 if it's the first one.
+func (t *domainTree) findChild(cur uint32, c byte) (uint32, uint32) {
+	var prev uint32
+	ch := t.nodes[cur].child
+	for ch != 0 && t.labels[t.nodes[ch].off] < c {
+		prev = ch
+		ch = t.nodes[ch].next
+	}
+	if ch != 0 && t.labels[t.nodes[ch].off] != c {
+		return 0, prev
+	}
+	return ch, prev
+}
+
+// Return true if the name added, false if it's already in the tree or too long
+func (t *domainTree) add(name string) bool {
+	if len(name) == 0 || len(name) > maxTreeNameLen {
+		return false
+	}
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, radixNode{})
+	}
+
+	var cur uint32
+	for i := 0; ; {
+		if i == len(name) {
+			if t.nodes[cur].name {
+				return false
+			}
+			t.nodes[cur].name = true
+			t.n++
+			return true
+		}
+
+		ch, prev := t.findChild(cur, reversedByte(name, i))
+		if ch == 0 {
+			// No edge shares the first byte, the rest of the name becomes a new leaf
+			leaf := uint32(len(t.nodes))
+			t.nodes = append(t.nodes, radixNode{off: uint32(len(t.labels)), n: uint16(len(name) - i), name: true})
+			for j := i; j < len(name); j++ {
+				t.labels = append(t.labels, reversedByte(name, j))
+			}
+			if prev == 0 {
+				t.nodes[leaf].next = t.nodes[cur].child
+				t.nodes[cur].child = leaf
+			} else {
+				t.nodes[leaf].next = t.nodes[prev].next
+				t.nodes[prev].next = leaf
+			}
+			t.n++
+			return true
+		}
+
+		e := t.nodes[ch]
+		k := 0
+		for k < int(e.n) && i+k < len(name) && t.labels[int(e.off)+k] == reversedByte(name, i+k) {
+			k++
+		}
+		if k < int(e.n) {
+			// Split the edge, the remaining part of it takes over children of the node
+			// Edge labels are sliced in place, thus no label byte is added.
+			rest := uint32(len(t.nodes))
+			t.nodes = append(t.nodes, radixNode{off: e.off + uint32(k), n: e.n - uint16(k), name: e.name, child: e.child})
+			t.nodes[ch].n = uint16(k)
+			t.nodes[ch].name = false
+			t.nodes[ch].child = rest
+		}
+		cur = ch
+		i += k
+	}
+}
+
+// Return the longest name in the tree which is `child' itself or a parent of it
+// The returned name is a substring of `child', thus nothing allocated.
+func (t *domainTree) match(child string) (string, bool) {
+	if len(t.nodes) == 0 {
+		return "", false
+	}
+	matched := -1
+	var cur uint32
+	for i := 0; ; {
+		if t.nodes[cur].name && (i == len(child) || reversedByte(child, i) == '.') {
+			matched = i
+		}
+		if i == len(child) {
+			break
+		}
+		ch, _ := t.findChild(cur, reversedByte(child, i))
+		if ch == 0 {
+			break
+		}
+		e := t.nodes[ch]
+		if int(e.n) > len(child)-i || !t.edgeEqual(e, child, i) {
+			break
+		}
+		cur = ch
+		i += int(e.n)
+	}
+	if matched < 0 {
+		return "", false
+	}
+	return child[len(child)-matched:], true
+}
+
+// Return true if the name itself(rather than its parent) is in the tree
+func (t *domainTree) contains(name string) bool {
+	if len(t.nodes) == 0 || len(name) == 0 {
+		return false
+	}
+	var cur uint32
+	for i := 0; i < len(name); {
+		ch, _ := t.findChild(cur, reversedByte(name, i))
+		if ch == 0 {
+			return false
+		}
+		e := t.nodes[ch]
+		if int(e.n) > len(name)-i || !t.edgeEqual(e, name, i) {
+			return false
+		}
+		cur = ch
+		i += int(e.n)
+	}
+	return t.nodes[cur].name
+}
+
+// Return true if edge label of the node equals to `s' in reversed order starting from `i'
+func (t *domainTree) edgeEqual(e radixNode, s string, i int) bool {
+	for k := 0; k < int(e.n); k++ {
+		if t.labels[int(e.off)+k] != reversedByte(s, i+k) {
+			return false
+		}
+	}
+	return true
+}
+
+// for loop will exit in advance if f() return error
+func (t *domainTree) forEach(f func(name string) error) error {
+	if len(t.nodes) == 0 {
+		return nil
+	}
+	return t.walk(0, make([]byte, 0, 64), f)
+}
+
+// `path' is the reversed name from the root to the node, excluding the node's edge
+func (t *domainTree) walk(cur uint32, path []byte, f func(name string) error) error {
+	e := t.nodes[cur]
+	path = append(path, t.labels[e.off:e.off+uint32(e.n)]...)
+	if e.name {
+		name := make([]byte, len(path))
+		for i, c := range path {
+			name[len(path)-1-i] = c
+		}
+		if err := f(string(name)); err != nil {
+			return err
+		}
+	}
+	for ch := e.child; ch != 0; ch = t.nodes[ch].next {
+		if err := t.walk(ch, path, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return approximate memory footprint of the tree in bytes
+func (t *domainTree) size() uint64 {
+	const nodeSize = 16
+	return uint64(cap(t.nodes))*nodeSize + uint64(cap(t.labels))
+}
@@ -0,0 +1,171 @@
+package dnsredir
+
+import (
+	"github.com/leiless/dnsredir/compiled"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A source of names in FROM..., i.e. a name list item or INLINE
+type reconcileSource struct {
+	name  string
+	names domainSet
+	list  *compiled.List
+}
+
+// Return true if the name itself(rather than its parent) is in the source
+func (s *reconcileSource) contains(name string) bool {
+	return s.names.Contains(name) || (s.list != nil && s.list.Contains(name))
+}
+
+func (s *reconcileSource) match(name string) bool {
+	if s.names.Match(name) {
+		return true
+	}
+	if s.list != nil {
+		_, ok := s.list.Match(name)
+		return ok
+	}
+	return false
+}
+
+func (s *reconcileSource) forEach(f func(name string) error) {
+	_ = s.names.ForEachDomain(f)
+	if s.list != nil {
+		_ = s.list.ForEach(f)
+	}
+}
+
+type reconcileDuplicate struct {
+	Name    string   `json:"name"`
+	Sources []string `json:"sources"`
+}
+
+// Reconciliation of exclusions against FROM... of a stanza, samples are limited to maxReconcileSamples
+type reconcileReport struct {
+	// Entries of `except' and exception rules which no name in FROM... is above or under, thus take no effect
+	UnusedExcepts     []string `json:"unused_excepts"`
+	UnusedExceptCount uint64   `json:"unused_except_count"`
+	// Names present in more than one source of FROM...
+	Duplicates     []reconcileDuplicate `json:"duplicates"`
+	DuplicateCount uint64               `json:"duplicate_count"`
+}
+
+// Reconcile exclusions and sources of FROM...
+// Name sets are replaced rather than modified by reloads, thus they're iterated without the item lock.
+func (u *reloadableUpstream) reconcile() reconcileReport {
+	var r reconcileReport
+	if u.matchAny {
+		// Every exclusion takes effect
+		return r
+	}
+	sources := make([]*reconcileSource, 0, len(u.items)+1)
+	used := make(map[string]bool)
+	_ = u.ignored.ForEachDomain(func(name string) error {
+		used[name] = false
+		return nil
+	})
+	for _, item := range u.items {
+		s := item.loadNames()
+		if !item.except {
+			sources = append(sources, &reconcileSource{name: item.String(), names: s.names, list: s.compiled})
+		}
+		excepts := s.excepts
+		_ = excepts.ForEachDomain(func(name string) error {
+			used[name] = false
+			return nil
+		})
+	}
+	sources = append(sources, &reconcileSource{name: "INLINE", names: u.inline})
+
+	for i, s := range sources {
+		s.forEach(func(name string) error {
+			// Exclusions of the name or its parents
+			for child := name; len(used) != 0; child = child[strings.IndexByte(child, '.')+1:] {
+				if _, ok := used[child]; ok {
+					used[child] = true
+				}
+				if strings.IndexByte(child, '.') < 0 {
+					break
+				}
+			}
+
+			// Counted once when seen by the second source
+			seen := 0
+			for _, prev := range sources[:i] {
+				if prev.contains(name) {
+					seen++
+				}
+				if seen > 1 {
+					return nil
+				}
+			}
+			if seen == 0 {
+				return nil
+			}
+			r.DuplicateCount++
+			if len(r.Duplicates) < maxReconcileSamples {
+				d := reconcileDuplicate{Name: name}
+				for _, s := range sources {
+					if s.contains(name) {
+						d.Sources = append(d.Sources, s.name)
+					}
+				}
+				r.Duplicates = append(r.Duplicates, d)
+			}
+			return nil
+		})
+	}
+
+	for name, ok := range used {
+		if ok {
+			continue
+		}
+		// Exclusions under a name
+		for _, s := range sources {
+			if s.match(name) {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			continue
+		}
+		r.UnusedExceptCount++
+		r.UnusedExcepts = append(r.UnusedExcepts, name)
+	}
+	sort.Strings(r.UnusedExcepts)
+	if len(r.UnusedExcepts) > maxReconcileSamples {
+		r.UnusedExcepts = r.UnusedExcepts[:maxReconcileSamples]
+	}
+	sort.Slice(r.Duplicates, func(i, j int) bool {
+		return r.Duplicates[i].Name < r.Duplicates[j].Name
+	})
+	return r
+}
+
+func (u *reloadableUpstream) reportReconciliation() {
+	r := u.reconcile()
+	ReconcileUnusedExcepts.WithLabelValues(u.stanza).Set(float64(r.UnusedExceptCount))
+	ReconcileDuplicateNames.WithLabelValues(u.stanza).Set(float64(r.DuplicateCount))
+}
+
+func (u *reloadableUpstream) reconcileReportWorker() {
+	ticker := time.NewTicker(reconcileReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.reportReconciliation()
+		case <-u.stopPathReload:
+			return
+		}
+	}
+}
+
+const (
+	// Name lists are likely loaded after the first interval
+	reconcileReportInterval = 10 * time.Minute
+	maxReconcileSamples     = 100
+)
@@ -0,0 +1,240 @@
+package dnsredir
+
+import (
+	"context"
+	"errors"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// IPv4 addresses of root servers, see: https://www.internic.net/domain/named.root
+var rootHints = []string{
+	"198.41.0.4",     // a.root-servers.net
+	"170.247.170.2",  // b.root-servers.net
+	"192.33.4.12",    // c.root-servers.net
+	"199.7.91.13",    // d.root-servers.net
+	"192.203.230.10", // e.root-servers.net
+	"192.5.5.241",    // f.root-servers.net
+	"192.112.36.4",   // g.root-servers.net
+	"198.97.190.53",  // h.root-servers.net
+	"192.36.148.17",  // i.root-servers.net
+	"192.58.128.30",  // j.root-servers.net
+	"193.0.14.129",   // k.root-servers.net
+	"199.7.83.42",    // l.root-servers.net
+	"202.12.27.33",   // m.root-servers.net
+}
+
+// Last resort iterative resolution from root hints, used when every upstream of a `.' stanza is down
+// Thus the network degrades slowly instead of failing completely during upstream outages.
+type rootRecursor struct {
+	// Maximum queries sent on behalf of a single request
+	maxQueries int
+	client     *dns.Client
+	// Port of name servers, always 53 except in tests
+	port string
+}
+
+const (
+	recursionQueryTimeout = 2 * time.Second
+	// Maximum nested lookups, i.e. CNAME chasing and glueless NS resolution
+	recursionMaxDepth = 8
+)
+
+func newRootRecursor(maxQueries int) *rootRecursor {
+	return &rootRecursor{
+		maxQueries: maxQueries,
+		client:     &dns.Client{Net: "udp", Timeout: recursionQueryTimeout},
+		port:       "53",
+	}
+}
+
+// Resolve the request iteratively, the reply is ready to be written back to the client
+func (r *rootRecursor) resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	budget := r.maxQueries
+	ret, err := r.lookup(ctx, req.Question[0], &budget, 0)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Rcode = ret.Rcode
+	reply.RecursionAvailable = true
+	reply.Answer = ret.Answer
+	reply.Ns = ret.Ns
+	return reply, nil
+}
+
+func (r *rootRecursor) lookup(ctx context.Context, q dns.Question, budget *int, depth int) (*dns.Msg, error) {
+	if depth > recursionMaxDepth {
+		return nil, errRecursionTooDeep
+	}
+	zone := "."
+	servers := shuffledHints()
+	for {
+		reply, err := r.query(ctx, servers, q, budget)
+		if err != nil {
+			return nil, err
+		}
+		if len(reply.Answer) != 0 || reply.Rcode == dns.RcodeNameError || reply.Authoritative {
+			return r.chase(ctx, q, reply, budget, depth)
+		}
+
+		// Referral, which must lead us closer to the query name
+		var nsNames []string
+		child := ""
+		for _, rr := range reply.Ns {
+			if ns, ok := rr.(*dns.NS); ok {
+				child = strings.ToLower(ns.Hdr.Name)
+				nsNames = append(nsNames, strings.ToLower(ns.Ns))
+			}
+		}
+		if len(nsNames) == 0 {
+			// NODATA from a non-authoritative server
+			return reply, nil
+		}
+		if !dns.IsSubDomain(zone, child) || dns.CountLabel(child) <= dns.CountLabel(zone) || !dns.IsSubDomain(child, strings.ToLower(q.Name)) {
+			return nil, errBadReferral
+		}
+		zone = child
+
+		servers = glueAddrs(reply, nsNames)
+		if len(servers) == 0 {
+			// Glueless delegation, resolve one of the name servers
+			for _, name := range nsNames {
+				ret, err := r.lookup(ctx, dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, budget, depth+1)
+				if err == errRecursionBudget {
+					return nil, err
+				}
+				if err != nil {
+					continue
+				}
+				for _, rr := range ret.Answer {
+					if a, ok := rr.(*dns.A); ok {
+						servers = append(servers, a.A.String())
+					}
+				}
+				if len(servers) != 0 {
+					break
+				}
+			}
+			if len(servers) == 0 {
+				return nil, errBadReferral
+			}
+		}
+	}
+}
+
+// Follow dangling CNAME of the answer, if any
+func (r *rootRecursor) chase(ctx context.Context, q dns.Question, reply *dns.Msg, budget *int, depth int) (*dns.Msg, error) {
+	if q.Qtype == dns.TypeCNAME || len(reply.Answer) == 0 {
+		return reply, nil
+	}
+	target := strings.ToLower(q.Name)
+	for _, rr := range reply.Answer {
+		if strings.ToLower(rr.Header().Name) != target {
+			continue
+		}
+		if rr.Header().Rrtype == q.Qtype {
+			return reply, nil
+		}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target = strings.ToLower(cname.Target)
+		}
+	}
+	if target == strings.ToLower(q.Name) {
+		return reply, nil
+	}
+	ret, err := r.lookup(ctx, dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, budget, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	m := reply.Copy()
+	m.Rcode = ret.Rcode
+	m.Answer = append(m.Answer, ret.Answer...)
+	m.Ns = ret.Ns
+	return m, nil
+}
+
+// Query servers in order until a usable reply
+func (r *rootRecursor) query(ctx context.Context, servers []string, q dns.Question, budget *int) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Question[0].Qclass = q.Qclass
+	m.RecursionDesired = false
+	m.SetEdns0(1232, false)
+
+	err := errors.New("no server to query")
+	for _, server := range servers {
+		if *budget <= 0 {
+			return nil, errRecursionBudget
+		}
+		*budget--
+		addr := net.JoinHostPort(server, r.port)
+		var reply *dns.Msg
+		reply, _, err = r.client.ExchangeContext(ctx, m, addr)
+		if err == nil && reply.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: recursionQueryTimeout}
+			reply, _, err = tcp.ExchangeContext(ctx, m, addr)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if reply.Rcode == dns.RcodeSuccess || reply.Rcode == dns.RcodeNameError {
+			return reply, nil
+		}
+		err = errors.New("unexpected rcode " + dns.RcodeToString[reply.Rcode])
+	}
+	return nil, err
+}
+
+// Return IPv4 glue addresses of the name servers
+func glueAddrs(reply *dns.Msg, nsNames []string) []string {
+	var addrs []string
+	for _, rr := range reply.Extra {
+		if a, ok := rr.(*dns.A); ok && stringInSlice(strings.ToLower(a.Hdr.Name), nsNames) {
+			addrs = append(addrs, a.A.String())
+		}
+	}
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	return addrs
+}
+
+func shuffledHints() []string {
+	hints := append([]string(nil), rootHints...)
+	rand.Shuffle(len(hints), func(i, j int) {
+		hints[i], hints[j] = hints[j], hints[i]
+	})
+	return hints
+}
+
+// Answer the request by emergency recursion
+func (u *reloadableUpstream) recurse(ctx context.Context, w dns.ResponseWriter, state *request.Request, server, logName string) (int, error) {
+	reply, err := u.recursor.resolve(ctx, state.Req)
+	if err != nil {
+		log.Warningf("Emergency recursion of %q failed: %v", logName, err)
+		EmergencyRecursionCount.WithLabelValues(server, "0").Inc()
+		return dns.RcodeServerFailure, err
+	}
+	log.Debugf("%q answered by emergency recursion", logName)
+	EmergencyRecursionCount.WithLabelValues(server, "1").Inc()
+	if state.Proto() == "udp" {
+		fitReply(reply, state.Size(), u.minimalResponses)
+	}
+	_ = w.WriteMsg(reply)
+	return dns.RcodeSuccess, nil
+}
+
+var (
+	errRecursionBudget  = errors.New("emergency recursion query budget exhausted")
+	errRecursionTooDeep = errors.New("emergency recursion too deep")
+	errBadReferral      = errors.New("bad referral")
+)
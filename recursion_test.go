@@ -0,0 +1,133 @@
+package dnsredir
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Authoritative data of a fake name server hierarchy, keyed by server address
+//	127.0.0.1	root, delegates com. with glue, test. without glue and evil. to a bad referral
+//	127.0.0.2	com., delegates example.com. with glue
+//	127.0.0.3	example.com.
+//	127.0.0.4	test.
+func recursionHandler(queries *int32) dns.HandlerFunc {
+	rr := func(s string) dns.RR {
+		r, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		return r
+	}
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		name := strings.ToLower(req.Question[0].Name)
+		switch host, _, _ := net.SplitHostPort(w.LocalAddr().String()); host {
+		case "127.0.0.1":
+			switch {
+			case dns.IsSubDomain("com.", name):
+				m.Ns = append(m.Ns, rr("com. 60 IN NS a.gtld-servers.net."))
+				m.Extra = append(m.Extra, rr("a.gtld-servers.net. 60 IN A 127.0.0.2"))
+			case dns.IsSubDomain("test.", name):
+				m.Ns = append(m.Ns, rr("test. 60 IN NS ns.example.com."))
+			case dns.IsSubDomain("evil.", name):
+				m.Ns = append(m.Ns, rr("com. 60 IN NS a.gtld-servers.net."))
+				m.Extra = append(m.Extra, rr("a.gtld-servers.net. 60 IN A 127.0.0.2"))
+			}
+		case "127.0.0.2":
+			m.Ns = append(m.Ns, rr("example.com. 60 IN NS ns1.example.com."))
+			m.Extra = append(m.Extra, rr("ns1.example.com. 60 IN A 127.0.0.3"))
+		case "127.0.0.3":
+			m.Authoritative = true
+			switch name {
+			case "www.example.com.":
+				m.Answer = append(m.Answer, rr("www.example.com. 60 IN CNAME web.example.com."))
+			case "web.example.com.":
+				m.Answer = append(m.Answer, rr("web.example.com. 60 IN A 1.2.3.4"))
+			case "ns.example.com.":
+				m.Answer = append(m.Answer, rr("ns.example.com. 60 IN A 127.0.0.4"))
+			default:
+				m.Rcode = dns.RcodeNameError
+			}
+		case "127.0.0.4":
+			m.Authoritative = true
+			m.Answer = append(m.Answer, rr(name+" 60 IN A 5.6.7.8"))
+		}
+		_ = w.WriteMsg(m)
+	}
+}
+
+func TestRootRecursor(t *testing.T) {
+	// All fake name servers listen on the same port of different loopback addresses
+	var queries int32
+	handler := recursionHandler(&queries)
+	addrs := []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"}
+	port := "0"
+	for _, addr := range addrs {
+		pc, err := net.ListenPacket(udpProto, net.JoinHostPort(addr, port))
+		if err != nil {
+			t.Skipf("Cannot listen on %v, error: %v", addr, err)
+		}
+		_, port, _ = net.SplitHostPort(pc.LocalAddr().String())
+		server := &dns.Server{PacketConn: pc, Handler: handler}
+		go func() { _ = server.ActivateAndServe() }()
+		defer func() { _ = server.Shutdown() }()
+	}
+
+	hints := rootHints
+	rootHints = addrs[:1]
+	defer func() { rootHints = hints }()
+
+	tests := []struct {
+		name       string
+		maxQueries int
+		err        error
+		rcode      int
+		answer     []string
+		queries    int32
+	}{
+		// Referrals with glue, CNAME is chased from the root again
+		{"www.example.com.", 10, nil, dns.RcodeSuccess, []string{"www.example.com.", "web.example.com."}, 6},
+		{"nx.example.com.", 10, nil, dns.RcodeNameError, nil, 3},
+		// Glueless delegation, the name server is resolved before going on
+		{"glueless.test.", 10, nil, dns.RcodeSuccess, []string{"glueless.test."}, 5},
+		// Referral which doesn't lead closer to the query name
+		{"www.evil.", 10, errBadReferral, 0, nil, 1},
+		// Queries beyond the budget are never sent
+		{"www.example.com.", 2, errRecursionBudget, 0, nil, 2},
+	}
+	for i, test := range tests {
+		atomic.StoreInt32(&queries, 0)
+		r := newRootRecursor(test.maxQueries)
+		r.port = port
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		reply, err := r.resolve(context.Background(), req)
+		if n := atomic.LoadInt32(&queries); n != test.queries {
+			t.Errorf("Test#%v: expected %v queries sent, got %v", i, test.queries, n)
+		}
+		if err != test.err {
+			t.Errorf("Test#%v: expected error %v, got %v", i, test.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if reply.Id != req.Id || !reply.RecursionAvailable || reply.Rcode != test.rcode {
+			t.Errorf("Test#%v: unexpected reply %v", i, reply)
+		}
+		if len(reply.Answer) != len(test.answer) {
+			t.Fatalf("Test#%v: expected %v answers, got %v", i, len(test.answer), len(reply.Answer))
+		}
+		for j, name := range test.answer {
+			if reply.Answer[j].Header().Name != name {
+				t.Errorf("Test#%v: expected answer of %v, got %v", i, name, reply.Answer[j])
+			}
+		}
+	}
+}
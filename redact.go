@@ -0,0 +1,62 @@
+package dnsredir
+
+import (
+	"fmt"
+	"strings"
+)
+
+// qnameRedactor redacts query names in log output, only the matched suffix is kept
+type qnameRedactor struct {
+	hash bool // Hash leading labels if true, truncate them otherwise
+}
+
+var redactModes = map[string]bool{
+	"hash":     true,
+	"truncate": false,
+}
+
+// Redact a name, `suffix' is the matched list entry of the name(if any)
+// If the name has no matched suffix, only the top level label will be kept.
+func (r *qnameRedactor) redact(name, suffix string) string {
+	if r == nil {
+		return name
+	}
+	fqdn := strings.HasSuffix(name, ".")
+	name = removeTrailingDot(name)
+	if len(name) == 0 {
+		// Root zone reveals nothing
+		return "."
+	}
+
+	if len(suffix) == 0 || suffix == "." || !strings.HasSuffix(name, suffix) {
+		suffix = name[strings.LastIndexByte(name, '.')+1:]
+	}
+	var s string
+	if name == suffix {
+		s = suffix
+	} else {
+		prefix := strings.TrimSuffix(strings.TrimSuffix(name, suffix), ".")
+		if r.hash {
+			s = fmt.Sprintf("%08x.%v", uint32(stringHash(prefix)), suffix)
+		} else {
+			s = "*." + suffix
+		}
+	}
+	if fqdn {
+		s += "."
+	}
+	return s
+}
+
+// Return the name for log output, which is redacted if `redact_qnames' enabled
+func (u *reloadableUpstream) logName(name string) string {
+	if u.redact == nil {
+		return name
+	}
+	child := removeTrailingDot(name)
+	suffix, ok := u.inline.MatchName(child)
+	if !ok {
+		suffix, _ = u.NameList.matchName(child)
+	}
+	return u.redact.redact(name, suffix)
+}
@@ -0,0 +1,127 @@
+package dnsredir
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// Upstream hosts specified by domain name are resolved via bootstrap DNS at startup and periodically re-resolved
+// Resolved addresses are used for dialing, thus anycast providers which rotate IPs are followed
+//	without a bootstrap lookup per dial. Until resolved, the name is resolved on each dial.
+
+// Return a resolver which uses bootstrap DNS, nil to use system default resolvers(i.e. /etc/resolv.conf)
+func bootstrapResolver(bootstrap []string, noIPv6 bool) *net.Resolver {
+	if len(bootstrap) == 0 {
+		return nil
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if noIPv6 {
+				if strings.HasPrefix(network, "tcp") {
+					network = "tcp4"
+				}
+				if strings.HasPrefix(network, "udp") {
+					network = "udp4"
+				}
+			}
+			var d net.Dialer
+			// Randomly choose a bootstrap DNS to resolve upstream host
+			addr := bootstrap[rand.Intn(len(bootstrap))]
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// Return the address used for dialing, i.e. the resolved one if any
+func (uh *UpstreamHost) dialAddr() string {
+	if addr, ok := uh.resolvedAddr.Load().(string); ok {
+		return addr
+	}
+	return uh.addr
+}
+
+func (uh *UpstreamHost) resolve() {
+	host, port, err := net.SplitHostPort(uh.addr)
+	if err != nil {
+		return
+	}
+	resolver := uh.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHcTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		log.Warningf("Failed to resolve %v: %v", uh.Name(), err)
+		return
+	}
+
+	current := uh.dialAddr()
+	var picked string
+	for _, addr := range addrs {
+		ip4 := addr.IP.To4() != nil
+		if (uh.noIPv6 && !ip4) || (uh.ipv6Only && ip4) {
+			continue
+		}
+		s := net.JoinHostPort(addr.String(), port)
+		if s == current {
+			// Stick to the current address if it's still valid, so pooled connections won't be wasted
+			return
+		}
+		if len(picked) == 0 {
+			picked = s
+		}
+	}
+	if len(picked) == 0 {
+		log.Warningf("No usable address of %v resolved: %v", uh.Name(), addrs)
+		return
+	}
+	uh.resolvedAddr.Store(picked)
+	log.Infof("%v resolved to %v", uh.Name(), picked)
+}
+
+func (hc *HealthCheck) resolveWorker(hosts UpstreamHostPool) {
+	resolve := func() {
+		for _, host := range hosts {
+			go host.resolve()
+		}
+	}
+	// Kick off initial resolution immediately
+	resolve()
+
+	ticker := clock.NewTicker(reresolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.Chan():
+			resolve()
+		case <-hc.stop:
+			return
+		}
+	}
+}
+
+// Return hosts which specified by domain name, including those in transport fallback chains
+func (hc *HealthCheck) hostsToResolve() UpstreamHostPool {
+	var hosts UpstreamHostPool
+	for _, host := range hc.hosts {
+		if host.resolves {
+			hosts = append(hosts, host)
+		}
+		if host.fallback != nil {
+			for _, h := range host.fallback.hosts {
+				if h.resolves {
+					hosts = append(hosts, h)
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+const reresolveInterval = 5 * time.Minute
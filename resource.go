@@ -0,0 +1,182 @@
+package dnsredir
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Rough per-object memory overheads used by estimations, in bytes
+const (
+	// String header plus map bucket slot
+	mapEntryOverhead = 48
+	// Slice header
+	sliceOverhead = 24
+
+	udpConnBytes = 4 * 1024
+	tcpConnBytes = 8 * 1024
+	// TLS conn holds record buffers and crypto state
+	tlsConnBytes = 48 * 1024
+)
+
+// Estimate memory footprint of a name set and its tags
+func estimateNamesBytes(names domainSet, tags map[string][]string) uint64 {
+	var n uint64
+	for _, t := range names {
+		n += mapEntryOverhead + t.size()
+	}
+	for name, nameTags := range tags {
+		n += uint64(len(name)) + mapEntryOverhead + sliceOverhead
+		for _, tag := range nameTags {
+			n += uint64(len(tag)) + 16
+		}
+	}
+	return n
+}
+
+// Resource usage estimations of a stanza
+type stanzaResources struct {
+	Names      uint64 `json:"names"`
+	NamesBytes uint64 `json:"names_bytes"`
+	Conns      uint64 `json:"conns"`
+	ConnsBytes uint64 `json:"conns_bytes"`
+	Goroutines uint64 `json:"goroutines"`
+}
+
+// Return number of pooled connections by transport type
+func (t *Transport) pooledConns() [typeTotalCount]int32 {
+	var n [typeTotalCount]int32
+	for i := range n {
+		n[i] = atomic.LoadInt32(&t.pooled[i])
+	}
+	return n
+}
+
+// Estimate resource usage of the stanza
+func (u *reloadableUpstream) resources() stanzaResources {
+	var r stanzaResources
+	for _, item := range u.items {
+		s := item.loadNames()
+		if s.names != nil {
+			r.Names += s.names.Len()
+		}
+		if s.compiled != nil {
+			r.Names += uint64(s.compiled.Len())
+		}
+		r.NamesBytes += s.bytes
+		if s.canary != nil {
+			r.NamesBytes += s.canary.bytes
+		}
+	}
+	r.Names += u.inline.Len()
+	r.NamesBytes += estimateNamesBytes(u.inline, nil) + estimateNamesBytes(u.ignored, nil)
+
+	for _, host := range u.allHosts() {
+		if host.transport == nil {
+			continue
+		}
+		pooled := host.transport.pooledConns()
+		r.Conns += uint64(pooled[typeUdp] + pooled[typeTcp] + pooled[typeTls])
+		r.ConnsBytes += uint64(pooled[typeUdp])*udpConnBytes +
+			uint64(pooled[typeTcp])*tcpConnBytes +
+			uint64(pooled[typeTls])*tlsConnBytes
+	}
+
+	r.Goroutines = uint64(u.goroutines())
+	return r
+}
+
+// Estimate number of long-running goroutines owned by the stanza
+func (u *reloadableUpstream) goroutines() int {
+	n := 1 // Resource reporter
+	if !u.matchAny && !u.lite {
+		// Reconciliation reporter
+		n++
+	}
+	if u.pathReload > 0 {
+		n++
+	}
+	if atomic.LoadInt32(&u.watching) != 0 {
+		n++
+	}
+	if u.urlReload > 0 {
+		n++
+	}
+	if u.canary != nil {
+		n++
+	}
+	// Name items reloaded by their own workers
+	n += u.scheduledItems()
+	if u.stats != nil {
+		n++
+	}
+	if u.audit != nil {
+		n++
+	}
+	if u.connHook != nil {
+		n++
+	}
+	hcs := []*HealthCheck{u.HealthCheck}
+	if u.groupRef != nil {
+		// Owned by the stanza which defines the group
+		hcs = nil
+	}
+	if u.split != nil {
+		hcs = append(hcs, u.split.HealthCheck)
+	}
+	for _, hc := range hcs {
+		// Connection manager of each host
+		n += len(hc.hosts)
+		if hc.checkInterval != 0 {
+			n++
+		}
+		if hc.udpProbeInterval != 0 {
+			n++
+		}
+		if hc.capabilityProbeInterval != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (u *reloadableUpstream) reportResources() {
+	r := u.resources()
+	StanzaMemoryBytes.WithLabelValues(u.stanza, "names").Set(float64(r.NamesBytes))
+	StanzaMemoryBytes.WithLabelValues(u.stanza, "conns").Set(float64(r.ConnsBytes))
+	StanzaGoroutines.WithLabelValues(u.stanza).Set(float64(r.Goroutines))
+}
+
+func (u *reloadableUpstream) resourceReportWorker() {
+	u.reportResources()
+
+	ticker := time.NewTicker(resourceReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.reportResources()
+		case <-u.stopPathReload:
+			return
+		}
+	}
+}
+
+// Process-wide resource usage
+type processResources struct {
+	HeapBytes  uint64 `json:"heap_bytes"`
+	SysBytes   uint64 `json:"sys_bytes"`
+	Goroutines int    `json:"goroutines"`
+}
+
+func currentProcessResources() processResources {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return processResources{
+		HeapBytes:  m.HeapAlloc,
+		SysBytes:   m.Sys,
+		Goroutines: runtime.NumGoroutine(),
+	}
+}
+
+const resourceReportInterval = 30 * time.Second
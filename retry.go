@@ -0,0 +1,67 @@
+package dnsredir
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Fetch the URL item and account consecutive failures
+// A failed item is retried with jittered exponential backoff by retryItem() rather than waiting for the next interval.
+func (n *NameList) fetchItem(item *NameItem, bootstrap []string) bool {
+	ok := n.updateItemFromUrl(item, bootstrap)
+	var failures int32
+	if ok {
+		atomic.StoreInt32(&item.failures, 0)
+	} else {
+		failures = atomic.AddInt32(&item.failures, 1)
+	}
+	UrlFetchFailures.WithLabelValues(n.stanza, item.url).Set(float64(failures))
+	return ok
+}
+
+// Retry the failed URL item until succeeded, no-op if it's being retried already
+// Periodic reloads skip the item meanwhile, see updateList().
+func (n *NameList) retryItem(item *NameItem, bootstrap []string) {
+	if !atomic.CompareAndSwapInt32(&item.retrying, 0, 1) {
+		return
+	}
+	maxDelay := n.reloadInterval(item)
+	if maxDelay == 0 {
+		maxDelay = urlRetryMaxDelay
+	}
+	go func() {
+		defer atomic.StoreInt32(&item.retrying, 0)
+		for attempt := uint(0); ; attempt++ {
+			delay := retryBackoff(attempt, maxDelay)
+			log.Infof("Retry %v in %v, consecutive failures: %v", item.url, delay.Round(time.Second), atomic.LoadInt32(&item.failures))
+			select {
+			case <-n.stopUrlReload:
+				return
+			case <-time.After(delay):
+			}
+			if n.isFrozen() {
+				return
+			}
+			if n.fetchItem(item, bootstrap) {
+				return
+			}
+		}
+	}()
+}
+
+// Return jittered delay of the retry attempt, which doubles from urlRetryBaseDelay up to `maxDelay'
+func retryBackoff(attempt uint, maxDelay time.Duration) time.Duration {
+	delay := maxDelay
+	if attempt < 16 && urlRetryBaseDelay<<attempt < maxDelay {
+		delay = urlRetryBaseDelay << attempt
+	}
+	// +/- 20% jitter, thus instances failed together won't retry in lockstep
+	return time.Duration(float64(delay) * (0.8 + 0.4*rand.Float64()))
+}
+
+const (
+	urlRetryBaseDelay = 15 * time.Second
+	// Maximum retry delay of URLs never reloaded
+	urlRetryMaxDelay = 30 * time.Minute
+)
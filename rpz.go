@@ -0,0 +1,55 @@
+package dnsredir
+
+import (
+	"github.com/miekg/dns"
+	"io"
+	"strings"
+)
+
+// Policy of the passthru action, i.e. the trigger is exempted from other triggers
+const rpzPassthru = "rpz-passthru."
+
+// Parse a Response Policy Zone file, return number of records parsed
+// QNAME triggers are added to `names' regardless of their actions, except that passthru triggers are added to `excepts'.
+// Since a name matches its subdomains in name lists, a `*.example.com' trigger is taken as `example.com'.
+// IP, NSDNAME, NSIP and client IP triggers aren't applicable thus ignored.
+func parseRpz(names, excepts domainSet, r io.Reader) (uint64, error) {
+	// Owner names are relative to the policy zone, i.e. the SOA owner
+	origin := "."
+	var records uint64
+	zp := dns.NewZoneParser(r, "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		records++
+		owner := strings.ToLower(rr.Header().Name)
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			origin = owner
+			continue
+		case dns.TypeNS:
+			continue
+		}
+		if owner == origin || !dns.IsSubDomain(origin, owner) {
+			continue
+		}
+
+		trigger := strings.TrimSuffix(owner[:len(owner)-len(origin)], ".")
+		trigger = strings.TrimPrefix(trigger, "*.")
+		if i := strings.LastIndexByte(trigger, '.'); strings.HasPrefix(trigger[i+1:], "rpz-") {
+			// e.g. 32.2.0.0.127.rpz-ip, ns.example.com.rpz-nsdname
+			continue
+		}
+
+		set := names
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target := strings.ToLower(cname.Target)
+			// CNAME to the trigger itself is the obsolete form of passthru
+			if target == rpzPassthru || target == trigger+"." {
+				set = excepts
+			}
+		}
+		if _, ok := set.add(trigger); !ok {
+			log.Debugf("%q isn't a domain name", trigger)
+		}
+	}
+	return records, zp.Err()
+}
@@ -0,0 +1,205 @@
+package dnsredir
+
+import (
+	"github.com/coredns/caddy"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Reload interval of the item, zero if never reloaded
+// Items with overridden interval are reloaded by their own workers rather than the stanza-wide ones, see `from'.
+func (n *NameList) reloadInterval(item *NameItem) time.Duration {
+	if item.reload != 0 {
+		if item.reload < 0 {
+			return 0
+		}
+		return item.reload
+	}
+	if item.whichType == NameItemTypePath {
+		return n.pathReload
+	}
+	return n.urlReload
+}
+
+// URL read timeout of the item
+func (n *NameList) readTimeout(item *NameItem) time.Duration {
+	if item.timeout != 0 {
+		return item.timeout
+	}
+	return n.urlReadTimeout
+}
+
+// Reload the item with overridden interval periodically
+func (n *NameList) scheduleItem(item *NameItem, bootstrap []string) {
+	stop := n.stopPathReload
+	if item.whichType == NameItemTypeUrl {
+		stop = n.stopUrlReload
+	}
+	go func() {
+		ticker := clock.NewTicker(item.reload)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.Chan():
+				if n.isFrozen() {
+					continue
+				}
+				if item.whichType == NameItemTypePath {
+					n.updateItemFromPath(item)
+				} else if atomic.LoadInt32(&item.retrying) == 0 && !n.fetchItem(item, bootstrap) {
+					n.retryItem(item, bootstrap)
+				}
+			}
+		}
+	}()
+}
+
+// Return number of items reloaded by their own workers
+func (n *NameList) scheduledItems() int {
+	count := 0
+	for _, item := range n.items {
+		if item != nil && item.reload > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// from SOURCE [reload=DURATION] [timeout=DURATION] [format=FORMAT]
+// Override reload settings and format of a source in FROM...
+func parseFromOverride(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.ArgErr()
+	}
+	if u.matchAny {
+		return c.Errf("%v: forbidden since FROM is .", dir)
+	}
+	item := u.sourceItem(args[0])
+	if item == nil {
+		return c.Errf("%v: %q isn't a source in FROM...", dir, args[0])
+	}
+
+	for _, arg := range args[1:] {
+		key, val := SplitByByte(arg, '=')
+		if len(val) == 0 {
+			return c.Errf("%v: expected KEY=VALUE, got %q", dir, arg)
+		}
+		val = val[1:]
+		switch key {
+		case "reload":
+			dur, err := parseDuration0(dir, val)
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			minInterval := minPathReloadInterval
+			if item.whichType == NameItemTypeUrl {
+				minInterval = minUrlReloadInterval
+			}
+			if dur < minInterval && dur != 0 {
+				return c.Errf("%v: minimal reload interval of %q is %v", dir, args[0], minInterval)
+			}
+			item.reload = dur
+			if dur == 0 {
+				item.reload = noReload
+			}
+		case "timeout":
+			if item.whichType != NameItemTypeUrl {
+				return c.Errf("%v: timeout is only applicable to URLs", dir)
+			}
+			dur, err := parseDuration0(dir, val)
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			if dur < minUrlReadTimeout {
+				return c.Errf("%v: minimal read timeout is %v", dir, minUrlReadTimeout)
+			}
+			item.timeout = dur
+		case "format":
+			if item.format == nameFormatGeosite {
+				return c.Errf("%v: format of geosite source cannot be overridden", dir)
+			}
+			format, ok := sourceFormats[strings.ToLower(val)]
+			if !ok {
+				return c.Errf("%v: unknown format %q", dir, val)
+			}
+			item.format = format
+		default:
+			return c.Errf("%v: unknown option %q", dir, key)
+		}
+	}
+	log.Infof("%v: %v reload: %v timeout: %v format: %v", dir, args[0], item.reload, item.timeout, item.format)
+	return nil
+}
+
+// url_header SOURCE|* NAME: VALUE
+// Add a request header of a URL in FROM..., or all URLs if `*', e.g. Authorization of private lists.
+func parseUrlHeader(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.ArgErr()
+	}
+	// Value of an unquoted header is split into multiple arguments
+	name, value := SplitByByte(strings.Join(args[1:], " "), ':')
+	name = strings.TrimSpace(name)
+	if len(name) == 0 || len(value) == 0 || strings.ContainsAny(name, " \t") {
+		return c.Errf("%v: expected NAME: VALUE, got %q", dir, strings.Join(args[1:], " "))
+	}
+	value = strings.TrimSpace(value[1:])
+
+	var items []*NameItem
+	if args[0] == "*" {
+		for _, item := range u.items {
+			if item != nil && item.whichType == NameItemTypeUrl {
+				items = append(items, item)
+			}
+		}
+		if len(items) == 0 {
+			return c.Errf("%v: no URL found in FROM...", dir)
+		}
+	} else {
+		item := u.sourceItem(args[0])
+		if item == nil || item.whichType != NameItemTypeUrl {
+			return c.Errf("%v: %q isn't a URL in FROM...", dir, args[0])
+		}
+		items = append(items, item)
+	}
+	for _, item := range items {
+		if item.header == nil {
+			item.header = make(http.Header)
+		}
+		item.header.Add(name, value)
+	}
+	// Header values are usually credentials, which are never logged
+	log.Infof("%v: %v %v", dir, args[0], http.CanonicalHeaderKey(name))
+	return nil
+}
+
+// Return the name item of the source in FROM... or `except', nil if not found
+// The source is specified as in FROM..., with or without the format prefix.
+func (u *reloadableUpstream) sourceItem(source string) *NameItem {
+	for i, form := range u.source.forms {
+		if i >= len(u.items) || u.items[i] == nil {
+			continue
+		}
+		if stripped, _ := splitFormPrefix(form); form == source || stripped == source {
+			return u.items[i]
+		}
+	}
+	return u.exceptItem(source)
+}
+
+var sourceFormats = map[string]int{
+	"plain": nameFormatAuto,
+	"hosts": nameFormatHosts,
+	"rpz":   nameFormatRpz,
+}
+
+// Reload interval of an item which is never reloaded
+const noReload = -1
@@ -3,6 +3,9 @@ package dnsredir
 import (
 	"fmt"
 	"github.com/coredns/caddy"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -77,3 +80,345 @@ func TestSetupTo(t *testing.T) {
 		}
 	}
 }
+
+func TestSetupErrors(t *testing.T) {
+	tests := []testCase{
+		{"dnsredir . {\n to 1.2.3.4\n max_fial 3\n}", true, `did you mean "max_fails"?`},
+		{"dnsredir . {\n to 1.2.3.4\n helth_check 5s\n}", true, `did you mean "health_check"?`},
+		{"dnsredir . {\n to 1.2.3.4\n max_fails x\n expire y\n}", true, "2 config errors found"},
+		{"dnsredir . {\n max_fails x\n}", true, `missing mandatory property: "to"`},
+		{"dnsredir foo.txt {\n to 1.2.3.4\n example.com\n}", false, ""},
+		// Dotless INLINE names close to directives
+		{"dnsredir foo.txt {\n to 1.2.3.4\n stanzas\n tagg\n}", false, ""},
+		{"dnsredir foo.txt {\n to 1.2.3.4\n tagg a\n}", true, `did you mean "tag"?`},
+		{"dnsredir . {\n to 1.2.3.4\n max_fails x\n}", true, "Testfile:3"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		c.Next()
+		_, err := newReloadableUpstream(c)
+		if !test.Pass(err) {
+			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
+		}
+	}
+}
+
+func TestSetupGroupRef(t *testing.T) {
+	const group = "dnsredir example.com {\n to 1.2.3.4\n group foo\n policy random\n}\n"
+	tests := []testCase{
+		{group + "dnsredir example.org {\n to @foo\n max_retry 2\n}", false, ""},
+		{group + "dnsredir example.org {\n to @bar\n}", true, "not defined"},
+		// Settings of hosts, transport and health check are taken from the group
+		{group + "dnsredir example.org {\n to @foo\n policy round_robin\n}", true, `"policy" is conflict with "to @GROUP"`},
+		{group + "dnsredir example.org {\n health_check 1s\n to @foo\n}", true, `"health_check" is conflict with "to @GROUP"`},
+		{group + "dnsredir example.org {\n to @foo\n max_fails 5\n spray\n}", true, "2 config errors found"},
+		{group + "dnsredir example.org {\n to @foo\n tls_servername dns.example.org\n}", true, `"tls_servername" is conflict`},
+		{group + "dnsredir example.org {\n to @foo\n read_timeout 5s\n}", true, `"read_timeout" is conflict`},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		_, err := NewReloadableUpstreams(c)
+		if !test.Pass(err) {
+			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
+		}
+	}
+}
+
+func TestSetupHostOptions(t *testing.T) {
+	tests := []testCase{
+		{"dnsredir . {\n to tls://1.1.1.1 read_timeout=5s 192.168.1.1 write_timeout=500ms\n}", false, ""},
+		{"dnsredir . {\n to read_timeout=5s 192.168.1.1\n}", true, "must follow a host"},
+		{"dnsredir . {\n to 192.168.1.1 read_timeout=1ms\n}", true, "minimal timeout"},
+		{"dnsredir . {\n to 192.168.1.1 read_timeout=foo\n}", true, "invalid duration"},
+		{"dnsredir . {\n to 192.168.1.1\n read_timeout 5s\n write_timeout 1s\n}", false, ""},
+		{"dnsredir . {\n to tcp://192.168.1.1 no_reuse tls://1.1.1.1\n}", false, ""},
+		{"dnsredir . {\n to tcp://192.168.1.1 no_reuse=true\n}", true, "unexpected value"},
+		{"dnsredir . {\n to tls://9.9.9.9@dns.quad9.net fallback=tcp,udp\n}", false, ""},
+		{"dnsredir . {\n to tls://9.9.9.9 fallback=quic\n}", true, "unsupported transport"},
+		{"dnsredir . {\n to tls://9.9.9.9 fallback\n}", true, "expected transports"},
+		{"dnsredir . {\n to https://dns.google/dns-query fallback=tls\n}", true, "isn't supported"},
+		{"dnsredir . {\n to tls://9.9.9.9 tls_cert=client.crt\n}", true, "must be specified together"},
+		{"dnsredir . {\n to tls://9.9.9.9 tls_key=\n}", true, "expected a file path"},
+		{"dnsredir . {\n to tcp://9.9.9.9 tls_ca=ca.crt\n}", true, "don't apply"},
+		{"dnsredir . {\n to tls://9.9.9.9 tls_cert=nonexistent.crt tls_key=nonexistent.key\n}", true, "nonexistent"},
+		{"dnsredir . {\n to tls://9.9.9.9 tls_pin=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n}", false, ""},
+		{"dnsredir . {\n to tls://9.9.9.9@dns.quad9.net tls_pin=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU= fallback=tcp\n}", false, ""},
+		{"dnsredir . {\n to tls://9.9.9.9 tls_pin=Zm9v\n}", true, "invalid SPKI pin"},
+		{"dnsredir . {\n to tls://9.9.9.9\n tls_expiry_warning 30\n}", false, ""},
+		{"dnsredir . {\n to tls://9.9.9.9\n tls_expiry_warning 2w\n}", true, "number of days"},
+		{"dnsredir . {\n to 9.9.9.9 quota=100000/month 1.1.1.1\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9 quota=100000\n}", true, "N/month"},
+		{"dnsredir . {\n to 9.9.9.9 quota=0/month\n}", true, "N/month"},
+		{"dnsredir . {\n to 9.9.9.9 quota=100/day\n}", true, "N/month"},
+		{"dnsredir . {\n to udp://9.9.9.9 tls_pin=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n}", true, "don't apply"},
+		{"dnsredir . {\n to tls://9.9.9.9 udp://1.1.1.1\n tls_pin 47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=\n}", false, ""},
+		{"dnsredir . {\n to tls://9.9.9.9\n tls_pin\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to tls://9.9.9.9\n tls_min_version 1.3\n tls_ciphers TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256\n}", false, ""},
+		{"dnsredir . {\n to tls://9.9.9.9\n tls_min_version 1.4\n}", true, "unsupported TLS version"},
+		{"dnsredir . {\n to 9.9.9.9\n emergency_recursion 64\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n emergency_recursion 0\n}", true, "expected an integer"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n emergency_recursion\n}", true, "only applicable"},
+		{"dnsredir . {\n to 9.9.9.9\n deny_qname_regex [a-z0-9]{48,}\n allow_qname_regex ^[a-z0-9._-]+$\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n deny_qname_regex\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n deny_qname_regex [a-z\n}", true, "invalid regex"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n allow_qname_regex ^[a-z.]+$\n}", true, "only applicable"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n *.cdn.example.com\n regex:^ads?[0-9]+\\.\n except *.a.example.com regex:^tracker\\.\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n *.cdn.example.com\n}", true, "forbidden"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n {www,api}.example.com\n cdn{01..16}.example.com\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n {www,api.example.com\n}", true, "unbalanced braces"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n except regex:[a-z\n}", true, "invalid regex"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n negate\n}", false, ""},
+		{"dnsredir . {\n to 1.1.1.1 weight=3 8.8.8.8\n policy weighted_round_robin\n}", false, ""},
+		{"dnsredir . {\n to 1.1.1.1 8.8.8.8\n policy latency\n}", false, ""},
+		{"dnsredir . {\n to 1.1.1.1 8.8.8.8\n policy qname_hash\n}", false, ""},
+		{"dnsredir . {\n to 1.1.1.1 weight=0\n}", true, "expected an integer"},
+		{"dnsredir . {\n to 1.1.1.1 weight=x\n}", true, "expected an integer"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n negate x\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n negate\n}", true, "will match all requests"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n negate\n tag video skip\n}", true, "is conflict with"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n except example.com file:whitelist.txt https://example.com/whitelist.txt\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n except s3://bucket/whitelist.txt\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n except ftp://example.com/whitelist.txt\n}", true, "Unsupport URL"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n except https://example.com/whitelist.txt\n from https://example.com/whitelist.txt reload=1h\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n except *.example.net\n example.org\n}", true, "must comes before"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n server_override\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n server_override yes\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n server_override\n}", true, "forbidden"},
+		{"dnsredir . {\n to 9.9.9.9\n admin 127.0.0.1:8053\n admin_token 0123456789abcdef\n metrics_namespace team_a\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n admin 127.0.0.1:8053\n admin_token short\n}", true, "at least"},
+		{"dnsredir . {\n to 9.9.9.9\n admin 127.0.0.1:8053\n metrics_namespace 1team\n}", true, "invalid namespace"},
+		{"dnsredir . {\n to 9.9.9.9\n admin_token 0123456789abcdef\n}", true, "only applicable"},
+		// Admin server reachable by others must be protected
+		{"dnsredir . {\n to 9.9.9.9\n admin [::1]:8053\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n admin localhost:8053\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n admin :8053\n}", true, "is mandatory"},
+		{"dnsredir . {\n to 9.9.9.9\n admin 192.168.1.1:8053\n}", true, "is mandatory"},
+		{"dnsredir . {\n to 9.9.9.9\n admin 0.0.0.0:8053\n admin_token 0123456789abcdef\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n explain 65001\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n whichupstream whichupstream.bind.\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9 1.1.1.1\n policy geoip\n}", true, "is required by"},
+		{"dnsredir . {\n to 9.9.9.9\n lite\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n audit_log /var/log/audit.log 64M\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n audit_log\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n audit_log /var/log/audit.log 0\n}", true, "positive size"},
+		{"dnsredir . {\n to 9.9.9.9\n conn_hook exec:/usr/local/bin/route-hook 9.9.9.9\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n conn_hook unix:/run/dnsredir.sock\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n conn_hook\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n conn_hook http://127.0.0.1\n}", true, "unknown hook type"},
+		{"dnsredir . {\n to 9.9.9.9\n conn_hook exec:\n}", true, "expected exec:PROGRAM"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n match_accel bloom\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n flush_hook http://127.0.0.1:8080/flush\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n flush_hook ftp://127.0.0.1/flush\n}", true, "HTTP(S) URL"},
+		{"dnsredir . {\n to 9.9.9.9\n flush_hook http://127.0.0.1:8080/flush\n}", true, "forbidden"},
+		{"dnsredir example.conf https://example.com/list.txt {\n to 9.9.9.9\n from https://example.com/list.txt reload=1h timeout=2m format=hosts\n from example.conf reload=0\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n from example.org reload=1h\n}", true, "isn't a source"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n from example.conf timeout=2m\n}", true, "only applicable to URLs"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n from example.conf format=yaml\n}", true, "unknown format"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n from example.conf\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n from . reload=1h\n}", true, "forbidden"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n url_cache /tmp 24h\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n prefer_family ipv4\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n prefer_family ipv6 filter\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n prefer_family ipx\n}", true, "unknown address family"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n prefer_family ipv4 drop\n}", true, "unknown option"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n url_cache /nonexistent\n}", true, "isn't a directory"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n url_cache /tmp\n url_shared_cache /tmp\n}", true, "cannot be used along with"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n list_sign minisign RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n list_sign minisign /nonexistent.pub\n}", true, "no such file"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n list_sign pgp keyring.gpg\n}", true, "unknown signature scheme"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n list_sign minisign\n}", true, "Wrong argument count"},
+		{"dnsredir https://example.com/list.txt {\n to 9.9.9.9\n url_header * Authorization: Bearer xxx\n url_header https://example.com/list.txt \"User-Agent: dnsredir\"\n}", false, ""},
+		{"dnsredir https://example.com/list.txt {\n to 9.9.9.9\n url_header *\n}", true, "Wrong argument count"},
+		{"dnsredir https://example.com/list.txt {\n to 9.9.9.9\n url_header * Authorization\n}", true, "expected NAME: VALUE"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n url_header example.conf X-Token: xxx\n}", true, "isn't a URL"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n url_header * X-Token: xxx\n}", true, "no URL found"},
+		{"dnsredir . {\n to 9.9.9.9\n list_sign minisign RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3\n}", true, "will match all requests"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n url_max_size 512M\n}", false, ""},
+		{"dnsredir example.conf {\n to 9.9.9.9\n url_max_size 0\n}", true, "positive size"},
+		{"dnsredir example.conf {\n to 9.9.9.9\n match_accel cuckoo\n}", true, "unknown accelerator"},
+		{"dnsredir . {\n to 9.9.9.9\n match_accel bloom\n}", true, "forbidden"},
+		{"dnsredir . {\n to 9.9.9.9\n from_clients 10.0.0.0/8 192.168.1.1\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n from_clients 10.0.0.0/33\n}", true, "from_clients"},
+		{"dnsredir . {\n to 9.9.9.9\n from_clients\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n lite 8M\n}", false, ""},
+		{"dnsredir . {\n to 9.9.9.9\n lite 8X\n}", true, "expected a positive size"},
+		{"dnsredir . {\n to 9.9.9.9\n lite\n canary 10m 5%\n}", true, "forbidden"},
+		{"dnsredir . {\n to 9.9.9.9\n geoip_db /nonexistent/GeoLite2-City.mmdb\n}", true, "geoip_db"},
+		{"dnsredir . {\n to 9.9.9.9\n explain 12\n}", true, "local/experimental"},
+		{"dnsredir . {\n to 9.9.9.9\n explain\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n whichupstream\n}", true, "Wrong argument count"},
+		{"dnsredir . {\n to 9.9.9.9\n whichupstream a..b\n}", true, "isn't a domain name"},
+		{"dnsredir . {\n to tls://9.9.9.9\n tls_ciphers TLS_RSA_WITH_RC4_128_SHA\n}", true, "insecure"},
+		{"dnsredir . {\n to tls://9.9.9.9\n tls_ciphers TLS_AES_128_GCM_SHA256\n}", true, "isn't configurable"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		c.Next()
+		_, err := newReloadableUpstream(c)
+		if !test.Pass(err) {
+			t.Errorf("Test#%v failed  %v vs err: %v", i, test, err)
+		}
+	}
+}
+
+func TestStanzaPatch(t *testing.T) {
+	c := caddy.NewTestController("dns", "dnsredir . {\n to 1.2.3.4 5.6.7.8\n max_fails 5\n}")
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, error: %v", err)
+	}
+	u := up.(*reloadableUpstream)
+
+	patched, err := u.patched("to tls://9.9.9.9@dns.quad9.net\npolicy round_robin")
+	if err != nil {
+		t.Fatalf("patched() failed, error: %v", err)
+	}
+	if len(patched.hosts) != 1 || patched.hosts[0].Name() != "tls://9.9.9.9:853" {
+		t.Errorf("Expected patched host tls://9.9.9.9:853, got %v", patched.hosts)
+	}
+	if patched.maxFails != 5 {
+		t.Errorf("Expected unpatched max_fails 5, got %v", patched.maxFails)
+	}
+	if patched.stanza != u.stanza {
+		t.Errorf("Expected stanza %q, got %q", u.stanza, patched.stanza)
+	}
+
+	for _, patch := range []string{"", "to", "group foo", "policy foobar"} {
+		if _, err := u.patched(patch); err == nil {
+			t.Errorf("Expected error for patch %q", patch)
+		}
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsredir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := `
+match: [foo.txt, bar.txt]
+to:
+  - tls://1.1.1.1@cloudflare-dns.com
+  - 9.9.9.9
+policy: round_robin
+max_fails: 5
+no_ipv6: true
+spray: false
+inline: [example.com, example.net]
+tag:
+  - [ads, block]
+  - ["*", skip]
+`
+	path := filepath.Join(dir, "stanza.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := caddy.NewTestController("dns", "dnsredir {\n config_file "+path+"\n}")
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, error: %v", err)
+	}
+	u := up.(*reloadableUpstream)
+	if u.stanza != "foo.txt bar.txt" || len(u.hosts) != 2 || u.maxFails != 5 || !u.noIPv6 || u.spray != nil {
+		t.Errorf("Unexpected stanza loaded from %v: %q hosts: %v max_fails: %v", path, u.stanza, u.hosts, u.maxFails)
+	}
+	if _, ok := u.policy.(*RoundRobin); !ok {
+		t.Errorf("Expected policy round_robin, got %T", u.policy)
+	}
+	if !u.inline.Match("example.net") || len(u.tagActions) != 2 {
+		t.Errorf("Expected inline names and tag actions loaded, got %v %v", u.inline, u.tagActions)
+	}
+
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{"to: 9.9.9.9\n", `missing mandatory key "match"`},
+		{"match: .\nto: 9.9.9.9\nmax_fial: 3\n", `did you mean "max_fails"?`},
+		{"match: .\nto: 9.9.9.9\nto: 1.1.1.1\n", "duplicate key"},
+		{"match: .\nto: {host: 9.9.9.9}\n", "expected a scalar or a list"},
+		{"match: .\nto: [9.9.9.9, [1.1.1.1]]\n", "expected a scalar argument"},
+		{"match: .\nto: 9.9.9.9\nmax_fails: x\n", "stanza.yaml:3"},
+		{"- match\n", "expected a mapping"},
+	}
+	for i, test := range tests {
+		if err := ioutil.WriteFile(path, []byte(test.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c := caddy.NewTestController("dns", "dnsredir {\n config_file "+path+"\n}")
+		c.Next()
+		if _, err := newReloadableUpstream(c); err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Errorf("Test#%v expected error %q, got %v", i, test.expectedErr, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", "dnsredir . {\n to 9.9.9.9\n config_file "+path+"\n}")
+	c.Next()
+	if _, err := newReloadableUpstream(c); err == nil || !strings.Contains(err.Error(), "must be the only directive") {
+		t.Errorf("Expected config_file along with other directives rejected, got %v", err)
+	}
+}
+
+func TestNegate(t *testing.T) {
+	c := caddy.NewTestController("dns", "dnsredir example.conf {\n to 9.9.9.9\n negate\n example.cn\n except example.org\n}")
+	c.Next()
+	up, err := newReloadableUpstream(c)
+	if err != nil {
+		t.Fatalf("newReloadableUpstream() failed, error: %v", err)
+	}
+	u := up.(*reloadableUpstream)
+	for name, expected := range map[string]bool{
+		"example.cn":      false,
+		"www.example.cn":  false,
+		"example.com":     true,
+		"www.example.org": false,
+	} {
+		if matched := u.match(name, false); matched != expected {
+			t.Errorf("Expected %q matched: %v, got %v", name, expected, matched)
+		}
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	tests := []struct {
+		patch    string
+		expected string
+	}{
+		// The placeholder FROM is never taken as a directive
+		{"max_fails 3", "[[max_fails 3]]"},
+		{"to 1.1.1.1 8.8.8.8\nmax_fails 3", "[[to 1.1.1.1 8.8.8.8] [max_fails 3]]"},
+		{"example.com", "[[example.com]]"},
+		{"except ads.example.com", "[[except ads.example.com]]"},
+	}
+	for i, test := range tests {
+		lines, err := parsePatch(test.patch)
+		if err != nil {
+			t.Errorf("Test#%v failed, patch %q, err: %v", i, test.patch, err)
+			continue
+		}
+		if s := fmt.Sprint(lines); s != test.expected {
+			t.Errorf("Test#%v failed, patch %q, expected %v, got %v", i, test.patch, test.expected, s)
+		}
+	}
+
+	for _, patch := range []string{
+		"", "\n", "admin 127.0.0.1:8053",
+		// Directives touching local files, programs or list sources
+		"conn_hook exec:/bin/sh", "stats_file /etc/passwd", "audit_log /tmp/audit.log", "url_shared_cache /tmp",
+		"from /etc/hosts", "url_cache /tmp", "flush_hook exec:/bin/sh", "tls /etc/ssl/cert.pem", "geoip_db /tmp/GeoIP.mmdb",
+		"max_fails 3\nmirror 100% to 127.0.0.1",
+		// Sources of except are loaded as name lists
+		"except file:/etc/passwd", "except example.com http://169.254.169.254/latest/meta-data",
+	} {
+		if _, err := parsePatch(patch); err == nil {
+			t.Errorf("Expected error for patch %q", patch)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package dnsredir
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sharedUrlCache is a filesystem cache of URL contents shared by multiple CoreDNS instances
+// Only one instance(i.e. the fetch leader) fetches a given URL per interval,
+// which is elected by exclusively creating a lock file.
+type sharedUrlCache struct {
+	dir string
+}
+
+func (c *sharedUrlCache) contentPath(theUrl string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%016x.list", stringHash(theUrl)))
+}
+
+func (c *sharedUrlCache) lockPath(theUrl string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%016x.lock", stringHash(theUrl)))
+}
+
+// Open cached content of the URL, fresh is false if it's older than maxAge
+func (c *sharedUrlCache) open(theUrl string, maxAge time.Duration) (file *os.File, fresh bool, err error) {
+	file, err = os.Open(c.contentPath(theUrl))
+	if err != nil {
+		return nil, false, err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		Close(file)
+		return nil, false, err
+	}
+	return file, time.Since(st.ModTime()) < maxAge, nil
+}
+
+// Create a cache file of the URL, which replaces the cached content once committed
+func (c *sharedUrlCache) create(theUrl string) (*urlCacheFile, error) {
+	path := c.contentPath(theUrl)
+	f, err := ioutil.TempFile(c.dir, filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &urlCacheFile{f: f, path: path}, nil
+}
+
+// Try to become the fetch leader of the URL, true if the lock acquired
+// A lock older than staleAfter is considered abandoned by a crashed leader
+func (c *sharedUrlCache) tryLock(theUrl string, staleAfter time.Duration) bool {
+	path := c.lockPath(theUrl)
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, _ = fmt.Fprintf(f, "%v\n", os.Getpid())
+			Close(f)
+			return true
+		}
+		if !os.IsExist(err) {
+			log.Warningf("Failed to create lock %q: %v", path, err)
+			return false
+		}
+		st, err := os.Stat(path)
+		if err != nil || time.Since(st.ModTime()) < staleAfter {
+			return false
+		}
+		log.Warningf("Removing stale lock %q", path)
+		_ = os.Remove(path)
+	}
+	return false
+}
+
+func (c *sharedUrlCache) unlock(theUrl string) {
+	if err := os.Remove(c.lockPath(theUrl)); err != nil {
+		log.Warningf("Failed to remove lock: %v", err)
+	}
+}
+
+// Fetch URL content through the shared cache, the content is streamed to `consume'
+// Fresh cached content is used directly, otherwise fetch it if we're the leader.
+// Stale content is used if other instance is fetching it.
+// Fetched content goes through the size limit of url_max_size, and it's cached only if consumed without error.
+func (n *NameList) fetchUrlShared(item *NameItem, bootstrap []string, consume func(r io.Reader) error) error {
+	theUrl, timeout := item.url, n.readTimeout(item)
+	maxAge := n.reloadInterval(item)
+	if maxAge == 0 {
+		maxAge = defaultUrlReloadInterval
+	}
+
+	cached, fresh, err := n.sharedCache.open(theUrl, maxAge)
+	if err == nil {
+		defer Close(cached)
+	}
+	if err == nil && fresh {
+		log.Debugf("Fresh content of %q found in shared cache", theUrl)
+		return consume(cached)
+	}
+
+	leader := n.sharedCache.tryLock(theUrl, 2*timeout)
+	if !leader && err == nil {
+		log.Debugf("Other instance is fetching %q, use stale content in shared cache", theUrl)
+		return consume(cached)
+	}
+	if leader {
+		defer n.sharedCache.unlock(theUrl)
+	}
+
+	// Nothing cached yet if we're not the leader, fetch it anyway
+	resp, err := openUrl(theUrl, "text/plain", bootstrap, timeout, item.header, nil)
+	if err != nil {
+		return err
+	}
+	defer Close(resp.Body)
+	r := newSizeLimitReader(resp.Body, n.urlMaxSize)
+	if !leader {
+		return consume(r)
+	}
+
+	cache, err := n.sharedCache.create(theUrl)
+	if err != nil {
+		log.Warningf("Failed to write %q to shared cache: %v", theUrl, err)
+		return consume(r)
+	}
+	if err := consume(io.TeeReader(r, cache)); err != nil {
+		cache.abort()
+		return err
+	}
+	if err := cache.commit(); err != nil {
+		log.Warningf("Failed to write %q to shared cache: %v", theUrl, err)
+	}
+	return nil
+}
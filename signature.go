@@ -0,0 +1,217 @@
+package dnsredir
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/openpgp"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// Verification of detached signatures of list sources, see `list_sign'
+// A source is swapped in only if its content matches the signature, thus lists pulled over plain HTTP can't be tampered with.
+type listSigner struct {
+	scheme string
+	// Public key of minisign
+	keyId     [8]byte
+	publicKey ed25519.PublicKey
+	// Public keyring of GPG
+	keyring openpgp.EntityList
+}
+
+// Parse SCHEME KEY, `readFile' reads key files
+// KEY of minisign is either the public key(base64) or path of the public key file, KEY of GPG is path of the keyring.
+func parseListSigner(scheme, key string, readFile func(path string) ([]byte, error)) (*listSigner, error) {
+	s := &listSigner{scheme: scheme}
+	switch scheme {
+	case signSchemeMinisign:
+		data, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			content, err := readFile(key)
+			if err != nil {
+				return nil, err
+			}
+			if data, err = base64.StdEncoding.DecodeString(lastLine(content)); err != nil {
+				return nil, fmt.Errorf("malformed minisign public key %q: %v", key, err)
+			}
+		}
+		if len(data) != 2+len(s.keyId)+ed25519.PublicKeySize || string(data[:2]) != minisignAlgEd {
+			return nil, fmt.Errorf("malformed minisign public key %q", key)
+		}
+		copy(s.keyId[:], data[2:10])
+		s.publicKey = data[10:]
+	case signSchemeGpg:
+		content, err := readFile(key)
+		if err != nil {
+			return nil, err
+		}
+		if s.keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(content)); err != nil {
+			if s.keyring, err = openpgp.ReadKeyRing(bytes.NewReader(content)); err != nil {
+				return nil, fmt.Errorf("malformed GPG keyring %q: %v", key, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown signature scheme %q", scheme)
+	}
+	return s, nil
+}
+
+// Return suffix of detached signatures, i.e. signature of list.txt is list.txt.minisig or list.txt.sig
+func (s *listSigner) suffix() string {
+	if s.scheme == signSchemeMinisign {
+		return ".minisig"
+	}
+	return ".sig"
+}
+
+// Return URL of the detached signature of `theUrl', the suffix is appended to the URL path
+func (s *listSigner) signatureUrl(theUrl string) string {
+	u, err := url.Parse(theUrl)
+	if err != nil {
+		return theUrl + s.suffix()
+	}
+	u.Path += s.suffix()
+	u.RawPath = ""
+	return u.String()
+}
+
+// Content verifier against a detached signature, the content should be written to it before verify()
+type contentVerifier struct {
+	io.Writer
+	verify func() error
+}
+
+// Return verifier of the content signed by `sig'
+func (s *listSigner) verifier(sig []byte) (*contentVerifier, error) {
+	if s.scheme == signSchemeGpg {
+		buf := &bytes.Buffer{}
+		return &contentVerifier{Writer: buf, verify: func() error {
+			var err error
+			if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+				_, err = openpgp.CheckArmoredDetachedSignature(s.keyring, buf, bytes.NewReader(sig))
+			} else {
+				_, err = openpgp.CheckDetachedSignature(s.keyring, buf, bytes.NewReader(sig))
+			}
+			return err
+		}}, nil
+	}
+
+	// untrusted comment, signature, trusted comment and global signature
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(sig))
+	for scanner.Scan() && len(lines) < 4 {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], minisignTrustedComment) {
+		return nil, errMalformedSignature
+	}
+	data, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(data) != 2+len(s.keyId)+ed25519.SignatureSize {
+		return nil, errMalformedSignature
+	}
+	alg, keyId, signature := string(data[:2]), data[2:10], data[10:]
+	if !bytes.Equal(keyId, s.keyId[:]) {
+		return nil, fmt.Errorf("signed by key %X rather than %X", keyId, s.keyId)
+	}
+	globalSignature, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSignature) != ed25519.SignatureSize {
+		return nil, errMalformedSignature
+	}
+	trusted := append(append([]byte{}, signature...), lines[2][len(minisignTrustedComment):]...)
+	if !ed25519.Verify(s.publicKey, trusted, globalSignature) {
+		return nil, errors.New("trusted comment signature mismatch")
+	}
+
+	v := &contentVerifier{}
+	var message func() []byte
+	switch alg {
+	case minisignAlgEd:
+		// Legacy signature of the whole content
+		buf := &bytes.Buffer{}
+		v.Writer, message = buf, buf.Bytes
+	case minisignAlgPrehashed:
+		h, _ := blake2b.New512(nil)
+		v.Writer, message = h, func() []byte { return h.Sum(nil) }
+	default:
+		return nil, fmt.Errorf("unknown minisign signature algorithm %q", alg)
+	}
+	v.verify = func() error {
+		if !ed25519.Verify(s.publicKey, message(), signature) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return v, nil
+}
+
+// Return verifier of the item content, nil if not signed
+// The detached signature is fetched(or read) alongside the item.
+func (n *NameList) itemVerifier(item *NameItem, bootstrap []string) (*contentVerifier, error) {
+	if n.signer == nil {
+		return nil, nil
+	}
+	if item.whichType == NameItemTypePath {
+		return n.fileVerifier(item.path)
+	}
+	content, err := getUrlContent(n.signer.signatureUrl(item.url), "", bootstrap, n.readTimeout(item), item.header, maxSignatureSize)
+	return n.newVerifier([]byte(content), err)
+}
+
+// Return verifier of the file content, nil if not signed
+func (n *NameList) fileVerifier(path string) (*contentVerifier, error) {
+	if n.signer == nil {
+		return nil, nil
+	}
+	return n.newVerifier(ioutil.ReadFile(path + n.signer.suffix()))
+}
+
+func (n *NameList) newVerifier(sig []byte, err error) (*contentVerifier, error) {
+	var v *contentVerifier
+	if err == nil {
+		v, err = n.signer.verifier(sig)
+	}
+	if err != nil {
+		ListSignatureFailureCount.WithLabelValues(n.stanza).Inc()
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	return v, nil
+}
+
+// Verify the content read from `r' until EOF
+func (n *NameList) verifyContent(v *contentVerifier, r io.Reader) error {
+	// Drain the remaining content(if any) which isn't consumed by the parser
+	_, err := io.Copy(ioutil.Discard, r)
+	if err == nil {
+		err = v.verify()
+	}
+	if err != nil {
+		ListSignatureFailureCount.WithLabelValues(n.stanza).Inc()
+		return fmt.Errorf("signature: %w", err)
+	}
+	return nil
+}
+
+func lastLine(content []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+var errMalformedSignature = errors.New("malformed signature")
+
+const (
+	signSchemeMinisign = "minisign"
+	signSchemeGpg      = "gpg"
+
+	minisignAlgEd          = "Ed"
+	minisignAlgPrehashed   = "ED"
+	minisignTrustedComment = "trusted comment: "
+
+	maxSignatureSize = 64 << 10
+)
@@ -0,0 +1,91 @@
+package dnsredir
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Burn rate windows of the SLO, must be multiples of sloBucketWidth
+var sloWindows = []time.Duration{5 * time.Minute, 1 * time.Hour}
+
+const (
+	sloBucketWidth = 1 * time.Minute
+	sloBucketCount = 60 // Should cover the largest window
+	// Minimal interval between two burn rate gauge updates
+	sloUpdateInterval = 1 * time.Second
+)
+
+type sloBucket struct {
+	start int64 // Unix time in minutes
+	total uint64
+	bad   uint64
+}
+
+// sloTracker tracks latency SLO compliance of a stanza
+// A request is good if it's answered within the target latency
+type sloTracker struct {
+	sync.Mutex
+
+	stanza  string
+	latency time.Duration
+	target  float64 // Fraction of good requests, e.g. 0.95
+
+	buckets    [sloBucketCount]sloBucket
+	lastUpdate time.Time
+}
+
+func newSloTracker(stanza string, latency time.Duration, target float64) *sloTracker {
+	return &sloTracker{
+		stanza:  stanza,
+		latency: latency,
+		target:  target,
+	}
+}
+
+func (t *sloTracker) observe(rtt time.Duration, ok bool) {
+	good := ok && rtt <= t.latency
+	SloRequestCount.WithLabelValues(t.stanza, strconv.FormatBool(good)).Inc()
+
+	now := clock.Now()
+	minute := now.Unix() / int64(sloBucketWidth/time.Second)
+
+	t.Lock()
+	defer t.Unlock()
+
+	b := &t.buckets[minute%sloBucketCount]
+	if b.start != minute {
+		*b = sloBucket{start: minute}
+	}
+	b.total++
+	if !good {
+		b.bad++
+	}
+
+	if now.Sub(t.lastUpdate) < sloUpdateInterval {
+		return
+	}
+	t.lastUpdate = now
+	for _, window := range sloWindows {
+		SloBurnRate.WithLabelValues(t.stanza, window.String()).Set(t.burnRate(minute, window))
+	}
+}
+
+// Burn rate is the ratio of bad requests divided by the error budget
+// 1 means the error budget will be exactly consumed at the end of the SLO period
+// MT-Unsafe: must be called with lock held
+func (t *sloTracker) burnRate(minute int64, window time.Duration) float64 {
+	n := int64(window / sloBucketWidth)
+	var total, bad uint64
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if b.total != 0 && minute-b.start < n {
+			total += b.total
+			bad += b.bad
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - t.target)
+}
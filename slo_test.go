@@ -0,0 +1,66 @@
+package dnsredir
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSloBurnRate(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+
+	// 10% error budget
+	slo := newSloTracker("test", 100*time.Millisecond, 0.9)
+	tests := []struct {
+		advance time.Duration
+		good    int
+		slow    int
+		failed  int
+		// Expected burn rates of 5m and 1h windows
+		expected [2]float64
+	}{
+		// Bad requests exactly consume the budget
+		{0, 9, 1, 0, [2]float64{1, 1}},
+		{10 * time.Minute, 10, 0, 0, [2]float64{0, 0.5}},
+		// Failed requests are bad however fast they are
+		{2 * time.Minute, 5, 0, 5, [2]float64{2.5, 2}},
+		// Requests older than the window are forgotten
+		{50 * time.Minute, 0, 0, 0, [2]float64{0, 2.5}},
+		{9 * time.Minute, 0, 0, 0, [2]float64{0, 5}},
+		{time.Hour, 0, 0, 0, [2]float64{0, 0}},
+	}
+	for i, test := range tests {
+		fc.Advance(test.advance)
+		for j := 0; j < test.good; j++ {
+			slo.observe(10*time.Millisecond, true)
+		}
+		for j := 0; j < test.slow; j++ {
+			slo.observe(time.Second, true)
+		}
+		for j := 0; j < test.failed; j++ {
+			slo.observe(10*time.Millisecond, false)
+		}
+		minute := clock.Now().Unix() / int64(sloBucketWidth/time.Second)
+		for k, window := range sloWindows {
+			slo.Lock()
+			burn := slo.burnRate(minute, window)
+			slo.Unlock()
+			if math.Abs(burn-test.expected[k]) > 1e-9 {
+				t.Errorf("Test#%v: expected %v burn rate %v, got %v", i, window, test.expected[k], burn)
+			}
+		}
+	}
+
+	// Gauges are updated by observations
+	fc.Advance(sloUpdateInterval)
+	slo.observe(time.Second, true)
+	m := &dto.Metric{}
+	if err := SloBurnRate.WithLabelValues("test", sloWindows[0].String()).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if burn := m.GetGauge().GetValue(); math.Abs(burn-10) > 1e-9 {
+		t.Fatalf("expected burn rate gauge 10, got %v", burn)
+	}
+}
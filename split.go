@@ -0,0 +1,44 @@
+package dnsredir
+
+import (
+	"github.com/coredns/coredns/request"
+)
+
+// abSplit splits matched traffic between the `to' group(arm A) and another group(arm B)
+type abSplit struct {
+	percent  float64 // Percentage of traffic goes to arm B
+	byClient bool    // Sticky by client IP if true, by qname otherwise
+	hosts    UpstreamHostPool
+
+	// Arm B, which shares the health check settings of arm A
+	*HealthCheck
+}
+
+// Initialize arm B with health check settings of arm A
+func (s *abSplit) initArm(a *HealthCheck) {
+	s.HealthCheck = &HealthCheck{
+		stop:             make(chan struct{}),
+		hosts:            s.hosts,
+		policy:           a.policy,
+		spray:            a.spray,
+		maxFails:         a.maxFails,
+		checkInterval:    a.checkInterval,
+		udpProbeInterval: a.udpProbeInterval,
+		transport:        a.transport,
+	}
+}
+
+// Return true if the request should go to arm B
+// The same client or qname always goes to the same arm
+func (s *abSplit) inArmB(state *request.Request) bool {
+	key := state.Name()
+	if s.byClient {
+		key = state.IP()
+	}
+	return float64(stringHash(key)%10000) < s.percent*100
+}
+
+const (
+	splitArmA = "a"
+	splitArmB = "b"
+)
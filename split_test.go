@@ -0,0 +1,123 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"math"
+	"testing"
+	"time"
+)
+
+func newSplitTestState(name, client string) *request.Request {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	return &request.Request{W: &test.ResponseWriter{RemoteIP: client}, Req: req}
+}
+
+func TestSplitRatio(t *testing.T) {
+	const n = 10000
+	tests := []struct {
+		percent  float64
+		byClient bool
+	}{
+		{1, false},
+		{10, false},
+		{50, false},
+		{90, true},
+		{25, true},
+	}
+	for i, test := range tests {
+		s := &abSplit{percent: test.percent, byClient: test.byClient}
+		armB := 0
+		for j := 0; j < n; j++ {
+			name := fmt.Sprintf("host%v.example.com.", j)
+			client := "10.0.0.1"
+			if test.byClient {
+				name = "example.com."
+				client = fmt.Sprintf("10.%v.%v.%v", j>>16&0xff, j>>8&0xff, j&0xff)
+			}
+			if s.inArmB(newSplitTestState(name, client)) {
+				armB++
+			}
+		}
+		// Within 2% of the expected ratio
+		if ratio := float64(armB) * 100 / n; math.Abs(ratio-test.percent) > 2 {
+			t.Errorf("Test#%v: expected %v%% traffic in arm b, got %v%%", i, test.percent, ratio)
+		}
+	}
+}
+
+func TestSplitSticky(t *testing.T) {
+	byQname := &abSplit{percent: 50}
+	byClient := &abSplit{percent: 50, byClient: true}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("host%v.example.com.", i)
+		client := fmt.Sprintf("10.0.0.%v", i)
+
+		// Same qname goes to the same arm whoever asks
+		armB := byQname.inArmB(newSplitTestState(name, "10.0.0.1"))
+		for j := 2; j < 10; j++ {
+			if byQname.inArmB(newSplitTestState(name, fmt.Sprintf("10.0.0.%v", j))) != armB {
+				t.Fatalf("Test#%v: expected %q sticky to the same arm", i, name)
+			}
+		}
+		// Same client goes to the same arm whatever it asks
+		armB = byClient.inArmB(newSplitTestState("example.com.", client))
+		for j := 0; j < 10; j++ {
+			if byClient.inArmB(newSplitTestState(fmt.Sprintf("host%v.example.org.", j), client)) != armB {
+				t.Fatalf("Test#%v: expected client %v sticky to the same arm", i, client)
+			}
+		}
+	}
+}
+
+func TestSplitServe(t *testing.T) {
+	// Non-root queries received, the root one is used by health checks
+	queried := func(names chan string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			if name := req.Question[0].Name; name != "." {
+				names <- name
+			}
+			m := new(dns.Msg)
+			m.SetReply(req)
+			_ = w.WriteMsg(m)
+		}
+	}
+	namesA, namesB := make(chan string, 1), make(chan string, 1)
+	a, stopA := startTestServer(t, udpProto, queried(namesA))
+	defer stopA()
+	b, stopB := startTestServer(t, udpProto, queried(namesB))
+	defer stopB()
+
+	r, stop := newTestDnsredir(t, "dnsredir . {\n to "+a+"\n split 30% qname "+b+"\n}")
+	defer stop()
+	split := (*r.Upstreams)[0].(*reloadableUpstream).split
+
+	armB := 0
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("host%v.example.com.", i)
+		if _, rc, err := serveTestQuery(r, name); err != nil || rc != dns.RcodeSuccess {
+			t.Fatalf("Test#%v: expected %v, got %v %v", i, dns.RcodeSuccess, rc, err)
+		}
+		expected, unexpected := namesA, namesB
+		if split.inArmB(newTestState(name)) {
+			expected, unexpected = namesB, namesA
+			armB++
+		}
+		select {
+		case got := <-expected:
+			if got != name {
+				t.Fatalf("Test#%v: expected %q forwarded, got %q", i, name, got)
+			}
+		case got := <-unexpected:
+			t.Fatalf("Test#%v: %q forwarded to the wrong arm", i, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Test#%v: %q never forwarded", i, name)
+		}
+	}
+	if armB == 0 || armB == 50 {
+		t.Fatalf("Expected traffic split between both arms, got %v of 50 in arm b", armB)
+	}
+}
@@ -0,0 +1,187 @@
+package dnsredir
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Decoded DNS stamp
+// see: https://dnscrypt.info/stamps-specifications
+type dnsStamp struct {
+	proto    byte
+	addr     string   // IP[:PORT], may be empty for DoH and DoT
+	pk       []byte   // DNSCrypt provider public key
+	hashes   [][]byte // SHA256 digests of TBS certificates, any one in the chain must match
+	hostname string   // DNSCrypt provider name, or TLS server name(with optional port for DoH)
+	path     string   // DoH path
+}
+
+const (
+	stampPlain    = 0x00
+	stampDnscrypt = 0x01
+	stampDoh      = 0x02
+	stampDot      = 0x03
+)
+
+func parseStamp(s string) (*dnsStamp, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp: %v", err)
+	}
+	// Protocol identifier followed by 8 bytes properties
+	if len(b) < 9 {
+		return nil, errTruncatedStamp
+	}
+	st := &dnsStamp{proto: b[0]}
+	b = b[9:]
+
+	var field []byte
+	if field, b, err = stampLP(b); err != nil {
+		return nil, err
+	}
+	st.addr = string(field)
+
+	switch st.proto {
+	case stampPlain:
+	case stampDnscrypt:
+		if st.pk, b, err = stampLP(b); err != nil {
+			return nil, err
+		}
+		if field, b, err = stampLP(b); err != nil {
+			return nil, err
+		}
+		st.hostname = string(field)
+	case stampDoh, stampDot:
+		if st.hashes, b, err = stampVLP(b); err != nil {
+			return nil, err
+		}
+		if field, b, err = stampLP(b); err != nil {
+			return nil, err
+		}
+		st.hostname = string(field)
+		if st.proto == stampDoh {
+			if field, b, err = stampLP(b); err != nil {
+				return nil, err
+			}
+			st.path = string(field)
+		}
+		// Trailing bootstrap IPs are ignored, use the bootstrap directive instead
+	default:
+		return nil, fmt.Errorf("unsupported stamp protocol %#x", st.proto)
+	}
+	return st, nil
+}
+
+// Length-prefixed field
+func stampLP(b []byte) ([]byte, []byte, error) {
+	if len(b) == 0 || len(b) < 1+int(b[0]) {
+		return nil, nil, errTruncatedStamp
+	}
+	return b[1 : 1+int(b[0])], b[1+int(b[0]):], nil
+}
+
+// Variable length field set, high bit of the length byte denotes more fields to follow
+func stampVLP(b []byte) ([][]byte, []byte, error) {
+	var fields [][]byte
+	for {
+		if len(b) == 0 {
+			return nil, nil, errTruncatedStamp
+		}
+		n := int(b[0] & 0x7f)
+		more := b[0]&0x80 != 0
+		if len(b) < 1+n {
+			return nil, nil, errTruncatedStamp
+		}
+		if n != 0 {
+			fields = append(fields, b[1:1+n])
+		}
+		b = b[1+n:]
+		if !more {
+			return fields, b, nil
+		}
+	}
+}
+
+// Expand a stamp into the `to' host syntax, along with certificate pins if any
+// DNSCrypt stamps are kept as-is, since they can't be expressed otherwise.
+func expandStamp(s string) (string, [][]byte, error) {
+	st, err := parseStamp(s)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, h := range st.hashes {
+		if len(h) != sha256.Size {
+			return "", nil, fmt.Errorf("invalid certificate hash %x", h)
+		}
+	}
+
+	switch st.proto {
+	case stampPlain:
+		if len(st.addr) == 0 {
+			return "", nil, errors.New("empty address")
+		}
+		return "dns://" + st.addr, nil, nil
+	case stampDnscrypt:
+		return "sdns://" + s, nil, nil
+	case stampDoh:
+		if len(st.hostname) == 0 {
+			return "", nil, errors.New("empty DoH hostname")
+		}
+		path := st.path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		return "https://" + st.hostname + path, st.hashes, nil
+	case stampDot:
+		addr := st.addr
+		if len(addr) == 0 {
+			addr = st.hostname
+		}
+		if len(addr) == 0 {
+			return "", nil, errors.New("empty address")
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "853")
+		}
+		if len(st.hostname) != 0 {
+			hostname, _, err := net.SplitHostPort(st.hostname)
+			if err != nil {
+				hostname = st.hostname
+			}
+			addr += "@" + hostname
+		}
+		return "tls://" + addr, st.hashes, nil
+	default:
+		panic(fmt.Sprintf("Unexpected stamp protocol %#x", st.proto))
+	}
+}
+
+// Verify that any certificate in the chain matches one of the pinned TBS certificate hashes
+func verifyCertPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			h := sha256.Sum256(cert.RawTBSCertificate)
+			for _, pin := range pins {
+				if bytes.Equal(h[:], pin) {
+					return nil
+				}
+			}
+		}
+		return errCertPinMismatch
+	}
+}
+
+var (
+	errTruncatedStamp  = errors.New("truncated stamp")
+	errCertPinMismatch = errors.New("no certificate matches the pinned hashes")
+)
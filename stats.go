@@ -0,0 +1,241 @@
+package dnsredir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Persistent statistics of a stanza, which survives restarts on systems without Prometheus
+type stanzaStats struct {
+	sync.Mutex
+
+	path     string
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	// true once the stats file is handed over to a patched stanza, see handover()
+	handedOver bool
+
+	queries   uint64
+	matches   uint64
+	upstreams map[string]uint64
+	domains   map[string]uint64
+
+	// Hosts whose monthly usage is persisted, see quota.go
+	hosts UpstreamHostPool
+}
+
+// On-disk JSON representation of stanzaStats
+type statsSnapshot struct {
+	Stanza     string            `json:"stanza"`
+	Updated    time.Time         `json:"updated"`
+	Queries    uint64            `json:"queries"`
+	Matches    uint64            `json:"matches"`
+	Upstreams  map[string]uint64 `json:"upstreams"`
+	TopDomains map[string]uint64 `json:"top_domains"`
+	// Per-upstream queries of Month, used by `quota'
+	Month   string            `json:"month,omitempty"`
+	Monthly map[string]uint64 `json:"monthly,omitempty"`
+}
+
+func newStanzaStats(path string, interval time.Duration) *stanzaStats {
+	return &stanzaStats{
+		path:      path,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		upstreams: make(map[string]uint64),
+		domains:   make(map[string]uint64),
+	}
+}
+
+func (s *stanzaStats) countMatch(name string, matched bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.queries++
+	if !matched {
+		return
+	}
+	s.matches++
+	if _, ok := s.domains[name]; !ok && len(s.domains) >= maxStatsDomains {
+		s.evictDomains()
+	}
+	s.domains[name]++
+}
+
+func (s *stanzaStats) countUpstream(name string) {
+	s.Lock()
+	s.upstreams[name]++
+	s.Unlock()
+}
+
+// Evict the least counted half of domains, so that memory is bounded
+// MT-Unsafe: must be called with lock held
+func (s *stanzaStats) evictDomains() {
+	for _, name := range s.sortedDomains()[maxStatsDomains/2:] {
+		delete(s.domains, name)
+	}
+}
+
+// Return domain names sorted by count in descending order
+// MT-Unsafe: must be called with lock held
+func (s *stanzaStats) sortedDomains() []string {
+	names := make([]string, 0, len(s.domains))
+	for name := range s.domains {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return s.domains[names[i]] > s.domains[names[j]]
+	})
+	return names
+}
+
+func (s *stanzaStats) load(stanza string) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to load stats %q: %v", s.path, err)
+		}
+		return
+	}
+
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		log.Warningf("Failed to parse stats %q: %v", s.path, err)
+		return
+	}
+	if snapshot.Stanza != stanza {
+		log.Warningf("Stats %q belongs to stanza %q, expected %q", s.path, snapshot.Stanza, stanza)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.queries = snapshot.Queries
+	s.matches = snapshot.Matches
+	for name, n := range snapshot.Upstreams {
+		s.upstreams[name] = n
+	}
+	for name, n := range snapshot.TopDomains {
+		s.domains[name] = n
+	}
+	for _, host := range s.hosts {
+		if n, ok := snapshot.Monthly[host.Name()]; ok {
+			host.usage.restore(snapshot.Month, n)
+		}
+	}
+	log.Infof("Stats loaded from %q, queries: %v matches: %v", s.path, s.queries, s.matches)
+}
+
+func (s *stanzaStats) save(stanza string) error {
+	s.Lock()
+	snapshot := statsSnapshot{
+		Stanza:     stanza,
+		Updated:    clock.Now(),
+		Queries:    s.queries,
+		Matches:    s.matches,
+		Upstreams:  make(map[string]uint64, len(s.upstreams)),
+		TopDomains: make(map[string]uint64),
+	}
+	for name, n := range s.upstreams {
+		snapshot.Upstreams[name] = n
+	}
+	for i, name := range s.sortedDomains() {
+		if i == statsTopDomains {
+			break
+		}
+		snapshot.TopDomains[name] = s.domains[name]
+	}
+	s.Unlock()
+	if len(s.hosts) != 0 {
+		snapshot.Month = currentMonth()
+		snapshot.Monthly = make(map[string]uint64, len(s.hosts))
+		for _, host := range s.hosts {
+			snapshot.Monthly[host.Name()] = host.usage.get()
+		}
+	}
+
+	data, err := json.MarshalIndent(&snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so a crash won't leave a truncated snapshot
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		Close(tmp)
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *stanzaStats) start(stanza string) {
+	s.load(stanza)
+	s.run(stanza)
+}
+
+// Periodically save the stats until shutdown() or handover()
+func (s *stanzaStats) run(stanza string) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := clock.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				if err := s.save(stanza); err != nil {
+					log.Warningf("Failed to save stats %q: %v", s.path, err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *stanzaStats) shutdown(stanza string) error {
+	if s.handedOver {
+		return nil
+	}
+	close(s.stop)
+	s.wg.Wait()
+	return s.save(stanza)
+}
+
+// Stop the writer and flush the stats, so a patched stanza loads an up-to-date snapshot
+// The stats file belongs to the patched stanza since then, shutdown() won't overwrite it.
+func (s *stanzaStats) handover(stanza string) error {
+	close(s.stop)
+	s.wg.Wait()
+	s.handedOver = true
+	return s.save(stanza)
+}
+
+// Take the stats file back if the patched stanza failed to start
+func (s *stanzaStats) resume(stanza string) {
+	s.handedOver = false
+	s.stop = make(chan struct{})
+	s.run(stanza)
+}
+
+const (
+	defaultStatsInterval = 5 * time.Minute
+	minStatsInterval     = 10 * time.Second
+
+	// Maximum number of domains counted in memory
+	maxStatsDomains = 10000
+	// Number of top domains saved in the snapshot
+	statsTopDomains = 100
+)
@@ -0,0 +1,190 @@
+package dnsredir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Return the snapshot in the stats file, nil if not yet written
+func readStatsSnapshot(t *testing.T, path string) *statsSnapshot {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot statsSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		t.Fatalf("Expected a complete snapshot, got %q: %v", data, err)
+	}
+	return &snapshot
+}
+
+func TestStanzaStatsFile(t *testing.T) {
+	fc, restore := useFakeClock()
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "dnsredir-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+
+	s := newStanzaStats(path, time.Minute)
+	s.start("test")
+	stopped := false
+	defer func() {
+		if !stopped {
+			_ = s.shutdown("test")
+		}
+	}()
+	// Wait for the ticker, otherwise the clock may advance before it started
+	for {
+		fc.Lock()
+		n := len(fc.tickers)
+		fc.Unlock()
+		if n != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		matched   []string
+		unmatched int
+		queries   uint64
+		matches   uint64
+		top       map[string]uint64
+	}{
+		{[]string{"example.com", "example.com", "example.org"}, 1, 4, 3, map[string]uint64{"example.com": 2, "example.org": 1}},
+		{nil, 2, 6, 3, map[string]uint64{"example.com": 2, "example.org": 1}},
+		{[]string{"example.org", "example.org"}, 0, 8, 5, map[string]uint64{"example.com": 2, "example.org": 3}},
+	}
+	for i, test := range tests {
+		for _, name := range test.matched {
+			s.countMatch(name, true)
+			s.countUpstream("127.0.0.1:53")
+		}
+		for j := 0; j < test.unmatched; j++ {
+			s.countMatch("example.net", false)
+		}
+		if snapshot := readStatsSnapshot(t, path); i == 0 && snapshot != nil {
+			t.Fatalf("Test#%v: expected nothing written before the interval elapsed, got %v", i, snapshot)
+		}
+
+		// Snapshot is written by the periodic ticker
+		fc.Advance(time.Minute)
+		var snapshot *statsSnapshot
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if snapshot = readStatsSnapshot(t, path); snapshot != nil && snapshot.Queries == test.queries {
+				break
+			}
+		}
+		if snapshot == nil || snapshot.Queries != test.queries {
+			t.Fatalf("Test#%v: expected %v queries written, got %v", i, test.queries, snapshot)
+		}
+		if snapshot.Stanza != "test" || !snapshot.Updated.Equal(clock.Now()) {
+			t.Errorf("Test#%v: expected stanza %q updated at %v, got %q %v", i, "test", clock.Now(), snapshot.Stanza, snapshot.Updated)
+		}
+		if snapshot.Matches != test.matches {
+			t.Errorf("Test#%v: expected %v matches, got %v", i, test.matches, snapshot.Matches)
+		}
+		if len(snapshot.TopDomains) != len(test.top) {
+			t.Errorf("Test#%v: expected top domains %v, got %v", i, test.top, snapshot.TopDomains)
+		}
+		for name, n := range test.top {
+			if snapshot.TopDomains[name] != n {
+				t.Errorf("Test#%v: expected top domains %v, got %v", i, test.top, snapshot.TopDomains)
+			}
+		}
+	}
+
+	// Final snapshot is written on shutdown
+	s.countMatch("example.com", true)
+	stopped = true
+	if err := s.shutdown("test"); err != nil {
+		t.Fatalf("shutdown() failed, error: %v", err)
+	}
+	if snapshot := readStatsSnapshot(t, path); snapshot == nil || snapshot.Queries != 9 || snapshot.Matches != 6 || snapshot.Upstreams["127.0.0.1:53"] != 5 {
+		t.Fatalf("Expected 9 queries, 6 matches and 5 upstream queries saved on shutdown, got %v", snapshot)
+	}
+
+	// Written by rename, thus no temporary file left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "stats.json" {
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Fatalf("Expected only the stats file in its directory, got %v", names)
+	}
+
+	// Restarted stanza counts on top of the saved snapshot
+	s = newStanzaStats(path, time.Minute)
+	s.load("test")
+	s.countMatch("example.com", true)
+	if err := s.save("test"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot := readStatsSnapshot(t, path); snapshot == nil || snapshot.Queries != 10 || snapshot.TopDomains["example.com"] != 4 {
+		t.Fatalf("Expected 10 queries and 4 example.com restored across restarts, got %v", snapshot)
+	}
+}
+
+func TestStanzaStatsHandover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsredir-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+
+	old := newStanzaStats(path, time.Minute)
+	old.start("test")
+	for i := 0; i < 3; i++ {
+		old.countMatch("example.com", true)
+	}
+	if err := old.handover("test"); err != nil {
+		t.Fatalf("handover() failed, error: %v", err)
+	}
+
+	// Patched stanza starts from counts of the old one
+	s := newStanzaStats(path, time.Minute)
+	s.start("test")
+	s.countMatch("example.org", true)
+	// In-flight queries of the old stanza after handover are not saved
+	old.countMatch("example.com", true)
+	if err := s.shutdown("test"); err != nil {
+		t.Fatalf("shutdown() failed, error: %v", err)
+	}
+	if err := old.shutdown("test"); err != nil {
+		t.Fatalf("shutdown() failed, error: %v", err)
+	}
+	if snapshot := readStatsSnapshot(t, path); snapshot == nil || snapshot.Queries != 4 || snapshot.TopDomains["example.com"] != 3 {
+		t.Fatalf("Expected 4 queries and 3 example.com kept by the patched stanza, got %v", snapshot)
+	}
+
+	// Old stanza takes the stats back if the patched one failed to start
+	old = newStanzaStats(path, time.Minute)
+	old.start("test")
+	if err := old.handover("test"); err != nil {
+		t.Fatalf("handover() failed, error: %v", err)
+	}
+	old.resume("test")
+	old.countMatch("example.net", false)
+	if err := old.shutdown("test"); err != nil {
+		t.Fatalf("shutdown() failed, error: %v", err)
+	}
+	if snapshot := readStatsSnapshot(t, path); snapshot == nil || snapshot.Queries != 5 {
+		t.Fatalf("Expected 5 queries saved after resume, got %v", snapshot)
+	}
+}
@@ -0,0 +1,111 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Strip or rewrite parameters of SVCB/HTTPS records in answers
+// Redirection based filtering setups need to control these hints the same way they control A/AAAA.
+type svcbRewrite struct {
+	strip    map[dns.SVCBKey]bool
+	ipv4hint []net.IP // Replacement of ipv4hint, nil if untouched
+	ipv6hint []net.IP // Ditto.
+}
+
+var svcbRewriteKeys = map[string]dns.SVCBKey{
+	"ech":      dns.SVCB_ECHCONFIG,
+	"ipv4hint": dns.SVCB_IPV4HINT,
+	"ipv6hint": dns.SVCB_IPV6HINT,
+}
+
+// Parse KEY[=VALUE]... arguments, KEY alone strips the parameter
+// VALUE is comma separated IP addresses, only applicable to ipv4hint and ipv6hint.
+func parseSvcbRewrite(args []string) (*svcbRewrite, error) {
+	r := &svcbRewrite{strip: make(map[dns.SVCBKey]bool)}
+	for _, arg := range args {
+		name, value := SplitByByte(arg, '=')
+		key, ok := svcbRewriteKeys[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported key %q", name)
+		}
+		if len(value) == 0 {
+			r.strip[key] = true
+			continue
+		}
+		if key == dns.SVCB_ECHCONFIG {
+			return nil, fmt.Errorf("%v can only be stripped", name)
+		}
+		var ips []net.IP
+		for _, s := range strings.Split(value[1:], ",") {
+			ip := net.ParseIP(s)
+			if ip == nil || (ip.To4() != nil) != (key == dns.SVCB_IPV4HINT) {
+				return nil, fmt.Errorf("invalid %v address %q", name, s)
+			}
+			ips = append(ips, ip)
+		}
+		if key == dns.SVCB_IPV4HINT {
+			r.ipv4hint = ips
+		} else {
+			r.ipv6hint = ips
+		}
+	}
+	return r, nil
+}
+
+func (r *svcbRewrite) String() string {
+	var keys []string
+	for key := range r.strip {
+		keys = append(keys, "-"+key.String())
+	}
+	if r.ipv4hint != nil {
+		keys = append(keys, fmt.Sprintf("ipv4hint=%v", r.ipv4hint))
+	}
+	if r.ipv6hint != nil {
+		keys = append(keys, fmt.Sprintf("ipv6hint=%v", r.ipv6hint))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+func (r *svcbRewrite) apply(m *dns.Msg) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Extra} {
+		for _, rr := range rrs {
+			switch v := rr.(type) {
+			case *dns.SVCB:
+				r.rewrite(v)
+			case *dns.HTTPS:
+				r.rewrite(&v.SVCB)
+			}
+		}
+	}
+}
+
+func (r *svcbRewrite) rewrite(rr *dns.SVCB) {
+	// AliasMode records carry no parameters
+	if rr.Priority == 0 {
+		return
+	}
+	values := make([]dns.SVCBKeyValue, 0, len(rr.Value)+2)
+	for _, kv := range rr.Value {
+		key := kv.Key()
+		if r.strip[key] || (key == dns.SVCB_IPV4HINT && r.ipv4hint != nil) || (key == dns.SVCB_IPV6HINT && r.ipv6hint != nil) {
+			continue
+		}
+		values = append(values, kv)
+	}
+	if r.ipv4hint != nil {
+		values = append(values, &dns.SVCBIPv4Hint{Hint: r.ipv4hint})
+	}
+	if r.ipv6hint != nil {
+		values = append(values, &dns.SVCBIPv6Hint{Hint: r.ipv6hint})
+	}
+	// Parameters must be in strictly increasing key order
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key() < values[j].Key()
+	})
+	rr.Value = values
+}
@@ -5,6 +5,8 @@ package dnsredir
 import (
 	"crypto/tls"
 	"fmt"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
 	"net"
 )
 
@@ -31,20 +33,52 @@ func stringToTransportType(s string) transportType {
 	return typeUdp
 }
 
+// Protocol of the downstream listener which a request arrived over
+// Connection pools are isolated per downstream protocol, thus bursty TCP clients won't evict connections tuned for UDP traffic.
+type downstreamType int
+
+const (
+	downstreamUdp downstreamType = iota
+	downstreamTcp
+	downstreamTls
+	downstreamTotalCount // Dummy type
+)
+
+func requestDownstreamType(state *request.Request) downstreamType {
+	if state.W == nil {
+		// Internal requests, e.g. health check
+		return downstreamUdp
+	}
+	if cs, ok := state.W.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return downstreamTls
+	}
+	if state.Proto() == "tcp" {
+		return downstreamTcp
+	}
+	return downstreamUdp
+}
+
+// Pool key of a persistent connection
+type connKey struct {
+	downstream downstreamType
+	proto      string
+}
+
 func (t *Transport) transportTypeFromConn(pc *persistConn) transportType {
-	if _, ok := pc.c.Conn.(*net.UDPConn); ok {
+	conn := unwrapConn(pc.c.Conn)
+	if _, ok := conn.(*net.UDPConn); ok {
 		return typeUdp
 	}
 
 	if t.tlsConfig == nil {
-		if _, ok := pc.c.Conn.(*net.TCPConn); !ok {
-			panic(fmt.Sprintf("Expected TCP connection, got %T", pc.c.Conn))
+		if _, ok := conn.(*net.TCPConn); !ok {
+			panic(fmt.Sprintf("Expected TCP connection, got %T", conn))
 		}
 		return typeTcp
 	}
 
-	if _, ok := pc.c.Conn.(*tls.Conn); !ok {
-		panic(fmt.Sprintf("Expected TLS connection, got %T", pc.c.Conn))
+	if _, ok := conn.(*tls.Conn); !ok {
+		panic(fmt.Sprintf("Expected TLS connection, got %T", conn))
 	}
 	return typeTls
 }
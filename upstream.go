@@ -13,8 +13,11 @@ import (
 	"github.com/coredns/coredns/plugin"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -23,70 +26,271 @@ import (
 )
 
 type reloadableUpstream struct {
+	// Name of the stanza, used in metric labels
+	stanza string
 	// Flag indicate match any request, i.e. the root zone "."
 	matchAny bool
+	// Flag indicate match names NOT in name lists and INLINE, see `negate'
+	negate bool
 	*NameList
 	inline  domainSet
 	ignored domainSet
+	// Wildcards and regexes of INLINE and `except'
+	inlinePatterns  namePatterns
+	ignoredPatterns namePatterns
+	// Items of `except' sources, which are in name list items as well, and their forms
+	exceptItems []*NameItem
+	exceptForms []string
 	*HealthCheck
 	// Bootstrap DNS in IP:Port combo
 	bootstrap []string
 	ipset     interface{}
 	pf        interface{}
 	noIPv6    bool
-	maxRetry  int32
+	// Don't attach DNS Cookies to UDP queries
+	noCookies bool
+	// NAT64 prefix used when the host has no IPv4 route, nil if disabled
+	nat64    *net.IPNet
+	maxRetry int32
+	// SPKI pins of TLS upstreams, per-host `tls_pin' takes precedence
+	spkiPins [][]byte
+	// Warn if TLS certificates of DoT upstreams expire within, zero if disabled
+	tlsExpiryWarning time.Duration
+	// Maximum upstream attempts per query, shared by nested lookups
+	maxDepth int32
+	// Maximum in-flight queries per upstream host, zero if unlimited
+	maxInflight int32
+	// Block size of EDNS0 padding for encrypted transports, zero if disabled
+	padding int
+	// Answer memoization window, nil if disabled
+	dedup *answerMemo
+	// Iterative resolution from root hints when all upstreams are down, nil if disabled
+	recursor *rootRecursor
+	// Per-domain upstreams of `server=/DOMAIN/IP' lines in name lists, nil if disabled
+	overrides *serverOverrides
+	// Query name regex guards, nil if unspecified
+	guard *qnameGuard
+	// DNSSEC validator of upstream answers, nil if disabled
+	dnssec *dnssecValidator
+	// Bounded queue in front of upstream exchange, nil if unlimited
+	queue *exchangeQueue
+	// Actions keyed by tag of name list entries, "*" for any other entries
+	tagActions map[string]int
+	// Latency SLO tracker, nil if disabled
+	slo *sloTracker
+	// Persistent statistics, nil if disabled
+	stats *stanzaStats
+	// Audit trail of matched queries, nil if disabled
+	audit *auditLog
+	// Notification of upstream connections, nil if disabled
+	connHook *connHook
+	// Shadow upstream which receives a sample of matched queries, nil if disabled
+	mirror *queryMirror
+	// A/B splitting between upstream groups, nil if disabled
+	split *abSplit
+	// Lite mode for memory constrained devices, see applyLite()
+	lite bool
+	// MaxMind database of the geoip policy, nil if not specified
+	geoip *geoipDB
+	// Only queries from these clients are redirected by this stanza, empty if any client
+	fromClients []*net.IPNet
+	// Clients whose queries are traced verbosely
+	debugClients []*net.IPNet
+	// Answers introspection queries of the upstream served the caller, nil if disabled
+	which *whichUpstream
+	// EDNS0 option code asking for the routing explanation in replies, zero if disabled
+	explainCode uint16
+	// Name of the upstream group defined by this stanza, empty if none
+	group string
+	// Upstream group referenced by `to @NAME', nil if none
+	groupRef *HealthCheck
+	// Admin server address, empty if disabled
+	admin string
+	// Bearer token required to access this stanza via the admin server, empty if unrestricted
+	adminToken string
+	// Metric name prefix of this stanza exposed by the admin server, empty to use the plugin one
+	metricsNamespace string
+	// Source of the stanza, used by hot patching
+	source stanzaSource
+	// Query names redaction in log output, nil if disabled
+	redact *qnameRedactor
+	// EDNS Client Subnet policy, nil to keep the client one
+	ecs *ecsPolicy
+	// TTL floor in seconds of negative answers, zero if disabled
+	negativeMinTtl uint32
+	// Drop authority and additional sections before truncating oversized UDP replies
+	minimalResponses bool
+	// SVCB/HTTPS parameters rewriting, nil if disabled
+	svcb *svcbRewrite
+	// Preference of address family of answers, nil if disabled
+	preferFamily *familyPreference
 }
 
 // reloadableUpstream implements Upstream interface
 
 // Check if given name in upstream name list
 // `name' is lower cased and without trailing dot(except for root zone)
-func (u *reloadableUpstream) Match(name string) bool {
+func (u *reloadableUpstream) Match(state *request.Request, name string) bool {
+	if len(u.fromClients) != 0 && !ipNetsContain(u.fromClients, state.IP()) {
+		return false
+	}
+	matched := u.match(name, u.inCanary(state))
+	if u.stats != nil {
+		u.stats.countMatch(name, matched)
+	}
+	return matched
+}
+
+// Return true if queries of the request client should be traced verbosely
+func (u *reloadableUpstream) traces(state *request.Request) bool {
+	return len(u.debugClients) != 0 && ipNetsContain(u.debugClients, state.IP())
+}
+
+// Return true if the request should see canary name lists(if any)
+func (u *reloadableUpstream) inCanary(state *request.Request) bool {
+	return u.canary != nil && u.canary.selects(state)
+}
+
+func (u *reloadableUpstream) match(name string, canary bool) bool {
 	if u.matchAny {
 		if !plugin.Name(".").Matches(name) {
 			panic(fmt.Sprintf("Why %q doesn't match %q?!", name, "."))
 		}
 
-		ignored := u.ignored.Match(name)
+		ignored := u.ignoredMatch(name) || u.NameList.excepted(name, canary)
 		if ignored {
-			log.Debugf("#0 Skip %q since it's ignored", name)
+			log.Debugf("#0 Skip %q since it's ignored", u.redact.redact(name, ""))
 		}
 		return !ignored
 	}
 
-	if !u.NameList.Match(name) && !u.inline.Match(name) {
+	if len(u.tagActions) != 0 {
+		if action := u.nameAction(name, canary); action == tagActionNone || action == tagActionSkip {
+			return false
+		}
+	} else if u.NameList.match(name, canary) || u.inlineMatch(name) {
+		if u.negate {
+			log.Debugf("#3 Skip %q since it's in name list of negated stanza", u.redact.redact(name, ""))
+			return false
+		}
+	} else if !u.negate {
 		return false
 	}
 
-	if u.ignored.Match(name) {
-		log.Debugf("#1 Skip %q since it's ignored", name)
+	if u.ignoredMatch(name) {
+		log.Debugf("#1 Skip %q since it's ignored", u.redact.redact(name, ""))
+		return false
+	}
+	if u.NameList.excepted(name, canary) {
+		log.Debugf("#2 Skip %q since it's excepted by name list", u.redact.redact(name, ""))
 		return false
 	}
 	return true
 }
 
+// Return action of the given name according to its tags, tagActionNone if not in name list
+// `name' is lower cased and without trailing dot
+func (u *reloadableUpstream) nameAction(name string, canary bool) int {
+	tags, ok := u.NameList.matchTags(name, canary)
+	if !ok {
+		if !u.inlineMatch(name) {
+			return tagActionNone
+		}
+		// INLINE names are always untagged
+		tags = nil
+	}
+
+	for _, tag := range tags {
+		if action, ok := u.tagActions[tag]; ok {
+			return action
+		}
+	}
+	if action, ok := u.tagActions[tagAny]; ok {
+		return action
+	}
+	return tagActionRedirect
+}
+
+// Return upstream hosts of all groups
+func (u *reloadableUpstream) allHosts() UpstreamHostPool {
+	if u.split == nil {
+		return u.hosts
+	}
+	hosts := make(UpstreamHostPool, 0, len(u.hosts)+len(u.split.hosts))
+	hosts = append(hosts, u.hosts...)
+	return append(hosts, u.split.hosts...)
+}
+
 func (u *reloadableUpstream) Start() error {
+	u.applyNat64()
+	u.NameList.stanza = u.stanza
 	u.periodicUpdate(u.bootstrap)
-	u.HealthCheck.Start()
+	// Referenced upstream group is started by the stanza which defines it
+	if u.groupRef == nil {
+		u.HealthCheck.Start()
+	}
+	if u.split != nil {
+		u.split.Start()
+	}
 	if err := ipsetSetup(u); err != nil {
 		return err
 	}
 	if err := pfSetup(u); err != nil {
 		return err
 	}
+	if u.stats != nil {
+		u.stats.hosts = u.allHosts()
+		u.stats.start(u.stanza)
+	}
+	if u.audit != nil {
+		if err := u.audit.start(u.stanza); err != nil {
+			return err
+		}
+	}
+	if u.connHook != nil {
+		u.connHook.start(u.stanza)
+	}
+	go u.resourceReportWorker()
+	if !u.matchAny && !u.lite {
+		go u.reconcileReportWorker()
+	}
 	return nil
 }
 
 func (u *reloadableUpstream) Stop() error {
 	close(u.stopPathReload)
 	close(u.stopUrlReload)
-	u.HealthCheck.Stop()
+	if u.groupRef == nil {
+		u.HealthCheck.Stop()
+	}
+	if u.split != nil {
+		u.split.Stop()
+	}
+	if u.overrides != nil {
+		u.overrides.stop()
+	}
+	if u.geoip != nil {
+		if err := u.geoip.Close(); err != nil {
+			return err
+		}
+	}
 	if err := ipsetShutdown(u); err != nil {
 		return err
 	}
 	if err := pfShutdown(u); err != nil {
 		return err
 	}
+	if u.stats != nil {
+		if err := u.stats.shutdown(u.stanza); err != nil {
+			return err
+		}
+	}
+	if u.audit != nil {
+		u.audit.shutdown()
+	}
+	if u.connHook != nil {
+		u.connHook.shutdown()
+	}
 	return nil
 }
 
@@ -117,6 +321,12 @@ func protoToNetwork(proto string) string {
 }
 
 func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
+	if path, ok, err := configFilePath(c); err != nil {
+		return nil, err
+	} else if ok {
+		return loadConfigFile(c, path)
+	}
+
 	u := &reloadableUpstream{
 		NameList: &NameList{
 			pathReload:     defaultPathReloadInterval,
@@ -124,80 +334,88 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 			urlReload:      defaultUrlReloadInterval,
 			urlReadTimeout: defaultUrlReadTimeout,
 			stopUrlReload:  make(chan struct{}),
+			urlMaxSize:     defaultUrlMaxSize,
 		},
-		ignored:  make(domainSet),
-		inline:   make(domainSet),
-		maxRetry: defaultMaxRetry,
+		ignored:          make(domainSet),
+		inline:           make(domainSet),
+		maxRetry:         defaultMaxRetry,
+		maxDepth:         defaultMaxDepth,
+		padding:          defaultPaddingBlock,
+		tlsExpiryWarning: defaultTlsExpiryWarning,
 		HealthCheck: &HealthCheck{
 			stop:          make(chan struct{}),
 			maxFails:      defaultMaxFails,
 			checkInterval: defaultHcInterval,
 			transport: &Transport{
 				expire:           defaultConnExpire,
+				readTimeout:      defaultReadTimeout,
+				writeTimeout:     defaultWriteTimeout,
 				tlsConfig:        new(tls.Config),
 				recursionDesired: true,
 			},
 		},
 	}
 
+	// Aggregate all config problems of the stanza instead of failing at the first one
+	var errs configErrors
 	if err := parseFrom(c, u); err != nil {
-		return nil, err
+		errs = append(errs, err)
 	}
 
+	u.source.root = dnsserver.GetConfig(c).Root
+	if groups, ok := c.Get(upstreamGroupsKey).(map[string]*HealthCheck); ok {
+		u.source.groups = groups
+	}
 	for c.NextBlock() {
+		u.source.record(c)
 		if err := parseBlock(c, u); err != nil {
-			return nil, err
+			errs = append(errs, err)
+			// Skip remaining arguments of the erroneous line(if any)
+			_ = c.RemainingArgs()
 		}
 	}
 
-	if u.hosts == nil {
-		return nil, c.Errf("missing mandatory property: %q", "to")
-	}
-	for _, host := range u.hosts {
-		addr, tlsServerName := SplitByByte(host.addr, '@')
-		host.addr = addr
-
-		host.transport = newTransport()
-		// Inherit from global transport settings
-		host.transport.recursionDesired = u.transport.recursionDesired
-		host.transport.expire = u.transport.expire
-		if host.proto == transport.TLS {
-			// Deep copy
-			host.transport.tlsConfig = new(tls.Config)
-			host.transport.tlsConfig.Certificates = u.transport.tlsConfig.Certificates
-			host.transport.tlsConfig.RootCAs = u.transport.tlsConfig.RootCAs
-			// Don't set TLS server name if addr host part is already a domain name
-			if hostPortIsIpPort(addr) {
-				host.transport.tlsConfig.ServerName = u.transport.tlsConfig.ServerName
-			}
-
-			// TLS server name in tls:// takes precedence over the global one(if any)
-			if len(tlsServerName) != 0 {
-				tlsServerName = tlsServerName[1:]
-				serverName, ok := stringToDomain(tlsServerName)
-				if !ok {
-					return nil, c.Errf("invalid TLS server name %q", tlsServerName)
-				}
-				host.transport.tlsConfig.ServerName = serverName
+	if u.groupRef != nil {
+		if u.hosts != nil {
+			errs = append(errs, c.Errf("%q is conflict with other %q", "to @GROUP", "to"))
+		}
+		if len(u.group) != 0 {
+			errs = append(errs, c.Errf("%q is conflict with %q", "to @GROUP", "group"))
+		}
+		for _, line := range u.source.lines {
+			if stringInSlice(line[0], groupSharedDirectives) {
+				errs = append(errs, c.Errf("%q is conflict with %q, since it's taken from the group", line[0], "to @GROUP"))
 			}
 		}
+		// Hosts, transport and health check are all shared with the group
+		u.HealthCheck = u.groupRef
+	}
 
-		network := protoToNetwork(host.proto)
-		if network == "dns" {
-			// Use classic DNS protocol for health checking
-			network = "udp"
+	if u.hosts == nil {
+		errs = append(errs, c.Errf("missing mandatory property: %q", "to"))
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	if u.groupRef == nil {
+		for _, host := range u.hosts {
+			if err := u.initHost(c, host); err != nil {
+				return nil, err
+			}
 		}
-		host.c = &dns.Client{
-			Net:       network,
-			TLSConfig: host.transport.tlsConfig,
-			Timeout:   defaultHcTimeout,
+	}
+	if u.split != nil {
+		for _, host := range u.split.hosts {
+			if err := u.initHost(c, host); err != nil {
+				return nil, err
+			}
 		}
-		host.InitDOH(u)
+		u.split.initArm(u.HealthCheck)
 	}
 
 	if err := u.inline.ForEachDomain(func(name string) error {
 		// except takes precedence over INLINE
-		if u.ignored.Match(name) {
+		if u.ignoredMatch(name) {
 			return c.Errf("%q %v is conflict with %q", "INLINE", name, "except")
 		}
 		return nil
@@ -205,54 +423,248 @@ func newReloadableUpstream(c *caddy.Controller) (Upstream, error) {
 		return nil, err
 	}
 
+	if u.recursor != nil && !u.matchAny {
+		return nil, c.Errf("%q is only applicable when %q is specified", "emergency_recursion", ".")
+	}
+	if (len(u.adminToken) != 0 || len(u.metricsNamespace) != 0) && len(u.admin) == 0 {
+		return nil, c.Errf("%q and %q are only applicable when %q is specified", "admin_token", "metrics_namespace", "admin")
+	}
+	if len(u.admin) != 0 && len(u.adminToken) == 0 && !isLoopbackAddr(u.admin) {
+		return nil, c.Errf("%q is mandatory since %q %v is not a loopback address", "admin_token", "admin", u.admin)
+	}
+	if u.overrides != nil && u.matchAny {
+		return nil, c.Errf("%q is forbidden since %q will match all requests", "server_override", ".")
+	}
+	if u.guard != nil && !u.matchAny {
+		return nil, c.Errf("%q and %q are only applicable when %q is specified", "deny_qname_regex", "allow_qname_regex", ".")
+	}
+	if u.matchAny && u.NameList.bloom {
+		return nil, c.Errf("%q is forbidden since %q will match all requests", "match_accel", ".")
+	}
+	if u.NameList.flushHook != nil && (u.matchAny || u.lite) {
+		return nil, c.Errf("%q is forbidden if %q is specified or in %q mode", "flush_hook", ".", "lite")
+	}
+	if u.signer != nil && u.matchAny {
+		return nil, c.Errf("%q is forbidden since %q will match all requests", "list_sign", ".")
+	}
+	if u.urlCache != nil && u.sharedCache != nil {
+		return nil, c.Errf("%q cannot be used along with %q", "url_cache", "url_shared_cache")
+	}
+	if u.lite && u.canary != nil {
+		return nil, c.Errf("%q is forbidden in %q mode, since name lists are compacted", "canary", "lite")
+	}
+	if g, ok := u.policy.(*GeoIP); ok {
+		if u.geoip == nil {
+			return nil, c.Errf("%q is required by %q", "geoip_db", "policy geoip")
+		}
+		g.db = u.geoip
+	} else if u.geoip != nil {
+		return nil, c.Errf("%q is only applicable when %q is specified", "geoip_db", "policy geoip")
+	}
+
 	if u.matchAny {
 		if u.inline.Len() != 0 {
 			return nil, c.Errf("INLINE %q is forbidden since %q will match all requests", u.inline, ".")
 		}
-		if u.pathReload != 0 {
-			log.Debugf("Reset path_reload %v to zero since %q is matched", u.pathReload, ".")
-			u.pathReload = 0
+		if u.inlinePatterns.Len() != 0 {
+			return nil, c.Errf("INLINE %q is forbidden since %q will match all requests", u.inlinePatterns.String(), ".")
 		}
-		if u.urlReload != 0 {
-			log.Debugf("Reset url_reload %v to zero since %q is matched", u.urlReload, ".")
-			u.urlReload = 0
-		}
-	} else {
-		hasPath := false
-		hasUrl := false
-		for _, item := range u.NameList.items {
-			switch item.whichType {
-			case NameItemTypePath:
-				hasPath = true
-			case NameItemTypeUrl:
-				hasUrl = true
-			default:
-				panic(fmt.Sprintf("Unexpected NameItem type %v", item.whichType))
-			}
+		if len(u.tagActions) != 0 {
+			return nil, c.Errf("%q is forbidden since %q will match all requests", "tag", ".")
 		}
-		if !hasPath {
-			log.Debugf("Reset path_reload %v to zero since no path found", u.pathReload)
-			u.NameList.pathReload = 0
+		if u.negate {
+			return nil, c.Errf("%q is forbidden since %q will match all requests", "negate", ".")
 		}
-		if !hasUrl {
-			log.Debugf("Reset url_reload %v to zero since no url found", u.urlReload)
-			u.NameList.urlReload = 0
+	}
+	if u.negate && len(u.tagActions) != 0 {
+		return nil, c.Errf("%q is conflict with %q", "negate", "tag")
+	}
+	// Sources of `except' are name list items even if FROM is .
+	hasPath := false
+	hasUrl := false
+	for _, item := range u.NameList.items {
+		switch item.whichType {
+		case NameItemTypePath:
+			hasPath = true
+		case NameItemTypeUrl:
+			hasUrl = true
+		default:
+			panic(fmt.Sprintf("Unexpected NameItem type %v", item.whichType))
 		}
 	}
+	if !hasPath {
+		log.Debugf("Reset path_reload %v to zero since no path found", u.pathReload)
+		u.NameList.pathReload = 0
+	}
+	if !hasUrl {
+		log.Debugf("Reset url_reload %v to zero since no url found", u.urlReload)
+		u.NameList.urlReload = 0
+	}
 
 	if u.inline.Len() != 0 {
 		log.Infof("inline: %v", u.inline)
 	}
+	if u.inlinePatterns.Len() != 0 {
+		log.Infof("inline patterns: %v", u.inlinePatterns.String())
+	}
+
+	if u.noIPv6 && u.nat64 != nil {
+		return nil, c.Errf("%q is conflict with %q", "no_ipv6", "nat64")
+	}
+
+	if len(u.group) != 0 {
+		if err := registerUpstreamGroup(c, u.group, u.HealthCheck); err != nil {
+			return nil, err
+		}
+	}
 
 	return u, nil
 }
 
+// Initialize transport and health check client of the upstream host
+func (u *reloadableUpstream) initHost(c *caddy.Controller, host *UpstreamHost) error {
+	if host.proto == "dnscrypt" || host.proto == "sdns" {
+		server, err := parseDnscryptServer(host.proto, host.addr)
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		host.proto = "dnscrypt"
+		host.addr = server.addr
+		host.dnscrypt = server
+	}
+	addr, tlsServerName := SplitByByte(host.addr, '@')
+	addr, iface, err := splitInterface(addr)
+	if err != nil {
+		return c.Err(err.Error())
+	}
+	fallbackServerName := tlsServerName
+	host.addr = addr
+	host.iface = iface
+	host.warm = u.warm
+	host.redact = u.redact
+	host.ecs = u.ecs
+	host.maxInflight = u.maxInflight
+	host.padding = u.padding
+	host.certWarning = u.tlsExpiryWarning
+	if u.connHook != nil && u.connHook.covers(host) {
+		host.connHook = u.connHook
+	}
+
+	host.transport = newTransport()
+	// Inherit from global transport settings
+	host.transport.recursionDesired = u.transport.recursionDesired
+	host.transport.expire = u.transport.expire
+	host.transport.tcpFallback = u.transport.tcpFallback
+	host.transport.maxPooled = u.transport.maxPooled
+	if !u.noCookies {
+		host.transport.cookies = newDnsCookies()
+	}
+	host.transport.readTimeout = u.transport.readTimeout
+	host.transport.writeTimeout = u.transport.writeTimeout
+	if host.opts.readTimeout != 0 {
+		host.transport.readTimeout = host.opts.readTimeout
+	}
+	if host.opts.writeTimeout != 0 {
+		host.transport.writeTimeout = host.opts.writeTimeout
+	}
+	// gRPC uses TLS only if explicitly configured, as with CoreDNS grpc plugin
+	useTls := host.proto == transport.TLS ||
+		(host.proto == transport.GRPC && (u.transport.tlsExplicit || len(tlsServerName) != 0))
+	isDoh := strings.HasSuffix(host.proto, "doh")
+	// Per-host SPKI pins take precedence over the global ones(if any)
+	if len(host.opts.spkiPins) == 0 && (useTls || isDoh) {
+		host.opts.spkiPins = u.spkiPins
+	}
+	if useTls {
+		// Deep copy
+		host.transport.tlsConfig = new(tls.Config)
+		host.transport.tlsConfig.Certificates = u.transport.tlsConfig.Certificates
+		host.transport.tlsConfig.RootCAs = u.transport.tlsConfig.RootCAs
+		host.transport.tlsConfig.MinVersion = u.transport.tlsConfig.MinVersion
+		host.transport.tlsConfig.CipherSuites = u.transport.tlsConfig.CipherSuites
+		// Don't set TLS server name if addr host part is already a domain name
+		if hostPortIsIpPort(addr) {
+			host.transport.tlsConfig.ServerName = u.transport.tlsConfig.ServerName
+		}
+
+		// TLS server name in tls:// takes precedence over the global one(if any)
+		if len(tlsServerName) != 0 {
+			tlsServerName = tlsServerName[1:]
+			serverName, ok := stringToDomain(tlsServerName)
+			if !ok {
+				return c.Errf("invalid TLS server name %q", tlsServerName)
+			}
+			host.transport.tlsConfig.ServerName = serverName
+		}
+		host.transport.tlsConfig.VerifyPeerCertificate = host.opts.verifyPeer()
+		// Per-host client certificate(i.e. mTLS) and/or CA
+		if args := host.opts.tlsArgs(); len(args) != 0 {
+			tlsConfig, err := pkgtls.NewTLSConfigFromArgs(args...)
+			if err != nil {
+				return c.Errf("%v: %v", host.Name(), err)
+			}
+			if len(host.opts.tlsCert) != 0 {
+				host.transport.tlsConfig.Certificates = tlsConfig.Certificates
+			}
+			if len(host.opts.tlsCa) != 0 {
+				host.transport.tlsConfig.RootCAs = tlsConfig.RootCAs
+			}
+		}
+	} else if len(host.opts.tlsArgs()) != 0 || (len(host.opts.spkiPins) != 0 && !isDoh) {
+		return c.Errf("TLS host options don't apply to %v", host.Name())
+	}
+
+	if h, _, err := net.SplitHostPort(host.addr); err == nil && net.ParseIP(h) == nil && !strings.HasSuffix(host.proto, "doh") {
+		host.resolves = true
+		host.resolver = bootstrapResolver(u.bootstrap, u.noIPv6)
+		host.noIPv6 = u.noIPv6
+		// Dialing by resolved IP, TLS server name must be kept
+		if host.transport.tlsConfig != nil && len(host.transport.tlsConfig.ServerName) == 0 {
+			host.transport.tlsConfig.ServerName = h
+		}
+	}
+
+	if len(host.opts.fallback) != 0 {
+		if err := u.initFallback(c, host, fallbackServerName); err != nil {
+			return err
+		}
+	}
+
+	if host.proto == transport.GRPC {
+		if err := host.initGrpc(host.transport.tlsConfig, u.bootstrap, u.noIPv6); err != nil {
+			return c.Errf("failed to init gRPC client of %v: %v", host.Name(), err)
+		}
+	}
+
+	network := protoToNetwork(host.proto)
+	if network == "dns" || network == "dnscrypt" || network == "grpc" {
+		// Use classic DNS protocol for health checking, DNSCrypt certificates are fetched over it as well
+		network = "udp"
+	}
+	host.c = &dns.Client{
+		Net:       network,
+		TLSConfig: host.transport.tlsConfig,
+		Timeout:   defaultHcTimeout,
+	}
+	if len(host.iface) != 0 {
+		host.c.Dialer = &net.Dialer{
+			Timeout: defaultHcTimeout,
+			Control: bindToDeviceControl(host.iface),
+		}
+	}
+	host.InitDOH(u)
+	return nil
+}
+
 func parseFrom(c *caddy.Controller, u *reloadableUpstream) error {
 	forms := c.RemainingArgs()
 	n := len(forms)
 	if n == 0 {
 		return c.ArgErr()
 	}
+	// Default stanza name, may be overridden by the stanza directive
+	u.stanza = strings.Join(forms, " ")
+	u.source.forms = forms
 
 	if n == 1 && forms[0] == "." {
 		u.matchAny = true
@@ -262,7 +674,12 @@ func parseFrom(c *caddy.Controller, u *reloadableUpstream) error {
 
 	config := dnsserver.GetConfig(c)
 	for _, from := range forms {
-		if strings.Index(from, "://") > 0 {
+		from, format := splitFormPrefix(from)
+		if format == nameFormatGeosite {
+			// Malformed forms are reported by NewNameItemsWithForms()
+			from, _, _ = splitGeositeCategory(from)
+		}
+		if strings.Index(from, "://") > 0 || hasGlobMeta(from) {
 			continue
 		}
 
@@ -277,7 +694,7 @@ func parseFrom(c *caddy.Controller, u *reloadableUpstream) error {
 			} else {
 				return err
 			}
-		} else if st != nil && !st.Mode().IsRegular() {
+		} else if st != nil && !st.Mode().IsRegular() && !st.IsDir() {
 			log.Warningf("File %q isn't a regular file", from)
 		}
 	}
@@ -291,9 +708,62 @@ func parseFrom(c *caddy.Controller, u *reloadableUpstream) error {
 	return nil
 }
 
-func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
-	switch dir := c.Val(); dir {
-	case "path_reload":
+// Directives applied to hosts, transport or health check of a stanza
+// They're taken from the group by a stanza which references it, see `to @GROUP'
+var groupSharedDirectives = []string{
+	"policy", "spray", "max_fails", "health_check", "health_check_quiet", "warm_probe", "capability_probe", "udp_probe",
+	"expire", "tcp_fallback", "read_timeout", "write_timeout",
+	"tls", "tls_servername", "tls_pin", "tls_min_version", "tls_ciphers", "tls_expiry_warning",
+	"no_cookies", "ecs", "padding", "max_inflight", "conn_hook",
+}
+
+// Return the closest known directive of a misspelled one
+// Domain names(i.e. INLINE) and short words are never considered misspelled directives.
+func suggestDirective(dir string) (string, bool) {
+	if strings.Contains(dir, ".") || len(dir) < 4 {
+		return "", false
+	}
+	maxDistance := 1
+	if len(dir) > 5 {
+		maxDistance = 2
+	}
+	best, bestDistance := "", maxDistance+1
+	for known := range blockDirectives {
+		// Ties are broken lexicographically, since map iteration order is random
+		if d := editDistance(dir, known); d < bestDistance || (d == bestDistance && known < best) {
+			best, bestDistance = known, d
+		}
+	}
+	return best, len(best) != 0
+}
+
+// Error of an unknown directive, with a suggestion if it looks like a misspelled one
+func unknownDirectiveErr(c *caddy.Controller, dir string) error {
+	if suggestion, ok := suggestDirective(dir); ok {
+		return c.Errf("unknown property: %q, did you mean %q?", dir, suggestion)
+	}
+	return c.Errf("unknown property: %q", dir)
+}
+
+// configErrors aggregates all problems found in a stanza, each one prefixed with Corefile position
+type configErrors []error
+
+func (errs configErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	msgs := make([]string, 0, len(errs)+1)
+	msgs = append(msgs, fmt.Sprintf("%v config errors found:", len(errs)))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Parsers of directives in a stanza block, keyed by directive name
+// It drives both parseBlock() and suggestions of misspelled directives.
+var blockDirectives = map[string]func(c *caddy.Controller, u *reloadableUpstream, dir string) error{
+	"path_reload": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		dur, err := parseDuration(c)
 		if err != nil {
 			return err
@@ -303,75 +773,777 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		}
 		u.pathReload = dur
 		log.Infof("%v: %v", dir, u.pathReload)
-	case "url_reload":
+		return nil
+	},
+	"url_reload": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		n := len(args)
+		if n != 1 && n != 2 {
+			return c.ArgErr()
+		}
+		dur, err := parseDuration0(dir, args[0])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if dur < minUrlReloadInterval && dur != 0 {
+			return c.Errf("%v: minimal reload interval is %v", dir, minUrlReloadInterval)
+		}
+		if n == 2 {
+			dur, err := parseDuration0(dir, args[1])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			if dur < minUrlReadTimeout {
+				return c.Errf("%v: minimal read timeout is %v", dir, minUrlReadTimeout)
+			}
+			u.urlReadTimeout = dur
+		}
+		u.urlReload = dur
+		log.Infof("%v: %v %v", dir, u.urlReload, u.urlReadTimeout)
+		return nil
+	},
+	"url_max_size": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		size, err := parseByteSize(args[0])
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.urlMaxSize = int64(size)
+		log.Infof("%v: %v", dir, u.urlMaxSize)
+		return nil
+	},
+	"from": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		if err := parseFromOverride(c, u); err != nil {
+			return err
+		}
+		return nil
+	},
+	"url_shared_cache": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		path := args[0]
+		if config := dnsserver.GetConfig(c); !filepath.IsAbs(path) && config.Root != "" {
+			path = filepath.Join(config.Root, path)
+		}
+		if st, err := os.Stat(path); err != nil || !st.IsDir() {
+			return c.Errf("%v: %q isn't a directory", dir, path)
+		}
+		u.sharedCache = &sharedUrlCache{dir: path}
+		log.Infof("%v: %v", dir, path)
+		return nil
+	},
+	"url_cache": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		path := args[0]
+		if config := dnsserver.GetConfig(c); !filepath.IsAbs(path) && config.Root != "" {
+			path = filepath.Join(config.Root, path)
+		}
+		if st, err := os.Stat(path); err != nil || !st.IsDir() {
+			return c.Errf("%v: %q isn't a directory", dir, path)
+		}
+		cache := &urlCache{dir: path, ttl: defaultUrlCacheTtl}
+		if len(args) == 2 {
+			dur, err := parseDuration0(dir, args[1])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			cache.ttl = dur
+		}
+		u.urlCache = cache
+		log.Infof("%v: %v %v", dir, path, cache.ttl)
+		return nil
+	},
+	"url_header": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		if err := parseUrlHeader(c, u); err != nil {
+			return err
+		}
+		return nil
+	},
+	"list_sign": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		root := dnsserver.GetConfig(c).Root
+		signer, err := parseListSigner(args[0], args[1], func(path string) ([]byte, error) {
+			if !filepath.IsAbs(path) && root != "" {
+				path = filepath.Join(root, path)
+			}
+			return ioutil.ReadFile(path)
+		})
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.signer = signer
+		log.Infof("%v: %v %v", dir, args[0], args[1])
+		return nil
+	},
+	"svcb_rewrite": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		r, err := parseSvcbRewrite(args)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.svcb = r
+		log.Infof("%v: %v", dir, r)
+		return nil
+	},
+	"prefer_family": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		p, err := parseFamilyPreference(args)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.preferFamily = p
+		log.Infof("%v: %v", dir, p)
+		return nil
+	},
+	"minimal_responses": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.minimalResponses = true
+		log.Infof("%v: %v", dir, u.minimalResponses)
+		return nil
+	},
+	"negative_min_ttl": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minNegativeTtl && dur != 0 {
+			return c.Errf("%v: minimal TTL is %v", dir, minNegativeTtl)
+		}
+		if dur > maxNegativeTtl {
+			return c.Errf("%v: maximal TTL is %v", dir, maxNegativeTtl)
+		}
+		u.negativeMinTtl = uint32(dur / time.Second)
+		log.Infof("%v: %v", dir, dur)
+		return nil
+	},
+	"redact_qnames": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		mode := "hash"
+		if len(args) == 1 {
+			mode = args[0]
+		}
+		hash, ok := redactModes[mode]
+		if !ok {
+			return c.Errf("%v: unknown mode %q", dir, mode)
+		}
+		u.redact = &qnameRedactor{hash: hash}
+		log.Infof("%v: %v", dir, mode)
+		return nil
+	},
+	"ecs": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		ecs, err := parseEcs(args[0])
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.ecs = ecs
+		log.Infof("%v: %v", dir, args[0])
+		return nil
+	},
+	"admin": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if _, _, err := net.SplitHostPort(args[0]); err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.admin = args[0]
+		log.Infof("%v: %v", dir, u.admin)
+		return nil
+	},
+	"admin_token": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if len(args[0]) < minAdminTokenLen {
+			return c.Errf("%v: token should be at least %v characters", dir, minAdminTokenLen)
+		}
+		u.adminToken = args[0]
+		log.Infof("%v: <redacted>", dir)
+		return nil
+	},
+	"metrics_namespace": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if !isMetricsNamespace(args[0]) {
+			return c.Errf("%v: invalid namespace %q", dir, args[0])
+		}
+		u.metricsNamespace = args[0]
+		log.Infof("%v: %v", dir, u.metricsNamespace)
+		return nil
+	},
+	"group": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if !isGroupName(args[0]) {
+			return c.Errf("%v: invalid group name %q", dir, args[0])
+		}
+		u.group = args[0]
+		log.Infof("%v: %v", dir, u.group)
+		return nil
+	},
+	"from_clients": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		nets, err := parseIPNets(args)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.fromClients = append(u.fromClients, nets...)
+		log.Infof("%v: %v", dir, nets)
+		return nil
+	},
+	"debug_clients": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		nets, err := parseIPNets(args)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.debugClients = append(u.debugClients, nets...)
+		log.Infof("%v: %v", dir, nets)
+		return nil
+	},
+	"whichupstream": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		name, ok := stringToDomain(args[0])
+		if !ok {
+			return c.Errf("%v: %q isn't a domain name", dir, args[0])
+		}
+		u.which = newWhichUpstream(name)
+		log.Infof("%v: %v", dir, name)
+		return nil
+	},
+	"explain": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		code, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil || code < minExplainCode || code > maxExplainCode {
+			return c.Errf("%v: expected an EDNS0 option code in local/experimental use range [%v, %v], got %q",
+				dir, minExplainCode, maxExplainCode, args[0])
+		}
+		u.explainCode = uint16(code)
+		log.Infof("%v: %v", dir, code)
+		return nil
+	},
+	"canary": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		soak, err := parseDuration0(dir, args[0])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if soak < minCanarySoak {
+			return c.Errf("%v: minimal soak period is %v", dir, minCanarySoak)
+		}
+		canary := &canaryRollout{soak: soak}
+		for _, arg := range args[1:] {
+			if strings.HasSuffix(arg, "%") {
+				percent, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+				if err != nil || percent <= 0 || percent >= 100 {
+					return c.Errf("%v: invalid percentage %q", dir, arg)
+				}
+				canary.percent = percent
+				continue
+			}
+			_, cidr, err := net.ParseCIDR(arg)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			canary.clients = append(canary.clients, cidr)
+		}
+		u.canary = canary
+		log.Infof("%v: %v", dir, args)
+		return nil
+	},
+	"except": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		// Multiple "except"s will be merged together
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		var sources []string
+		for _, name := range args {
+			if ok, err := u.ignoredPatterns.add(name); ok {
+				if err != nil {
+					return c.Errf("%v: %v", dir, err)
+				}
+				continue
+			}
+			if source, ok := exceptSource(name); ok {
+				sources = append(sources, source)
+				continue
+			}
+			if !u.ignored.Add(name) {
+				log.Warningf("%q isn't a domain name", name)
+			}
+		}
+		log.Infof("%v: %v", dir, u.ignored)
+		if u.ignoredPatterns.Len() != 0 {
+			log.Infof("%v patterns: %v", dir, u.ignoredPatterns.String())
+		}
+		if len(sources) != 0 {
+			items, err := NewNameItemsWithForms(sources)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			for i, item := range items {
+				if item == nil {
+					continue
+				}
+				// Loaded and reloaded along with sources in FROM..., but names are exceptions
+				item.except = true
+				u.items = append(u.items, item)
+				u.exceptItems = append(u.exceptItems, item)
+				u.exceptForms = append(u.exceptForms, sources[i])
+			}
+			log.Infof("%v sources: %v", dir, sources)
+		}
+		return nil
+	},
+	"spray": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		spray := &Spray{}
+		if len(args) == 1 {
+			dur, err := parseDuration0(dir, args[0])
+			if err != nil {
+				return c.Err(err.Error())
+			}
+			if dur < minSprayCooldown {
+				return c.Errf("%v: minimal cooldown is %v", dir, minSprayCooldown)
+			}
+			spray.cooldown = dur
+		}
+		u.spray = spray
+		log.Infof("%v: enabled %v", dir, spray.cooldown)
+		return nil
+	},
+	"policy": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		arr := c.RemainingArgs()
+		if len(arr) != 1 {
+			return c.ArgErr()
+		}
+		if arr[0] == "geoip" {
+			// Each stanza has its own database, see `geoip_db'
+			u.policy = &GeoIP{}
+			log.Infof("%v: %v", dir, arr[0])
+			return nil
+		}
+		if newPolicy, ok := statefulPolicies[arr[0]]; ok {
+			// Each stanza has its own state
+			u.policy = newPolicy()
+			log.Infof("%v: %v", dir, arr[0])
+			return nil
+		}
+		policy, ok := SupportedPolicies[arr[0]]
+		if !ok {
+			return c.Errf("unknown policy: %q", arr[0])
+		}
+		u.policy = policy
+		log.Infof("%v: %v", dir, arr[0])
+		return nil
+	},
+	"lite": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		ceiling := uint64(defaultLiteMemoryCeiling)
+		if len(args) == 1 {
+			n, err := parseByteSize(args[0])
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			ceiling = n
+		}
+		u.applyLite(ceiling)
+		log.Infof("%v: memory ceiling %v bytes", dir, ceiling)
+		return nil
+	},
+	"flush_hook": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		hookUrl, err := url.Parse(args[0])
+		if err != nil || (hookUrl.Scheme != "http" && hookUrl.Scheme != "https") || len(hookUrl.Host) == 0 {
+			return c.Errf("%v: expected a HTTP(S) URL, got %q", dir, args[0])
+		}
+		u.NameList.flushHook = newFlushHook(args[0])
+		log.Infof("%v: %v", dir, args[0])
+		return nil
+	},
+	"match_accel": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if args[0] != "bloom" {
+			return c.Errf("%v: unknown accelerator %q, expected %q", dir, args[0], "bloom")
+		}
+		u.NameList.bloom = true
+		log.Infof("%v: %v", dir, args[0])
+		return nil
+	},
+	"geoip_db": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if u.geoip != nil {
+			_ = u.geoip.Close()
+		}
+		db, err := openGeoipDB(args[0])
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.geoip = db
+		log.Infof("%v: %v", dir, db.path)
+		return nil
+	},
+	"max_fails": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		u.maxFails = n
+		log.Infof("%v: %v", dir, n)
+		return nil
+	},
+	"max_retry": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		u.maxRetry = n
+		log.Infof("%v: %v", dir, n)
+		return nil
+	},
+	"max_depth": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n < minMaxDepth {
+			return c.Errf("%v: minimal depth is %v", dir, minMaxDepth)
+		}
+		u.maxDepth = n
+		log.Infof("%v: %v", dir, n)
+		return nil
+	},
+	"dnssec_validate": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		path := ""
+		if len(args) == 1 {
+			path = args[0]
+		}
+		v, err := newDnssecValidator(path)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.dnssec = v
+		log.Infof("%v: trust anchors: %v", dir, len(v.anchors))
+		return nil
+	},
+	"emergency_recursion": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		n := defaultRecursionQueries
+		if len(args) == 1 {
+			var err error
+			n, err = strconv.Atoi(args[0])
+			if err != nil || n < minRecursionQueries {
+				return c.Errf("%v: expected an integer not less than %v, got %q", dir, minRecursionQueries, args[0])
+			}
+		}
+		u.recursor = newRootRecursor(n)
+		log.Infof("%v: %v", dir, n)
+		return nil
+	},
+	"server_override": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.overrides = newServerOverrides(u)
+		log.Infof("%v: %v", dir, true)
+		return nil
+	},
+	"deny_qname_regex":  parseQnameRegex,
+	"allow_qname_regex": parseQnameRegex,
+	"dedup_window": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minDedupWindow || dur > maxDedupWindow {
+			return c.Errf("%v: window should be in range [%v, %v]", dir, minDedupWindow, maxDedupWindow)
+		}
+		u.dedup = newAnswerMemo(dur)
+		log.Infof("%v: %v", dir, dur)
+		return nil
+	},
+	"padding": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n < 0 || n > maxPaddingBlock {
+			return c.Errf("%v: padding block size should be in range [0, %v]", dir, maxPaddingBlock)
+		}
+		u.padding = int(n)
+		log.Infof("%v: %v", dir, n)
+		return nil
+	},
+	"max_inflight": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		n, err := parseInt32(c)
+		if err != nil {
+			return err
+		}
+		if n < minMaxInflight {
+			return c.Errf("%v: minimal in-flight limit is %v", dir, minMaxInflight)
+		}
+		u.maxInflight = n
+		log.Infof("%v: %v", dir, n)
+		return nil
+	},
+	"queue": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		n := len(args)
+		if n != 1 && n != 2 {
+			return c.ArgErr()
+		}
+		concurrency, err := strconv.Atoi(args[0])
+		if err != nil || concurrency <= 0 || concurrency > 0x7fffffff {
+			return c.Errf("%v: invalid concurrency %q", dir, args[0])
+		}
+		length := defaultQueueLength
+		if n == 2 {
+			length, err = strconv.Atoi(args[1])
+			if err != nil || length < 0 || length > 0x7fffffff {
+				return c.Errf("%v: invalid queue length %q", dir, args[1])
+			}
+		}
+		u.queue = newExchangeQueue(int32(concurrency), int32(length))
+		log.Infof("%v: %v %v", dir, concurrency, length)
+		return nil
+	},
+	"tag": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		action, ok := tagActionNames[args[len(args)-1]]
+		if !ok {
+			return c.Errf("%v: unknown action %q", dir, args[len(args)-1])
+		}
+		if u.tagActions == nil {
+			u.tagActions = make(map[string]int)
+		}
+		for _, tag := range args[:len(args)-1] {
+			if tag != tagAny && !isTagName(tag) {
+				return c.Errf("%v: %q isn't a valid tag", dir, tag)
+			}
+			u.tagActions[strings.ToLower(tag)] = action
+		}
+		log.Infof("%v: %v", dir, args)
+		return nil
+	},
+	"stanza": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if u.slo != nil {
+			return c.Errf("%q must comes before %q", dir, "slo")
+		}
+		u.stanza = args[0]
+		log.Infof("%v: %v", dir, u.stanza)
+		return nil
+	},
+	"slo": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		latency, err := parseDuration0(dir, args[0])
+		if err != nil {
+			return c.Err(err.Error())
+		}
+		if latency == 0 {
+			return c.Errf("%v: latency must be positive", dir)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(args[1], "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return c.Errf("%v: invalid percentage %q", dir, args[1])
+		}
+		u.slo = newSloTracker(u.stanza, latency, percent/100)
+		log.Infof("%v: %v%% < %v", dir, percent, latency)
+		return nil
+	},
+	"stats_file": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		args := c.RemainingArgs()
 		n := len(args)
 		if n != 1 && n != 2 {
 			return c.ArgErr()
 		}
-		dur, err := parseDuration0(dir, args[0])
-		if err != nil {
-			return c.Err(err.Error())
-		}
-		if dur < minUrlReloadInterval && dur != 0 {
-			return c.Errf("%v: minimal reload interval is %v", dir, minUrlReloadInterval)
+		path := args[0]
+		if config := dnsserver.GetConfig(c); !filepath.IsAbs(path) && config.Root != "" {
+			path = filepath.Join(config.Root, path)
 		}
+		interval := defaultStatsInterval
 		if n == 2 {
 			dur, err := parseDuration0(dir, args[1])
 			if err != nil {
 				return c.Err(err.Error())
 			}
-			if dur < minUrlReadTimeout {
-				return c.Errf("%v: minimal read timeout is %v", dir, minUrlReadTimeout)
+			if dur < minStatsInterval {
+				return c.Errf("%v: minimal interval is %v", dir, minStatsInterval)
 			}
-			u.urlReadTimeout = dur
+			interval = dur
 		}
-		u.urlReload = dur
-		log.Infof("%v: %v %v", dir, u.urlReload, u.urlReadTimeout)
-	case "except":
-		// Multiple "except"s will be merged together
+		u.stats = newStanzaStats(path, interval)
+		log.Infof("%v: %v %v", dir, path, interval)
+		return nil
+	},
+	"audit_log": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		args := c.RemainingArgs()
-		if len(args) == 0 {
+		n := len(args)
+		if n != 1 && n != 2 {
 			return c.ArgErr()
 		}
-		for _, name := range args {
-			if !u.ignored.Add(name) {
-				log.Warningf("%q isn't a domain name", name)
+		path := args[0]
+		if config := dnsserver.GetConfig(c); !filepath.IsAbs(path) && config.Root != "" {
+			path = filepath.Join(config.Root, path)
+		}
+		var maxSize uint64
+		if n == 2 {
+			size, err := parseByteSize(args[1])
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
 			}
+			maxSize = size
 		}
-		log.Infof("%v: %v", dir, u.ignored)
-	case "spray":
-		if len(c.RemainingArgs()) != 0 {
+		u.audit = newAuditLog(path, int64(maxSize))
+		log.Infof("%v: %v max size: %v", dir, path, maxSize)
+		return nil
+	},
+	"config_file": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		_ = c.RemainingArgs()
+		return c.Errf("%v: must be the only directive of a stanza without FROM...", dir)
+	},
+	"conn_hook": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
 			return c.ArgErr()
 		}
-		u.spray = &Spray{}
-		log.Infof("%v: enabled", dir)
-	case "policy":
-		arr := c.RemainingArgs()
-		if len(arr) != 1 {
+		h, err := parseConnHook(args)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.connHook = h
+		log.Infof("%v: %v", dir, args)
+		return nil
+	},
+	"mirror": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 3 || args[1] != "to" {
 			return c.ArgErr()
 		}
-		policy, ok := SupportedPolicies[arr[0]]
-		if !ok {
-			return c.Errf("unknown policy: %q", arr[0])
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return c.Errf("%v: invalid percentage %q", dir, args[0])
 		}
-		u.policy = policy
-		log.Infof("%v: %v", dir, arr[0])
-	case "max_fails":
-		n, err := parseInt32(c)
+		mirror, err := newQueryMirror(percent, args[2], u.transport.tlsConfig)
 		if err != nil {
-			return err
+			return c.Errf("%v: %v", dir, err)
 		}
-		u.maxFails = n
-		log.Infof("%v: %v", dir, n)
-	case "max_retry":
-		n, err := parseInt32(c)
+		u.mirror = mirror
+		log.Infof("%v: %v%% to %v", dir, percent, mirror.name)
+		return nil
+	},
+	"split": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) < 3 {
+			return c.ArgErr()
+		}
+		if u.split != nil {
+			return c.Errf("%v: duplicated directive", dir)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return c.Errf("%v: invalid percentage %q", dir, args[0])
+		}
+		var byClient bool
+		switch args[1] {
+		case "client":
+			byClient = true
+		case "qname":
+		default:
+			return c.Errf("%v: unknown sticky key %q", dir, args[1])
+		}
+		hosts, err := parseHosts(args[2:], u)
 		if err != nil {
 			return err
 		}
-		u.maxRetry = n
-		log.Infof("%v: %v", dir, n)
-	case "health_check":
+		u.split = &abSplit{
+			percent:  percent,
+			byClient: byClient,
+			hosts:    hosts,
+		}
+		log.Infof("%v: %v%% %v %v", dir, percent, args[1], args[2:])
+		return nil
+	},
+	"health_check": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		args := c.RemainingArgs()
 		n := len(args)
 		if n != 1 && n != 2 {
@@ -390,12 +1562,72 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		u.checkInterval = dur
 		u.transport.recursionDesired = n == 1
 		log.Infof("%v: %v %v", dir, u.checkInterval, u.transport.recursionDesired)
-	case "to":
+		return nil
+	},
+	"health_check_quiet": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			w, err := parseQuietWindow(arg)
+			if err != nil {
+				return c.Errf("%v: %v", dir, err)
+			}
+			u.quiet = append(u.quiet, w)
+		}
+		log.Infof("%v: %v", dir, u.quiet)
+		return nil
+	},
+	"warm_probe": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		size := defaultWarmSampleSize
+		if len(args) == 1 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < minWarmSampleSize {
+				return c.Errf("%v: invalid sample size %q, minimal is %v", dir, args[0], minWarmSampleSize)
+			}
+			size = n
+		}
+		u.warm = newWarmSample(size)
+		log.Infof("%v: %v", dir, size)
+		return nil
+	},
+	"capability_probe": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minCapabilityProbeInterval && dur != 0 {
+			return c.Errf("%v: minimal interval is %v", dir, minCapabilityProbeInterval)
+		}
+		u.capabilityProbeInterval = dur
+		log.Infof("%v: %v", dir, dur)
+		return nil
+	},
+	"udp_probe": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minUdpProbeInterval && dur != 0 {
+			return c.Errf("%v: minimal interval is %v", dir, minUdpProbeInterval)
+		}
+		u.udpProbeInterval = dur
+		log.Infof("%v: %v", dir, dur)
+		return nil
+	},
+	"to": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		// Multiple "to"s will be merged together
 		if err := parseTo(c, u); err != nil {
 			return err
 		}
-	case "expire":
+		return nil
+	},
+	"expire": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		dur, err := parseDuration(c)
 		if err != nil {
 			return err
@@ -405,7 +1637,23 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		}
 		u.transport.expire = dur
 		log.Infof("%v: %v", dir, dur)
-	case "tls":
+		return nil
+	},
+	"read_timeout":  parseIOTimeout,
+	"write_timeout": parseIOTimeout,
+	"tcp_fallback": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		dur, err := parseDuration(c)
+		if err != nil {
+			return err
+		}
+		if dur < minTcpFallback && dur != 0 {
+			return c.Errf("%v: minimal duration is %v", dir, minTcpFallback)
+		}
+		u.transport.tcpFallback = dur
+		log.Infof("%v: %v", dir, dur)
+		return nil
+	},
+	"tls": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		args := c.RemainingArgs()
 		if len(args) > 3 {
 			return c.ArgErr()
@@ -414,11 +1662,70 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 		if err != nil {
 			return err
 		}
-		// Merge server name if tls_servername set previously
+		// Merge server name, version and cipher suites if set previously
 		tlsConfig.ServerName = u.transport.tlsConfig.ServerName
+		if u.transport.tlsConfig.MinVersion != 0 {
+			tlsConfig.MinVersion = u.transport.tlsConfig.MinVersion
+		}
+		tlsConfig.CipherSuites = u.transport.tlsConfig.CipherSuites
 		u.transport.tlsConfig = tlsConfig
+		u.transport.tlsExplicit = true
 		log.Infof("%v: %v", dir, args)
-	case "tls_servername":
+		return nil
+	},
+	"tls_min_version": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		version, ok := tlsVersions[args[0]]
+		if !ok {
+			return c.Errf("%v: unsupported TLS version %q", dir, args[0])
+		}
+		u.transport.tlsConfig.MinVersion = version
+		log.Infof("%v: %v", dir, args[0])
+		return nil
+	},
+	"tls_ciphers": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		suites, err := parseCipherSuites(args)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.transport.tlsConfig.CipherSuites = suites
+		log.Infof("%v: %v", dir, args)
+		return nil
+	},
+	"tls_pin": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		pins, err := parseSpkiPins(args)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.spkiPins = pins
+		log.Infof("%v: %v", dir, args)
+		return nil
+	},
+	"tls_expiry_warning": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		days, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil {
+			return c.Errf("%v: expected number of days, got %q", dir, args[0])
+		}
+		u.tlsExpiryWarning = time.Duration(days) * 24 * time.Hour
+		log.Infof("%v: %v", dir, u.tlsExpiryWarning)
+		return nil
+	},
+	"tls_servername": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		args := c.RemainingArgs()
 		if len(args) != 1 {
 			return c.ArgErr()
@@ -428,34 +1735,148 @@ func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
 			return c.Errf("%v: %q isn't a valid domain name", dir, args[0])
 		}
 		u.transport.tlsConfig.ServerName = serverName
+		u.transport.tlsExplicit = true
 		log.Infof("%v: %v", dir, serverName)
-	case "bootstrap":
+		return nil
+	},
+	"bootstrap": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		if err := parseBootstrap(c, u); err != nil {
 			return err
 		}
-	case "ipset":
+		return nil
+	},
+	"ipset": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		if err := ipsetParse(c, u); err != nil {
 			return err
 		}
-	case "pf":
+		return nil
+	},
+	"pf": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		if err := pfParse(c, u); err != nil {
 			return err
 		}
-	case "no_ipv6":
+		return nil
+	},
+	"no_ipv6": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
 		args := c.RemainingArgs()
 		if len(args) != 0 {
 			return c.ArgErr()
 		}
 		u.noIPv6 = true
 		log.Infof("%v: %v", dir, u.noIPv6)
-	default:
-		if len(c.RemainingArgs()) != 0 || !u.inline.Add(dir) {
-			return c.Errf("unknown property: %q", dir)
+		return nil
+	},
+	"negate": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.negate = true
+		log.Infof("%v: %v", dir, u.negate)
+		return nil
+	},
+	"no_path_watch": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.noPathWatch = true
+		log.Infof("%v: %v", dir, u.noPathWatch)
+		return nil
+	},
+	"no_cookies": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		u.noCookies = true
+		log.Infof("%v: %v", dir, u.noCookies)
+		return nil
+	},
+	"nat64": func(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+		args := c.RemainingArgs()
+		if len(args) > 1 {
+			return c.ArgErr()
+		}
+		prefix := defaultNat64Prefix
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		nat64, err := parseNat64Prefix(prefix)
+		if err != nil {
+			return c.Errf("%v: %v", dir, err)
+		}
+		u.nat64 = nat64
+		log.Infof("%v: %v", dir, u.nat64)
+		return nil
+	},
+}
+
+func parseQnameRegex(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return c.ArgErr()
+	}
+	res, err := compileRegexps(args)
+	if err != nil {
+		return c.Errf("%v: %v", dir, err)
+	}
+	if u.guard == nil {
+		u.guard = &qnameGuard{}
+	}
+	if dir == "deny_qname_regex" {
+		u.guard.deny = append(u.guard.deny, res...)
+	} else {
+		u.guard.allow = append(u.guard.allow, res...)
+	}
+	log.Infof("%v: %v", dir, args)
+	return nil
+}
+
+func parseIOTimeout(c *caddy.Controller, u *reloadableUpstream, dir string) error {
+	dur, err := parseDuration(c)
+	if err != nil {
+		return err
+	}
+	if dur < minIOTimeout {
+		return c.Errf("%v: minimal timeout is %v", dir, minIOTimeout)
+	}
+	if dir == "read_timeout" {
+		u.transport.readTimeout = dur
+	} else {
+		u.transport.writeTimeout = dur
+	}
+	log.Infof("%v: %v", dir, dur)
+	return nil
+}
+
+func parseBlock(c *caddy.Controller, u *reloadableUpstream) error {
+	dir := c.Val()
+	if parse, ok := blockDirectives[dir]; ok {
+		return parse(c, u, dir)
+	}
+
+	// A dotless name is a valid INLINE name, only suggest if it takes arguments or cannot be added
+	if len(c.RemainingArgs()) != 0 {
+		return unknownDirectiveErr(c, dir)
+	}
+	names := []string{dir}
+	if strings.ContainsAny(dir, "{}") && !strings.HasPrefix(dir, regexPrefix) {
+		expanded, err := expandBraces(dir)
+		if err != nil {
+			return c.Errf("INLINE %q: %v", dir, err)
 		}
-		if u.ignored.Len() != 0 {
-			return c.Errf("%q must comes before %q", "INLINE", "except")
+		names = expanded
+	}
+	for _, name := range names {
+		if ok, err := u.inlinePatterns.add(name); ok {
+			if err != nil {
+				return c.Errf("INLINE: %v", err)
+			}
+		} else if !u.inline.Add(name) {
+			return unknownDirectiveErr(c, name)
 		}
 	}
+	if u.ignored.Len() != 0 || u.ignoredPatterns.Len() != 0 {
+		return c.Errf("%q must comes before %q", "INLINE", "except")
+	}
 	return nil
 }
 
@@ -470,7 +1891,7 @@ func parseInt32(c *caddy.Controller) (int32, error) {
 
 	n, err := strconv.Atoi(args[0])
 	if err != nil {
-		return 0, err
+		return 0, c.Errf("%v: expected an integer, got %q", dir, args[0])
 	}
 
 	// In case of n is 64-bit
@@ -513,12 +1934,190 @@ func parseTo(c *caddy.Controller, u *reloadableUpstream) error {
 		return c.ArgErr()
 	}
 
-	toHosts, err := HostPort(args)
+	if strings.HasPrefix(args[0], "@") {
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		name := args[0][1:]
+		group, ok := upstreamGroups(c)[name]
+		if !ok {
+			return c.Errf("upstream group %q not defined, note that it must be defined before referencing", name)
+		}
+		u.groupRef = group
+		log.Infof("%v: upstream group %q", c.Val(), name)
+		return nil
+	}
+
+	hosts, err := parseHosts(args, u)
 	if err != nil {
 		return err
 	}
+	u.hosts = append(u.hosts, hosts...)
+	return nil
+}
+
+// Per-host options, which follow the host in TO..., e.g. `to tls://1.1.1.1 read_timeout=5s 192.168.1.1`
+type hostOptions struct {
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// Bypass the persistent connection pool, i.e. always dial and close
+	noReuse bool
+	// SHA256 digests of TBS certificates pinned by a DNS stamp
+	pins [][]byte
+	// SHA256 digests of certificate SubjectPublicKeyInfo, see pin.go
+	spkiPins [][]byte
+	// Transports to step down to in order, see fallback.go
+	fallback []string
+	// Client certificate, key and CA of TLS upstreams, override the global `tls' ones
+	tlsCert string
+	tlsKey  string
+	tlsCa   string
+	// Monthly query quota, zero if unlimited, see quota.go
+	quota uint64
+	// Weight of `policy weighted_round_robin', zero means the default weight 1
+	weight int
+}
+
+// Return arguments for pkgtls.NewTLSConfigFromArgs(), nil if no TLS option specified
+func (opts *hostOptions) tlsArgs() []string {
+	var args []string
+	if len(opts.tlsCert) != 0 {
+		args = append(args, opts.tlsCert, opts.tlsKey)
+	}
+	if len(opts.tlsCa) != 0 {
+		args = append(args, opts.tlsCa)
+	}
+	return args
+}
+
+// Return true if the argument is a per-host option rather than a host
+func isHostOption(arg string) bool {
+	name, _ := SplitByByte(arg, '=')
+	switch name {
+	case "read_timeout", "write_timeout", "no_reuse", "fallback", "tls_cert", "tls_key", "tls_ca", "tls_pin", "quota", "weight":
+		return true
+	}
+	return false
+}
+
+func parseHostOption(opts *hostOptions, arg string) error {
+	name, value := SplitByByte(arg, '=')
+	if len(value) != 0 {
+		// Strip the leading '='
+		value = value[1:]
+	}
+	switch name {
+	case "read_timeout":
+		fallthrough
+	case "write_timeout":
+		dur, err := parseDuration0(name, value)
+		if err != nil {
+			return err
+		}
+		if dur < minIOTimeout {
+			return fmt.Errorf("%v: minimal timeout is %v", name, minIOTimeout)
+		}
+		if name == "read_timeout" {
+			opts.readTimeout = dur
+		} else {
+			opts.writeTimeout = dur
+		}
+	case "no_reuse":
+		if len(value) != 0 {
+			return fmt.Errorf("%v: unexpected value %q", name, value)
+		}
+		opts.noReuse = true
+	case "tls_cert", "tls_key", "tls_ca":
+		if len(value) == 0 {
+			return fmt.Errorf("%v: expected a file path", name)
+		}
+		switch name {
+		case "tls_cert":
+			opts.tlsCert = value
+		case "tls_key":
+			opts.tlsKey = value
+		default:
+			opts.tlsCa = value
+		}
+	case "tls_pin":
+		if len(value) == 0 {
+			return fmt.Errorf("%v: expected base64 encoded SHA256 digest(s)", name)
+		}
+		pins, err := parseSpkiPins(strings.Split(value, ","))
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		opts.spkiPins = pins
+	case "fallback":
+		if len(value) == 0 {
+			return fmt.Errorf("%v: expected transports, e.g. %q", name, "tcp,udp")
+		}
+		for _, trans := range strings.Split(value, ",") {
+			if !stringInSlice(trans, fallbackTransports) {
+				return fmt.Errorf("%v: unsupported transport %q, supported: %v", name, trans, fallbackTransports)
+			}
+			opts.fallback = append(opts.fallback, trans)
+		}
+	case "quota":
+		quota, err := parseQuota(value)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		opts.quota = quota
+	case "weight":
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 1 || weight > maxHostWeight {
+			return fmt.Errorf("%v: expected an integer in range [1, %v], got %q", name, maxHostWeight, value)
+		}
+		opts.weight = weight
+	default:
+		return fmt.Errorf("unknown host option %q", name)
+	}
+	return nil
+}
+
+// Parse upstream hosts in TO... format
+func parseHosts(args []string, u *reloadableUpstream) (UpstreamHostPool, error) {
+	// Separate per-host options from hosts, options apply to the preceding host
+	var addrs []string
+	var opts []hostOptions
+	for _, arg := range args {
+		if !isHostOption(arg) {
+			var opt hostOptions
+			if trans, stamp := SplitTransportHost(arg); trans == "sdns" {
+				host, pins, err := expandStamp(stamp)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse %q: %v", arg, err)
+				}
+				log.Infof("Stamp %v expanded to %v, pinned certificates: %v", arg, host, len(pins))
+				arg = host
+				opt.pins = pins
+			}
+			addrs = append(addrs, arg)
+			opts = append(opts, opt)
+			continue
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("host option %q must follow a host", arg)
+		}
+		if err := parseHostOption(&opts[len(opts)-1], arg); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range opts {
+		if (len(opts[i].tlsCert) == 0) != (len(opts[i].tlsKey) == 0) {
+			return nil, fmt.Errorf("%q and %q of %v must be specified together", "tls_cert", "tls_key", addrs[i])
+		}
+	}
+
+	toHosts, err := HostPort(addrs)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, host := range toHosts {
+	var hosts UpstreamHostPool
+	for i, host := range toHosts {
 		trans, addr := SplitTransportHost(host)
 		log.Infof("Transport: %v Address: %v", trans, addr)
 
@@ -526,14 +2125,15 @@ func parseTo(c *caddy.Controller, u *reloadableUpstream) error {
 			proto: trans,
 			// Not an error, host and tls server name will be separated later
 			addr:     addr,
+			opts:     opts[i],
 			downFunc: checkDownFunc(u),
 		}
-		u.hosts = append(u.hosts, uh)
+		hosts = append(hosts, uh)
 
 		log.Infof("Upstream: %v", uh)
 	}
 
-	return nil
+	return hosts, nil
 }
 
 func parseBootstrap(c *caddy.Controller, u *reloadableUpstream) error {
@@ -592,13 +2192,37 @@ func parseBootstrap(c *caddy.Controller, u *reloadableUpstream) error {
 	return nil
 }
 
+const (
+	tagActionNone     = iota // Name not found in name list
+	tagActionRedirect        // Redirect to upstream hosts in `to'
+	tagActionBlock           // Answer NXDOMAIN locally
+	tagActionSkip            // Treat as unmatched, i.e. pass to next block or plugin
+)
+
+var tagActionNames = map[string]int{
+	"redirect": tagActionRedirect,
+	"block":    tagActionBlock,
+	"skip":     tagActionSkip,
+}
+
+// Tag denotes any name list entry whose tags have no explicit action, including untagged ones
+const tagAny = "*"
+
 const (
 	defaultMaxFails = 3
 	defaultMaxRetry = 10
+	defaultMaxDepth = 16
+	// Recommended block size of queries, see: https://tools.ietf.org/html/rfc8467#section-4.1
+	defaultPaddingBlock = 128
+
+	defaultRecursionQueries = 32
+
+	defaultQueueLength = 1024
 
 	defaultPathReloadInterval = 2 * time.Second
 	defaultUrlReloadInterval  = 30 * time.Minute
 	defaultUrlReadTimeout     = 15 * time.Second
+	defaultUrlMaxSize         = 256 << 20
 
 	defaultHcInterval = 2000 * time.Millisecond
 	defaultHcTimeout  = 5000 * time.Millisecond
@@ -611,4 +2235,26 @@ const (
 
 	minHcInterval     = 1 * time.Second
 	minExpireInterval = 1 * time.Second
+	minSprayCooldown  = 1 * time.Second
+	minTcpFallback    = 1 * time.Second
+
+	minUdpProbeInterval = 10 * time.Second
+	minCanarySoak       = 1 * time.Minute
+	minMaxDepth         = 1
+	minMaxInflight      = 1
+	maxPaddingBlock     = 1024
+	minDedupWindow      = 1 * time.Millisecond
+	maxDedupWindow      = 1 * time.Second
+	minRecursionQueries = 1
+	minAdminTokenLen    = 16
+	minExplainCode      = 65001
+	maxExplainCode      = 65534
+	minWarmSampleSize   = 1
+	minIOTimeout        = 100 * time.Millisecond
+	maxHostWeight       = 1000
+	minNegativeTtl      = 1 * time.Second
+	// see: https://tools.ietf.org/html/rfc2308#section-5
+	maxNegativeTtl = 3 * time.Hour
+
+	minCapabilityProbeInterval = 1 * time.Minute
 )
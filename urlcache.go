@@ -0,0 +1,114 @@
+package dnsredir
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// urlCache is a persistent cache of downloaded URL contents, see `url_cache'
+// Cached copies are loaded at startup, thus matching survives restarts while the network is down.
+type urlCache struct {
+	dir string
+	// Cached copies older than this are not loaded, zero if never expire
+	ttl time.Duration
+}
+
+func (c *urlCache) path(theUrl string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%016x.list", stringHash(theUrl)))
+}
+
+// Create a cache file of the URL, which replaces the cached copy once committed
+func (c *urlCache) create(theUrl string) (*urlCacheFile, error) {
+	path := c.path(theUrl)
+	f, err := ioutil.TempFile(c.dir, filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	return &urlCacheFile{f: f, path: path}, nil
+}
+
+// Refresh modification time of the cached copy, e.g. the URL content isn't modified
+func (c *urlCache) touch(theUrl string) {
+	now := time.Now()
+	if err := os.Chtimes(c.path(theUrl), now, now); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to touch cached copy of %q: %v", theUrl, err)
+	}
+}
+
+// Cache file being written along with downloading
+// Write errors are deferred to commit(), thus downloading won't fail due to the cache.
+type urlCacheFile struct {
+	f    *os.File
+	path string
+	err  error
+}
+
+func (w *urlCacheFile) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.f.Write(p)
+	}
+	return len(p), nil
+}
+
+func (w *urlCacheFile) commit() error {
+	err := w.f.Close()
+	if w.err != nil {
+		err = w.err
+	}
+	if err != nil {
+		_ = os.Remove(w.f.Name())
+		return err
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
+
+func (w *urlCacheFile) abort() {
+	Close(w.f)
+	_ = os.Remove(w.f.Name())
+}
+
+// Load the cached copy of the URL item(if any)
+func (n *NameList) loadUrlCache(item *NameItem) {
+	path := n.urlCache.path(item.url)
+	file, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to open cached copy of %q: %v", item.url, err)
+		}
+		return
+	}
+	defer Close(file)
+	stat, err := file.Stat()
+	if err != nil {
+		log.Warningf("%v", err)
+		return
+	}
+	if age := time.Since(stat.ModTime()); n.urlCache.ttl > 0 && age > n.urlCache.ttl {
+		log.Infof("Cached copy of %q is expired, age: %v", item.url, age.Round(time.Second))
+		return
+	}
+
+	h := fnv.New64a()
+	names, tags, excepts, totalLines, err := n.parse(io.TeeReader(file, h), item)
+	if err != nil {
+		log.Warningf("Failed to parse cached copy of %q after %v lines, err: %v", item.url, totalLines, err)
+		return
+	}
+	log.Infof("Loaded cached copy of %v, age: %v, added: %v / %v",
+		item.url, time.Since(stat.ModTime()).Round(time.Second), names.Len(), totalLines)
+
+	item.Lock()
+	// The fetched content is taken only if it's changed, see updateItemFromUrl()
+	if item.contentHash == 0 {
+		n.swapNames(item, names, tags, excepts)
+		item.contentHash = h.Sum64()
+	}
+	item.Unlock()
+}
+
+const defaultUrlCacheTtl = 7 * 24 * time.Hour
@@ -2,6 +2,7 @@ package dnsredir
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/coredns/coredns/plugin"
 	"hash/fnv"
@@ -126,7 +127,39 @@ func isContentType(contentType string, h *http.Header) bool {
 // see:
 //	https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
 //	https://medium.com/@nate510/don-t-use-go-s-default-http-client-4804cb19f779
-func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.Duration) (string, error) {
+func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.Duration, header http.Header, maxSize int64) (string, error) {
+	resp, err := openUrl(theUrl, contentType, bootstrap, timeout, header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer Close(resp.Body)
+
+	content, err := ioutil.ReadAll(newSizeLimitReader(resp.Body, maxSize))
+	if err != nil {
+		return "", err
+	}
+	// We don't use http.DetectContentType()
+	return string(content), nil
+}
+
+// Validators of a fetched URL content, which make subsequent fetches conditional
+type urlValidators struct {
+	etag         string
+	lastModified string
+}
+
+// Open the URL for streaming its content, the response body should be closed by the caller
+// `header' is added to the request(e.g. Authorization of private lists), it overrides the default one(e.g. User-Agent).
+// errNotModified is returned if `cond' is non-nil and the content isn't modified since.
+func openUrl(theUrl, contentType string, bootstrap []string, timeout time.Duration, header http.Header, cond *urlValidators) (*http.Response, error) {
+	if isObjectUrl(theUrl) {
+		resp, err := openObject(theUrl, timeout, cond)
+		if err != nil {
+			return nil, err
+		}
+		return decompressResponse(resp, compressionOf(theUrl))
+	}
+
 	var transport http.RoundTripper
 
 	if len(bootstrap) != 0 {
@@ -159,10 +192,23 @@ func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.
 
 	req, err := http.NewRequest(http.MethodGet, theUrl, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	// Set a fake user agent in case of access denied error
 	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:80.0) Gecko/20100101 Firefox/80.0")
+	// Decompressed by ourselves rather than the transport, which doesn't decompress once the header set explicitly
+	req.Header.Set("Accept-Encoding", "gzip")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if cond != nil {
+		if len(cond.etag) != 0 {
+			req.Header.Set("If-None-Match", cond.etag)
+		}
+		if len(cond.lastModified) != 0 {
+			req.Header.Set("If-Modified-Since", cond.lastModified)
+		}
+	}
 
 	c := &http.Client{
 		Transport: transport, // [sic] If nil, DefaultTransport is used.
@@ -170,30 +216,97 @@ func getUrlContent(theUrl, contentType string, bootstrap []string, timeout time.
 	}
 	resp, err := c.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer Close(resp.Body)
 
+	if resp.StatusCode == http.StatusNotModified && cond != nil {
+		Close(resp.Body)
+		return nil, errNotModified
+	}
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("bad status code: %v", resp.StatusCode)
+		Close(resp.Body)
+		return nil, fmt.Errorf("bad status code: %v", resp.StatusCode)
 	}
 
-	if len(contentType) != 0 && !isContentType(contentType, &resp.Header) {
+	// Content type of compressed lists, e.g. list.txt.gz, is usually application/gzip or application/octet-stream
+	compression := compressionOf(theUrl)
+	if len(contentType) != 0 && compression == compressionNone && !isContentType(contentType, &resp.Header) {
+		Close(resp.Body)
 		if theUrl, err = fixUrl(theUrl, resp.Header); err != nil {
-			return "", err
+			return nil, err
 		} else {
-			return getUrlContent(theUrl, contentType, bootstrap, timeout)
+			return openUrl(theUrl, contentType, bootstrap, timeout, header, cond)
 		}
 	}
 
-	content, err := ioutil.ReadAll(resp.Body)
+	return decompressResponse(resp, compression)
+}
+
+// Decompress the response body by its Content-Encoding and `compression' of the URL
+func decompressResponse(resp *http.Response, compression string) (*http.Response, error) {
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), compressionGzip) {
+		body, err := newDecompressReader(resp.Body, compressionGzip)
+		if err != nil {
+			Close(resp.Body)
+			return nil, err
+		}
+		resp.Body = body
+	}
+	body, err := newDecompressReader(resp.Body, compression)
 	if err != nil {
-		return "", err
+		Close(resp.Body)
+		return nil, err
 	}
-	// We don't use http.DetectContentType()
-	return string(content), nil
+	resp.Body = body
+	return resp, nil
+}
+
+// Reader fails with errContentTooLarge once more than `n' bytes read, rather than truncating silently as io.LimitReader
+type sizeLimitReader struct {
+	r io.Reader
+	n int64 // Bytes remaining
+}
+
+// Zero `maxSize' means unlimited
+func newSizeLimitReader(r io.Reader, maxSize int64) io.Reader {
+	if maxSize <= 0 {
+		return r
+	}
+	return &sizeLimitReader{r: r, n: maxSize}
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errContentTooLarge
+	}
+	// Read one more byte to tell if the limit is exceeded
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), errContentTooLarge
+	}
+	return n, err
+}
+
+// Return validators of the response, nil if there is none
+func responseValidators(resp *http.Response) *urlValidators {
+	v := &urlValidators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if len(v.etag) == 0 && len(v.lastModified) == 0 {
+		return nil
+	}
+	return v
 }
 
+var errNotModified = errors.New("content not modified")
+
+var errContentTooLarge = errors.New("content size exceeds the limit, see url_max_size")
+
 func fixUrl(theUrl string, h http.Header) (string, error) {
 	const LocationKey = "Location"
 	location := h.Get(LocationKey)
@@ -227,3 +340,87 @@ func hostPortIsIpPort(hostport string) bool {
 	i := strings.IndexByte(host, '%')
 	return i > 0 && net.ParseIP(host[:i]) != nil
 }
+
+// Parse a list of IP addresses and/or CIDRs, a bare IP is treated as a single host network
+func parseIPNets(args []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, arg := range args {
+		if !strings.Contains(arg, "/") {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", arg)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// Return true if the IP address string is contained in any of the networks
+func ipNetsContain(nets []*net.IPNet, ipStr string) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the optimal string alignment distance between two strings
+// i.e. the Levenshtein distance which counts a transposition of two adjacent characters as one edit
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < curr[j] {
+				curr[j] = prev2[j-2] + 1
+			}
+		}
+		prev2, prev, curr = prev, curr, prev2
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
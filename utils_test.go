@@ -1,7 +1,25 @@
 package dnsredir
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/klauspost/compress/zstd"
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStringToDomain(t *testing.T) {
@@ -59,3 +77,908 @@ func TestStringToDomain(t *testing.T) {
 		}
 	}
 }
+
+func TestNat64Embed(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		ip4      string
+		expected string
+	}{
+		// see: https://tools.ietf.org/html/rfc6052#section-2.4
+		{"2001:db8::/32", "192.0.2.33", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "192.0.2.33", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "192.0.2.33", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "192.0.2.33", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "192.0.2.33", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "192.0.2.33", "2001:db8:122:344::192.0.2.33"},
+		{"64:ff9b::/96", "192.0.2.33", "64:ff9b::192.0.2.33"},
+	}
+	for i, test := range tests {
+		prefix, err := parseNat64Prefix(test.prefix)
+		if err != nil {
+			t.Errorf("Test case#%v failed, error: %v", i, err)
+			continue
+		}
+		ip6 := nat64Embed(prefix, net.ParseIP(test.ip4))
+		if !ip6.Equal(net.ParseIP(test.expected)) {
+			t.Errorf("Test case#%v failed, expected %v, got %v", i, test.expected, ip6)
+		}
+	}
+
+	for _, prefix := range []string{"64:ff9b::/80", "10.0.0.0/8", "foobar"} {
+		if _, err := parseNat64Prefix(prefix); err == nil {
+			t.Errorf("Expected error for prefix %q", prefix)
+		}
+	}
+}
+
+func TestIPNetsContain(t *testing.T) {
+	nets, err := parseIPNets([]string{"192.168.1.50", "10.0.0.0/8", "fd00::1"})
+	if err != nil {
+		t.Fatalf("parseIPNets() failed, error: %v", err)
+	}
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"192.168.1.50", true},
+		{"192.168.1.51", false},
+		{"10.1.2.3", true},
+		{"fd00::1", true},
+		{"fd00::2", false},
+		{"foobar", false},
+	}
+	for i, test := range tests {
+		if ipNetsContain(nets, test.ip) != test.expected {
+			t.Errorf("Test case#%v failed, expected %v for %q", i, test.expected, test.ip)
+		}
+	}
+
+	for _, arg := range []string{"192.168.1", "10.0.0.0/33", "foobar"} {
+		if _, err := parseIPNets([]string{arg}); err == nil {
+			t.Errorf("Expected error for %q", arg)
+		}
+	}
+}
+
+func TestQnameRedact(t *testing.T) {
+	truncate := &qnameRedactor{}
+	hash := &qnameRedactor{hash: true}
+	tests := []struct {
+		r        *qnameRedactor
+		name     string
+		suffix   string
+		expected string
+	}{
+		{nil, "secret.example.com.", "example.com", "secret.example.com."},
+		{truncate, "secret.example.com.", "example.com", "*.example.com."},
+		{truncate, "a.b.example.com", "example.com", "*.example.com"},
+		{truncate, "example.com.", "example.com", "example.com."},
+		{truncate, "secret.example.com.", "", "*.com."},
+		{truncate, "localhost.", "", "localhost."},
+		{truncate, ".", "", "."},
+		{hash, "example.com.", "example.com", "example.com."},
+	}
+	for i, test := range tests {
+		if s := test.r.redact(test.name, test.suffix); s != test.expected {
+			t.Errorf("Test case#%v failed, expected %q, got %q", i, test.expected, s)
+		}
+	}
+
+	s := hash.redact("secret.example.com.", "example.com")
+	if !strings.HasSuffix(s, ".example.com.") || strings.Contains(s, "secret") {
+		t.Errorf("Unexpected hash redaction %q", s)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	query := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		return m
+	}
+
+	noQuestion := query()
+	noQuestion.Question = nil
+	twoQuestions := query()
+	twoQuestions.Question = append(twoQuestions.Question, dns.Question{Name: "example.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	response := query()
+	response.Response = true
+	notify := query()
+	notify.Opcode = dns.OpcodeNotify
+
+	tests := []struct {
+		req      *dns.Msg
+		expected int
+	}{
+		{query(), dns.RcodeSuccess},
+		{noQuestion, dns.RcodeFormatError},
+		{twoQuestions, dns.RcodeFormatError},
+		{response, dns.RcodeFormatError},
+		// Opcode is checked only if the request is going to be forwarded
+		{notify, dns.RcodeSuccess},
+	}
+	for i, test := range tests {
+		if rc := validateRequest(test.req); rc != test.expected {
+			t.Errorf("Test case#%v failed, expected %v, got %v", i, test.expected, rc)
+		}
+	}
+}
+
+func TestServeDNSValidate(t *testing.T) {
+	inline := make(domainSet)
+	inline.Add("example.com")
+	u := &reloadableUpstream{NameList: &NameList{}, ignored: make(domainSet), inline: inline}
+	r := &Dnsredir{Next: test.NextHandler(dns.RcodeRefused, nil), Upstreams: &[]Upstream{u}}
+
+	query := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		return m
+	}
+
+	noQuestion := query("example.com.")
+	noQuestion.Question = nil
+	// Validated before matching, thus rejected even if the first question doesn't match
+	twoQuestions := query("example.org.")
+	twoQuestions.Question = append(twoQuestions.Question, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	notify := query("example.org.")
+	notify.Opcode = dns.OpcodeNotify
+	matchedNotify := query("example.com.")
+	matchedNotify.Opcode = dns.OpcodeNotify
+	response := query("example.org.")
+	response.Response = true
+
+	tests := []struct {
+		req      *dns.Msg
+		expected int
+		// Whether the request is answered locally, otherwise it falls through to the next plugin
+		answered bool
+	}{
+		{query("example.org."), dns.RcodeRefused, false},
+		{noQuestion, dns.RcodeFormatError, true},
+		{twoQuestions, dns.RcodeFormatError, true},
+		// NOTIFY of a zone not matched reaches the next plugin, e.g. a secondary zone
+		{notify, dns.RcodeRefused, false},
+		{matchedNotify, dns.RcodeNotImplemented, true},
+		{response, dns.RcodeFormatError, true},
+	}
+	for i, test0 := range tests {
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rc, err := r.ServeDNS(context.Background(), rec, test0.req)
+		if err != nil || rc != test0.expected {
+			t.Errorf("Test case#%v failed, expected %v, got %v %v", i, test0.expected, rc, err)
+		}
+		if answered := rec.Msg != nil; answered != test0.answered {
+			t.Errorf("Test case#%v failed, expected answered %v, got %v", i, test0.answered, answered)
+		} else if answered && rec.Msg.Rcode != test0.expected {
+			t.Errorf("Test case#%v failed, expected rcode %v, got %v", i, test0.expected, rec.Msg.Rcode)
+		}
+	}
+}
+
+func TestRaiseNegativeTtl(t *testing.T) {
+	soa := func(ttl, minttl uint32) *dns.SOA {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:     "ns.example.com.",
+			Mbox:   "admin.example.com.",
+			Minttl: minttl,
+		}
+	}
+	tests := []struct {
+		rcode    int
+		answers  int
+		ttl      uint32
+		minttl   uint32
+		expected uint32
+	}{
+		{dns.RcodeNameError, 0, 5, 5, 60},
+		{dns.RcodeSuccess, 0, 5, 5, 60},
+		{dns.RcodeNameError, 0, 300, 300, 300},
+		{dns.RcodeSuccess, 1, 5, 5, 5},
+		{dns.RcodeServerFailure, 0, 5, 5, 5},
+	}
+	for i, test := range tests {
+		m := new(dns.Msg)
+		m.Rcode = test.rcode
+		for j := 0; j < test.answers; j++ {
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(127, 0, 0, 1)})
+		}
+		m.Ns = append(m.Ns, soa(test.ttl, test.minttl))
+		raiseNegativeTtl(m, 60)
+		rr := m.Ns[0].(*dns.SOA)
+		if rr.Hdr.Ttl != test.expected || rr.Minttl != test.expected {
+			t.Errorf("Test case#%v failed, expected %v, got %v %v", i, test.expected, rr.Hdr.Ttl, rr.Minttl)
+		}
+	}
+}
+
+func TestFitReply(t *testing.T) {
+	build := func(n int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		m.Response = true
+		m.Compress = true
+		for i := 0; i < n; i++ {
+			rr, _ := dns.NewRR("example.org. 60 IN A 192.0.2." + strconv.Itoa(i+1))
+			m.Answer = append(m.Answer, rr)
+		}
+		ns, _ := dns.NewRR("example.org. 60 IN NS ns.example.org.")
+		m.Ns = append(m.Ns, ns)
+		m.SetEdns0(4096, false)
+		return m
+	}
+
+	full := build(10).Len()
+	tests := []struct {
+		size           int
+		minimize       bool
+		expectedAnswer int
+		expectedTc     bool
+	}{
+		{full, false, 10, false},
+		{full + 1, false, 10, false},
+		{full - 1, false, 10, true},
+		{full - 1, true, 10, false},
+		{512, false, 10, false},
+		{100, false, 3, true},
+		{100, true, 3, true},
+		// Header, question and OPT RR take 40 bytes, each compressed A RR takes 16 bytes
+		{40, false, 0, true},
+		{55, false, 0, true},
+		{56, true, 1, true},
+	}
+
+	for i, test := range tests {
+		reply := build(10)
+		fitReply(reply, test.size, test.minimize)
+		if len(reply.Answer) != test.expectedAnswer || reply.Truncated != test.expectedTc {
+			t.Errorf("Test%v: size %v minimize %v: expected %v answers TC %v, got %v answers TC %v",
+				i, test.size, test.minimize, test.expectedAnswer, test.expectedTc, len(reply.Answer), reply.Truncated)
+		}
+		if reply.Truncated && reply.Len() > test.size {
+			t.Errorf("Test%v: truncated reply length %v exceeds %v", i, reply.Len(), test.size)
+		}
+		if reply.IsEdns0() == nil {
+			t.Errorf("Test%v: EDNS0 OPT RR should be preserved", i)
+		}
+	}
+}
+
+func TestSvcbRewrite(t *testing.T) {
+	tests := []struct {
+		args      []string
+		input     string
+		shouldErr bool
+		expected  string
+	}{
+		{[]string{"ech", "ipv4hint", "ipv6hint"}, `example.com. 60 IN HTTPS 1 . alpn="h2" ipv4hint="1.2.3.4" ech="AAAA" ipv6hint="::1"`, false, `alpn="h2"`},
+		{[]string{"ipv4hint=10.0.0.1,10.0.0.2"}, `example.com. 60 IN HTTPS 1 . alpn="h2" ipv4hint="1.2.3.4"`, false, `alpn="h2" ipv4hint="10.0.0.1,10.0.0.2"`},
+		{[]string{"ipv6hint=fd00::1"}, `example.com. 60 IN SVCB 1 . alpn="h2" ech="AAAA"`, false, `alpn="h2" ech="AAAA" ipv6hint="fd00::1"`},
+		{[]string{"ech"}, `example.com. 60 IN HTTPS 0 alias.example.com.`, false, ""},
+		{[]string{"alpn"}, "", true, ""},
+		{[]string{"ech=foo"}, "", true, ""},
+		{[]string{"ipv4hint=::1"}, "", true, ""},
+		{[]string{"ipv6hint=1.2.3.4"}, "", true, ""},
+	}
+
+	for i, test := range tests {
+		r, err := parseSvcbRewrite(test.args)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test%v: expected error %v, got %v", i, test.shouldErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		rr, err := dns.NewRR(test.input)
+		if err != nil {
+			t.Fatalf("Test%v: dns.NewRR() failed: %v", i, err)
+		}
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{rr}
+		r.apply(m)
+
+		var svcb *dns.SVCB
+		switch v := rr.(type) {
+		case *dns.SVCB:
+			svcb = v
+		case *dns.HTTPS:
+			svcb = &v.SVCB
+		}
+		var params []string
+		for _, kv := range svcb.Value {
+			params = append(params, kv.Key().String()+`="`+kv.String()+`"`)
+		}
+		if got := strings.Join(params, " "); got != test.expected {
+			t.Errorf("Test%v: expected %q, got %q", i, test.expected, got)
+		}
+	}
+}
+
+func TestEcsPolicy(t *testing.T) {
+	subnetOf := func(m *dns.Msg) string {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if o.Option() == dns.EDNS0SUBNET {
+					return o.String()
+				}
+			}
+		}
+		return ""
+	}
+	withEcs := func(prefix string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		if len(prefix) != 0 {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			_, ipNet, _ := net.ParseCIDR(prefix)
+			ones, _ := ipNet.Mask.Size()
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ipNet.IP})
+		}
+		return m
+	}
+
+	tests := []struct {
+		policy    string
+		prefix    string
+		shouldErr bool
+		expected  string
+	}{
+		{"strip", "192.0.2.0/24", false, ""},
+		{"strip", "", false, ""},
+		{"203.0.113.0/24", "192.0.2.0/24", false, "203.0.113.0/24/0"},
+		{"203.0.113.0/24", "", false, "203.0.113.0/24/0"},
+		{"2001:db8::/56", "", false, "[2001:db8::]/56/0"},
+		{"foo", "", true, ""},
+	}
+
+	for i, test := range tests {
+		e, err := parseEcs(test.policy)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test%v: expected error %v, got %v", i, test.shouldErr, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		req := withEcs(test.prefix)
+		orig := subnetOf(req)
+		m := e.apply(req)
+		if got := subnetOf(m); got != test.expected {
+			t.Errorf("Test%v: expected subnet %q, got %q", i, test.expected, got)
+		}
+		if subnetOf(req) != orig {
+			t.Errorf("Test%v: original query modified", i)
+		}
+
+		// Upstream echoes the subnet back
+		reply := m.Copy()
+		reply.Response = true
+		e.restore(req, reply)
+		if got := subnetOf(reply); got != orig {
+			t.Errorf("Test%v: expected restored subnet %q, got %q", i, orig, got)
+		}
+		if (reply.IsEdns0() == nil) != (req.IsEdns0() == nil) {
+			t.Errorf("Test%v: OPT RR presence mismatch", i)
+		}
+	}
+}
+
+func TestPadQuery(t *testing.T) {
+	for _, name := range []string{"a.", "example.com.", "a-rather-long-label.of.some.example.org."} {
+		for _, edns := range []bool{false, true} {
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			if edns {
+				req.SetEdns0(dns.DefaultMsgSize, true)
+			}
+			m := padQuery(req, 128)
+			if n := m.Len(); n%128 != 0 {
+				t.Errorf("%v edns: %v expected padded length multiple of 128, got %v", name, edns, n)
+			}
+			if (req.IsEdns0() != nil) != edns {
+				t.Errorf("%v edns: %v original query modified", name, edns)
+			}
+
+			reply := m.Copy()
+			reply.Response = true
+			unpadReply(req, reply)
+			if opt := reply.IsEdns0(); (opt != nil) != edns {
+				t.Errorf("%v edns: %v OPT RR presence mismatch", name, edns)
+			} else if opt != nil && len(opt.Option) != 0 {
+				t.Errorf("%v edns: %v expected padding removed, got %v", name, edns, opt.Option)
+			}
+		}
+	}
+}
+
+func TestDnsCookies(t *testing.T) {
+	c := newDnsCookies()
+	cookieOf := func(m *dns.Msg) string {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+					return cookie.Cookie
+				}
+			}
+		}
+		return ""
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	m := c.attach(req)
+	if got := cookieOf(m); got != c.client {
+		t.Fatalf("expected client cookie only %q, got %q", c.client, got)
+	}
+	if req.IsEdns0() != nil {
+		t.Fatalf("original query modified")
+	}
+
+	serverCookie := "0123456789abcdef"
+	reply := m.Copy()
+	reply.Response = true
+	reply.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: c.client + serverCookie}}
+	if err := c.learn(req, reply); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if reply.IsEdns0() != nil {
+		t.Fatalf("expected OPT RR removed from reply")
+	}
+	if got := cookieOf(c.attach(req)); got != c.client+serverCookie {
+		t.Fatalf("expected learned server cookie attached, got %q", got)
+	}
+
+	spoofed := m.Copy()
+	spoofed.Response = true
+	spoofed.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "ffffffffffffffff" + serverCookie}}
+	if err := c.learn(req, spoofed); err != errCookieMismatch {
+		t.Fatalf("expected %v, got %v", errCookieMismatch, err)
+	}
+}
+
+func TestQnameGuard(t *testing.T) {
+	deny, _ := compileRegexps([]string{"[a-z0-9]{48,}"})
+	allow, _ := compileRegexps([]string{"^[a-z0-9._-]+$"})
+	g := &qnameGuard{deny: deny, allow: allow}
+	tests := []struct {
+		name     string
+		rejected bool
+	}{
+		{"example.com", false},
+		{"_dmarc.mail-01.example.com", false},
+		{strings.Repeat("a1", 24) + ".example.com", true},
+		{"ex\\000ample.com", true},
+		{"exa mple.com", true},
+	}
+	for _, test := range tests {
+		if got := g.rejects(test.name); got != test.rejected {
+			t.Errorf("rejects(%q) expected %v, got %v", test.name, test.rejected, got)
+		}
+	}
+
+	// Deny only guard accepts everything else
+	g = &qnameGuard{deny: deny}
+	if g.rejects("exa mple.com") {
+		t.Errorf("unexpected rejection without allow regexes")
+	}
+}
+
+func TestScopeMetrics(t *testing.T) {
+	str := func(s string) *string { return &s }
+	metric := func(name, value string) *dto.Metric {
+		return &dto.Metric{Label: []*dto.LabelPair{{Name: str(name), Value: str(value)}}}
+	}
+	mfs := []*dto.MetricFamily{
+		{Name: str("coredns_dnsredir_request_count_total"), Metric: []*dto.Metric{
+			metric("to", "udp://10.0.0.1:53"),
+			metric("to", "udp://10.0.0.2:53"),
+		}},
+		{Name: str("coredns_dnsredir_slo_request_count_total"), Metric: []*dto.Metric{
+			metric("stanza", "b"),
+		}},
+		{Name: str("coredns_dns_requests_total"), Metric: []*dto.Metric{
+			metric("to", "udp://10.0.0.1:53"),
+		}},
+	}
+	u := &reloadableUpstream{
+		stanza:           "a",
+		metricsNamespace: "team_a",
+		HealthCheck:      &HealthCheck{hosts: UpstreamHostPool{&UpstreamHost{proto: "udp", addr: "10.0.0.1:53"}}},
+	}
+
+	scoped := u.scopeMetrics(mfs)
+	if len(scoped) != 1 || len(scoped[0].Metric) != 1 {
+		t.Fatalf("Expected a single series, got %v", scoped)
+	}
+	if name := scoped[0].GetName(); name != "team_a_request_count_total" {
+		t.Errorf("Expected namespaced metric name, got %q", name)
+	}
+
+	if !u.adminGrants("", false) {
+		t.Errorf("Expected stanza without token accessible")
+	}
+	if u.adminGrants("", true) || u.adminGrants("0123456789abcdef", true) {
+		t.Errorf("Expected stanza without token denied once any stanza has a token")
+	}
+	u.adminToken = "0123456789abcdef"
+	if u.adminGrants("", false) || u.adminGrants("0123456789abcdeF", false) || !u.adminGrants("0123456789abcdef", true) {
+		t.Errorf("Unexpected admin token check")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	publish(Event{Type: EventQueryFailed})
+
+	ch, cancel := Subscribe(1)
+	publish(Event{Type: EventUpstreamDown, Upstream: "udp://10.0.0.1:53"})
+	// Dropped since the channel is full
+	publish(Event{Type: EventUpstreamUp})
+
+	e := <-ch
+	if e.Type != EventUpstreamDown || e.Upstream != "udp://10.0.0.1:53" || e.Time.IsZero() {
+		t.Errorf("Unexpected event %v %+v", e.Type, e)
+	}
+	select {
+	case e := <-ch:
+		t.Errorf("Unexpected event %v", e.Type)
+	default:
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("Expected channel closed")
+	}
+	if subscribed() {
+		t.Errorf("Expected no subscriber")
+	}
+}
+
+func TestExplainReply(t *testing.T) {
+	u := &reloadableUpstream{explainCode: 65001}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if u.explains(req) {
+		t.Fatal("Expected no explanation without OPT RR")
+	}
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: 65001})
+	if !u.explains(req) {
+		t.Fatal("Expected explanation asked")
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	host := &UpstreamHost{proto: "udp", addr: "1.1.1.1:53"}
+	explainReply(reply, u.explainCode, "example.com", &RoundRobin{}, "", host, 2)
+	opt := reply.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("Expected one option, got %v", opt)
+	}
+	expected := `stanza="example.com" policy=round_robin upstream=udp://1.1.1.1:53 attempts=2`
+	if data := string(opt.Option[0].(*dns.EDNS0_LOCAL).Data); data != expected {
+		t.Errorf("Expected %q, got %q", expected, data)
+	}
+}
+
+func TestAnswerWhichUpstream(t *testing.T) {
+	u := &reloadableUpstream{stanza: "example.com", which: newWhichUpstream("whichupstream.bind")}
+	r := &Dnsredir{Upstreams: &[]Upstream{u}}
+	w := &test.ResponseWriter{}
+
+	req := new(dns.Msg)
+	req.SetQuestion("whichupstream.bind.", dns.TypeTXT)
+	if reply := r.answerWhichUpstream(&request.Request{W: w, Req: req}); reply != nil {
+		t.Fatalf("Expected no answer of IN class query, got %v", reply)
+	}
+	req.Question[0].Qclass = dns.ClassCHAOS
+	reply := r.answerWhichUpstream(&request.Request{W: w, Req: req})
+	if reply == nil || len(reply.Answer) != 1 {
+		t.Fatalf("Expected one answer, got %v", reply)
+	}
+	if txt := reply.Answer[0].(*dns.TXT).Txt; len(txt) != 1 || txt[0] != "none" {
+		t.Errorf("Expected none, got %v", txt)
+	}
+
+	u.which.record(w.RemoteAddr().(*net.UDPAddr).IP.String(), u.stanza, "udp://1.1.1.1:53")
+	reply = r.answerWhichUpstream(&request.Request{W: w, Req: req})
+	if txt := reply.Answer[0].(*dns.TXT).Txt; len(txt) != 3 || txt[0] != "udp://1.1.1.1:53" || txt[1] != `stanza=example.com` {
+		t.Errorf("Expected the recorded upstream, got %v", txt)
+	}
+
+	for i := 0; i < maxWhichClients+1; i++ {
+		u.which.record(fmt.Sprintf("client%v", i), u.stanza, "udp://1.1.1.1:53")
+	}
+	if n := len(u.which.clients); n != maxWhichClients {
+		t.Errorf("Expected %v clients remembered, got %v", maxWhichClients, n)
+	}
+}
+
+func TestGeoLocationDistance(t *testing.T) {
+	tokyo := geoLocation{country: "JP", hasCoords: true, lat: 35.68, lon: 139.69}
+	osaka := geoLocation{country: "JP", hasCoords: true, lat: 34.69, lon: 135.50}
+	if d := tokyo.distance(osaka); d < 390 || d > 410 {
+		t.Errorf("Expected about 400km between Tokyo and Osaka, got %v", d)
+	}
+	if d := tokyo.distance(geoLocation{country: "JP"}); d != 0 {
+		t.Errorf("Expected zero distance in the same country, got %v", d)
+	}
+	if d := tokyo.distance(geoLocation{country: "US"}); d != math.MaxFloat64 {
+		t.Errorf("Expected farthest distance, got %v", d)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if ip := clientIP(req, "192.0.2.1"); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Expected source address, got %v", ip)
+	}
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("198.51.100.0"),
+	})
+	if ip := clientIP(req, "192.0.2.1"); !ip.Equal(net.ParseIP("198.51.100.0")) {
+		t.Errorf("Expected client subnet address, got %v", ip)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		shouldOk bool
+		expected uint64
+	}{
+		{"", false, 0},
+		{"0", false, 0},
+		{"M", false, 0},
+		{"1024", true, 1024},
+		{"512K", true, 512 << 10},
+		{"16m", true, 16 << 20},
+		{"1G", true, 1 << 30},
+		{"-1M", false, 0},
+		{"16MB", false, 0},
+	}
+	for i, test := range tests {
+		n, err := parseByteSize(test.input)
+		if (err == nil) != test.shouldOk || n != test.expected {
+			t.Errorf("Test#%v failed  expected %v %v, got %v %v", i, test.shouldOk, test.expected, n, err)
+		}
+	}
+}
+
+func TestExpandBraces(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		hasErr   bool
+	}{
+		{"example.com", "example.com", false},
+		{"{www,api}.example.com", "www.example.com api.example.com", false},
+		{"cdn{1..3}.example.com", "cdn1.example.com cdn2.example.com cdn3.example.com", false},
+		{"n{08..10}.example.com", "n08.example.com n09.example.com n10.example.com", false},
+		{"{a,{b,c}}{1,2}.example.com", "a1.example.com a2.example.com b1.example.com b2.example.com c1.example.com c2.example.com", false},
+		{"{3..1}.example.com", "3.example.com 2.example.com 1.example.com", false},
+		{"{}.example.com", "", true},
+		{"{a,b.example.com", "", true},
+		{"a}.{b,c}.example.com", "", true},
+		{"{1..99999}.example.com", "", true},
+	}
+	for i, test := range tests {
+		expanded, err := expandBraces(test.input)
+		if hasErr := err != nil; hasErr != test.hasErr {
+			t.Errorf("Test %v: expected error %v, got %v", i, test.hasErr, err)
+			continue
+		}
+		if s := strings.Join(expanded, " "); s != test.expected {
+			t.Errorf("Test %v: expected %q, got %q", i, test.expected, s)
+		}
+	}
+}
+
+func TestSizeLimitReader(t *testing.T) {
+	tests := []struct {
+		content string
+		maxSize int64
+		wantErr bool
+	}{
+		{"", 4, false},
+		{"abcd", 4, false},
+		{"abcde", 4, true},
+		{"abcde", 0, false},
+	}
+	for i, test := range tests {
+		data, err := ioutil.ReadAll(newSizeLimitReader(strings.NewReader(test.content), test.maxSize))
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test#%v failed  expected error %v, got %v", i, test.wantErr, err)
+		}
+		if int64(len(data)) > test.maxSize && test.maxSize > 0 {
+			t.Errorf("Test#%v failed  %v bytes read beyond the limit %v", i, len(data), test.maxSize)
+		}
+	}
+}
+
+func TestDecompressReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"/etc/blocklist.txt", compressionNone},
+		{"/etc/blocklist.txt.gz", compressionGzip},
+		{"/etc/blocklist.ZST", compressionZstd},
+		{"https://example.com/blocklist.txt.gz?token=1", compressionGzip},
+		{"https://example.com/blocklist.gz/list.txt", compressionNone},
+	}
+	for i, test := range tests {
+		if c := compressionOf(test.name); c != test.expected {
+			t.Errorf("Test#%v failed  expected %q, got %q", i, test.expected, c)
+		}
+	}
+
+	content := "example.com\nexample.org\n"
+	var gz, zst bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, _ = gw.Write([]byte(content))
+	_ = gw.Close()
+	zw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = zw.Write([]byte(content))
+	_ = zw.Close()
+	for _, c := range []struct {
+		compression string
+		data        []byte
+	}{{compressionGzip, gz.Bytes()}, {compressionZstd, zst.Bytes()}, {compressionNone, []byte(content)}} {
+		r, err := newDecompressReader(ioutil.NopCloser(bytes.NewReader(c.data)), c.compression)
+		if err != nil {
+			t.Fatalf("%q: %v", c.compression, err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil || string(data) != content {
+			t.Errorf("%q: expected %q, got %q %v", c.compression, content, data, err)
+		}
+		_ = r.Close()
+	}
+	if _, err := newDecompressReader(ioutil.NopCloser(strings.NewReader(content)), compressionGzip); err == nil {
+		t.Errorf("Expected error of decompressing plain text")
+	}
+}
+
+func TestOpenUrlConditional(t *testing.T) {
+	const etag = `"v1"`
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte("example.com\n"))
+	}))
+	defer server.Close()
+
+	resp, err := openUrl(server.URL, "text/plain", nil, time.Second, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Close(resp.Body)
+	cond := responseValidators(resp)
+	if cond == nil || cond.etag != etag {
+		t.Fatalf("Expected ETag %v, got %+v", etag, cond)
+	}
+	if _, err := openUrl(server.URL, "text/plain", nil, time.Second, nil, cond); err != errNotModified {
+		t.Errorf("Expected %v, got %v", errNotModified, err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %v", requests)
+	}
+}
+
+func TestOpenUrlHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xxx" || r.Header.Get("User-Agent") != "dnsredir" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("example.com\n"))
+	}))
+	defer server.Close()
+
+	if _, err := getUrlContent(server.URL, "text/plain", nil, time.Second, nil, 0); err == nil {
+		t.Errorf("Expected error without authorization")
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer xxx")
+	header.Set("User-Agent", "dnsredir")
+	if content, err := getUrlContent(server.URL, "text/plain", nil, time.Second, header, 0); err != nil || content != "example.com\n" {
+		t.Errorf("Expected content fetched with header, got %q, error: %v", content, err)
+	}
+}
+
+func TestParseObjectUrl(t *testing.T) {
+	tests := []struct {
+		url       string
+		shouldErr bool
+		expected  objectLocation
+	}{
+		{"s3://bucket/list.txt", false, objectLocation{scheme: "s3", bucket: "bucket", key: "list.txt"}},
+		{"S3://bucket/dir/list.txt.gz?region=eu-west-1", false, objectLocation{scheme: "s3", bucket: "bucket", key: "dir/list.txt.gz", region: "eu-west-1"}},
+		{"gs://bucket/dir/list.txt", false, objectLocation{scheme: "gs", bucket: "bucket", key: "dir/list.txt"}},
+		{"s3://bucket", true, objectLocation{}},
+		{"s3://bucket/dir/", true, objectLocation{}},
+		{"gs:///list.txt", true, objectLocation{}},
+		{"gs://bucket/list.txt?region=us", true, objectLocation{}},
+		{"s3://bucket/list.txt?foo=bar", true, objectLocation{}},
+	}
+	for i, test := range tests {
+		loc, err := parseObjectUrl(test.url)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %v: expected error for %q", i, test.url)
+			}
+			continue
+		}
+		if err != nil || *loc != test.expected {
+			t.Errorf("Test %v: expected %+v, got %+v, error: %v", i, test.expected, loc, err)
+		}
+	}
+	if isObjectUrl("https://example.com/list.txt") || !isObjectUrl("GS://bucket/list.txt") {
+		t.Errorf("Unexpected object URL detection")
+	}
+}
+
+func TestFamilyPreference(t *testing.T) {
+	newReply := func(rrs ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeAAAA)
+		for _, s := range rrs {
+			m.Answer = append(m.Answer, test.AAAA(s))
+		}
+		return m
+	}
+	cname := test.CNAME("www.example.com. 60 IN CNAME example.com.")
+	withA := func(uint16) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{test.A("example.com. 60 IN A 192.0.2.1")}
+		return m, nil
+	}
+	withoutA := func(uint16) (*dns.Msg, error) {
+		return new(dns.Msg), nil
+	}
+
+	tests := []struct {
+		args     []string
+		qtype    uint16
+		lookup   func(uint16) (*dns.Msg, error)
+		expected int // Number of answers left
+	}{
+		{[]string{"ipv4"}, dns.TypeAAAA, withA, 1},
+		{[]string{"ipv4"}, dns.TypeAAAA, withoutA, 3},
+		{[]string{"ipv4", "filter"}, dns.TypeAAAA, withoutA, 1},
+		{[]string{"ipv6"}, dns.TypeAAAA, withA, 3},
+	}
+	for i, tc := range tests {
+		p, err := parseFamilyPreference(tc.args)
+		if err != nil {
+			t.Fatalf("Test#%v: %v", i, err)
+		}
+		reply := newReply("example.com. 60 IN AAAA 2001:db8::1", "example.com. 60 IN AAAA 2001:db8::2")
+		reply.Answer = append([]dns.RR{cname}, reply.Answer...)
+		p.apply(reply, tc.qtype, tc.lookup)
+		if len(reply.Answer) != tc.expected {
+			t.Errorf("Test#%v failed  expected %v answers, got %v", i, tc.expected, reply.Answer)
+		}
+	}
+	if _, err := parseFamilyPreference([]string{"ipv5"}); err == nil {
+		t.Errorf("Expected error of unknown family")
+	}
+}
@@ -0,0 +1,66 @@
+package dnsredir
+
+import (
+	"github.com/miekg/dns"
+	"math/rand"
+	"sync"
+)
+
+// warmSample keeps a rotating sample of recently seen real questions
+// Which are used as health check queries, so probes exercise the same code path and caches as production traffic.
+// Only question name and type are retained, client info is never recorded.
+type warmSample struct {
+	sync.Mutex
+	questions []dns.Question // Ring buffer
+	seen      map[uint64]struct{}
+	next      int
+}
+
+func newWarmSample(size int) *warmSample {
+	return &warmSample{
+		questions: make([]dns.Question, 0, size),
+		seen:      make(map[uint64]struct{}, size),
+	}
+}
+
+// Sample a question of a matched request, only one in warmSampleRate questions is recorded
+func (w *warmSample) observe(name string, qtype uint16) {
+	if rand.Intn(warmSampleRate) != 0 {
+		return
+	}
+	name = dns.Fqdn(name)
+	key := stringHash(name) ^ uint64(qtype)
+
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.seen[key]; ok {
+		return
+	}
+	q := dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+	if len(w.questions) < cap(w.questions) {
+		w.questions = append(w.questions, q)
+	} else {
+		old := w.questions[w.next]
+		delete(w.seen, stringHash(old.Name)^uint64(old.Qtype))
+		w.questions[w.next] = q
+		w.next = (w.next + 1) % len(w.questions)
+	}
+	w.seen[key] = struct{}{}
+}
+
+// Return a random sampled question, or the artificial `. IN NS' question if none sampled yet
+func (w *warmSample) pick() dns.Question {
+	if w != nil {
+		w.Lock()
+		defer w.Unlock()
+		if n := len(w.questions); n != 0 {
+			return w.questions[rand.Intn(n)]
+		}
+	}
+	return dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+}
+
+const (
+	defaultWarmSampleSize = 64
+	warmSampleRate        = 16
+)
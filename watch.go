@@ -0,0 +1,113 @@
+package dnsredir
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Watch paths in FROM... for changes, thus they're reloaded immediately rather than on the next poll
+// Parent directories are watched rather than files, thus atomic replacements(i.e. rename) are noticed as well.
+// Items with overridden reload interval are left to their own workers, see `from'.
+// Return false if watches are unavailable, the caller should fall back to polling.
+func (n *NameList) watchPaths() bool {
+	dirs := make(map[string][]*NameItem)
+	for _, item := range n.items {
+		if item != nil && item.whichType == NameItemTypePath && item.reload == 0 {
+			dir := filepath.Dir(filepath.Clean(item.watchedPath()))
+			if hasGlobMeta(dir) {
+				log.Warningf("Cannot watch %v, fall back to polling every %v", item, n.pathReload)
+				return false
+			}
+			dirs[dir] = append(dirs[dir], item)
+		}
+	}
+	if len(dirs) == 0 {
+		return false
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warningf("Failed to watch paths, fall back to polling every %v, err: %v", n.pathReload, err)
+		return false
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			Close(w)
+			log.Warningf("Failed to watch %v, fall back to polling every %v, err: %v", dir, n.pathReload, err)
+			return false
+		}
+	}
+
+	atomic.StoreInt32(&n.watching, 1)
+	go func() {
+		defer atomic.StoreInt32(&n.watching, 0)
+		defer Close(w)
+
+		// Writes of a file come in bursts, thus changed items are reloaded in batch once settled
+		pending := make(map[*NameItem]struct{})
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-n.stopPathReload:
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if e.Op == fsnotify.Chmod {
+					continue
+				}
+				name := filepath.Clean(e.Name)
+				for _, item := range dirs[filepath.Dir(name)] {
+					if item.watches(name) {
+						pending[item] = struct{}{}
+					}
+				}
+				if len(pending) != 0 && settle == nil {
+					settle = time.After(pathWatchSettleDelay)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// e.g. event queue overflow, changes are still picked up by the fallback polling
+				log.Warningf("Path watch error: %v", err)
+			case <-settle:
+				settle = nil
+				for item := range pending {
+					delete(pending, item)
+					// Changes made while frozen are picked up by the fallback polling once thawed
+					if !n.isFrozen() {
+						n.updateItemFromPath(item)
+					}
+				}
+			}
+		}
+	}()
+	return true
+}
+
+// Return the path whose directory is watched, i.e. the glob pattern of a glob item
+func (item *NameItem) watchedPath() string {
+	if len(item.glob) != 0 {
+		return item.glob
+	}
+	return item.path
+}
+
+// Return true if changes of the file `name' should reload the item
+func (item *NameItem) watches(name string) bool {
+	if len(item.glob) != 0 {
+		ok, _ := filepath.Match(filepath.Clean(item.glob), name)
+		return ok
+	}
+	return filepath.Clean(item.path) == name
+}
+
+const (
+	pathWatchSettleDelay = 200 * time.Millisecond
+	// Polling interval of watched paths, which catches changes missed by watches, e.g. on network filesystems
+	pathWatchPollInterval = time.Minute
+)
@@ -0,0 +1,98 @@
+package dnsredir
+
+import (
+	"fmt"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// Upstream which served the most recent matched query of a client
+type whichRecord struct {
+	stanza   string
+	upstream string
+	time     time.Time
+}
+
+// Answers `NAME CH TXT' introspection queries with the upstream served the most recent matched query of the caller
+type whichUpstream struct {
+	// Query name lower cased and without trailing dot, e.g. whichupstream.bind
+	name string
+
+	sync.Mutex
+	clients map[string]whichRecord
+}
+
+func newWhichUpstream(name string) *whichUpstream {
+	return &whichUpstream{
+		name:    name,
+		clients: make(map[string]whichRecord),
+	}
+}
+
+func (w *whichUpstream) record(client, stanza, upstream string) {
+	w.Lock()
+	defer w.Unlock()
+	if _, ok := w.clients[client]; !ok && len(w.clients) >= maxWhichClients {
+		// Evict an arbitrary client, since the record is only for manual debugging
+		for k := range w.clients {
+			delete(w.clients, k)
+			break
+		}
+	}
+	w.clients[client] = whichRecord{stanza: stanza, upstream: upstream, time: clock.Now()}
+}
+
+func (w *whichUpstream) lookup(client string) (whichRecord, bool) {
+	w.Lock()
+	defer w.Unlock()
+	rec, ok := w.clients[client]
+	return rec, ok
+}
+
+// Return the reply if the request is a `whichupstream' query of any stanza, nil otherwise
+// The most recent record among stanzas with the same query name is answered.
+func (r *Dnsredir) answerWhichUpstream(state *request.Request) *dns.Msg {
+	if state.Req.Opcode != dns.OpcodeQuery || state.QClass() != dns.ClassCHAOS || state.QType() != dns.TypeTXT {
+		return nil
+	}
+	name := removeTrailingDot(state.Name())
+	found := false
+	var latest whichRecord
+	r.RLock()
+	for _, up := range *r.Upstreams {
+		w := up.(*reloadableUpstream).which
+		if w == nil || w.name != name {
+			continue
+		}
+		found = true
+		if rec, ok := w.lookup(state.IP()); ok && rec.time.After(latest.time) {
+			latest = rec
+		}
+	}
+	r.RUnlock()
+	if !found {
+		return nil
+	}
+
+	txt := []string{"none"}
+	if len(latest.upstream) != 0 {
+		txt = []string{
+			latest.upstream,
+			fmt.Sprintf("stanza=%v", latest.stanza),
+			fmt.Sprintf("age=%v", clock.Now().Sub(latest.time).Round(time.Second)),
+		}
+	}
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative = true
+	m.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: txt,
+	}}
+	return m
+}
+
+// Maximum clients remembered by `whichupstream' of a stanza
+const maxWhichClients = 4096